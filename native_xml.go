@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -93,43 +95,56 @@ var (
 	}
 )
 
+// Byte-wise reader with the characters read ahead in Surplus.
+//
+// Deprecated: documents are read by an index based scanner over the whole input,
+// use TNativeXml.ReadFromString. The Read functions of this reader use that scanner.
 type TsdSurplusReader struct {
 	Reader  *bytes.Reader
 	Surplus string
+	MaxText int //Maximum length of a string read,0 is no limit
 }
 
 func (this *TsdSurplusReader) ReadChar() (Ch byte, readlen int) {
 	if len(this.Surplus) > 0 {
 		Ch = this.Surplus[0]
-		this.Surplus = string(this.Surplus[1:])
-		readlen = 1
-	} else {
-		var err error
-		Ch, err = this.Reader.ReadByte()
-		if err != nil {
-			readlen = 0
-		} else {
-			readlen = 1
-		}
+		this.Surplus = this.Surplus[1:]
+		return Ch, 1
+	}
+	if this.Reader == nil {
+		return 0, 0
+	}
+	Ch, err := this.Reader.ReadByte()
+	if err != nil {
+		return Ch, 0
 	}
-	return Ch, readlen
+	return Ch, 1
 }
 func (this *TsdSurplusReader) ReadCharSkipBlanks() (Ch byte, b bool) {
-	for exec := true; exec; {
-		//Read character,exit if none available
-		i := 0
-		if Ch, i = this.ReadChar(); i == 0 {
-			//Skip if in controlchars
+	//The next character that is not a blank
+	for {
+		Ch, i := this.ReadChar()
+		if i == 0 {
 			return Ch, false
 		}
-		exec = func() bool {
-			if strings.Index(cControlChars, string(Ch)) >= 0 {
-				return false
-			}
-			return false
-		}()
+		if !isControlChar(Ch) {
+			return Ch, true
+		}
+	}
+}
+func (this *TsdSurplusReader) scanner() *tXmlScanner {
+	//A scanner over the rest of the input,done returns what it did not read to Surplus
+	Text := this.Surplus
+	if this.Reader != nil {
+		Data, _ := io.ReadAll(this.Reader)
+		Text += string(Data)
 	}
-	return Ch, true
+	Scanner := newXmlScanner(nil, Text, 0)
+	Scanner.maxText = this.MaxText
+	return Scanner
+}
+func (this *TsdSurplusReader) done(Scanner *tXmlScanner) {
+	this.Surplus = Scanner.Text[Scanner.Pos:]
 }
 
 // Xml Node
@@ -144,6 +159,11 @@ type TXmlNode struct {
 	Value       string            // The *escaped* value
 	MaxNodeID   int               // Node item id count
 	NodeID      int               // Node at level globle id
+	BlankLines  int               // Blank lines before this node when it was read
+	source      *tXmlSource       // Original text,only kept when the document preserves its source
+	sourcePos   int               // Offset+1 of the node in the text it was read from
+	texts       []string          // Text in front of each child and behind the last one as read,see textSegments
+	generation  int               // Document version that may change the node,older ones are shared by snapshots
 }
 
 func NewXmlNode(nodename string) *TXmlNode {
@@ -156,10 +176,8 @@ func NewXmlNode(nodename string) *TXmlNode {
 func (this *TXmlNode) Document() *TNativeXml {
 	if this.Parent != nil {
 		return this.Parent.Document()
-	} else {
-		return this.document
 	}
-	return nil
+	return this.document
 }
 func (this *TXmlNode) TreeDepth() int {
 	//The node level
@@ -169,12 +187,81 @@ func (this *TXmlNode) TreeDepth() int {
 		return 0
 	}
 }
+func (this *TXmlNode) NodePath() string {
+	//The path of this node for the path functions,repeated names get an "[n]" index.
+	//Comments and processing instructions are named "comment()" and "processing-instruction()"
+	if this.Parent == nil {
+		return "/" + this.Name
+	}
+	Name := this.Name
+	if Test := nodeTest(this.ElementType); Test != "" {
+		Name = Test
+	}
+	Index, Count := 0, 0
+	for _, v := range this.Parent.NodeList() {
+		if v.hasPathName(Name) {
+			Count++
+			if v == this {
+				Index = Count
+			}
+		}
+	}
+	if Count > 1 {
+		Name += "[" + strconv.Itoa(Index) + "]"
+	}
+	return this.Parent.NodePath() + "/" + Name
+}
+func nodeTest(ElementType TXmlElementType) string {
+	switch ElementType {
+	case xeComment:
+		return "comment()"
+	case xeQuestion:
+		return "processing-instruction()"
+	}
+	return ""
+}
+func (this *TXmlNode) hasPathName(Name string) bool {
+	if Test := nodeTest(this.ElementType); Test != "" {
+		return Test == Name
+	}
+	return (this.ElementType == xeNormal || this.ElementType == xeCData) && this.Name == Name
+}
+func (this *TXmlNode) SourcePosition() (Line, Column int) {
+	//Line and column (1-based) where the node starts in the xml text the document
+	//was read from,0 for nodes that were not read
+	doc := this.Document()
+	if doc == nil || this.sourcePos == 0 || this.sourcePos > len(doc.XmlString) {
+		return 0, 0
+	}
+	return textPosition(doc.XmlString, this.sourcePos-1)
+}
 func (this *TXmlNode) NodeCount() int {
 	return len(this.Nodes)
 }
+func (this *TXmlNode) NodeList() []*TXmlNode {
+	//The child nodes in document order (ascending node key)
+	keys := make([]int, 0, len(this.Nodes))
+	for k := range this.Nodes {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	list := make([]*TXmlNode, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, this.Nodes[k])
+	}
+	return list
+}
 func (this *TXmlNode) ParseTag(AValue string, TagStart, TagClose int) {
-	//Create a list to hold string items
-	ParseAttributes(AValue, TagStart, TagClose, this.Attributes)
+	//Read the attributes in AValue from TagStart,like the attributes of an element
+	if this.Attributes == nil {
+		this.Attributes = make(map[string]string)
+	}
+	for k := range this.Attributes {
+		delete(this.Attributes, k)
+	}
+	if TagStart >= 0 && TagStart < len(AValue) {
+		newXmlScanner(nil, "", 0).parseAttributes(this, AValue[TagStart:])
+	}
 	//Determine name,attributes or value for each element type
 	switch this.ElementType {
 	case xeDeclaration:
@@ -200,244 +287,157 @@ func (this *TXmlNode) NodeAdd(ANode *TXmlNode) int {
 	}
 }
 func (this *TXmlNode) AddCharDataNode(ANodeValue string) {
-	//Add all text up till now as xeCharData
-	ANodeValue = strings.Trim(ANodeValue, " ")
-	ANodeValue = strings.Trim(ANodeValue, "\x0A")
-	ANodeValue = strings.Trim(ANodeValue, "\x0D")
-	this.Value = ANodeValue
+	//Add all text up till now as xeCharData. Value holds the last text that is not
+	//blank: indentation after the last sub node,tabs included,must not clear the text
+	//in front of it or "<a>x<b/>\n</a>" would lose "x" when it is written again
+	ANodeValue = trimControlChars(ANodeValue)
+	if len(ANodeValue) > 0 {
+		this.Value = ANodeValue
+	}
 }
 func (this *TXmlNode) ReadFromString(AValue string) {
-	rd := &bytes.Reader{}
-	rd.Read([]byte(AValue))
-	this.ReadFromStream(rd)
+	newXmlScanner(this.Document(), AValue, 0).readNode(this)
 }
 func (this *TXmlNode) ReadFromStream(S *bytes.Reader) {
 	//Read the node from the starting "<" until the closing ">" from the stream in S.
-	ANodeValue := new(bytes.Buffer)
-	HasCR := false
-	HasSubTags := false
-	var (
-		err    error
-		Ch     byte
-		bret   bool
-		AValue string
-	)
-	Reader := &TsdSurplusReader{Reader: S}
-	//Trailing blanks/controls chars?
-	if Ch, bret = Reader.ReadCharSkipBlanks(); !bret {
-		return
-	}
-	//What is it? Tag is End or Start
-	if Ch == '<' {
-		// A tag - which one?
-		ATagIndex := ReadOpenTag(Reader)
-		if ATagIndex >= 0 {
-			this.ElementType = cTags[ATagIndex].FStyle
-			switch this.ElementType {
-			case xeNormal, xeDeclaration, xeStyleSheet:
-				//These tags we will process
-				AValue, _ = ReadStringFromStreamUntil(Reader, cTags[ATagIndex].FClose, true)
-				ALength := len(AValue)
-				IsDirect := false
-				if this.ElementType == xeNormal {
-					if (ALength > 0) && (AValue[ALength-1] == '/') {
-						//Is it a direct tag?
-						ALength--
-						IsDirect = true
-						AValue = AValue[:ALength]
-					}
-					for i := 0; i < ALength; i++ {
-						if strings.Index(cControlChars, string(AValue[i])) >= 0 {
-							this.Name = strings.Trim(AValue[:i], " ")
-							AValue = AValue[i:]
-							break
-						} else {
-							this.Name = strings.Trim(AValue, " ")
-						}
-					}
-					if this.Name == "" {
-						this.Name = strings.Trim(AValue, " ")
-					}
-				}
-				ALength = len(AValue)
-
-				this.ParseTag(AValue, 0, ALength-1)
-				//Now the tag can be a direct close - in that case we're finished
-				if IsDirect || this.ElementType == xeDeclaration || this.ElementType == xeStyleSheet {
-					return
-				}
-				//Process reset of tag
-				for {
-					//Read character from stream
-					if Ch, err = S.ReadByte(); err != nil {
-						panic(errors.New(fmt.Sprintf(sxeMissingCloseTag, this.Name)))
-					}
-					//Is there a subtag?
-					if Ch == '<' {
-						if Ch, bret = Reader.ReadCharSkipBlanks(); !bret {
-							panic(errors.New(fmt.Sprintf(sxeMissingDataAfterGreaterThan, this.Name)))
-						}
-						if Ch == '/' {
-							//This seems our closing tag
-							if AValue, bret = ReadStringFromStreamUntil(Reader, ">", true); !bret {
-								panic(errors.New(fmt.Sprintf(sxeMissingLessThanInCloseTag, this.Name)))
-							}
-							if strings.Compare(strings.Trim(AValue, " "), this.Name) != 0 {
-								panic(errors.New(fmt.Sprintf(sxeIncorrectCloseTag, this.Name)))
-							}
-							AValue = ""
-							break
-						} else {
-							//Add all text up till now as xeCharData
-							this.AddCharDataNode(ANodeValue.String())
-							ANodeValue.Reset()
-							//Reset this HasCR flag if we add node ,we only want to detect
-							//The CR after last subnode
-							HasCR = false
-							//This is a subtag... so create it and let it process
-							HasSubTags = true
-							S.Seek(-2, io.SeekCurrent)
-							ANode := &TXmlNode{Attributes: make(map[string]string),
-								Nodes: make(map[int]*TXmlNode)}
-							this.NodeAdd(ANode)
-							ANode.ReadFromStream(S)
-						}
-					} else {
-						//If we detect a CR we will set the flag.This will signal the fact
-						//That this XML file was saved with xfReadable
-						if Ch == 0x0D {
-							HasCR = true
-						}
-						//Add the character to the node value buffer.
-						ANodeValue.WriteByte(Ch)
-					}
-				}
-				//Add all text up till now as xeText
-				this.AddCharDataNode(ANodeValue.String())
-				ANodeValue.Reset()
-				//Check CharData nodes,remove trailing CRLF + indentation if we
-				//were in xfReadable mode
-				if HasSubTags && HasCR {
-					for _, v := range this.Nodes {
-						if v.ElementType == xeCharData {
-							AClose := strings.IndexAny(v.Value, "\x0D\x0A")
-							if AClose < 0 {
-								AClose = len(v.Value)
-							}
-							v.Value = v.Value[:AClose]
-						}
-					}
-				}
-				// If this first node is xeCharData we use it as ValueDirect
-			case xeDocType:
-				this.Name = "DTD"
-				AValue, _ = ReadStringFromStreamUntil(Reader, cTags[ATagIndex].FClose, false)
-				this.Value = AValue
-			//Parse DTD
-			case xeElement, xeAttList, xeEntity, xeNotation:
-				//DTD elements
-				AValue, _ = ReadStringFromStreamWithQuotes(Reader, cTags[ATagIndex].FClose)
-				ALength := len(AValue)
-				Words := make(map[string]string)
-				ParseAttributes(AValue, 0, ALength-1, Words)
-				for k, v := range Words {
-					if len(this.Name) == 0 {
-						this.Name = k
-					}
-					this.Value += k + "=" + v + "\x0D\x0A"
-				}
-			default:
-				switch this.ElementType {
-				case xeComment:
-					this.Name = "Comment"
-				case xeCData:
-					this.Name = "CData"
-				case xeExclam:
-					this.Name = "Special"
-				case xeQuestion:
-					this.Name = "Special"
-				default:
-					this.Name = "Unknown"
-				}
-				//In these cases just get all data up till the closing tag
-				AValue, _ = ReadStringFromStreamUntil(Reader, cTags[ATagIndex].FClose, false)
-				this.Value = AValue
-			} //case
-		}
+	Data := make([]byte, S.Size())
+	S.ReadAt(Data, 0)
+	Scanner := newXmlScanner(this.Document(), string(Data), streamPos(S))
+	defer func() {
+		S.Seek(int64(Scanner.Pos), io.SeekStart)
+	}()
+	Scanner.readNode(this)
+}
+func (this *TXmlNode) writer() tXmlWriter {
+	if doc := this.Document(); doc != nil {
+		return tXmlWriter{Doc: doc, Format: doc.XmlFormat}
 	}
+	return tXmlWriter{Format: xfCompact}
 }
-func (this *TXmlNode) GetIndent() string {
-	if this.Document != nil {
-		switch this.Document().XmlFormat {
-		case xfCompact:
-			return ""
-		case xfReadable:
-			return strings.Repeat(this.Document().IndentString, this.TreeDepth())
-		}
+func (this tXmlWriter) indent(Node *TXmlNode) string {
+	if this.Doc != nil && this.Format == xfReadable {
+		return strings.Repeat(this.Doc.Indent(), Node.TreeDepth())
 	}
 	return ""
 }
-func (this *TXmlNode) GetLineFeed() string {
-	if this.Document != nil {
-		switch this.Document().XmlFormat {
-		case xfCompact:
-			return ""
-		case xfReadable:
-			return "\x0D\x0A"
-		default:
-			return "\x0A"
-		}
+func (this tXmlWriter) lineFeed() string {
+	if this.Doc == nil || this.Format != xfReadable {
+		return ""
 	}
-	return ""
+	if this.Doc.FormatOptions.LineFeed == "" {
+		return "\x0D\x0A"
+	}
+	return this.Doc.FormatOptions.LineFeed
 }
-func (this *TXmlNode) UseFullNodes() bool {
-	if this.Document() != nil {
-		return this.Document().UseFullNodes
+func (this tXmlWriter) fullNodes(Node *TXmlNode) bool {
+	if this.Doc != nil {
+		//An entry for the element name overrides the document setting
+		if v, ok := this.Doc.FormatOptions.FullNodes[Node.Name]; ok {
+			return v
+		}
+		return this.Doc.UseFullNodes
 	}
 	return false
 }
+func (this *TXmlNode) GetIndent() string {
+	return this.writer().indent(this)
+}
+func (this *TXmlNode) GetLineFeed() string {
+	return this.writer().lineFeed()
+}
+func (this *TXmlNode) UseFullNodes() bool {
+	return this.writer().fullNodes(this)
+}
 func (this *TXmlNode) QualifyAsDirectNode() bool {
+	return this.qualifyAsDirectNode(this.writer())
+}
+func (this *TXmlNode) qualifyAsDirectNode(W tXmlWriter) bool {
 	//If this node qualifies as a direct node when writing ,we return true.
 	//A direct node may have attributes,but no value or subnodes.Furhtermore
 	//The root node will never be displayed as a direct node.
 	return (len(this.Value) == 0) &&
 		(this.NodeCount() == 0) &&
 		(this.ElementType == xeNormal) &&
-		!this.UseFullNodes() &&
+		!W.fullNodes(this) &&
 		(this.TreeDepth() > 0)
 }
 func (this *TXmlNode) DeclarationWriteInnerTag() string {
+	return this.declarationInnerTag(this.writer())
+}
+func (this *TXmlNode) declarationInnerTag(W tXmlWriter) string {
 	//Write the inner part of the tag,the one that contains the attributes
 	//Attributes
 	val := ""
 	//Do not write empty attributes
-	for k, v := range this.Attributes {
+	for _, k := range this.AttributeNames() {
 		if strings.ToLower(k) == "version" {
-			val = " " + k + "=\"" + v + "\" " + val
+			val = " " + k + "=\"" + this.Attributes[k] + "\"" + val
 		} else {
-			val += " " + k + "=\"" + v + "\""
+			val += " " + k + "=\"" + this.Attributes[k] + "\""
 		}
 	}
 	//End of tag - direct nodes get an extra "/"
-	if this.QualifyAsDirectNode() {
+	if this.qualifyAsDirectNode(W) {
 		val += "/"
 	}
 	return val
 }
 func (this *TXmlNode) WriteInnerTag() string {
+	return this.writeInnerTag(this.writer())
+}
+func (this *TXmlNode) writeInnerTag(W tXmlWriter) string {
 	//Write the inner part of the tag,the one that contains the attributes
 	//Attributes
-	val := ""
-	//Do not write empty attributes
-	for k, v := range this.Attributes {
-		val += " " + k + "=\"" + v + "\""
-	}
+	val := this.writeAttributes(this.AttributeNames(), W)
 	//End of tag - direct nodes get an extra "/"
-	if this.QualifyAsDirectNode() {
+	if this.qualifyAsDirectNode(W) {
 		val += "/"
 	}
 	return val
 }
+func (this *TXmlNode) AttributeNames() []string {
+	//Attribute names in the order they are written
+	Names := make([]string, 0, len(this.Attributes))
+	for k := range this.Attributes {
+		Names = append(Names, k)
+	}
+	sort.Strings(Names)
+	return Names
+}
+func (this *TXmlNode) writeAttributes(Names []string, W tXmlWriter) string {
+	//Write the attributes,wrapping them over several lines when the format
+	//options limit the line width or the number of attributes per line
+	Attrs := make([]string, len(Names))
+	Width := len(W.indent(this)) + 1 + len(this.Name)
+	for i, k := range Names {
+		Attrs[i] = " " + k + "=\"" + this.Attributes[k] + "\""
+		Width += len(Attrs[i])
+	}
+	doc := W.Doc
+	if doc == nil || W.Format != xfReadable {
+		return strings.Join(Attrs, "")
+	}
+	MaxWidth := doc.FormatOptions.MaxLineWidth
+	PerLine := doc.FormatOptions.AttributesPerLine
+	if (MaxWidth <= 0 || Width <= MaxWidth) && (PerLine <= 0 || len(Attrs) <= PerLine) {
+		return strings.Join(Attrs, "")
+	}
+	AIndent := W.indent(this) + doc.Indent()
+	buf := new(bytes.Buffer)
+	LineWidth := len(W.indent(this)) + 1 + len(this.Name)
+	Count := 0
+	for _, v := range Attrs {
+		if Count > 0 && ((PerLine > 0 && Count >= PerLine) || (MaxWidth > 0 && LineWidth+len(v) > MaxWidth)) {
+			buf.WriteString(W.lineFeed() + AIndent)
+			LineWidth = len(AIndent)
+			Count = 0
+		}
+		buf.WriteString(v)
+		LineWidth += len(v)
+		Count++
+	}
+	return buf.String()
+}
 func (this *TXmlNode) WriteToString() string {
 	buf := &bytes.Buffer{}
 	this.WriteToStream(buf)
@@ -445,25 +445,30 @@ func (this *TXmlNode) WriteToString() string {
 }
 
 func (this *TXmlNode) WriteToStream(S *bytes.Buffer) {
-	AIndent := this.GetIndent()
-	ALineFeed := this.GetLineFeed()
+	this.writeToStream(S, this.writer())
+}
+func (this *TXmlNode) writeToStream(S *bytes.Buffer, W tXmlWriter) {
+	//W holds the settings of the document that writes the node
+	W.Cancel.check()
+	AIndent := W.indent(this)
+	ALineFeed := W.lineFeed()
 	NodeCount := this.NodeCount()
 	//Write indent
 	ALine := AIndent
 	//Write the node - disinguish node type
 	switch this.ElementType {
 	case xeDeclaration: //Xml declaration <?xml{declaration}?>
-		ALine = AIndent + fmt.Sprintf("<?xml%s?>", this.DeclarationWriteInnerTag())
+		ALine = AIndent + fmt.Sprintf("<?xml%s?>", this.declarationInnerTag(W))
 	case xeStyleSheet: //StyeSheet <?xml-stylesheet{stylesheet}?>
-		ALine = AIndent + fmt.Sprintf("<?xml-stylesheet%s?>", this.WriteInnerTag())
+		ALine = AIndent + fmt.Sprintf("<?xml-stylesheet%s?>", this.writeInnerTag(W))
 	case xeDocType:
 		if NodeCount == 0 {
 			ALine = AIndent + fmt.Sprintf("<!DOCTYPE %s>", this.Value)
 		} else {
 			ALine = AIndent + fmt.Sprintf("<!DOCTYPE %s[", this.Value) + ALineFeed
 			WriteStringToStream(S, ALine)
-			for _, v := range this.Nodes {
-				v.WriteToStream(S)
+			for _, v := range this.NodeList() {
+				v.writeToStream(S, W)
 				WriteStringToStream(S, ALineFeed)
 			}
 			ALine = "]>"
@@ -490,7 +495,7 @@ func (this *TXmlNode) WriteToStream(S *bytes.Buffer) {
 		ALine = AIndent + fmt.Sprintf("<%s>", this.Value)
 	case xeNormal:
 		//Write tag
-		ALine = AIndent + fmt.Sprintf("<%s%s>", this.Name, this.WriteInnerTag())
+		ALine = AIndent + fmt.Sprintf("<%s%s>", this.Name, this.writeInnerTag(W))
 		//Write value (if Any)
 		ALine += this.Value
 		if NodeCount > 0 {
@@ -499,15 +504,18 @@ func (this *TXmlNode) WriteToStream(S *bytes.Buffer) {
 		}
 		WriteStringToStream(S, ALine)
 		//Write child element
-		for _, v := range this.Nodes {
-			v.WriteToStream(S)
+		for _, v := range this.NodeList() {
+			if v.BlankLines > 0 && len(ALineFeed) > 0 && W.Doc.FormatOptions.PreserveBlankLines {
+				WriteStringToStream(S, strings.Repeat(ALineFeed, v.BlankLines))
+			}
+			v.writeToStream(S, W)
 			if v.ElementType != xeCharData {
 				WriteStringToStream(S, ALineFeed)
 			}
 		}
 		//Write end tag
 		ALine = ""
-		if !this.QualifyAsDirectNode() {
+		if !this.qualifyAsDirectNode(W) {
 			if NodeCount > 0 {
 				ALine = AIndent
 			}
@@ -538,6 +546,25 @@ func (this *TXmlNode)NameToValue(name string) string{
 	return ""
 }
 
+// Output formatting,apart from OmitDeclaration only used by the readable format
+type TXmlFormatOptions struct {
+	LineFeed           string          //Line ending,"\x0D\x0A" when empty or "\x0A"
+	IndentString       string          //Indent per level,TNativeXml.IndentString when empty
+	MaxLineWidth       int             //Wrap the attributes of longer start tags,0 is unlimited
+	AttributesPerLine  int             //Wrap the attributes after this many per line,0 is unlimited
+	PreserveBlankLines bool            //Write the blank lines found between nodes when reading
+	FullNodes          map[string]bool //Per element name: true writes empty nodes as <a></a>,false as <a/>
+	OmitDeclaration    bool            //Do not write the xml declaration
+}
+
+// Document settings a node is written with,nodes shared by snapshots are written
+// with the settings of the document that writes them
+type tXmlWriter struct {
+	Doc    *TNativeXml
+	Format TxmlFormatType
+	Cancel *tCancelCheck
+}
+
 //Xml Operation
 type TNativeXml struct {
 	XmlString      string
@@ -547,6 +574,23 @@ type TNativeXml struct {
 	XmlRoot        *TXmlNode
 	RootNodes      map[TXmlElementType]*TXmlNode
 	ParserWarnings bool
+	FormatOptions  TXmlFormatOptions
+	PreserveSource bool //Lossless mode,unmodified nodes are written exactly as they were read
+	EntityOptions  TXmlEntityOptions
+	ParseOptions   TXmlParseOptions //Resource limits while reading
+	RecoverErrors  bool             //Repair broken documents while reading instead of failing
+	Warnings       []TXmlParseWarning
+	source         *tXmlDocSource
+	parse          *tXmlParseState
+	TrackChanges   bool         //Record the changes made through the path api in Changes
+	UndoLevels     int          //Path api calls and transactions Undo can revert,0 disables undo
+	Changes        []TXmlChange //Changes since the document was read or ClearChanges
+	generation     int          //Version of the tree,incremented by each snapshot
+	readOnly       bool         //A snapshot,the path api does not change it
+	observers      []tXmlObserver
+	observerID     int
+	undo           *tXmlHistory
+	dtd            *tXmlDtdCache
 }
 
 func (this *TNativeXml) SetXmlFormat(xftype bool) {
@@ -557,38 +601,45 @@ func (this *TNativeXml) SetXmlFormat(xftype bool) {
 	}
 }
 func (this *TNativeXml) LineFeed() string {
-	switch this.XmlFormat {
-	case xfCompact:
-		return ""
-	case xfReadable:
-		return "\x0D\x0A"
-	default:
-		return "\x0A"
+	return tXmlWriter{Doc: this, Format: this.XmlFormat}.lineFeed()
+}
+func (this *TNativeXml) Indent() string {
+	if this.FormatOptions.IndentString == "" {
+		return this.IndentString
 	}
+	return this.FormatOptions.IndentString
 }
 func (this *TNativeXml) WriteToStream(S *bytes.Buffer) {
+	this.writeToStream(S, nil)
+}
+func (this *TNativeXml) writeToStream(S *bytes.Buffer, Cancel *tCancelCheck) {
 	if this.RootNodes == nil && this.ParserWarnings {
 		panic(errors.New(sxeRootElementNotDefined))
 	}
+	if this.PreserveSource && this.source != nil {
+		this.writeSource(S, Cancel)
+		return
+	}
+	W := tXmlWriter{Doc: this, Format: this.XmlFormat, Cancel: Cancel}
 	//Write the Xml declaration <?xml{declaration}?>
 	for k, v := range this.RootNodes {
-		if k == xeDeclaration {
-			v.WriteToStream(S)
-			WriteStringToStream(S, this.LineFeed())
+		if k == xeDeclaration && !this.FormatOptions.OmitDeclaration {
+			v.writeToStream(S, W)
+			WriteStringToStream(S, W.lineFeed())
 		}
 	}
 	//Write to XML DOCTYPE DTD declaration <!DOCTYPE{spec}>
 	for k, v := range this.RootNodes {
 		if k == xeDocType {
-			v.WriteToStream(S)
-			WriteStringToStream(S, this.LineFeed())
+			v.writeToStream(S, W)
+			WriteStringToStream(S, W.lineFeed())
 		}
 	}
 	//Write the root node
 	for k, v := range this.RootNodes {
 		if k == xeNormal || k == xeCData {
-			v.WriteToStream(S)
-			WriteStringToStream(S, this.LineFeed())
+			v.writeToStream(S, W)
+			WriteStringToStream(S, W.lineFeed())
 		}
 	}
 }
@@ -624,19 +675,46 @@ func (this *TNativeXml) ReadFromString(AValue string) {
 	this.ReadFromStream(bytes.NewBuffer([]byte(AValue)))
 }
 func (this *TNativeXml) ReadFromStream(S *bytes.Buffer) {
+	this.readFromStream(S, nil)
+}
+func (this *TNativeXml) readFromStream(S *bytes.Buffer, Cancel *tCancelCheck) {
+	if Max := this.ParseOptions.MaxInputBytes; Max > 0 && S.Len() > Max {
+		limitExceeded(LimitInputBytes, Max, Max)
+	}
+	this.parse = &tXmlParseState{Options: &this.ParseOptions, Cancel: Cancel}
+	defer func() {
+		this.parse = nil
+	}()
 	this.XmlString = S.String()
+	this.Warnings = nil
+	this.Changes = nil
+	this.undo = nil
+	this.dtd = &tXmlDtdCache{}
+	this.XmlString = this.checkXmlChars(this.XmlString)
 	//Clear the old root nodes - we do not reset the defaults
 	this.RootNodes = make(map[TXmlElementType]*TXmlNode)
-	Reader := bytes.NewReader(S.Bytes())
-	for Reader.Len() > 0 {
+	this.source = nil
+	if this.PreserveSource {
+		this.source = &tXmlDocSource{}
+	}
+	Scanner := newXmlScanner(this, this.XmlString, 0)
+	for Scanner.Pos < len(Scanner.Text) {
 		ANode := &TXmlNode{Attributes: make(map[string]string),
 			document: this,
 			Nodes:    make(map[int]*TXmlNode)}
-		ANode.ReadFromStream(Reader)
+		Scanner.readNode(ANode)
+		if this.source != nil && !ANode.IsClear() {
+			this.source.add(ANode, this.XmlString, Scanner.Pos)
+		}
 		//XML declaration
 		if ANode.ElementType == xeDeclaration {
 			//if has "encoding" node ,check encoding and encode content
 		}
+		//Only the first root element is kept when recovering
+		if ANode.ElementType == xeNormal && !ANode.IsClear() && this.RootNodes[xeNormal] != nil && this.recovering() {
+			this.warn(ANode.sourcePos-1, fmt.Sprintf(sxeWarnExtraRoot, ANode.Name))
+			continue
+		}
 		//Skip clear nodes
 		if !ANode.IsClear() {
 			if ANode.ElementType == xeNormal {
@@ -645,6 +723,9 @@ func (this *TNativeXml) ReadFromStream(S *bytes.Buffer) {
 			this.RootNodes[ANode.ElementType] = ANode
 		}
 	}
+	if this.source != nil {
+		this.source.Trailing = this.XmlString[this.source.LastPos:]
+	}
 	//Do some checks
 	NormalCount := 0
 	DeclarationCount := 0
@@ -692,14 +773,21 @@ func (this *TNativeXml) ReadFromStream(S *bytes.Buffer) {
 			panic(errors.New(sxeCDATAInRoot))
 		}
 	}
+	//Expand entities declared in the doctype
+	if this.EntityOptions.Expand {
+		if err := this.ExpandEntities(); err != nil {
+			panic(err)
+		}
+	}
 }
-func (this *TNativeXml) getpath(v *TXmlNode, parent string, nodepath *[]string) {
+func (this *TNativeXml) getpath(v *TXmlNode, parent string, nodepath *[]string, Cancel *tCancelCheck) {
+	Cancel.check()
 	if v.ElementType == xeCData {
 		*nodepath = append(*nodepath, parent)
 	} else if len(v.Nodes) > 0 {
 		for _, v1 := range v.Nodes {
 			if v1.ElementType == xeNormal || v1.ElementType == xeCData {
-				this.getpath(v1, parent+"/"+v.Name, nodepath)
+				this.getpath(v1, parent+"/"+v.Name, nodepath, Cancel)
 			}
 		}
 	} else {
@@ -709,6 +797,9 @@ func (this *TNativeXml) getpath(v *TXmlNode, parent string, nodepath *[]string)
 	}
 }
 func (this *TNativeXml) XmlNodePath() []string {
+	return this.xmlNodePath(nil)
+}
+func (this *TNativeXml) xmlNodePath(Cancel *tCancelCheck) []string {
 	if this.XmlRoot == nil {
 		panic(errors.New(sxeNoRootElement))
 	}
@@ -717,7 +808,7 @@ func (this *TNativeXml) XmlNodePath() []string {
 	for k, v := range this.RootNodes {
 		if k == xeNormal {
 			rootcount++
-			this.getpath(v, "", &nodepath)
+			this.getpath(v, "", &nodepath, Cancel)
 		}
 	}
 	if rootcount != 1 {
@@ -726,6 +817,9 @@ func (this *TNativeXml) XmlNodePath() []string {
 	return nodepath
 }
 func (this *TNativeXml) XmlNodePathForNode(NodePath string) []string {
+	return this.xmlNodePathForNode(NodePath, nil)
+}
+func (this *TNativeXml) xmlNodePathForNode(NodePath string, Cancel *tCancelCheck) []string {
 	if this.XmlRoot == nil {
 		panic(errors.New(sxeNoRootElement))
 	}
@@ -736,14 +830,23 @@ func (this *TNativeXml) XmlNodePathForNode(NodePath string) []string {
 
 	nodepath := make([]string, 0)
 	for _, v := range findnode.Nodes {
-		this.getpath(v, "/"+findnode.Name, &nodepath)
+		this.getpath(v, "/"+findnode.Name, &nodepath, Cancel)
 	}
 	return nodepath
 }
 func (this *TNativeXml) findNodeForName(NodeName string, Node *TXmlNode) *TXmlNode {
-	for _, v := range Node.Nodes {
-		if (v.ElementType == xeNormal || v.ElementType == xeCData) && v.Name == NodeName {
-			return v
+	//A name like "Item[2]" selects the second child node with that name
+	Index := 1
+	if p := strings.IndexByte(NodeName, '['); p > 0 && strings.HasSuffix(NodeName, "]") {
+		if i, err := strconv.Atoi(NodeName[p+1 : len(NodeName)-1]); err == nil && i > 0 {
+			NodeName, Index = NodeName[:p], i
+		}
+	}
+	for _, v := range Node.NodeList() {
+		if v.hasPathName(NodeName) {
+			if Index--; Index == 0 {
+				return v
+			}
 		}
 	}
 	return nil
@@ -757,7 +860,7 @@ func (this *TNativeXml) findNodeForPath(ParentPath string) *TXmlNode {
 			continue
 		}
 		if findnode == nil {
-			if this.XmlRoot.Name == v {
+			if this.XmlRoot != nil && this.XmlRoot.Name == v {
 				findnode = this.XmlRoot
 				continue
 			} else {
@@ -772,29 +875,39 @@ func (this *TNativeXml) findNodeForPath(ParentPath string) *TXmlNode {
 	return findnode
 }
 func (this *TNativeXml) AddNodeForPathN(ParentPath string, Child TXmlNode) bool {
-	findnode := this.findNodeForPath(ParentPath)
+	if !isEditableNode(&Child) {
+		return false
+	}
+	findnode := this.findNodeForEdit(ParentPath)
 	if findnode != nil {
 		findnode.MaxNodeID++
 		Child.NodeID = findnode.MaxNodeID
 		Child.Parent = findnode
+		Child.generation = this.generation
 		findnode.Nodes[Child.NodeID] = &Child
+		this.nodeAdded(&Child)
 	}
 	return findnode != nil
 }
 func (this *TNativeXml) AddNodeForPathS(ParentPath string, Child string) bool {
-	findnode := this.findNodeForPath(ParentPath)
+	if !IsXmlName(Child) {
+		return false
+	}
+	findnode := this.findNodeForEdit(ParentPath)
 	if findnode != nil {
 		findnode.MaxNodeID++
 		findnode.Nodes[findnode.MaxNodeID] = &TXmlNode{Attributes: make(map[string]string),
-			Nodes:  make(map[int]*TXmlNode),
-			Name:   Child,
-			NodeID: findnode.MaxNodeID,
-			Parent: findnode}
+			Nodes:      make(map[int]*TXmlNode),
+			Name:       Child,
+			NodeID:     findnode.MaxNodeID,
+			Parent:     findnode,
+			generation: this.generation}
+		this.nodeAdded(findnode.Nodes[findnode.MaxNodeID])
 	}
 	return findnode != nil
 }
 func (this *TNativeXml) AddNodeForPathB(ParentPath string, Child *bytes.Buffer) bool {
-	findnode := this.findNodeForPath(ParentPath)
+	findnode := this.findNodeForEdit(ParentPath)
 	if findnode != nil {
 		newnativexml := NewNativeXml()
 		newnativexml.ReadFromStream(Child)
@@ -802,7 +915,9 @@ func (this *TNativeXml) AddNodeForPathB(ParentPath string, Child *bytes.Buffer)
 			findnode.MaxNodeID++
 			newnativexml.XmlRoot.NodeID = findnode.MaxNodeID
 			newnativexml.XmlRoot.Parent = findnode
+			newnativexml.XmlRoot.generation = this.generation
 			findnode.Nodes[findnode.MaxNodeID] = newnativexml.XmlRoot
+			this.nodeAdded(newnativexml.XmlRoot)
 		} else {
 			return false
 		}
@@ -812,6 +927,10 @@ func (this *TNativeXml) AddNodeForPathB(ParentPath string, Child *bytes.Buffer)
 func (this *TNativeXml) AddNodeForPath(Path string) bool {
 	spath := strings.Replace(Path, " ", "", -1)
 	path := strings.Split(spath, "/")
+	if this.readOnly || !this.canAddPath(path) {
+		return false
+	}
+	defer this.groupChanges()()
 	var findnode, profindnode *TXmlNode
 	for _, v := range path {
 		if v == "" {
@@ -820,15 +939,17 @@ func (this *TNativeXml) AddNodeForPath(Path string) bool {
 		if findnode == nil {
 			if this.XmlRoot == nil {
 				findnode = &TXmlNode{Attributes: make(map[string]string),
-					document: this,
-					Nodes:    make(map[int]*TXmlNode),
-					Name:     v,
-					NodeID:   0}
+					document:   this,
+					Nodes:      make(map[int]*TXmlNode),
+					Name:       v,
+					NodeID:     0,
+					generation: this.generation}
 				this.RootNodes[xeNormal] = findnode
 				this.XmlRoot = findnode
+				this.nodeAdded(findnode)
 				continue
 			} else if this.XmlRoot.Name == v {
-				findnode = this.XmlRoot
+				findnode = this.editRoot()
 				continue
 			} else {
 				return false
@@ -839,26 +960,72 @@ func (this *TNativeXml) AddNodeForPath(Path string) bool {
 		if findnode == nil {
 			profindnode.MaxNodeID++
 			findnode = &TXmlNode{Attributes: make(map[string]string),
-				Nodes:  make(map[int]*TXmlNode),
-				Name:   v,
-				NodeID: profindnode.MaxNodeID,
-				Parent: profindnode}
+				Nodes:      make(map[int]*TXmlNode),
+				Name:       v,
+				NodeID:     profindnode.MaxNodeID,
+				Parent:     profindnode,
+				generation: this.generation}
 			profindnode.Nodes[profindnode.MaxNodeID] = findnode
+			this.nodeAdded(findnode)
 		} else {
+			findnode = this.editChild(profindnode, findnode)
 			profindnode = findnode
 		}
 	}
 	return findnode != nil
 }
+func (this *TNativeXml) canAddPath(path []string) bool {
+	//Nodes are only created for plain xml names,an indexed name must exist
+	var findnode *TXmlNode
+	Create := false
+	for _, v := range path {
+		if v == "" {
+			continue
+		}
+		Name, Indexed, ok := isEditablePathName(v)
+		if !ok || (Indexed && Create) {
+			return false
+		}
+		switch {
+		case Create:
+		case findnode == nil:
+			if this.XmlRoot == nil {
+				if Indexed {
+					return false
+				}
+				Create = true
+			} else if this.XmlRoot.Name != Name || Indexed {
+				return false
+			} else {
+				findnode = this.XmlRoot
+			}
+		default:
+			if findnode = this.findNodeForName(v, findnode); findnode == nil {
+				if Indexed {
+					return false
+				}
+				Create = true
+			}
+		}
+	}
+	return true
+}
 func (this *TNativeXml) XMLNodeForPath(FindPath string) *TXmlNode {
 	return this.findNodeForPath(FindPath)
 }
 func (this *TNativeXml) SetNodeValueForPath(FindPath, Value string) bool {
-	findnode := this.findNodeForPath(FindPath)
+	if !IsXmlEscapedText(Value) {
+		return false
+	}
+	findnode := this.findNodeForEdit(FindPath)
 	if findnode == nil {
 		return false
 	} else {
+		OldValue := findnode.Value
 		findnode.Value = Value
+		if OldValue != Value && this.watched() {
+			this.changed(TXmlChange{Kind: ChangeValueSet, Path: findnode.NodePath(), OldValue: OldValue, NewValue: Value, Node: findnode})
+		}
 		return true
 	}
 }
@@ -871,7 +1038,11 @@ func (this *TNativeXml) GetNodeValueForPath(FindPath string) string {
 	}
 }
 func (this *TNativeXml) ReplaceNode(FindPath string, Node *TXmlNode) bool {
-	findnode := this.findNodeForPath(FindPath)
+	if !isEditableNode(Node) {
+		return false
+	}
+	defer this.groupChanges()()
+	findnode := this.findNodeForEdit(FindPath)
 	var profindnode *TXmlNode
 	if findnode != nil {
 		profindnode = findnode.Parent
@@ -879,8 +1050,15 @@ func (this *TNativeXml) ReplaceNode(FindPath string, Node *TXmlNode) bool {
 		return false
 	}
 	if profindnode != nil {
+		if this.watched() {
+			this.changed(TXmlChange{Kind: ChangeNodeRemoved, Path: findnode.NodePath(), OldValue: this.nodeXml(findnode),
+				Node: findnode, Parent: profindnode, NodeID: findnode.NodeID})
+		}
 		Node.Parent = profindnode
+		Node.NodeID = findnode.NodeID
+		Node.generation = this.generation
 		profindnode.Nodes[findnode.NodeID] = Node
+		this.nodeAdded(Node)
 		return true
 	} else {
 		return false
@@ -895,22 +1073,83 @@ func (this *TNativeXml) GetAttribute(FindPath, AttrName string) string {
 	}
 }
 func (this *TNativeXml) SetAttribute(FindPath, AttrName, AttrValue string) bool {
-	findnode := this.findNodeForPath(FindPath)
+	if !isEditableAttribute(AttrName, AttrValue) {
+		return false
+	}
+	findnode := this.findNodeForEdit(FindPath)
 	if findnode != nil {
+		OldValue, Existed := findnode.Attributes[AttrName]
 		findnode.Attributes[AttrName] = AttrValue
+		if (!Existed || OldValue != AttrValue) && this.watched() {
+			this.changed(TXmlChange{Kind: ChangeAttributeSet, Path: findnode.NodePath(), Name: AttrName,
+				OldValue: OldValue, NewValue: AttrValue, Existed: Existed, Node: findnode})
+		}
 		return true
 	} else {
 		return false
 	}
 }
-func (this *TNativeXml) RemoveNode(FindPath string) bool {
+func (this *TNativeXml) RemoveAttribute(FindPath, AttrName string) bool {
 	findnode := this.findNodeForPath(FindPath)
-	if findnode != nil {
+	if findnode == nil || !findnode.HasAttribute(AttrName) {
+		return false
+	}
+	findnode = this.findNodeForEdit(FindPath)
+	if findnode == nil {
+		return false
+	}
+	OldValue := findnode.Attributes[AttrName]
+	delete(findnode.Attributes, AttrName)
+	if this.watched() {
+		this.changed(TXmlChange{Kind: ChangeAttributeRemoved, Path: findnode.NodePath(), Name: AttrName,
+			OldValue: OldValue, Existed: true, Node: findnode})
+	}
+	return true
+}
+func (this *TNativeXml) RemoveNode(FindPath string) bool {
+	findnode := this.findNodeForEdit(FindPath)
+	//The root element is not removed,it has no parent to remove it from
+	if findnode != nil && findnode.Parent != nil {
+		if this.watched() {
+			this.changed(TXmlChange{Kind: ChangeNodeRemoved, Path: findnode.NodePath(), OldValue: this.nodeXml(findnode),
+				Node: findnode, Parent: findnode.Parent, NodeID: findnode.NodeID})
+		}
 		key := findnode.NodeID
-		findnode = findnode.Parent
-		delete(findnode.Nodes, key)
+		Parent := findnode.Parent
+		delete(Parent.Nodes, key)
+		this.pathsChanged(Parent, findnode)
 		return true
 	} else {
 		return false
 	}
 }
+func (this *TNativeXml) MoveNode(FindPath, NewParentPath string) bool {
+	//Make the node the last child of the node at NewParentPath
+	findnode := this.findNodeForEdit(FindPath)
+	if findnode == nil || findnode.Parent == nil {
+		return false
+	}
+	newparent := this.findNodeForEdit(NewParentPath)
+	for p := newparent; p != nil; p = p.Parent {
+		if p == findnode {
+			//A node cannot be moved into itself
+			return false
+		}
+	}
+	if newparent == nil {
+		return false
+	}
+	OldPath, OldParent, OldID := findnode.NodePath(), findnode.Parent, findnode.NodeID
+	delete(OldParent.Nodes, OldID)
+	newparent.MaxNodeID++
+	findnode.NodeID = newparent.MaxNodeID
+	findnode.Parent = newparent
+	newparent.Nodes[findnode.NodeID] = findnode
+	this.pathsChanged(OldParent, findnode)
+	this.pathsChanged(newparent, findnode)
+	if this.watched() {
+		this.changed(TXmlChange{Kind: ChangeNodeMoved, Path: findnode.NodePath(), OldPath: OldPath,
+			Node: findnode, Parent: OldParent, NodeID: OldID})
+	}
+	return true
+}
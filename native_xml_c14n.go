@@ -0,0 +1,266 @@
+package native_xml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	XmlC14N                = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"
+	XmlC14NWithComments    = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315#WithComments"
+	XmlExcC14N             = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	XmlExcC14NWithComments = "http://www.w3.org/2001/10/xml-exc-c14n#WithComments"
+	XmlNamespaceURI        = "http://www.w3.org/XML/1998/namespace"
+
+	sxeUnsupportedCanonicalization = "Unsupported canonicalization method \"%s\""
+)
+
+// Canonical XML writer (C14N 1.0 and Exclusive C14N 1.0)
+type TXmlCanonicalizer struct {
+	Exclusive         bool      //Exclusive canonicalization,only visibly utilized namespaces are written
+	WithComments      bool      //Keep comment nodes in the output
+	InclusivePrefixes []string  //Exclusive only: prefixes treated as in inclusive mode,"#default" for the default namespace
+	Exclude           *TXmlNode //This subtree is left out of the output (enveloped signature)
+	written           bool      //Text as the document writes it instead of as it was read,for signing
+}
+
+func NewXmlCanonicalizer(Method string) (*TXmlCanonicalizer, error) {
+	switch Method {
+	case XmlC14N:
+		return &TXmlCanonicalizer{}, nil
+	case XmlC14NWithComments:
+		return &TXmlCanonicalizer{WithComments: true}, nil
+	case XmlExcC14N:
+		return &TXmlCanonicalizer{Exclusive: true}, nil
+	case XmlExcC14NWithComments:
+		return &TXmlCanonicalizer{Exclusive: true, WithComments: true}, nil
+	}
+	return nil, errors.New(fmt.Sprintf(sxeUnsupportedCanonicalization, Method))
+}
+func (this *TXmlCanonicalizer) WriteToString(Node *TXmlNode) string {
+	buf := new(bytes.Buffer)
+	this.WriteToStream(Node, buf)
+	return buf.String()
+}
+func (this *TXmlCanonicalizer) WriteToStream(Node *TXmlNode, S *bytes.Buffer) {
+	//Namespaces declared above the apex node are in scope but not rendered yet
+	InScope := make(map[string]string)
+	if Node.Parent != nil {
+		InScope = Node.Parent.InScopeNamespaces()
+	}
+	this.writeNode(Node, InScope, make(map[string]string), S)
+}
+func (this *TXmlCanonicalizer) writeNode(Node *TXmlNode, InScope, Rendered map[string]string, S *bytes.Buffer) {
+	if Node == this.Exclude {
+		return
+	}
+	switch Node.ElementType {
+	case xeNormal:
+		this.writeElement(Node, InScope, Rendered, S)
+	case xeCData:
+		S.WriteString(canonicalEscapeText(Node.Value))
+	case xeCharData:
+		S.WriteString(canonicalEscapeText(UnescapeString(Node.Value)))
+	case xeComment:
+		if this.WithComments {
+			S.WriteString("<!--" + Node.Value + "-->")
+		}
+	case xeQuestion:
+		S.WriteString("<?" + strings.TrimRight(Node.Value, cControlChars) + "?>")
+	}
+}
+func (this *TXmlCanonicalizer) writeElement(Node *TXmlNode, InScope, Rendered map[string]string, S *bytes.Buffer) {
+	//Namespaces in scope of this element
+	Scope := make(map[string]string, len(InScope))
+	for k, v := range InScope {
+		Scope[k] = v
+	}
+	for k, v := range Node.Attributes {
+		if Prefix, ok := namespaceDeclPrefix(k); ok {
+			Scope[Prefix] = UnescapeString(v)
+		}
+	}
+	//Which of them must be rendered here
+	Candidates := make(map[string]bool)
+	if this.Exclusive {
+		Prefix, _ := SplitQualifiedName(Node.Name)
+		Candidates[Prefix] = true
+		for k := range Node.Attributes {
+			if _, ok := namespaceDeclPrefix(k); ok {
+				continue
+			}
+			if Prefix, _ := SplitQualifiedName(k); Prefix != "" && Prefix != "xml" {
+				Candidates[Prefix] = true
+			}
+		}
+		for _, v := range this.InclusivePrefixes {
+			if v == "#default" {
+				v = ""
+			}
+			if _, ok := Scope[v]; ok {
+				Candidates[v] = true
+			}
+		}
+	} else {
+		for k := range Scope {
+			Candidates[k] = true
+		}
+	}
+	Prefixes := make([]string, 0, len(Candidates))
+	NewRendered := Rendered
+	for Prefix := range Candidates {
+		URI := Scope[Prefix]
+		if Rendered[Prefix] == URI || (Prefix != "" && URI == "") {
+			continue
+		}
+		if len(Prefixes) == 0 {
+			NewRendered = make(map[string]string, len(Rendered)+1)
+			for k, v := range Rendered {
+				NewRendered[k] = v
+			}
+		}
+		NewRendered[Prefix] = URI
+		Prefixes = append(Prefixes, Prefix)
+	}
+	sort.Strings(Prefixes)
+	//Attributes are ordered on namespace uri first and local name second
+	type TCanonicalAttr struct {
+		URI, Local, Name, Value string
+	}
+	Attrs := make([]TCanonicalAttr, 0, len(Node.Attributes))
+	for k, v := range Node.Attributes {
+		if _, ok := namespaceDeclPrefix(k); ok {
+			continue
+		}
+		Prefix, Local := SplitQualifiedName(k)
+		URI := ""
+		if Prefix == "xml" {
+			URI = XmlNamespaceURI
+		} else if Prefix != "" {
+			URI = Scope[Prefix]
+		}
+		Attrs = append(Attrs, TCanonicalAttr{URI: URI, Local: Local, Name: k, Value: v})
+	}
+	sort.Slice(Attrs, func(i, j int) bool {
+		if Attrs[i].URI != Attrs[j].URI {
+			return Attrs[i].URI < Attrs[j].URI
+		}
+		return Attrs[i].Local < Attrs[j].Local
+	})
+	//Start tag
+	S.WriteString("<" + Node.Name)
+	for _, Prefix := range Prefixes {
+		if Prefix == "" {
+			S.WriteString(" xmlns=\"")
+		} else {
+			S.WriteString(" xmlns:" + Prefix + "=\"")
+		}
+		S.WriteString(canonicalEscapeAttr(NewRendered[Prefix]) + "\"")
+	}
+	for _, v := range Attrs {
+		S.WriteString(" " + v.Name + "=\"" + canonicalAttrValue(v.Value) + "\"")
+	}
+	S.WriteString(">")
+	//Text and child nodes,empty elements are never written as direct nodes
+	Segments := Node.textSegments()
+	if this.written {
+		Segments = Node.writtenSegments()
+	}
+	for i, v := range Node.NodeList() {
+		S.WriteString(canonicalText(Segments[i]))
+		this.writeNode(v, Scope, NewRendered, S)
+	}
+	S.WriteString(canonicalText(Segments[len(Segments)-1]))
+	S.WriteString("</" + Node.Name + ">")
+}
+func canonicalText(Segment string) string {
+	//Character data of a text segment as read: line ends are normalised before the
+	//references are replaced,a "&#xD;" stays a carriage return
+	Segment = strings.ReplaceAll(strings.ReplaceAll(Segment, "\x0D\x0A", "\x0A"), "\x0D", "\x0A")
+	return canonicalEscapeText(UnescapeString(Segment))
+}
+func canonicalAttrValue(AValue string) string {
+	//Attribute values are normalised: each white space character read becomes a space
+	AValue = strings.ReplaceAll(AValue, "\x0D\x0A", " ")
+	AValue = strings.NewReplacer("\x09", " ", "\x0A", " ", "\x0D", " ").Replace(AValue)
+	return canonicalEscapeAttr(UnescapeString(AValue))
+}
+func canonicalEscapeText(AValue string) string {
+	r := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\x0D", "&#xD;")
+	return r.Replace(AValue)
+}
+func canonicalEscapeAttr(AValue string) string {
+	r := strings.NewReplacer("&", "&amp;", "<", "&lt;", "\"", "&quot;",
+		"\x09", "&#x9;", "\x0A", "&#xA;", "\x0D", "&#xD;")
+	return r.Replace(AValue)
+}
+func namespaceDeclPrefix(AttrName string) (string, bool) {
+	//"xmlns" declares the default namespace,"xmlns:p" the prefix p
+	if AttrName == "xmlns" {
+		return "", true
+	}
+	if strings.HasPrefix(AttrName, "xmlns:") {
+		return AttrName[len("xmlns:"):], true
+	}
+	return "", false
+}
+func SplitQualifiedName(Name string) (Prefix, LocalName string) {
+	if p := strings.IndexByte(Name, ':'); p >= 0 {
+		return Name[:p], Name[p+1:]
+	}
+	return "", Name
+}
+func (this *TXmlNode) LocalName() string {
+	_, Local := SplitQualifiedName(this.Name)
+	return Local
+}
+func (this *TXmlNode) InScopeNamespaces() map[string]string {
+	//All namespace declarations in scope of this node,the default namespace has prefix ""
+	var Scope map[string]string
+	if this.Parent != nil {
+		Scope = this.Parent.InScopeNamespaces()
+	} else {
+		Scope = make(map[string]string)
+	}
+	for k, v := range this.Attributes {
+		if Prefix, ok := namespaceDeclPrefix(k); ok {
+			Scope[Prefix] = UnescapeString(v)
+		}
+	}
+	return Scope
+}
+func (this *TXmlNode) LookupNamespaceURI(Prefix string) string {
+	for Node := this; Node != nil; Node = Node.Parent {
+		AttrName := "xmlns"
+		if Prefix != "" {
+			AttrName += ":" + Prefix
+		}
+		if v, ok := Node.Attributes[AttrName]; ok {
+			return UnescapeString(v)
+		}
+	}
+	if Prefix == "xml" {
+		return XmlNamespaceURI
+	}
+	return ""
+}
+func (this *TXmlNode) NamespaceURI() string {
+	Prefix, _ := SplitQualifiedName(this.Name)
+	return this.LookupNamespaceURI(Prefix)
+}
+func (this *TXmlNode) CanonicalString(Method string) (string, error) {
+	Canonicalizer, err := NewXmlCanonicalizer(Method)
+	if err != nil {
+		return "", err
+	}
+	return Canonicalizer.WriteToString(this), nil
+}
+func (this *TNativeXml) CanonicalString(Method string) (string, error) {
+	if this.XmlRoot == nil {
+		return "", errors.New(sxeRootElementNotDefined)
+	}
+	return this.XmlRoot.CanonicalString(Method)
+}
@@ -0,0 +1,106 @@
+package native_xml
+
+import (
+	"bytes"
+)
+
+type TXmlChangeKind int
+
+const (
+	ChangeNodeAdded TXmlChangeKind = iota
+	ChangeNodeRemoved
+	ChangeNodeMoved
+	ChangeValueSet
+	ChangeAttributeSet
+	ChangeAttributeRemoved
+)
+
+// One mutation made through the path api
+type TXmlChange struct {
+	Kind     TXmlChangeKind
+	Path     string    //Path of the node after the change,before it for a removed node
+	OldPath  string    //Path of a moved node before the move
+	Name     string    //Attribute name
+	OldValue string    //Old value or attribute value,the xml of a removed node
+	NewValue string    //New value or attribute value,the xml of an added node
+	Existed  bool      //The attribute had a value before ChangeAttributeSet
+	Node     *TXmlNode //The node that changed,was added,removed or moved
+	Parent   *TXmlNode //Parent of a removed node,the old parent of a moved node
+	NodeID   int       //Node key of a removed or moved node in Parent
+}
+
+// Gets the changes of a document after they are made
+type TXmlChangeObserver interface {
+	XmlChanged(Doc *TNativeXml, Change TXmlChange)
+}
+
+type tXmlObserver struct {
+	ID       int
+	Observer TXmlChangeObserver
+}
+
+// A function as TXmlChangeObserver
+type TXmlChangeFunc func(Doc *TNativeXml, Change TXmlChange)
+
+func (this TXmlChangeFunc) XmlChanged(Doc *TNativeXml, Change TXmlChange) {
+	this(Doc, Change)
+}
+func (this TXmlChangeKind) String() string {
+	switch this {
+	case ChangeNodeAdded:
+		return "NodeAdded"
+	case ChangeNodeRemoved:
+		return "NodeRemoved"
+	case ChangeNodeMoved:
+		return "NodeMoved"
+	case ChangeValueSet:
+		return "ValueSet"
+	case ChangeAttributeSet:
+		return "AttributeSet"
+	case ChangeAttributeRemoved:
+		return "AttributeRemoved"
+	}
+	return "Unknown"
+}
+
+func (this *TNativeXml) AddObserver(Observer TXmlChangeObserver) int {
+	//The result identifies the observer for RemoveObserver
+	this.observerID++
+	this.observers = append(this.observers, tXmlObserver{ID: this.observerID, Observer: Observer})
+	return this.observerID
+}
+func (this *TNativeXml) RemoveObserver(ID int) {
+	for i, v := range this.observers {
+		if v.ID == ID {
+			this.observers = append(this.observers[:i:i], this.observers[i+1:]...)
+			return
+		}
+	}
+}
+func (this *TNativeXml) ClearChanges() {
+	this.Changes = nil
+}
+func (this *TNativeXml) watched() bool {
+	//Are changes recorded or observed,the event data is only built then
+	return this.TrackChanges || len(this.observers) > 0 || this.recording()
+}
+func (this *TNativeXml) changed(Change TXmlChange) {
+	this.record(Change)
+	if this.TrackChanges {
+		this.Changes = append(this.Changes, Change)
+	}
+	for _, v := range this.observers {
+		v.Observer.XmlChanged(this, Change)
+	}
+}
+func (this *TNativeXml) nodeAdded(Node *TXmlNode) {
+	this.pathsChanged(Node.Parent, Node)
+	if this.watched() {
+		this.changed(TXmlChange{Kind: ChangeNodeAdded, Path: Node.NodePath(), NewValue: this.nodeXml(Node), Node: Node})
+	}
+}
+func (this *TNativeXml) nodeXml(Node *TXmlNode) string {
+	buf := new(bytes.Buffer)
+	Node.writeToStream(buf, tXmlWriter{Doc: this, Format: xfCompact})
+	return buf.String()
+}
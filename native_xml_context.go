@@ -0,0 +1,106 @@
+package native_xml
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+const (
+	cCancelCheckInterval = 256 //Nodes between two checks of the context
+)
+
+// Periodic check of a context while parsing,walking or writing a tree,a done
+// context panics with its error like the other parser errors
+type tCancelCheck struct {
+	ctx   context.Context
+	count int
+}
+
+// Reader that stops reading when the context is done
+type tContextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newCancelCheck(ctx context.Context) *tCancelCheck {
+	if ctx == nil || ctx.Done() == nil {
+		//Background and TODO are never done
+		return nil
+	}
+	return &tCancelCheck{ctx: ctx}
+}
+func (this *tCancelCheck) check() {
+	if this == nil {
+		return
+	}
+	if this.count++; this.count%cCancelCheckInterval == 0 {
+		if err := this.ctx.Err(); err != nil {
+			panic(err)
+		}
+	}
+}
+func (this *tContextReader) Read(p []byte) (int, error) {
+	if err := this.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return this.r.Read(p)
+}
+
+func (this *TNativeXml) ParseStreamContext(ctx context.Context, S *bytes.Buffer) (err error) {
+	//ParseStream that returns ctx.Err() when ctx is done before the document is read
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	defer recoverError(&err)
+	this.readFromStream(S, newCancelCheck(ctx))
+	return nil
+}
+func (this *TNativeXml) ParseStringContext(ctx context.Context, AValue string) error {
+	return this.ParseStreamContext(ctx, bytes.NewBufferString(AValue))
+}
+func (this *TNativeXml) ParseReaderContext(ctx context.Context, R io.Reader) error {
+	//Read no more than MaxInputBytes from R before parsing,a slow reader is
+	//left when ctx is done
+	if Max := this.ParseOptions.MaxInputBytes; Max > 0 {
+		R = io.LimitReader(R, int64(Max)+1)
+	}
+	if ctx.Done() != nil {
+		R = &tContextReader{ctx: ctx, r: R}
+	}
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(R); err != nil {
+		return err
+	}
+	return this.ParseStreamContext(ctx, buf)
+}
+func (this *TNativeXml) XmlNodePathContext(ctx context.Context) (Paths []string, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer recoverError(&err)
+	return this.xmlNodePath(newCancelCheck(ctx)), nil
+}
+func (this *TNativeXml) XmlNodePathForNodeContext(ctx context.Context, NodePath string) (Paths []string, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer recoverError(&err)
+	return this.xmlNodePathForNode(NodePath, newCancelCheck(ctx)), nil
+}
+func (this *TNativeXml) WriteToStreamContext(ctx context.Context, S *bytes.Buffer) (err error) {
+	//WriteToStream that stops with ctx.Err() when ctx is done,S may hold a part of the document then
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	defer recoverError(&err)
+	this.writeToStream(S, newCancelCheck(ctx))
+	return nil
+}
+func (this *TNativeXml) WriteToStringContext(ctx context.Context) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := this.WriteToStreamContext(ctx, buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,409 @@
+package native_xml
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type TXmlDiffKind int
+
+const (
+	DiffInserted TXmlDiffKind = iota
+	DiffDeleted
+	DiffMoved
+	DiffValueChanged
+	DiffAttributeChanged
+)
+
+// Settings of Diff
+type TXmlDiffOptions struct {
+	IgnoreWhitespace     bool              //Values that only differ in white space are equal
+	IgnoreComments       bool              //Comment nodes are left out
+	IgnoreAttributeOrder bool              //The attribute order is only known for documents read with PreserveSource
+	IgnoreSiblingOrder   bool              //Child nodes in another order are not reported as moved
+	KeyAttributes        map[string]string //Element name to the attribute that identifies repeated siblings,"*" for any element
+}
+
+// One difference between two documents. Inserted and deleted attributes have Name set
+// and the paths of their element
+type TXmlDifference struct {
+	Kind       TXmlDiffKind
+	Path       string    //Path of the node in the old document,empty for an inserted node
+	NewPath    string    //Path of the node in the new document,empty for a deleted node
+	ParentPath string    //Path of the parent in the old document for an inserted node
+	Name       string    //Attribute name,empty for a changed attribute order
+	OldValue   string    //Old value or attribute value,the xml of a deleted node
+	NewValue   string    //New value or attribute value,the xml of an inserted node
+	OldNode    *TXmlNode //The node in the old document
+	NewNode    *TXmlNode //The node in the new document
+}
+
+// State of one Diff call
+type tXmlDiff struct {
+	Options *TXmlDiffOptions
+	Old     *TNativeXml
+	New     *TNativeXml
+	Result  []TXmlDifference
+	Pairs   map[*TXmlNode]*TXmlNode //Matched nodes,the new node to the old one
+	Moved   map[*TXmlNode]bool      //New nodes of the moves
+	Equal   map[*TXmlNode]bool      //New nodes moved from another parent,their children are not compared
+	hashes  map[*TXmlNode]uint64
+}
+
+func (this TXmlDiffKind) String() string {
+	switch this {
+	case DiffInserted:
+		return "Inserted"
+	case DiffDeleted:
+		return "Deleted"
+	case DiffMoved:
+		return "Moved"
+	case DiffValueChanged:
+		return "ValueChanged"
+	case DiffAttributeChanged:
+		return "AttributeChanged"
+	}
+	return "Unknown"
+}
+func (this TXmlDifference) String() string {
+	//A readable line for reports,like "ValueChanged /a/b "x" -> "y""
+	Path := this.Path
+	switch {
+	case Path == "":
+		Path = this.NewPath
+	case this.Kind == DiffMoved:
+		Path += " -> " + this.NewPath
+	}
+	if this.Name != "" {
+		Path += "/@" + this.Name
+	}
+	switch {
+	case this.Kind == DiffMoved:
+		return this.Kind.String() + " " + Path
+	case this.Kind == DiffInserted:
+		return this.Kind.String() + " " + Path + " " + strconv.Quote(this.NewValue)
+	case this.Kind == DiffDeleted:
+		return this.Kind.String() + " " + Path + " " + strconv.Quote(this.OldValue)
+	}
+	return this.Kind.String() + " " + Path + " " + strconv.Quote(this.OldValue) + " -> " + strconv.Quote(this.NewValue)
+}
+
+func Diff(a, b *TNativeXml, Options TXmlDiffOptions) []TXmlDifference {
+	//The differences that turn document a into b. Child nodes are matched by element
+	//type,name and key attribute,equal subtrees first,the rest in document order.
+	//A node found under another parent is reported as moved
+	return newXmlDiff(a, b, Options).Result
+}
+func newXmlDiff(a, b *TNativeXml, Options TXmlDiffOptions) *tXmlDiff {
+	D := &tXmlDiff{Options: &Options, Old: a, New: b, Pairs: make(map[*TXmlNode]*TXmlNode),
+		Moved: make(map[*TXmlNode]bool), Equal: make(map[*TXmlNode]bool), hashes: make(map[*TXmlNode]uint64)}
+	OldRoot, NewRoot := diffRoot(a), diffRoot(b)
+	switch {
+	case OldRoot == nil && NewRoot == nil:
+	case OldRoot == nil:
+		D.inserted("", NewRoot)
+	case NewRoot == nil:
+		D.deleted(OldRoot)
+	case OldRoot.Name != NewRoot.Name:
+		D.deleted(OldRoot)
+		D.inserted("", NewRoot)
+	default:
+		D.compare(OldRoot, NewRoot)
+		D.findMoves()
+	}
+	return D
+}
+func diffRoot(Doc *TNativeXml) *TXmlNode {
+	if Doc == nil {
+		return nil
+	}
+	return Doc.XmlRoot
+}
+func (this *tXmlDiff) add(Difference TXmlDifference) {
+	this.Result = append(this.Result, Difference)
+}
+func (this *tXmlDiff) inserted(ParentPath string, Node *TXmlNode) {
+	this.add(TXmlDifference{Kind: DiffInserted, NewPath: Node.NodePath(), ParentPath: ParentPath,
+		NewValue: this.New.nodeXml(Node), NewNode: Node})
+}
+func (this *tXmlDiff) deleted(Node *TXmlNode) {
+	this.add(TXmlDifference{Kind: DiffDeleted, Path: Node.NodePath(), OldValue: this.Old.nodeXml(Node), OldNode: Node})
+}
+func (this *tXmlDiff) value(AValue string) string {
+	if this.Options.IgnoreWhitespace {
+		return strings.Join(strings.Fields(AValue), " ")
+	}
+	return AValue
+}
+func (this *tXmlDiff) compare(A, B *TXmlNode) {
+	this.Pairs[B] = A
+	Path, NewPath := A.NodePath(), B.NodePath()
+	if this.value(A.Value) != this.value(B.Value) {
+		this.add(TXmlDifference{Kind: DiffValueChanged, Path: Path, NewPath: NewPath,
+			OldValue: A.Value, NewValue: B.Value, OldNode: A, NewNode: B})
+	}
+	this.attributes(A, B, Path, NewPath)
+	this.children(A, B, Path)
+}
+func (this *tXmlDiff) attributes(A, B *TXmlNode, Path, NewPath string) {
+	Names := make([]string, 0, len(A.Attributes)+len(B.Attributes))
+	for k := range A.Attributes {
+		Names = append(Names, k)
+	}
+	for k := range B.Attributes {
+		if _, ok := A.Attributes[k]; !ok {
+			Names = append(Names, k)
+		}
+	}
+	sort.Strings(Names)
+	for _, k := range Names {
+		OldValue, InOld := A.Attributes[k]
+		NewValue, InNew := B.Attributes[k]
+		Difference := TXmlDifference{Path: Path, NewPath: NewPath, Name: k, OldValue: OldValue, NewValue: NewValue,
+			OldNode: A, NewNode: B}
+		switch {
+		case !InOld:
+			Difference.Kind = DiffInserted
+		case !InNew:
+			Difference.Kind = DiffDeleted
+		case this.value(OldValue) != this.value(NewValue):
+			Difference.Kind = DiffAttributeChanged
+		default:
+			continue
+		}
+		this.add(Difference)
+	}
+	if this.Options.IgnoreAttributeOrder || A.source == nil || B.source == nil {
+		return
+	}
+	//Compare the order of the attributes both nodes have
+	OldOrder := commonAttributes(A.source.AttrOrder, B.Attributes, A.Attributes)
+	NewOrder := commonAttributes(B.source.AttrOrder, A.Attributes, B.Attributes)
+	if len(OldOrder) == len(NewOrder) && strings.Join(OldOrder, " ") != strings.Join(NewOrder, " ") {
+		this.add(TXmlDifference{Kind: DiffAttributeChanged, Path: Path, NewPath: NewPath,
+			OldValue: strings.Join(OldOrder, " "), NewValue: strings.Join(NewOrder, " "), OldNode: A, NewNode: B})
+	}
+}
+func commonAttributes(Order []string, Other, Own map[string]string) []string {
+	Result := make([]string, 0, len(Order))
+	for _, v := range Order {
+		_, InOther := Other[v]
+		_, InOwn := Own[v]
+		if InOther && InOwn {
+			Result = append(Result, v)
+		}
+	}
+	return Result
+}
+
+func (this *tXmlDiff) nodes(Node *TXmlNode) []*TXmlNode {
+	List := Node.NodeList()
+	Result := List[:0]
+	for _, v := range List {
+		if v.ElementType == xeComment && this.Options.IgnoreComments {
+			continue
+		}
+		if v.ElementType == xeCData && this.Options.IgnoreWhitespace && strings.TrimSpace(v.Value) == "" {
+			continue
+		}
+		Result = append(Result, v)
+	}
+	return Result
+}
+func (this *tXmlDiff) key(Node *TXmlNode) string {
+	//Only nodes with the same key are matched
+	Key := strconv.Itoa(int(Node.ElementType)) + "\x00" + Node.Name
+	if AValue, ok := this.keyValue(Node); ok {
+		Key += "\x00" + this.value(AValue)
+	}
+	return Key
+}
+func (this *tXmlDiff) keyValue(Node *TXmlNode) (string, bool) {
+	//The value of the key attribute of Node,when it has one
+	if Node.ElementType != xeNormal || this.Options.KeyAttributes == nil {
+		return "", false
+	}
+	Attr, ok := this.Options.KeyAttributes[Node.Name]
+	if !ok {
+		Attr, ok = this.Options.KeyAttributes["*"]
+	}
+	if !ok {
+		return "", false
+	}
+	AValue, ok := Node.Attributes[Attr]
+	return AValue, ok
+}
+func (this *tXmlDiff) hash(Node *TXmlNode) uint64 {
+	//Equal subtrees under the options have the same hash
+	if h, ok := this.hashes[Node]; ok {
+		return h
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString(this.key(Node))
+	buf.WriteByte(0)
+	buf.WriteString(this.value(Node.Value))
+	Names := make([]string, 0, len(Node.Attributes))
+	for k := range Node.Attributes {
+		Names = append(Names, k)
+	}
+	sort.Strings(Names)
+	for _, k := range Names {
+		buf.WriteString("\x00" + k + "=" + this.value(Node.Attributes[k]))
+	}
+	Children := make([]uint64, 0, len(Node.Nodes))
+	for _, v := range this.nodes(Node) {
+		Children = append(Children, this.hash(v))
+	}
+	if this.Options.IgnoreSiblingOrder {
+		sort.Slice(Children, func(i, j int) bool {
+			return Children[i] < Children[j]
+		})
+	}
+	for _, v := range Children {
+		buf.WriteString("\x01" + strconv.FormatUint(v, 16))
+	}
+	h := fnv.New64a()
+	h.Write(buf.Bytes())
+	this.hashes[Node] = h.Sum64()
+	return this.hashes[Node]
+}
+func (this *tXmlDiff) children(A, B *TXmlNode, Path string) {
+	OldList, NewList := this.nodes(A), this.nodes(B)
+	Match := this.match(OldList, NewList)
+	Matched := make([]bool, len(NewList))
+	for _, j := range Match {
+		if j >= 0 {
+			Matched[j] = true
+		}
+	}
+	Moved := make([]bool, len(OldList))
+	if !this.Options.IgnoreSiblingOrder {
+		//The longest run of matched nodes in the same order stays,the others moved
+		Keep := inOrder(Match)
+		for i, j := range Match {
+			Moved[i] = j >= 0 && !Keep[i]
+		}
+	}
+	for i, v := range OldList {
+		if Match[i] < 0 {
+			this.deleted(v)
+			continue
+		}
+		if Moved[i] {
+			this.add(TXmlDifference{Kind: DiffMoved, Path: v.NodePath(), NewPath: NewList[Match[i]].NodePath(),
+				OldNode: v, NewNode: NewList[Match[i]]})
+			this.Moved[NewList[Match[i]]] = true
+		}
+		this.compare(v, NewList[Match[i]])
+	}
+	for j, v := range NewList {
+		if !Matched[j] {
+			this.inserted(Path, v)
+		}
+	}
+}
+func (this *tXmlDiff) match(OldList, NewList []*TXmlNode) []int {
+	//The index in NewList of the node matched with each node of OldList,-1 for none
+	Match := make([]int, len(OldList))
+	Matched := make([]bool, len(NewList))
+	for i := range Match {
+		Match[i] = -1
+	}
+	//Group the children by key,in each group equal subtrees are matched first and
+	//the remaining nodes in document order
+	Groups := make(map[string][]int)
+	for j, v := range NewList {
+		k := this.key(v)
+		Groups[k] = append(Groups[k], j)
+	}
+	Rest := make(map[string][]int)
+	for i, v := range OldList {
+		k := this.key(v)
+		Group := Groups[k]
+		for n, j := range Group {
+			if !Matched[j] && this.hash(v) == this.hash(NewList[j]) {
+				Match[i], Matched[j] = j, true
+				Groups[k] = append(Group[:n:n], Group[n+1:]...)
+				break
+			}
+		}
+		if Match[i] < 0 {
+			Rest[k] = append(Rest[k], i)
+		}
+	}
+	for k, Group := range Rest {
+		for n, i := range Group {
+			if n < len(Groups[k]) {
+				Match[i] = Groups[k][n]
+				Matched[Match[i]] = true
+			}
+		}
+	}
+	return Match
+}
+func inOrder(Match []int) []bool {
+	//Marks the longest increasing subsequence of the matched positions
+	Keep := make([]bool, len(Match))
+	Tails := make([]int, 0, len(Match)) //Index in Match of the last element of each length
+	Prev := make([]int, len(Match))
+	for i, j := range Match {
+		if j < 0 {
+			continue
+		}
+		n := sort.Search(len(Tails), func(n int) bool {
+			return Match[Tails[n]] >= j
+		})
+		Prev[i] = -1
+		if n > 0 {
+			Prev[i] = Tails[n-1]
+		}
+		if n == len(Tails) {
+			Tails = append(Tails, i)
+		} else {
+			Tails[n] = i
+		}
+	}
+	if len(Tails) > 0 {
+		for i := Tails[len(Tails)-1]; i >= 0; i = Prev[i] {
+			Keep[i] = true
+		}
+	}
+	return Keep
+}
+func (this *tXmlDiff) findMoves() {
+	//A deleted node that is inserted unchanged under another parent was moved
+	Deleted := make(map[uint64][]int)
+	for i, v := range this.Result {
+		if v.Kind == DiffDeleted && v.Name == "" && v.OldNode.Parent != nil {
+			h := this.hash(v.OldNode)
+			Deleted[h] = append(Deleted[h], i)
+		}
+	}
+	if len(Deleted) == 0 {
+		return
+	}
+	Drop := make([]bool, len(this.Result))
+	for i, v := range this.Result {
+		if v.Kind == DiffInserted && v.Name == "" && v.NewNode.Parent != nil {
+			h := this.hash(v.NewNode)
+			if List := Deleted[h]; len(List) > 0 {
+				Deleted[h] = List[1:]
+				Old := &this.Result[List[0]]
+				Old.Kind, Old.NewPath, Old.NewNode, Old.OldValue = DiffMoved, v.NewPath, v.NewNode, ""
+				Drop[i] = true
+				this.Pairs[v.NewNode] = Old.OldNode
+				this.Moved[v.NewNode], this.Equal[v.NewNode] = true, true
+			}
+		}
+	}
+	Result := this.Result[:0]
+	for i, v := range this.Result {
+		if !Drop[i] {
+			Result = append(Result, v)
+		}
+	}
+	this.Result = Result
+}
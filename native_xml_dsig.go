@@ -0,0 +1,662 @@
+package native_xml
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const (
+	XmlDSigNamespace          = "http://www.w3.org/2000/09/xmldsig#"
+	XmlDSigEnvelopedSignature = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	XmlDSigSHA1               = "http://www.w3.org/2000/09/xmldsig#sha1"
+	XmlDSigSHA256             = "http://www.w3.org/2001/04/xmlenc#sha256"
+	XmlDSigSHA512             = "http://www.w3.org/2001/04/xmlenc#sha512"
+	XmlDSigRSASHA1            = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	XmlDSigRSASHA256          = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	XmlDSigRSASHA512          = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	XmlDSigECDSASHA256        = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	XmlDSigECDSASHA512        = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512"
+	XmlDSigHMACSHA1           = "http://www.w3.org/2000/09/xmldsig#hmac-sha1"
+	XmlDSigHMACSHA256         = "http://www.w3.org/2001/04/xmldsig-more#hmac-sha256"
+	XmlDSigHMACSHA512         = "http://www.w3.org/2001/04/xmldsig-more#hmac-sha512"
+
+	sxeSigUnsupportedKey       = "Unsupported signature key type %T"
+	sxeSigUnsupportedMethod    = "Unsupported signature method \"%s\""
+	sxeSigUnsupportedDigest    = "Unsupported digest method \"%s\""
+	sxeSigUnsupportedTransform = "Unsupported transform \"%s\""
+	sxeSigKeyMismatch          = "Signature method \"%s\" does not match key type %T"
+	sxeSigMissingElement       = "Missing signature element %s"
+	sxeSigNotASignature        = "Node \"%s\" is not a signature element"
+	sxeSigNoSignatures         = "No signature found in xml"
+	sxeSigNoReferences         = "Signature has no references"
+	sxeSigReferenceNotFound    = "Signature reference \"%s\" not found"
+	sxeSigReferenceAmbiguous   = "Signature reference \"%s\" matches more than one element"
+	sxeSigNoResolver           = "No resolver for external signature reference \"%s\""
+	sxeSigNoID                 = "Node \"%s\" has no Id attribute and is not the root element"
+	sxeSigTransformNeedsNodes  = "Transform \"%s\" needs xml input"
+	sxeSigDigestMismatch       = "Digest mismatch for signature reference \"%s\""
+	sxeSigInvalidValue         = "Invalid signature value"
+	sxeSigTruncatedHMAC        = "Truncated HMAC output is not allowed"
+	sxeSigNoKey                = "No key to verify signature"
+	sxeSigNodeNotSigned        = "Node \"%s\" is not covered by a verified signature"
+)
+
+// A reference to sign
+type TXmlSigReference struct {
+	URI        string   //"" is the whole document,"#id" an element,any other uri an external (detached) object
+	Data       []byte   //Data of an external object
+	Transforms []string //Transform algorithms in the order they are applied
+}
+
+// Creates enveloped and detached XML signatures. The digests cover the text as the
+// document writes it,the output format must be set before signing and not changed after
+type TXmlSigner struct {
+	Key                    interface{}       //*rsa.PrivateKey,*ecdsa.PrivateKey,other crypto.Signer or []byte for HMAC
+	Certificate            *x509.Certificate //Written to KeyInfo when assigned
+	SignatureMethod        string            //Derived from the key when empty
+	DigestMethod           string            //Reference digest method,sha256 when empty
+	CanonicalizationMethod string            //Exclusive c14n when empty
+	Prefix                 string            //Namespace prefix of the signature elements
+}
+
+// Checks XML signatures
+type TXmlVerifier struct {
+	Key        interface{}                      //*rsa.PublicKey,*ecdsa.PublicKey,*x509.Certificate or []byte for HMAC
+	UseKeyInfo bool                             //Use the KeyInfo certificate when Key is nil,the caller must trust that certificate
+	Resolver   func(URI string) ([]byte, error) //Returns the data of external references
+}
+
+type tXmlSigTransform struct {
+	Algorithm         string
+	InclusivePrefixes []string
+}
+
+func NewXmlSigner(Key interface{}) *TXmlSigner {
+	return &TXmlSigner{Key: Key,
+		DigestMethod:           XmlDSigSHA256,
+		CanonicalizationMethod: XmlExcC14N,
+		Prefix:                 "ds"}
+}
+func NewXmlVerifier(Key interface{}) *TXmlVerifier {
+	return &TXmlVerifier{Key: Key}
+}
+func (this *TXmlSigner) SignEnveloped(Node *TXmlNode) (*TXmlNode, error) {
+	//Sign Node and add the signature as its last child. Nodes with an Id attribute
+	//are referenced by "#id",the root element may be referenced as the whole document
+	URI := ""
+	if ID := nodeID(Node); ID != "" {
+		URI = "#" + ID
+	} else if Node.Parent != nil {
+		return nil, errors.New(fmt.Sprintf(sxeSigNoID, Node.Name))
+	}
+	return this.sign(Node, []TXmlSigReference{{URI: URI,
+		Transforms: []string{XmlDSigEnvelopedSignature, this.canonicalizationMethod()}}})
+}
+func (this *TXmlSigner) SignDetached(Parent *TXmlNode, References ...TXmlSigReference) (*TXmlNode, error) {
+	//Sign the references and add the signature to Parent,a nil Parent returns a
+	//standalone signature element. References to elements default to the c14n transform
+	for i, v := range References {
+		if v.Data == nil && len(v.Transforms) == 0 {
+			References[i].Transforms = []string{this.canonicalizationMethod()}
+		}
+	}
+	return this.sign(Parent, References)
+}
+func (this *TXmlSigner) canonicalizationMethod() string {
+	if this.CanonicalizationMethod == "" {
+		return XmlExcC14N
+	}
+	return this.CanonicalizationMethod
+}
+func (this *TXmlSigner) sign(Parent *TXmlNode, References []TXmlSigReference) (*TXmlNode, error) {
+	if len(References) == 0 {
+		return nil, errors.New(sxeSigNoReferences)
+	}
+	SignatureMethod := this.SignatureMethod
+	if SignatureMethod == "" {
+		SignatureMethod = defaultSignatureMethod(this.Key)
+	}
+	DigestMethod := this.DigestMethod
+	if DigestMethod == "" {
+		DigestMethod = XmlDSigSHA256
+	}
+	Prefix := this.Prefix
+	if Prefix != "" {
+		Prefix += ":"
+	}
+	//Build the signature element and insert it,so the namespace context is in place
+	Signature := NewXmlNode(Prefix + "Signature")
+	if this.Prefix == "" {
+		Signature.Attributes["xmlns"] = XmlDSigNamespace
+	} else {
+		Signature.Attributes["xmlns:"+this.Prefix] = XmlDSigNamespace
+	}
+	SignedInfo := addSigElement(Signature, Prefix+"SignedInfo", "")
+	addSigElement(SignedInfo, Prefix+"CanonicalizationMethod", "").Attributes["Algorithm"] = this.canonicalizationMethod()
+	addSigElement(SignedInfo, Prefix+"SignatureMethod", "").Attributes["Algorithm"] = SignatureMethod
+	if Parent != nil {
+		Parent.NodeAdd(Signature)
+	}
+	for _, v := range References {
+		Transforms := make([]tXmlSigTransform, 0, len(v.Transforms))
+		for _, t := range v.Transforms {
+			Transforms = append(Transforms, tXmlSigTransform{Algorithm: t})
+		}
+		Digest, _, err := digestReference(Signature, v.URI, v.Data, Transforms, DigestMethod, nil, true)
+		if err != nil {
+			if Parent != nil {
+				delete(Parent.Nodes, Signature.NodeID)
+			}
+			return nil, err
+		}
+		Reference := addSigElement(SignedInfo, Prefix+"Reference", "")
+		Reference.Attributes["URI"] = v.URI
+		if len(v.Transforms) > 0 {
+			TransformsNode := addSigElement(Reference, Prefix+"Transforms", "")
+			for _, t := range v.Transforms {
+				addSigElement(TransformsNode, Prefix+"Transform", "").Attributes["Algorithm"] = t
+			}
+		}
+		addSigElement(Reference, Prefix+"DigestMethod", "").Attributes["Algorithm"] = DigestMethod
+		addSigElement(Reference, Prefix+"DigestValue", base64.StdEncoding.EncodeToString(Digest))
+	}
+	//Sign the canonical SignedInfo as the document writes it
+	Canonicalizer, err := NewXmlCanonicalizer(this.canonicalizationMethod())
+	if err == nil {
+		Canonicalizer.written = true
+		var Value []byte
+		if Value, err = signValue(this.Key, SignatureMethod, []byte(Canonicalizer.WriteToString(SignedInfo))); err == nil {
+			addSigElement(Signature, Prefix+"SignatureValue", base64.StdEncoding.EncodeToString(Value))
+		}
+	}
+	if err != nil {
+		if Parent != nil {
+			delete(Parent.Nodes, Signature.NodeID)
+		}
+		return nil, err
+	}
+	if this.Certificate != nil {
+		X509Data := addSigElement(addSigElement(Signature, Prefix+"KeyInfo", ""), Prefix+"X509Data", "")
+		addSigElement(X509Data, Prefix+"X509Certificate", base64.StdEncoding.EncodeToString(this.Certificate.Raw))
+	}
+	return Signature, nil
+}
+func (this *TXmlVerifier) Verify(Signature *TXmlNode) ([]*TXmlNode, error) {
+	//Check all reference digests and the signature value of a Signature element and
+	//return the elements it signs: the root element for "" and the elements of "#id"
+	//references. Only these nodes are signed,the signed data must be read from them and
+	//not looked up in the document again or a wrapped copy may be read instead
+	if Signature == nil || Signature.LocalName() != "Signature" || Signature.NamespaceURI() != XmlDSigNamespace {
+		Name := ""
+		if Signature != nil {
+			Name = Signature.Name
+		}
+		return nil, errors.New(fmt.Sprintf(sxeSigNotASignature, Name))
+	}
+	SignedInfo, err := sigChild(Signature, "SignedInfo")
+	if err != nil {
+		return nil, err
+	}
+	C14NMethod, err := sigChild(SignedInfo, "CanonicalizationMethod")
+	if err != nil {
+		return nil, err
+	}
+	MethodNode, err := sigChild(SignedInfo, "SignatureMethod")
+	if err != nil {
+		return nil, err
+	}
+	if len(sigChildren(MethodNode, "HMACOutputLength")) > 0 {
+		return nil, errors.New(sxeSigTruncatedHMAC)
+	}
+	ValueNode, err := sigChild(Signature, "SignatureValue")
+	if err != nil {
+		return nil, err
+	}
+	References := sigChildren(SignedInfo, "Reference")
+	if len(References) == 0 {
+		return nil, errors.New(sxeSigNoReferences)
+	}
+	//References
+	Signed := make([]*TXmlNode, 0, len(References))
+	for _, Reference := range References {
+		URI := Reference.Attributes["URI"]
+		Transforms := make([]tXmlSigTransform, 0)
+		if TransformsNode := sigChildren(Reference, "Transforms"); len(TransformsNode) > 0 {
+			for _, t := range sigChildren(TransformsNode[0], "Transform") {
+				Transforms = append(Transforms, tXmlSigTransform{Algorithm: t.Attributes["Algorithm"],
+					InclusivePrefixes: inclusivePrefixes(t)})
+			}
+		}
+		DigestMethod, err := sigChild(Reference, "DigestMethod")
+		if err != nil {
+			return nil, err
+		}
+		DigestValue, err := sigChild(Reference, "DigestValue")
+		if err != nil {
+			return nil, err
+		}
+		Expected, err := decodeBase64Value(DigestValue.Value)
+		if err != nil {
+			return nil, err
+		}
+		Digest, Node, err := digestReference(Signature, URI, nil, Transforms, DigestMethod.Attributes["Algorithm"], this.Resolver, false)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(Digest, Expected) {
+			return nil, errors.New(fmt.Sprintf(sxeSigDigestMismatch, URI))
+		}
+		if Node != nil {
+			Signed = append(Signed, Node)
+		}
+	}
+	//Signature value over the canonical SignedInfo
+	Canonicalizer, err := NewXmlCanonicalizer(C14NMethod.Attributes["Algorithm"])
+	if err != nil {
+		return nil, err
+	}
+	Canonicalizer.InclusivePrefixes = inclusivePrefixes(C14NMethod)
+	Value, err := decodeBase64Value(ValueNode.Value)
+	if err != nil {
+		return nil, err
+	}
+	Key := this.Key
+	if Key == nil && this.UseKeyInfo {
+		if Key, err = SignatureCertificate(Signature); err != nil {
+			return nil, err
+		}
+	}
+	if Key == nil {
+		return nil, errors.New(sxeSigNoKey)
+	}
+	if err = verifyValue(Key, MethodNode.Attributes["Algorithm"], []byte(Canonicalizer.WriteToString(SignedInfo)), Value); err != nil {
+		return nil, err
+	}
+	return Signed, nil
+}
+func (this *TNativeXml) Signatures() []*TXmlNode {
+	//All Signature elements in the document
+	list := make([]*TXmlNode, 0)
+	if this.XmlRoot != nil {
+		findSignatures(this.XmlRoot, &list)
+	}
+	return list
+}
+func (this *TNativeXml) VerifySignatures(Verifier *TXmlVerifier) ([]*TXmlNode, error) {
+	//Verify all signatures of the document and return the elements they sign,see Verify
+	Signatures := this.Signatures()
+	if len(Signatures) == 0 {
+		return nil, errors.New(sxeSigNoSignatures)
+	}
+	Signed := make([]*TXmlNode, 0, len(Signatures))
+	for _, v := range Signatures {
+		Nodes, err := Verifier.Verify(v)
+		if err != nil {
+			return nil, err
+		}
+		Signed = append(Signed, Nodes...)
+	}
+	return Signed, nil
+}
+func (this *TNativeXml) VerifyNode(Node *TXmlNode, Verifier *TXmlVerifier) error {
+	//Verify all signatures of the document and check that Node is one of the signed
+	//elements or inside one. Node is the element the caller is going to trust
+	Signed, err := this.VerifySignatures(Verifier)
+	if err != nil {
+		return err
+	}
+	for Parent := Node; Parent != nil; Parent = Parent.Parent {
+		for _, v := range Signed {
+			if v == Parent {
+				return nil
+			}
+		}
+	}
+	Name := ""
+	if Node != nil {
+		Name = Node.Name
+	}
+	return errors.New(fmt.Sprintf(sxeSigNodeNotSigned, Name))
+}
+func SignatureCertificate(Signature *TXmlNode) (*x509.Certificate, error) {
+	//The certificate in KeyInfo/X509Data/X509Certificate
+	KeyInfo, err := sigChild(Signature, "KeyInfo")
+	if err != nil {
+		return nil, err
+	}
+	X509Data, err := sigChild(KeyInfo, "X509Data")
+	if err != nil {
+		return nil, err
+	}
+	CertNode, err := sigChild(X509Data, "X509Certificate")
+	if err != nil {
+		return nil, err
+	}
+	Der, err := decodeBase64Value(CertNode.Value)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(Der)
+}
+func (this *TXmlNode) FindNodeByID(ID string) *TXmlNode {
+	//Find the element in this subtree with an Id,ID or id attribute of value ID
+	list := make([]*TXmlNode, 0, 1)
+	findNodesByID(this, ID, &list)
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
+func findNodesByID(Node *TXmlNode, ID string, list *[]*TXmlNode) {
+	if Node.ElementType != xeNormal {
+		return
+	}
+	if nodeID(Node) == ID {
+		*list = append(*list, Node)
+	}
+	for _, v := range Node.NodeList() {
+		findNodesByID(v, ID, list)
+	}
+}
+func findSignatures(Node *TXmlNode, list *[]*TXmlNode) {
+	if Node.ElementType != xeNormal {
+		return
+	}
+	if Node.LocalName() == "Signature" && Node.NamespaceURI() == XmlDSigNamespace {
+		*list = append(*list, Node)
+		return
+	}
+	for _, v := range Node.NodeList() {
+		findSignatures(v, list)
+	}
+}
+func nodeID(Node *TXmlNode) string {
+	for _, k := range []string{"Id", "ID", "id"} {
+		if v, ok := Node.Attributes[k]; ok {
+			return v
+		}
+	}
+	return ""
+}
+func addSigElement(Parent *TXmlNode, Name, Value string) *TXmlNode {
+	Node := NewXmlNode(Name)
+	Node.Value = Value
+	Parent.NodeAdd(Node)
+	return Node
+}
+func sigChildren(Node *TXmlNode, LocalName string) []*TXmlNode {
+	list := make([]*TXmlNode, 0)
+	for _, v := range Node.NodeList() {
+		if v.ElementType == xeNormal && v.LocalName() == LocalName && v.NamespaceURI() == XmlDSigNamespace {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+func sigChild(Node *TXmlNode, LocalName string) (*TXmlNode, error) {
+	if list := sigChildren(Node, LocalName); len(list) > 0 {
+		return list[0], nil
+	}
+	return nil, errors.New(fmt.Sprintf(sxeSigMissingElement, LocalName))
+}
+func inclusivePrefixes(Node *TXmlNode) []string {
+	//PrefixList of an exclusive c14n InclusiveNamespaces child
+	for _, v := range Node.NodeList() {
+		if v.ElementType == xeNormal && v.LocalName() == "InclusiveNamespaces" {
+			return strings.Fields(v.Attributes["PrefixList"])
+		}
+	}
+	return nil
+}
+func decodeBase64Value(AValue string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Map(func(r rune) rune {
+		if strings.ContainsRune(cControlChars, r) {
+			return -1
+		}
+		return r
+	}, AValue))
+}
+func documentTop(Node *TXmlNode) *TXmlNode {
+	for Node.Parent != nil {
+		Node = Node.Parent
+	}
+	return Node
+}
+func digestReference(Signature *TXmlNode, URI string, Data []byte, Transforms []tXmlSigTransform,
+	DigestMethod string, Resolver func(string) ([]byte, error), Written bool) ([]byte, *TXmlNode, error) {
+	//Dereference URI,run the transform chain and digest the resulting octets,the element
+	//of a same document reference is returned with the digest. The signer digests the
+	//text as the document writes it,the verifier the text as it was read
+	Hash, err := digestHash(DigestMethod)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		Node    *TXmlNode
+		Exclude *TXmlNode
+		Octets  []byte
+	)
+	switch {
+	case Data != nil:
+		Octets = Data
+	case URI == "":
+		Node = documentTop(Signature)
+	case strings.HasPrefix(URI, "#"):
+		list := make([]*TXmlNode, 0, 1)
+		findNodesByID(documentTop(Signature), URI[1:], &list)
+		if len(list) == 0 {
+			return nil, nil, errors.New(fmt.Sprintf(sxeSigReferenceNotFound, URI))
+		}
+		if len(list) > 1 {
+			return nil, nil, errors.New(fmt.Sprintf(sxeSigReferenceAmbiguous, URI))
+		}
+		Node = list[0]
+	default:
+		if Resolver == nil {
+			return nil, nil, errors.New(fmt.Sprintf(sxeSigNoResolver, URI))
+		}
+		if Octets, err = Resolver(URI); err != nil {
+			return nil, nil, err
+		}
+	}
+	Referenced := Node
+	for _, t := range Transforms {
+		switch t.Algorithm {
+		case XmlDSigEnvelopedSignature:
+			if Node == nil {
+				return nil, nil, errors.New(fmt.Sprintf(sxeSigTransformNeedsNodes, t.Algorithm))
+			}
+			Exclude = Signature
+		case XmlC14N, XmlC14NWithComments, XmlExcC14N, XmlExcC14NWithComments:
+			if Node == nil {
+				if Node, err = parseSigOctets(Octets); err != nil {
+					return nil, nil, err
+				}
+				//Parsed octets are signed as they were read
+				Written = false
+			}
+			Canonicalizer, _ := NewXmlCanonicalizer(t.Algorithm)
+			Canonicalizer.InclusivePrefixes = t.InclusivePrefixes
+			Canonicalizer.Exclude = Exclude
+			Canonicalizer.written = Written
+			Octets = []byte(Canonicalizer.WriteToString(Node))
+			Node = nil
+		default:
+			return nil, nil, errors.New(fmt.Sprintf(sxeSigUnsupportedTransform, t.Algorithm))
+		}
+	}
+	//A node set left at the end of the chain is converted with inclusive c14n
+	if Node != nil {
+		Canonicalizer := &TXmlCanonicalizer{Exclude: Exclude, written: Written}
+		Octets = []byte(Canonicalizer.WriteToString(Node))
+	}
+	h := Hash.New()
+	h.Write(Octets)
+	return h.Sum(nil), Referenced, nil
+}
+func parseSigOctets(Octets []byte) (Node *TXmlNode, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			Node = nil
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	Xml := NewNativeXml()
+	Xml.ReadFromStream(bytes.NewBuffer(Octets))
+	return Xml.XmlRoot, nil
+}
+func digestHash(Method string) (crypto.Hash, error) {
+	switch Method {
+	case XmlDSigSHA1:
+		return crypto.SHA1, nil
+	case XmlDSigSHA256:
+		return crypto.SHA256, nil
+	case XmlDSigSHA512:
+		return crypto.SHA512, nil
+	}
+	return 0, errors.New(fmt.Sprintf(sxeSigUnsupportedDigest, Method))
+}
+func signatureHash(Method string) (crypto.Hash, string, error) {
+	//The hash and key kind ("rsa","ecdsa" or "hmac") of a signature method
+	switch Method {
+	case XmlDSigRSASHA1:
+		return crypto.SHA1, "rsa", nil
+	case XmlDSigRSASHA256:
+		return crypto.SHA256, "rsa", nil
+	case XmlDSigRSASHA512:
+		return crypto.SHA512, "rsa", nil
+	case XmlDSigECDSASHA256:
+		return crypto.SHA256, "ecdsa", nil
+	case XmlDSigECDSASHA512:
+		return crypto.SHA512, "ecdsa", nil
+	case XmlDSigHMACSHA1:
+		return crypto.SHA1, "hmac", nil
+	case XmlDSigHMACSHA256:
+		return crypto.SHA256, "hmac", nil
+	case XmlDSigHMACSHA512:
+		return crypto.SHA512, "hmac", nil
+	}
+	return 0, "", errors.New(fmt.Sprintf(sxeSigUnsupportedMethod, Method))
+}
+func defaultSignatureMethod(Key interface{}) string {
+	switch k := Key.(type) {
+	case []byte:
+		return XmlDSigHMACSHA256
+	case crypto.Signer:
+		if _, ok := k.Public().(*ecdsa.PublicKey); ok {
+			return XmlDSigECDSASHA256
+		}
+	}
+	return XmlDSigRSASHA256
+}
+func signValue(Key interface{}, Method string, Data []byte) ([]byte, error) {
+	Hash, Kind, err := signatureHash(Method)
+	if err != nil {
+		return nil, err
+	}
+	if Kind == "hmac" {
+		Secret, ok := Key.([]byte)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf(sxeSigKeyMismatch, Method, Key))
+		}
+		mac := hmac.New(Hash.New, Secret)
+		mac.Write(Data)
+		return mac.Sum(nil), nil
+	}
+	Signer, ok := Key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(sxeSigUnsupportedKey, Key))
+	}
+	h := Hash.New()
+	h.Write(Data)
+	switch Public := Signer.Public().(type) {
+	case *rsa.PublicKey:
+		if Kind != "rsa" {
+			return nil, errors.New(fmt.Sprintf(sxeSigKeyMismatch, Method, Key))
+		}
+		return Signer.Sign(rand.Reader, h.Sum(nil), Hash)
+	case *ecdsa.PublicKey:
+		if Kind != "ecdsa" {
+			return nil, errors.New(fmt.Sprintf(sxeSigKeyMismatch, Method, Key))
+		}
+		Der, err := Signer.Sign(rand.Reader, h.Sum(nil), Hash)
+		if err != nil {
+			return nil, err
+		}
+		//XML signatures use the fixed size r||s form instead of ASN.1
+		var rs struct{ R, S *big.Int }
+		if _, err = asn1.Unmarshal(Der, &rs); err != nil {
+			return nil, err
+		}
+		Size := (Public.Curve.Params().BitSize + 7) / 8
+		Value := make([]byte, 2*Size)
+		rs.R.FillBytes(Value[:Size])
+		rs.S.FillBytes(Value[Size:])
+		return Value, nil
+	}
+	return nil, errors.New(fmt.Sprintf(sxeSigUnsupportedKey, Key))
+}
+func verifyValue(Key interface{}, Method string, Data, Value []byte) error {
+	Hash, Kind, err := signatureHash(Method)
+	if err != nil {
+		return err
+	}
+	if Cert, ok := Key.(*x509.Certificate); ok {
+		Key = Cert.PublicKey
+	}
+	switch k := Key.(type) {
+	case []byte:
+		if Kind != "hmac" {
+			break
+		}
+		mac := hmac.New(Hash.New, k)
+		mac.Write(Data)
+		if !hmac.Equal(mac.Sum(nil), Value) {
+			return errors.New(sxeSigInvalidValue)
+		}
+		return nil
+	case *rsa.PublicKey:
+		if Kind != "rsa" {
+			break
+		}
+		h := Hash.New()
+		h.Write(Data)
+		if rsa.VerifyPKCS1v15(k, Hash, h.Sum(nil), Value) != nil {
+			return errors.New(sxeSigInvalidValue)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if Kind != "ecdsa" {
+			break
+		}
+		Size := (k.Curve.Params().BitSize + 7) / 8
+		if len(Value) != 2*Size {
+			return errors.New(sxeSigInvalidValue)
+		}
+		h := Hash.New()
+		h.Write(Data)
+		r := new(big.Int).SetBytes(Value[:Size])
+		s := new(big.Int).SetBytes(Value[Size:])
+		if !ecdsa.Verify(k, h.Sum(nil), r, s) {
+			return errors.New(sxeSigInvalidValue)
+		}
+		return nil
+	default:
+		return errors.New(fmt.Sprintf(sxeSigUnsupportedKey, Key))
+	}
+	return errors.New(fmt.Sprintf(sxeSigKeyMismatch, Method, Key))
+}
@@ -0,0 +1,787 @@
+package native_xml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	sxeDtdUnexpectedEnd     = "Unexpected end of doctype declaration"
+	sxeDtdExpected          = "Expected %s at position %d in doctype declaration"
+	sxeDtdUnknownDecl       = "Unknown declaration at position %d in doctype declaration"
+	sxeDtdMissingName       = "Missing name at position %d in doctype declaration"
+	sxeDtdInvalidContent    = "Invalid content model for element \"%s\""
+	sxeDtdInvalidAttType    = "Invalid type for attribute \"%s\" of element \"%s\""
+	sxeDtdInvalidDefault    = "Invalid default for attribute \"%s\" of element \"%s\""
+	sxeDtdUnknownEntity     = "Unknown parameter entity \"%s\""
+	sxeDtdConditionalInside = "Conditional sections are not allowed in the internal subset"
+	sxeDtdExternalFailed    = "Cannot load the external subset \"%s\": %v"
+)
+
+// Document type declaration,with the declarations of its internal subset
+type TXmlDtd struct {
+	Name              string                         //Root element name
+	PublicID          string                         //Public identifier of the external subset
+	SystemID          string                         //System identifier of the external subset
+	InternalSubset    string                         //Text between "[" and "]"
+	ExternalLoaded    bool                           //The external subset was read through the entity resolver
+	Elements          map[string]*TXmlDtdElement     //Element declarations by element name
+	Attributes        map[string][]*TXmlDtdAttribute //Attribute declarations by element name,in declaration order
+	Entities          map[string]*TXmlDtdEntity      //General entities
+	ParameterEntities map[string]*TXmlDtdEntity      //Parameter entities
+	Notations         map[string]*TXmlDtdNotation    //Notations
+	expanded          int                            //Bytes added by parameter entity references so far
+	options           *TXmlEntityOptions             //MaxSize and MaxDepth of the expansion,nil for the defaults
+	maxDepth          int                            //Nesting limit of content model groups
+}
+
+// <!ELEMENT> declaration
+type TXmlDtdElement struct {
+	Name        string
+	ContentType string           //"EMPTY","ANY","MIXED" or "CHILDREN"
+	Content     *TXmlDtdParticle //Content model of MIXED and CHILDREN elements
+	Spec        string           //The content specification as declared
+}
+
+// Element name or group in a content model
+type TXmlDtdParticle struct {
+	Name   string             //Element name,empty for a group
+	Choice bool               //Group is a choice (a|b) instead of a sequence (a,b)
+	Items  []*TXmlDtdParticle //Group members
+	Occurs byte               //0,'?','*' or '+'
+}
+
+// Attribute definition of an <!ATTLIST> declaration
+type TXmlDtdAttribute struct {
+	Element string
+	Name    string
+	Type    string   //CDATA,ID,IDREF,IDREFS,ENTITY,ENTITIES,NMTOKEN,NMTOKENS,NOTATION or ENUMERATION
+	Values  []string //Allowed values of NOTATION and ENUMERATION types
+	Default string   //"#REQUIRED","#IMPLIED","#FIXED" or empty for a plain default value
+	Value   string   //Default or fixed value
+}
+
+// <!ENTITY> declaration
+type TXmlDtdEntity struct {
+	Name      string
+	Parameter bool   //Parameter entity (%name;)
+	Value     string //Replacement text of an internal entity
+	PublicID  string
+	SystemID  string
+	Notation  string //NDATA notation of an unparsed entity
+}
+
+// <!NOTATION> declaration
+type TXmlDtdNotation struct {
+	Name     string
+	PublicID string
+	SystemID string
+}
+
+type tDtdScanner struct {
+	Text     string
+	Pos      int
+	MaxDepth int //Nesting limit of content model groups
+}
+
+// The parsed doctype of a document,shared with its snapshots. It is parsed again
+// when the doctype node or its text changed
+type tXmlDtdCache struct {
+	sync.Mutex
+	Node     *TXmlNode
+	Value    string
+	MaxSize  int //Entity options it was parsed with
+	MaxDepth int
+	Resolver TXmlEntityResolver
+	Groups   int //Nesting limit of content model groups it was parsed with
+	Dtd      *TXmlDtd
+	Err      error
+}
+
+func NewXmlDtd() *TXmlDtd {
+	return &TXmlDtd{Elements: make(map[string]*TXmlDtdElement),
+		Attributes:        make(map[string][]*TXmlDtdAttribute),
+		Entities:          make(map[string]*TXmlDtdEntity),
+		ParameterEntities: make(map[string]*TXmlDtdEntity),
+		Notations:         make(map[string]*TXmlDtdNotation)}
+}
+func ParseDtd(AValue string) (*TXmlDtd, error) {
+	//Parse the text of a doctype declaration after "<!DOCTYPE" up to the closing ">"
+	return parseDtd(AValue, nil, 0)
+}
+func parseDtd(AValue string, Options *TXmlEntityOptions, MaxDepth int) (*TXmlDtd, error) {
+	//Parameter entities are expanded within the limits of Options,content model groups
+	//are nested up to MaxDepth levels like elements
+	Dtd := NewXmlDtd()
+	Dtd.options = Options
+	Dtd.maxDepth = parseMaxDepth(MaxDepth)
+	Scanner := &tDtdScanner{Text: AValue}
+	Scanner.skipBlanks()
+	if Dtd.Name = Scanner.readName(); Dtd.Name == "" {
+		return nil, errors.New(fmt.Sprintf(sxeDtdMissingName, Scanner.Pos))
+	}
+	var err error
+	if Dtd.PublicID, Dtd.SystemID, err = Scanner.readExternalID(false); err != nil {
+		return nil, err
+	}
+	Scanner.skipBlanks()
+	if Scanner.hasPrefix("[") {
+		Close := Scanner.subsetEnd()
+		if Close < 0 {
+			return nil, errors.New(sxeDtdUnexpectedEnd)
+		}
+		Dtd.InternalSubset = AValue[Scanner.Pos+1 : Close]
+		if err = Dtd.ParseSubset(Dtd.InternalSubset); err != nil {
+			return nil, err
+		}
+		Scanner.Pos = Close + 1
+	}
+	Scanner.skipBlanks()
+	if !Scanner.eof() {
+		return nil, errors.New(fmt.Sprintf(sxeDtdExpected, "end", Scanner.Pos))
+	}
+	//The external subset comes after the internal one,whose declarations are binding
+	if Dtd.SystemID != "" && Options != nil && Options.Resolver != nil {
+		Text, err := Options.Resolver.ResolveEntity(Dtd.PublicID, Dtd.SystemID)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf(sxeDtdExternalFailed, Dtd.SystemID, err))
+		}
+		if err = Dtd.ParseExternalSubset(dropTextDecl(Text)); err != nil {
+			return nil, err
+		}
+		Dtd.ExternalLoaded = true
+	}
+	return Dtd, nil
+}
+func (this *TXmlDtd) ParseSubset(Subset string) error {
+	//Add the markup declarations in Subset
+	return this.parseSubset(Subset, 0, false)
+}
+func (this *TXmlDtd) ParseExternalSubset(Subset string) error {
+	//Add the markup declarations of an external subset,it may have conditional sections
+	return this.parseSubset(Subset, 0, true)
+}
+func (this *TXmlDtd) parseSubset(Subset string, Depth int, External bool) error {
+	Scanner := &tDtdScanner{Text: Subset}
+	for {
+		Scanner.skipBlanks()
+		if Scanner.eof() {
+			return nil
+		}
+		var err error
+		switch {
+		case Scanner.hasPrefix("<!--"):
+			err = Scanner.skipPast("-->")
+		case Scanner.hasPrefix("<?"):
+			err = Scanner.skipPast("?>")
+		case Scanner.hasPrefix("<!["):
+			if !External {
+				err = errors.New(sxeDtdConditionalInside)
+			} else {
+				err = this.parseConditional(Scanner, Depth)
+			}
+		case Scanner.hasPrefix("%"):
+			//Parameter entity reference between declarations
+			Scanner.Pos++
+			Name := Scanner.readName()
+			if err = Scanner.expect(";"); err == nil {
+				err = this.parsePEReference(Name, Depth, External)
+			}
+		case Scanner.hasPrefix("<!"):
+			var Decl string
+			Start := Scanner.Pos
+			if Decl, err = Scanner.readDecl(); err == nil {
+				if Decl, err = this.expandPEReferences(Decl, Depth); err == nil {
+					err = this.parseDecl(Decl, Start)
+				}
+			}
+		default:
+			err = errors.New(fmt.Sprintf(sxeDtdUnknownDecl, Scanner.Pos))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+func (this *TXmlDtd) parsePEReference(Name string, Depth int, External bool) error {
+	Entity, ok := this.ParameterEntities[Name]
+	if !ok {
+		return errors.New(fmt.Sprintf(sxeDtdUnknownEntity, Name))
+	}
+	if Max := this.options.maxDepth(); Depth >= Max {
+		return &TXmlEntityLimitError{Limit: LimitEntityDepth, Max: Max, Name: Name}
+	}
+	//External parameter entities are not loaded
+	if Entity.SystemID != "" {
+		return nil
+	}
+	if err := this.expand(Name, len(Entity.Value)); err != nil {
+		return err
+	}
+	return this.parseSubset(Entity.Value, Depth+1, External)
+}
+func (this *TXmlDtd) parseConditional(Scanner *tDtdScanner, Depth int) error {
+	//<![INCLUDE[...]]> or <![IGNORE[...]]>,the keyword may be a parameter entity reference
+	Scanner.Pos += len("<![")
+	Open := strings.IndexByte(Scanner.Text[Scanner.Pos:], '[')
+	if Open < 0 {
+		return errors.New(sxeDtdUnexpectedEnd)
+	}
+	Keyword, err := this.expandPEReferences(Scanner.Text[Scanner.Pos:Scanner.Pos+Open], Depth)
+	if err != nil {
+		return err
+	}
+	Start := Scanner.Pos + Open + 1
+	//The section ends at the "]]>" that matches its start,sections may be nested
+	Nested := 0
+	for Scanner.Pos = Start; ; {
+		p := strings.Index(Scanner.Text[Scanner.Pos:], "]]>")
+		if p < 0 {
+			return errors.New(sxeDtdUnexpectedEnd)
+		}
+		Nested += strings.Count(Scanner.Text[Scanner.Pos:Scanner.Pos+p], "<![")
+		Scanner.Pos += p + len("]]>")
+		if Nested == 0 {
+			break
+		}
+		Nested--
+	}
+	switch strings.Trim(Keyword, cControlChars) {
+	case "INCLUDE":
+		return this.parseSubset(Scanner.Text[Start:Scanner.Pos-len("]]>")], Depth, true)
+	case "IGNORE":
+		return nil
+	}
+	return errors.New(fmt.Sprintf(sxeDtdExpected, "INCLUDE or IGNORE", Start))
+}
+func (this *TXmlDtd) expandPEReferences(Decl string, Depth int) (string, error) {
+	//Replace parameter entity references inside a declaration,but not in its literals
+	if strings.IndexByte(Decl, '%') < 0 {
+		return Decl, nil
+	}
+	buf := new(strings.Builder)
+	var QuoteChar byte
+	for i := 0; i < len(Decl); i++ {
+		Ch := Decl[i]
+		switch {
+		case QuoteChar != 0:
+			if Ch == QuoteChar {
+				QuoteChar = 0
+			}
+		case Ch == '"' || Ch == '\'':
+			QuoteChar = Ch
+		case Ch == '%':
+			Close := strings.IndexByte(Decl[i:], ';')
+			if Close > 1 && !strings.ContainsAny(Decl[i+1:i+Close], cControlChars) {
+				Name := Decl[i+1 : i+Close]
+				Entity, ok := this.ParameterEntities[Name]
+				if !ok {
+					return "", errors.New(fmt.Sprintf(sxeDtdUnknownEntity, Name))
+				}
+				if Max := this.options.maxDepth(); Depth >= Max {
+					return "", &TXmlEntityLimitError{Limit: LimitEntityDepth, Max: Max, Name: Name}
+				}
+				Value, err := this.expandPEReferences(Entity.Value, Depth+1)
+				if err != nil {
+					return "", err
+				}
+				if err = this.expand(Name, len(Value)); err != nil {
+					return "", err
+				}
+				buf.WriteString(" " + Value + " ")
+				i += Close
+				continue
+			}
+		}
+		buf.WriteByte(Ch)
+	}
+	return buf.String(), nil
+}
+func (this *TXmlDtd) expand(Name string, Size int) error {
+	//All replacement texts of a doctype together may not exceed the MaxSize of the entity
+	//options,nested references count on each level,so a fan-out fails before it is built
+	//up in memory
+	if this.expanded += Size; this.expanded > this.options.maxSize() {
+		return &TXmlEntityLimitError{Limit: LimitEntitySize, Max: this.options.maxSize(), Name: Name}
+	}
+	return nil
+}
+func (this *TXmlDtd) parseDecl(Decl string, Pos int) error {
+	Scanner := &tDtdScanner{Text: Decl, MaxDepth: this.maxDepth}
+	if Scanner.MaxDepth == 0 {
+		Scanner.MaxDepth = cParseMaxDepth
+	}
+	switch {
+	case Scanner.hasPrefix("<!ELEMENT"):
+		Scanner.Pos += len("<!ELEMENT")
+		return this.parseElementDecl(Scanner)
+	case Scanner.hasPrefix("<!ATTLIST"):
+		Scanner.Pos += len("<!ATTLIST")
+		return this.parseAttListDecl(Scanner)
+	case Scanner.hasPrefix("<!ENTITY"):
+		Scanner.Pos += len("<!ENTITY")
+		return this.parseEntityDecl(Scanner)
+	case Scanner.hasPrefix("<!NOTATION"):
+		Scanner.Pos += len("<!NOTATION")
+		return this.parseNotationDecl(Scanner)
+	}
+	return errors.New(fmt.Sprintf(sxeDtdUnknownDecl, Pos))
+}
+func (this *TXmlDtd) parseElementDecl(Scanner *tDtdScanner) error {
+	Scanner.skipBlanks()
+	Element := &TXmlDtdElement{Name: Scanner.readName()}
+	if Element.Name == "" {
+		return errors.New(fmt.Sprintf(sxeDtdMissingName, Scanner.Pos))
+	}
+	Scanner.skipBlanks()
+	Element.Spec = strings.Trim(Scanner.Text[Scanner.Pos:len(Scanner.Text)-1], cControlChars)
+	switch {
+	case Scanner.hasPrefix("EMPTY"):
+		Element.ContentType = "EMPTY"
+		Scanner.Pos += len("EMPTY")
+	case Scanner.hasPrefix("ANY"):
+		Element.ContentType = "ANY"
+		Scanner.Pos += len("ANY")
+	case Scanner.hasPrefix("("):
+		Save := Scanner.Pos
+		Scanner.Pos++
+		Scanner.skipBlanks()
+		if Scanner.hasPrefix("#PCDATA") {
+			//Mixed content (#PCDATA|a|b)*
+			Scanner.Pos += len("#PCDATA")
+			Element.ContentType = "MIXED"
+			Element.Content = &TXmlDtdParticle{Choice: true}
+			for {
+				Scanner.skipBlanks()
+				if Scanner.hasPrefix(")") {
+					Scanner.Pos++
+					break
+				}
+				if !Scanner.hasPrefix("|") {
+					return errors.New(fmt.Sprintf(sxeDtdInvalidContent, Element.Name))
+				}
+				Scanner.Pos++
+				Scanner.skipBlanks()
+				Name := Scanner.readName()
+				if Name == "" {
+					return errors.New(fmt.Sprintf(sxeDtdInvalidContent, Element.Name))
+				}
+				Element.Content.Items = append(Element.Content.Items, &TXmlDtdParticle{Name: Name})
+			}
+			if Scanner.hasPrefix("*") {
+				Scanner.Pos++
+				Element.Content.Occurs = '*'
+			} else if len(Element.Content.Items) > 0 {
+				return errors.New(fmt.Sprintf(sxeDtdInvalidContent, Element.Name))
+			}
+		} else {
+			Scanner.Pos = Save
+			Element.ContentType = "CHILDREN"
+			Particle, err := Scanner.readParticle(1)
+			if Limit, ok := err.(*TXmlLimitError); ok {
+				return Limit
+			}
+			if err != nil || Particle.Name != "" {
+				return errors.New(fmt.Sprintf(sxeDtdInvalidContent, Element.Name))
+			}
+			Element.Content = Particle
+		}
+	default:
+		return errors.New(fmt.Sprintf(sxeDtdInvalidContent, Element.Name))
+	}
+	if err := Scanner.expectEnd(); err != nil {
+		return err
+	}
+	//The first declaration is binding
+	if _, ok := this.Elements[Element.Name]; !ok {
+		this.Elements[Element.Name] = Element
+	}
+	return nil
+}
+func (this *TXmlDtd) parseAttListDecl(Scanner *tDtdScanner) error {
+	Scanner.skipBlanks()
+	Element := Scanner.readName()
+	if Element == "" {
+		return errors.New(fmt.Sprintf(sxeDtdMissingName, Scanner.Pos))
+	}
+	for {
+		Scanner.skipBlanks()
+		if Scanner.hasPrefix(">") {
+			return Scanner.expectEnd()
+		}
+		Attr := &TXmlDtdAttribute{Element: Element, Name: Scanner.readName()}
+		if Attr.Name == "" {
+			return errors.New(fmt.Sprintf(sxeDtdMissingName, Scanner.Pos))
+		}
+		//Type
+		Scanner.skipBlanks()
+		if Scanner.hasPrefix("(") {
+			Attr.Type = "ENUMERATION"
+		} else {
+			Attr.Type = Scanner.readName()
+		}
+		switch Attr.Type {
+		case "CDATA", "ID", "IDREF", "IDREFS", "ENTITY", "ENTITIES", "NMTOKEN", "NMTOKENS":
+		case "NOTATION", "ENUMERATION":
+			Scanner.skipBlanks()
+			Values, err := Scanner.readEnumeration()
+			if err != nil {
+				return errors.New(fmt.Sprintf(sxeDtdInvalidAttType, Attr.Name, Element))
+			}
+			Attr.Values = Values
+		default:
+			return errors.New(fmt.Sprintf(sxeDtdInvalidAttType, Attr.Name, Element))
+		}
+		//Default
+		Scanner.skipBlanks()
+		switch {
+		case Scanner.hasPrefix("#REQUIRED"):
+			Attr.Default = "#REQUIRED"
+			Scanner.Pos += len(Attr.Default)
+		case Scanner.hasPrefix("#IMPLIED"):
+			Attr.Default = "#IMPLIED"
+			Scanner.Pos += len(Attr.Default)
+		default:
+			if Scanner.hasPrefix("#FIXED") {
+				Attr.Default = "#FIXED"
+				Scanner.Pos += len(Attr.Default)
+				Scanner.skipBlanks()
+			}
+			Value, err := Scanner.readLiteral()
+			if err != nil {
+				return errors.New(fmt.Sprintf(sxeDtdInvalidDefault, Attr.Name, Element))
+			}
+			Attr.Value = Value
+		}
+		//The first definition of an attribute is binding
+		if this.AttributeDecl(Element, Attr.Name) == nil {
+			this.Attributes[Element] = append(this.Attributes[Element], Attr)
+		}
+	}
+}
+func (this *TXmlDtd) parseEntityDecl(Scanner *tDtdScanner) error {
+	Scanner.skipBlanks()
+	Entity := &TXmlDtdEntity{}
+	if Scanner.hasPrefix("%") {
+		Entity.Parameter = true
+		Scanner.Pos++
+		Scanner.skipBlanks()
+	}
+	if Entity.Name = Scanner.readName(); Entity.Name == "" {
+		return errors.New(fmt.Sprintf(sxeDtdMissingName, Scanner.Pos))
+	}
+	Scanner.skipBlanks()
+	var err error
+	if Scanner.hasPrefix("\"") || Scanner.hasPrefix("'") {
+		if Entity.Value, err = Scanner.readLiteral(); err != nil {
+			return err
+		}
+	} else {
+		if Entity.PublicID, Entity.SystemID, err = Scanner.readExternalID(false); err != nil {
+			return err
+		}
+		if Entity.SystemID == "" {
+			return errors.New(fmt.Sprintf(sxeDtdExpected, "entity value", Scanner.Pos))
+		}
+		Scanner.skipBlanks()
+		if !Entity.Parameter && Scanner.hasPrefix("NDATA") {
+			Scanner.Pos += len("NDATA")
+			Scanner.skipBlanks()
+			if Entity.Notation = Scanner.readName(); Entity.Notation == "" {
+				return errors.New(fmt.Sprintf(sxeDtdMissingName, Scanner.Pos))
+			}
+		}
+	}
+	if err = Scanner.expectEnd(); err != nil {
+		return err
+	}
+	//The first declaration is binding
+	Entities := this.Entities
+	if Entity.Parameter {
+		Entities = this.ParameterEntities
+	}
+	if _, ok := Entities[Entity.Name]; !ok {
+		Entities[Entity.Name] = Entity
+	}
+	return nil
+}
+func (this *TXmlDtd) parseNotationDecl(Scanner *tDtdScanner) error {
+	Scanner.skipBlanks()
+	Notation := &TXmlDtdNotation{Name: Scanner.readName()}
+	if Notation.Name == "" {
+		return errors.New(fmt.Sprintf(sxeDtdMissingName, Scanner.Pos))
+	}
+	var err error
+	if Notation.PublicID, Notation.SystemID, err = Scanner.readExternalID(true); err != nil {
+		return err
+	}
+	if Notation.PublicID == "" && Notation.SystemID == "" {
+		return errors.New(fmt.Sprintf(sxeDtdExpected, "external id", Scanner.Pos))
+	}
+	if err = Scanner.expectEnd(); err != nil {
+		return err
+	}
+	this.Notations[Notation.Name] = Notation
+	return nil
+}
+func (this *TXmlDtd) AttributeDecl(Element, Name string) *TXmlDtdAttribute {
+	for _, v := range this.Attributes[Element] {
+		if v.Name == Name {
+			return v
+		}
+	}
+	return nil
+}
+func (this *TXmlDtdParticle) String() string {
+	//The particle in content model notation
+	val := this.Name
+	if this.Name == "" {
+		Sep := ","
+		if this.Choice {
+			Sep = "|"
+		}
+		Items := make([]string, len(this.Items))
+		for i, v := range this.Items {
+			Items[i] = v.String()
+		}
+		val = "(" + strings.Join(Items, Sep) + ")"
+	}
+	if this.Occurs != 0 {
+		val += string(this.Occurs)
+	}
+	return val
+}
+func (this *TNativeXml) Dtd() (*TXmlDtd, error) {
+	//The parsed doctype declaration,nil if the document has none. The doctype is
+	//parsed once,the result is shared and must not be changed. Parameter entities
+	//are expanded within the limits of EntityOptions
+	Node := this.RootNodes[xeDocType]
+	if Node == nil {
+		return nil, nil
+	}
+	Options := this.EntityOptions
+	Groups := this.ParseOptions.MaxDepth
+	Cache := this.dtd
+	if Cache == nil {
+		return parseDtd(Node.Value, &Options, Groups)
+	}
+	Cache.Lock()
+	defer Cache.Unlock()
+	if Cache.Node != Node || Cache.Value != Node.Value || Cache.MaxSize != Options.MaxSize ||
+		Cache.MaxDepth != Options.MaxDepth || !sameResolver(Cache.Resolver, Options.Resolver) || Cache.Groups != Groups {
+		Cache.Dtd, Cache.Err = parseDtd(Node.Value, &Options, Groups)
+		Cache.Node, Cache.Value, Cache.MaxSize, Cache.MaxDepth = Node, Node.Value, Options.MaxSize, Options.MaxDepth
+		Cache.Resolver, Cache.Groups = Options.Resolver, Groups
+	}
+	return Cache.Dtd, Cache.Err
+}
+func sameResolver(a, b TXmlEntityResolver) (Same bool) {
+	//Resolvers of a type that cannot be compared are never the same
+	defer func() {
+		if recover() != nil {
+			Same = false
+		}
+	}()
+	return a == b
+}
+
+func (this *tDtdScanner) eof() bool {
+	return this.Pos >= len(this.Text)
+}
+func (this *tDtdScanner) hasPrefix(APrefix string) bool {
+	return strings.HasPrefix(this.Text[this.Pos:], APrefix)
+}
+func (this *tDtdScanner) skipBlanks() {
+	for !this.eof() && strings.IndexByte(cControlChars, this.Text[this.Pos]) >= 0 {
+		this.Pos++
+	}
+}
+func (this *tDtdScanner) skipPast(ASearch string) error {
+	Close := strings.Index(this.Text[this.Pos:], ASearch)
+	if Close < 0 {
+		return errors.New(sxeDtdUnexpectedEnd)
+	}
+	this.Pos += Close + len(ASearch)
+	return nil
+}
+func (this *tDtdScanner) expect(AValue string) error {
+	if !this.hasPrefix(AValue) {
+		return errors.New(fmt.Sprintf(sxeDtdExpected, "\""+AValue+"\"", this.Pos))
+	}
+	this.Pos += len(AValue)
+	return nil
+}
+func (this *tDtdScanner) expectEnd() error {
+	this.skipBlanks()
+	if err := this.expect(">"); err != nil {
+		return err
+	}
+	if !this.eof() {
+		return errors.New(fmt.Sprintf(sxeDtdExpected, "end of declaration", this.Pos))
+	}
+	return nil
+}
+func (this *tDtdScanner) readName() string {
+	Start := this.Pos
+	for !this.eof() && strings.IndexByte(cControlChars+"()|,?*+>\"'[]%;=", this.Text[this.Pos]) < 0 {
+		this.Pos++
+	}
+	return this.Text[Start:this.Pos]
+}
+func (this *tDtdScanner) readLiteral() (string, error) {
+	if this.eof() || strings.IndexByte(cQuoteChars, this.Text[this.Pos]) < 0 {
+		return "", errors.New(fmt.Sprintf(sxeDtdExpected, "quoted literal", this.Pos))
+	}
+	QuoteChar := this.Text[this.Pos]
+	Close := strings.IndexByte(this.Text[this.Pos+1:], QuoteChar)
+	if Close < 0 {
+		return "", errors.New(sxeDtdUnexpectedEnd)
+	}
+	AValue := this.Text[this.Pos+1 : this.Pos+1+Close]
+	this.Pos += Close + 2
+	return AValue, nil
+}
+func (this *tDtdScanner) readExternalID(PublicOnly bool) (PublicID, SystemID string, err error) {
+	//SYSTEM "system" | PUBLIC "public" "system",notations may omit the system literal
+	this.skipBlanks()
+	switch {
+	case this.hasPrefix("SYSTEM"):
+		this.Pos += len("SYSTEM")
+		this.skipBlanks()
+		SystemID, err = this.readLiteral()
+	case this.hasPrefix("PUBLIC"):
+		this.Pos += len("PUBLIC")
+		this.skipBlanks()
+		if PublicID, err = this.readLiteral(); err != nil {
+			return
+		}
+		this.skipBlanks()
+		if PublicOnly && (this.eof() || strings.IndexByte(cQuoteChars, this.Text[this.Pos]) < 0) {
+			return
+		}
+		SystemID, err = this.readLiteral()
+	}
+	return
+}
+func (this *tDtdScanner) readDecl() (string, error) {
+	//Read a markup declaration up to its closing ">",skipping quoted literals
+	Start := this.Pos
+	var QuoteChar byte
+	for ; !this.eof(); this.Pos++ {
+		Ch := this.Text[this.Pos]
+		switch {
+		case QuoteChar != 0:
+			if Ch == QuoteChar {
+				QuoteChar = 0
+			}
+		case Ch == '"' || Ch == '\'':
+			QuoteChar = Ch
+		case Ch == '>':
+			this.Pos++
+			return this.Text[Start:this.Pos], nil
+		}
+	}
+	return "", errors.New(sxeDtdUnexpectedEnd)
+}
+func (this *tDtdScanner) subsetEnd() int {
+	//Position of the "]" closing the internal subset that starts at Pos
+	var QuoteChar byte
+	for i := this.Pos + 1; i < len(this.Text); i++ {
+		Ch := this.Text[i]
+		switch {
+		case QuoteChar != 0:
+			if Ch == QuoteChar {
+				QuoteChar = 0
+			}
+		case strings.HasPrefix(this.Text[i:], "<!--"):
+			Close := strings.Index(this.Text[i+4:], "-->")
+			if Close < 0 {
+				return -1
+			}
+			i += Close + 6
+		case strings.HasPrefix(this.Text[i:], "<?"):
+			Close := strings.Index(this.Text[i+2:], "?>")
+			if Close < 0 {
+				return -1
+			}
+			i += Close + 3
+		case Ch == '"' || Ch == '\'':
+			QuoteChar = Ch
+		case Ch == ']':
+			return i
+		}
+	}
+	return -1
+}
+func (this *tDtdScanner) readOccurs() byte {
+	if !this.eof() && strings.IndexByte("?*+", this.Text[this.Pos]) >= 0 {
+		this.Pos++
+		return this.Text[this.Pos-1]
+	}
+	return 0
+}
+func (this *tDtdScanner) readParticle(Depth int) (*TXmlDtdParticle, error) {
+	//cp ::= (Name | choice | seq) ('?' | '*' | '+')?,groups are nested up to MaxDepth levels
+	this.skipBlanks()
+	if !this.hasPrefix("(") {
+		Name := this.readName()
+		if Name == "" {
+			return nil, errors.New(fmt.Sprintf(sxeDtdMissingName, this.Pos))
+		}
+		return &TXmlDtdParticle{Name: Name, Occurs: this.readOccurs()}, nil
+	}
+	if Depth > this.MaxDepth {
+		return nil, &TXmlLimitError{Limit: LimitDepth, Max: this.MaxDepth, Pos: this.Pos}
+	}
+	this.Pos++
+	Group := &TXmlDtdParticle{}
+	var Sep byte
+	for {
+		Item, err := this.readParticle(Depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		Group.Items = append(Group.Items, Item)
+		this.skipBlanks()
+		if this.eof() {
+			return nil, errors.New(sxeDtdUnexpectedEnd)
+		}
+		Ch := this.Text[this.Pos]
+		this.Pos++
+		if Ch == ')' {
+			break
+		}
+		if (Ch != ',' && Ch != '|') || (Sep != 0 && Ch != Sep) {
+			return nil, errors.New(fmt.Sprintf(sxeDtdExpected, "\",\" or \"|\"", this.Pos-1))
+		}
+		Sep = Ch
+	}
+	Group.Choice = Sep == '|'
+	Group.Occurs = this.readOccurs()
+	return Group, nil
+}
+func (this *tDtdScanner) readEnumeration() ([]string, error) {
+	//(a|b|c)
+	if err := this.expect("("); err != nil {
+		return nil, err
+	}
+	Values := make([]string, 0)
+	for {
+		this.skipBlanks()
+		Value := this.readName()
+		if Value == "" {
+			return nil, errors.New(fmt.Sprintf(sxeDtdMissingName, this.Pos))
+		}
+		Values = append(Values, Value)
+		this.skipBlanks()
+		if this.hasPrefix(")") {
+			this.Pos++
+			return Values, nil
+		}
+		if err := this.expect("|"); err != nil {
+			return nil, err
+		}
+	}
+}
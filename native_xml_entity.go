@@ -0,0 +1,298 @@
+package native_xml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	cEntityMaxDepth = 16
+	cEntityMaxSize  = 1 << 20
+
+	sxeEntityRecursive     = "Entity \"%s\" references itself"
+	sxeEntityTooDeep       = "Entity \"%s\" is nested deeper than %d levels"
+	sxeEntityTooLarge      = "Expansion of entity \"%s\" exceeds %d bytes"
+	sxeEntityUnparsed      = "Unparsed entity \"%s\" may not be referenced"
+	sxeEntityExternalAttr  = "External entity \"%s\" may not be referenced in an attribute value"
+	sxeEntityMarkupInAttr  = "Entity reference in attribute \"%s\" contains markup"
+	sxeEntityNotLocal      = "Entity location \"%s\" is not a local file"
+	sxeEntityOutsideDir    = "Entity location \"%s\" is outside of \"%s\""
+	sxeEntityResolveFailed = "Cannot resolve entity \"%s\": %v"
+
+	LimitEntitySize  = "MaxSize"
+	LimitEntityDepth = "MaxDepth"
+)
+
+// Resolves the system identifier of an external entity to its replacement text
+type TXmlEntityResolver interface {
+	ResolveEntity(PublicID, SystemID string) (string, error)
+}
+
+// Entity expansion settings of a document
+type TXmlEntityOptions struct {
+	Expand   bool               //Replace references to entities declared in the doctype while reading
+	Resolver TXmlEntityResolver //Reads external entities,nil leaves their references unexpanded
+	MaxDepth int                //Maximum nesting of entity references,0 is cEntityMaxDepth
+	MaxSize  int                //Maximum number of bytes all expansions of a document or its doctype add,0 is cEntityMaxSize
+}
+
+// Error when the expansion of a general or parameter entity exceeds a limit of
+// the TXmlEntityOptions
+type TXmlEntityLimitError struct {
+	Limit string //LimitEntitySize or LimitEntityDepth
+	Max   int
+	Name  string //Entity whose expansion exceeded the limit
+}
+
+// Resolver for external entities in files below a base directory
+type TXmlFileResolver struct {
+	BaseDir string
+}
+
+type tEntityExpander struct {
+	Dtd      *TXmlDtd
+	Options  *TXmlEntityOptions
+	Size     int
+	open     map[string]bool
+	external map[string]string
+}
+
+func NewXmlFileResolver(BaseDir string) *TXmlFileResolver {
+	return &TXmlFileResolver{BaseDir: BaseDir}
+}
+func (this *TXmlFileResolver) ResolveEntity(PublicID, SystemID string) (string, error) {
+	//Only relative or absolute file names inside BaseDir are read,never urls
+	Name := strings.TrimPrefix(SystemID, "file://")
+	if strings.Contains(Name, "://") {
+		return "", errors.New(fmt.Sprintf(sxeEntityNotLocal, SystemID))
+	}
+	Base, err := filepath.Abs(this.BaseDir)
+	if err != nil {
+		return "", err
+	}
+	Path := filepath.FromSlash(Name)
+	if !filepath.IsAbs(Path) {
+		Path = filepath.Join(Base, Path)
+	}
+	//Symbolic links are followed before the check,a link may lead out of BaseDir
+	if Base, err = filepath.EvalSymlinks(Base); err != nil {
+		return "", err
+	}
+	if Path, err = filepath.EvalSymlinks(Path); err != nil {
+		return "", err
+	}
+	if Rel, err := filepath.Rel(Base, Path); err != nil || Rel == ".." ||
+		strings.HasPrefix(Rel, ".."+string(filepath.Separator)) {
+		return "", errors.New(fmt.Sprintf(sxeEntityOutsideDir, SystemID, this.BaseDir))
+	}
+	Data, err := os.ReadFile(Path)
+	if err != nil {
+		return "", err
+	}
+	return string(Data), nil
+}
+func (this *TNativeXml) ExpandEntities() error {
+	//Replace the references to entities declared in the doctype in all values
+	//and attributes of the root element
+	Dtd, err := this.Dtd()
+	if err != nil || Dtd == nil || this.XmlRoot == nil || len(Dtd.Entities) == 0 {
+		return err
+	}
+	Expander := &tEntityExpander{Dtd: Dtd, Options: &this.EntityOptions,
+		open: make(map[string]bool), external: make(map[string]string)}
+	return Expander.expandNode(this.XmlRoot)
+}
+
+func (this *TXmlEntityLimitError) Error() string {
+	if this.Limit == LimitEntityDepth {
+		return fmt.Sprintf(sxeEntityTooDeep, this.Name, this.Max)
+	}
+	return fmt.Sprintf(sxeEntityTooLarge, this.Name, this.Max)
+}
+
+func (this *TXmlEntityOptions) maxDepth() int {
+	//The limits apply to general entities in content and to parameter entities in
+	//the doctype,nil options have the defaults
+	if this != nil && this.MaxDepth > 0 {
+		return this.MaxDepth
+	}
+	return cEntityMaxDepth
+}
+func (this *TXmlEntityOptions) maxSize() int {
+	if this != nil && this.MaxSize > 0 {
+		return this.MaxSize
+	}
+	return cEntityMaxSize
+}
+func (this *tEntityExpander) expand(AValue string, InAttribute bool) (string, error) {
+	if strings.IndexByte(AValue, '&') < 0 {
+		return AValue, nil
+	}
+	buf := new(strings.Builder)
+	err := this.expandTo(buf, "", AValue, 0, InAttribute)
+	return buf.String(), err
+}
+func (this *tEntityExpander) expandTo(buf *strings.Builder, Name, AValue string, Depth int, InAttribute bool) error {
+	//Every byte that comes from a replacement text counts against the size limit,
+	//so nested expansions fail before they are built up in memory
+	for i := 0; i < len(AValue); i++ {
+		if AValue[i] == '&' {
+			if Close := strings.IndexByte(AValue[i:], ';'); Close > 1 {
+				Name := AValue[i+1 : i+Close]
+				if _, ok := ResolveCharReference(Name); !ok {
+					if Entity, ok := this.Dtd.Entities[Name]; ok {
+						Done, err := this.reference(buf, Entity, Depth, InAttribute)
+						if err != nil {
+							return err
+						}
+						if Done {
+							i += Close
+							continue
+						}
+					}
+				}
+			}
+		}
+		buf.WriteByte(AValue[i])
+		if Depth > 0 {
+			if this.Size++; this.Size > this.Options.maxSize() {
+				return &TXmlEntityLimitError{Limit: LimitEntitySize, Max: this.Options.maxSize(), Name: Name}
+			}
+		}
+	}
+	return nil
+}
+func (this *tEntityExpander) reference(buf *strings.Builder, Entity *TXmlDtdEntity, Depth int, InAttribute bool) (bool, error) {
+	//Write the replacement text of Entity,false when the reference stays as it is
+	if Entity.Notation != "" {
+		return false, errors.New(fmt.Sprintf(sxeEntityUnparsed, Entity.Name))
+	}
+	if this.open[Entity.Name] {
+		return false, errors.New(fmt.Sprintf(sxeEntityRecursive, Entity.Name))
+	}
+	if Max := this.Options.maxDepth(); Depth >= Max {
+		return false, &TXmlEntityLimitError{Limit: LimitEntityDepth, Max: Max, Name: Entity.Name}
+	}
+	Text := Entity.Value
+	if Entity.SystemID != "" {
+		if InAttribute {
+			return false, errors.New(fmt.Sprintf(sxeEntityExternalAttr, Entity.Name))
+		}
+		if this.Options.Resolver == nil {
+			return false, nil
+		}
+		var ok bool
+		if Text, ok = this.external[Entity.Name]; !ok {
+			var err error
+			if Text, err = this.Options.Resolver.ResolveEntity(Entity.PublicID, Entity.SystemID); err != nil {
+				return false, errors.New(fmt.Sprintf(sxeEntityResolveFailed, Entity.Name, err))
+			}
+			Text = dropTextDecl(Text)
+			this.external[Entity.Name] = Text
+		}
+	}
+	this.open[Entity.Name] = true
+	defer delete(this.open, Entity.Name)
+	return true, this.expandTo(buf, Entity.Name, Text, Depth+1, InAttribute)
+}
+func dropTextDecl(Text string) string {
+	//The replacement text of an external parsed entity,without its text declaration
+	if strings.HasPrefix(Text, "<?xml") {
+		if p := strings.Index(Text, "?>"); p >= 0 {
+			return Text[p+2:]
+		}
+	}
+	return Text
+}
+func (this *tEntityExpander) expandNode(Node *TXmlNode) error {
+	for k, v := range Node.Attributes {
+		Value, err := this.expand(v, true)
+		if err != nil {
+			return err
+		}
+		if strings.IndexByte(Value, '<') >= 0 {
+			return errors.New(fmt.Sprintf(sxeEntityMarkupInAttr, k))
+		}
+		Node.Attributes[k] = Value
+	}
+	Children := Node.NodeList()
+	if Node.ElementType == xeNormal {
+		if err := this.expandText(Node, Children); err != nil {
+			return err
+		}
+	}
+	for _, v := range Children {
+		if err := this.expandNode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (this *tEntityExpander) expandText(Node *TXmlNode, Children []*TXmlNode) error {
+	//Expand the text in front of each child and behind the last one,the elements of a
+	//replacement text are inserted where the reference was
+	Segments := Node.textSegments()
+	if strings.IndexByte(strings.Join(Segments, ""), '&') < 0 {
+		return nil
+	}
+	Texts := make([]string, 0, len(Segments))
+	Nodes := make([]*TXmlNode, 0, len(Children))
+	Text := ""
+	for i, Segment := range Segments {
+		Value, err := this.expand(Segment, false)
+		if err != nil {
+			return err
+		}
+		if strings.IndexByte(Value, '<') < 0 {
+			Text += Value
+		} else {
+			Fragment, err := readMarkup(Node, Value)
+			if err != nil {
+				return err
+			}
+			Inner := Fragment.textSegments()
+			for j, v := range Fragment.NodeList() {
+				Texts, Text = append(Texts, Text+Inner[j]), ""
+				v.setSourcePos(Node.sourcePos)
+				Nodes = append(Nodes, v)
+			}
+			Text += Inner[len(Inner)-1]
+		}
+		if i < len(Children) {
+			Texts, Text = append(Texts, Text), ""
+			Nodes = append(Nodes, Children[i])
+		}
+	}
+	Texts = append(Texts, Text)
+	if len(Nodes) > len(Children) {
+		//The children get keys in document order
+		Node.Nodes, Node.MaxNodeID = make(map[int]*TXmlNode, len(Nodes)), 0
+		for _, v := range Nodes {
+			Node.NodeAdd(v)
+		}
+	}
+	Node.texts = Texts
+	Node.Value = segmentsValue(Texts)
+	return nil
+}
+func readMarkup(Node *TXmlNode, Value string) (Fragment *TXmlNode, err error) {
+	//Replacement text with markup is read as content of an element named like Node
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	Fragment = &TXmlNode{Attributes: make(map[string]string), Nodes: make(map[int]*TXmlNode)}
+	Fragment.ReadFromStream(bytes.NewReader([]byte("<" + Node.Name + ">" + Value + "</" + Node.Name + ">")))
+	return Fragment, nil
+}
+func (this *TXmlNode) setSourcePos(Pos int) {
+	this.sourcePos = Pos
+	for _, v := range this.Nodes {
+		v.setSourcePos(Pos)
+	}
+}
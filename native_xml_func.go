@@ -2,7 +2,9 @@ package native_xml
 
 import (
 	"bytes"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 func NewNativeXml() *TNativeXml {
@@ -12,213 +14,169 @@ func NewNativeXml() *TNativeXml {
 		UseFullNodes:   true,
 		RootNodes:      make(map[TXmlElementType]*TXmlNode),
 		ParserWarnings: true,
+		FormatOptions:  TXmlFormatOptions{LineFeed: "\x0D\x0A"},
 	}
 }
+
+// Reads the type of the tag whose "<" was read last,the characters after the start
+// of the tag are left in the Surplus of AReader. The result indexes the tag types.
+//
+// Deprecated: documents are read by an index based scanner,use TNativeXml.ReadFromString.
 func ReadOpenTag(AReader *TsdSurplusReader) (idx int) {
-	//Try to read the type of open tag from s
-	var Surplus string
-	idx = cTagCount - 1
-	Candidates := make([]bool, cTagCount)
-	for i, _ := range Candidates {
-		Candidates[i] = true
-	}
-	for Found, AIndex := true, 1; Found; AIndex++ {
-		Found = false
-		if Ch, i := AReader.ReadChar(); i == 0 {
-			return idx
-		} else {
-			Surplus = Surplus + string(Ch)
-			for i := cTagCount - 1; i >= 0; i-- {
-				if Candidates[i] && (len(cTags[i].FStart) >= AIndex+1) {
-					if cTags[i].FStart[AIndex] == Ch {
-						Found = true
-						if len(cTags[i].FStart) == AIndex+1 {
-							idx = i
-							break
-						}
-					} else {
-						Candidates[i] = false
-					}
-				}
-			}
-		}
-	}
-	//The surplus string that we already read (everything after the tag)
-	AReader.Surplus = Surplus[len(cTags[idx].FStart)-1:]
+	Scanner := AReader.scanner()
+	Scanner.Text = "<" + Scanner.Text
+	idx = Scanner.tagIndex()
+	Scanner.Pos = len(cTags[idx].FStart)
+	AReader.done(Scanner)
 	return idx
 }
+
+// Reads up to ASearch,which is not part of the result. With SkipQuotes ASearch is
+// not found in quoted values.
+//
+// Deprecated: documents are read by an index based scanner,use TNativeXml.ReadFromString.
 func ReadStringFromStreamUntil(AReader *TsdSurplusReader, ASearch string, SkipQuotes bool) (AValue string, b bool) {
-	b = false
-	InQuotes := false
-	//Get last searchstring character
-	AIndex := len(ASearch)
-	if AIndex == 0 {
-		return "", b
-	}
-	LastSearchChar := ASearch[AIndex-1]
-	AValue = ""
-	var (
-		Ch        byte
-		i         int
-		QuoteChar byte
-	)
-	for !b {
-		//Add characters to the value to be returned
-		if Ch, i = AReader.ReadChar(); i == 0 {
-			return AValue, b
-		}
-		AValue += string(Ch)
-		//Do we skip quotes?
-		if SkipQuotes {
-			if InQuotes && Ch == QuoteChar {
-				InQuotes = false
-			} else {
-				if strings.Index(cQuoteChars, string(Ch)) >= 0 {
-					InQuotes = true
-					QuoteChar = Ch
-				}
-			}
-		}
-		//In quotes? If so ,we don't check the end condition
-		if !InQuotes {
-			// Is the last char the same as the last char of the search string?
-			if Ch == LastSearchChar {
-				//Check to see if the whole search string is present
-				ValueIndex := len(AValue) - 1
-				SearchIndex := len(ASearch) - 1
-				if ValueIndex < SearchIndex {
-					continue
-				}
-				b = true
-				for SearchIndex > 0 && b {
-					b = AValue[ValueIndex] == ASearch[SearchIndex]
-					ValueIndex--
-					SearchIndex--
-				}
-			}
-		}
+	if ASearch == "" {
+		return "", false
 	}
-	//Use only the part before the search string
-	AValue = AValue[:len(AValue)-len(ASearch)]
-	return AValue, b
+	Scanner := AReader.scanner()
+	defer AReader.done(Scanner)
+	return Scanner.readUntil(ASearch, SkipQuotes)
 }
+
+// Reads up to Terminator outside of quoted values,Terminator is not part of the result.
+//
+// Deprecated: documents are read by an index based scanner,use TNativeXml.ReadFromString.
+func ReadStringFromStreamWithQuotes(AReader *TsdSurplusReader, Terminator string) (AValue string, bret bool) {
+	if Terminator == "" {
+		//Without a terminator the rest is read
+		Scanner := AReader.scanner()
+		Scanner.checkText(len(Scanner.Text))
+		AReader.Surplus = ""
+		return Scanner.Text, false
+	}
+	return ReadStringFromStreamUntil(AReader, Terminator, true)
+}
+
+// Trims the blanks of AValue in [Start,Close] by moving Start and Close,b is false
+// when nothing is left.
+//
+// Deprecated: use strings.Trim with the blanks of the document.
 func TrimPos(AValue string, Start, Close int) (rStart, rClose int, b bool) {
-	//Trim the string in AValue in [Start,Close-1] by adjusting Start and Close variables
-	//Checks
 	if Start < 0 {
 		Start = 0
 	}
-	if Close < len(AValue)-1 {
+	if Close > len(AValue)-1 {
 		Close = len(AValue) - 1
 	}
 	if Close <= Start {
 		return -1, -1, false
 	}
-	var bleft, bright bool
-	//Trim left,right
-	for rStart, rClose = Start, Close; rStart < rClose; {
-		//Trim left
-		bleft = false
-		if strings.IndexAny(string(AValue[rStart]), cControlChars) >= 0 {
-			rStart++
-			bleft = true
-		}
-		//Trim right
-		bright = false
-		if strings.IndexAny(string(AValue[rClose]), cControlChars) >= 0 {
-			rClose--
-			bright = true
-		}
-		if !bleft && !bright {
-			break
-		}
+	for rStart, rClose = Start, Close; rStart < rClose && isControlChar(AValue[rStart]); rStart++ {
+	}
+	for ; rClose > rStart && isControlChar(AValue[rClose]); rClose-- {
 	}
 	return rStart, rClose, rClose > rStart
 }
+
+// Reads the attributes in AValue from Start into Attributes,which is cleared first.
+//
+// Deprecated: use TXmlNode.ParseTag,it reads the attributes like the scanner does.
 func ParseAttributes(AValue string, Start, Close int, Attributes map[string]string) {
-	//Convert the attributes string AValue in [Start,Close-1] to the attributes stirnglist
-	InQuotes := false
-	var AQuoteChar byte = '"'
 	if Attributes == nil {
 		return
 	}
-	b := false
-	if Start, Close, b = TrimPos(AValue, Start, Close); !b {
+	for k := range Attributes {
+		delete(Attributes, k)
+	}
+	if Start < 0 || Start >= len(AValue) {
 		return
 	}
-	//Clear first
-	for k, _ := range Attributes {
-		delete(Attributes, k)
+	if Close >= Start && Close < len(AValue)-1 {
+		AValue = AValue[:Close+1]
 	}
-	//Loop through characters
-	for i := Start; i <= Close; i++ {
-		//In quotes?
-		if InQuotes {
-			if AValue[i] == AQuoteChar {
-				InQuotes = false
-			}
-		} else {
-			if strings.Index(cQuoteChars, string(AValue[i])) >= 0 {
-				InQuotes = true
-				AQuoteChar = AValue[i]
-			}
-		}
-		//Add attribute strings on each controlchar break
-		if !InQuotes {
-			if strings.Index(cControlChars, string(AValue[i])) >= 0 {
-				if i > Start {
-					cutstr := string(AValue[Start:i])
-					cutstr = strings.Replace(cutstr, string(AQuoteChar), "", len(cutstr))
-					if p := strings.Index(cutstr, "="); p > 0 {
-						Attributes[cutstr[:p]] = cutstr[p+1:]
-					}
-				}
-				Start = i + 1
-			}
-		}
+	newXmlScanner(nil, "", 0).parseAttributes(&TXmlNode{Attributes: Attributes}, AValue[Start:])
+}
+func WriteStringToStream(S *bytes.Buffer, AString string) {
+	if len(AString) > 0 {
+		S.WriteString(AString)
 	}
-	//Add last attribute string
-	if Start < Close {
-		cutstr := string(AValue[Start:])
-		cutstr = strings.Replace(cutstr, string(AQuoteChar), "", len(cutstr))
-		if p := strings.Index(cutstr, "="); p > 0 {
-			Attributes[cutstr[:p]] = cutstr[p+1:]
+}
+func EscapeString(AValue string) string {
+	//Replace the xml special characters in AValue by their entity references
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(AValue); i++ {
+		switch AValue[i] {
+		case '&':
+			buf.WriteString("&amp;")
+		case '<':
+			buf.WriteString("&lt;")
+		case '>':
+			buf.WriteString("&gt;")
+		case '"':
+			buf.WriteString("&quot;")
+		case '\'':
+			buf.WriteString("&apos;")
+		default:
+			buf.WriteByte(AValue[i])
 		}
 	}
-
-	return
+	return buf.String()
 }
-func ReadStringFromStreamWithQuotes(AReader *TsdSurplusReader, Terminator string) (AValue string, bret bool) {
-	AValue = ""
-	QuoteChar := byte(0x00)
-	InQuotes := false
-	var (
-		Ch      byte
-		readlen int
-	)
-	for {
-		if Ch, readlen = AReader.ReadChar(); readlen != 1 {
-			return AValue, false
-		}
-		if !InQuotes {
-			if Ch == '"' || Ch == '\'' {
-				InQuotes = true
-				QuoteChar = Ch
-			} else {
-				if Ch == QuoteChar {
-					InQuotes = false
-				}
-			}
+func UnescapeString(AValue string) string {
+	//Replace the predefined entities and character references in AValue,
+	//unknown entities are left as they are
+	if strings.IndexByte(AValue, '&') < 0 {
+		return AValue
+	}
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(AValue); i++ {
+		if AValue[i] != '&' {
+			buf.WriteByte(AValue[i])
+			continue
 		}
-		if !InQuotes && string(Ch) == Terminator {
+		AClose := strings.IndexByte(AValue[i:], ';')
+		if AClose < 0 {
+			buf.WriteString(AValue[i:])
 			break
 		}
-		AValue += string(Ch)
+		if ARef, b := ResolveCharReference(AValue[i+1 : i+AClose]); b {
+			buf.WriteString(ARef)
+			i += AClose
+		} else {
+			buf.WriteByte('&')
+		}
 	}
-	return AValue, true
+	return buf.String()
 }
-func WriteStringToStream(S *bytes.Buffer, AString string) {
-	if len(AString) > 0 {
-		S.WriteString(AString)
+func ResolveCharReference(AName string) (string, bool) {
+	//Resolve a predefined entity name or a "#nn" / "#xhh" character reference
+	switch AName {
+	case "amp":
+		return "&", true
+	case "lt":
+		return "<", true
+	case "gt":
+		return ">", true
+	case "quot":
+		return "\"", true
+	case "apos":
+		return "'", true
+	}
+	if len(AName) < 2 || AName[0] != '#' {
+		return "", false
+	}
+	var (
+		Code int64
+		err  error
+	)
+	if AName[1] == 'x' {
+		Code, err = strconv.ParseInt(AName[2:], 16, 32)
+	} else {
+		Code, err = strconv.ParseInt(AName[1:], 10, 32)
+	}
+	if err != nil || Code < 0 || Code > utf8.MaxRune {
+		return "", false
 	}
+	return string(rune(Code)), true
 }
@@ -0,0 +1,126 @@
+package native_xml
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	cParseMaxDepth = 10000
+
+	LimitDepth      = "MaxDepth"
+	LimitAttributes = "MaxAttributes"
+	LimitNameLength = "MaxNameLength"
+	LimitTextSize   = "MaxTextSize"
+	LimitNodes      = "MaxNodes"
+	LimitInputBytes = "MaxInputBytes"
+
+	sxeLimitExceeded = "Parser limit %s of %d exceeded at position %d"
+)
+
+// Resource limits for reading a document,0 means no limit
+type TXmlParseOptions struct {
+	MaxDepth      int //Nesting level of elements,the root element is level 1,and of content model groups in the doctype. 0 is cParseMaxDepth,deeper trees are never read
+	MaxAttributes int //Attributes of one element
+	MaxNameLength int //Length of element and attribute names
+	MaxTextSize   int //Length of a text,tag,comment or other single value
+	MaxNodes      int //Nodes in the whole document
+	MaxInputBytes int //Size of the input
+}
+
+// Error when a document exceeds one of its TXmlParseOptions
+type TXmlLimitError struct {
+	Limit string //One of the Limit* names
+	Max   int
+	Pos   int //Byte offset in the input
+}
+
+type tXmlParseState struct {
+	Options *TXmlParseOptions
+	Depth   int
+	Nodes   int
+	Cursor  tTextCursor   //Position of the last warning
+	Cancel  *tCancelCheck //Stops the parser when the context of a ...Context call is done
+}
+
+// Line and column of a byte position in the input
+type tTextCursor struct {
+	Pos    int
+	Line   int
+	Column int
+}
+
+func DefaultParseOptions() TXmlParseOptions {
+	//Limits suitable for documents from untrusted sources
+	return TXmlParseOptions{MaxDepth: 256, MaxAttributes: 256, MaxNameLength: 1024,
+		MaxTextSize: 8 << 20, MaxNodes: 1 << 20, MaxInputBytes: 64 << 20}
+}
+func (this *TXmlLimitError) Error() string {
+	return fmt.Sprintf(sxeLimitExceeded, this.Limit, this.Max, this.Pos)
+}
+func limitExceeded(Limit string, Max, Pos int) {
+	panic(&TXmlLimitError{Limit: Limit, Max: Max, Pos: Pos})
+}
+func (this *tXmlParseState) maxDepth() int {
+	return parseMaxDepth(this.Options.MaxDepth)
+}
+func parseMaxDepth(MaxDepth int) int {
+	//Without a limit the depth is still capped,the tree is walked recursively
+	if MaxDepth > 0 && MaxDepth < cParseMaxDepth {
+		return MaxDepth
+	}
+	return cParseMaxDepth
+}
+func (this *tXmlParseState) enter(Pos int) {
+	//A node starts,depth and node count go up
+	this.Depth++
+	this.Nodes++
+	this.Cancel.check()
+	if Max := this.maxDepth(); this.Depth > Max {
+		limitExceeded(LimitDepth, Max, Pos)
+	}
+	if this.Options.MaxNodes > 0 && this.Nodes > this.Options.MaxNodes {
+		limitExceeded(LimitNodes, this.Options.MaxNodes, Pos)
+	}
+}
+func (this *tXmlParseState) checkTag(Node *TXmlNode, Pos int) {
+	if Max := this.Options.MaxAttributes; Max > 0 && len(Node.Attributes) > Max {
+		limitExceeded(LimitAttributes, Max, Pos)
+	}
+	if Max := this.Options.MaxNameLength; Max > 0 {
+		if len(Node.Name) > Max {
+			limitExceeded(LimitNameLength, Max, Pos)
+		}
+		for k := range Node.Attributes {
+			if len(k) > Max {
+				limitExceeded(LimitNameLength, Max, Pos)
+			}
+		}
+	}
+}
+func (this *TNativeXml) ParseStream(S *bytes.Buffer) (err error) {
+	//ReadFromStream that returns the parser errors instead of panicking,
+	//limit violations are a *TXmlLimitError
+	defer recoverError(&err)
+	this.ReadFromStream(S)
+	return nil
+}
+func (this *TNativeXml) ParseString(AValue string) error {
+	return this.ParseStream(bytes.NewBufferString(AValue))
+}
+func (this *TNativeXml) ParseReader(R io.Reader) error {
+	return this.ParseReaderContext(context.Background(), R)
+}
+func recoverError(err *error) {
+	//Deferred by the functions that return the panics of the parser as error
+	if r := recover(); r != nil {
+		if e, ok := r.(error); ok {
+			*err = e
+		} else {
+			*err = errors.New(fmt.Sprint(r))
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package native_xml
+
+import (
+	"sort"
+	"strconv"
+)
+
+type TXmlConflictKind int
+
+const (
+	ConflictValue     TXmlConflictKind = iota
+	ConflictAttribute                  //Both sides set or removed an attribute differently
+	ConflictDeleted                    //One side changed a node the other side deleted
+	ConflictReplaced                   //Both sides replaced the root element differently
+)
+
+// Settings of Merge
+type TXmlMergeOptions struct {
+	KeyAttributes    map[string]string //Element name to the attribute that identifies repeated siblings,"*" for any element
+	IgnoreWhitespace bool              //Values that only differ in white space are equal
+	PreferTheirs     bool              //Conflicts are resolved with theirs,otherwise with ours
+}
+
+// A change both sides made differently,the merged document has the version of the
+// preferred side
+type TXmlConflict struct {
+	Kind   TXmlConflictKind
+	Path   string //Path of the node in the base,in ours for a node both sides added
+	Name   string //Attribute name of an attribute conflict
+	Base   string //Value,attribute value or xml of the node in the base
+	Ours   string //Value,attribute value or xml of the node in ours,empty when removed
+	Theirs string //Value,attribute value or xml of the node in theirs,empty when removed
+}
+
+// State of one Merge call
+type tXmlMerge struct {
+	Options   *TXmlMergeOptions
+	Diff      *tXmlDiff //Matches and compares the nodes
+	Result    *TNativeXml
+	Conflicts []TXmlConflict
+}
+
+func (this TXmlConflictKind) String() string {
+	switch this {
+	case ConflictValue:
+		return "Value"
+	case ConflictAttribute:
+		return "Attribute"
+	case ConflictDeleted:
+		return "Deleted"
+	case ConflictReplaced:
+		return "Replaced"
+	}
+	return "Unknown"
+}
+func (this TXmlConflict) String() string {
+	Path := this.Path
+	if this.Name != "" {
+		Path += "/@" + this.Name
+	}
+	return this.Kind.String() + " " + Path + " base " + strconv.Quote(this.Base) + " ours " + strconv.Quote(this.Ours) +
+		" theirs " + strconv.Quote(this.Theirs)
+}
+
+func Merge(Base, Ours, Theirs *TNativeXml, Options TXmlMergeOptions) (*TNativeXml, []TXmlConflict) {
+	//Three-way merge of the changes ours and theirs made to base into a new document.
+	//Child nodes are matched like Diff does. Nodes only one side added are placed behind
+	//the node before them on that side,otherwise the order of ours is kept
+	M := &tXmlMerge{Options: &Options, Result: NewNativeXml(),
+		Diff: &tXmlDiff{Options: &TXmlDiffOptions{IgnoreWhitespace: Options.IgnoreWhitespace,
+			KeyAttributes: Options.KeyAttributes}, hashes: make(map[*TXmlNode]uint64)}}
+	From := Ours
+	if From == nil {
+		From = Theirs
+	}
+	if From != nil {
+		//The declaration and the other root level nodes of ours
+		M.Result.XmlFormat = From.XmlFormat
+		for k, v := range From.RootNodes {
+			if k != xeNormal {
+				Copy := v.copyTree(nil, 0)
+				Copy.document = M.Result
+				M.Result.RootNodes[k] = Copy
+			}
+		}
+	}
+	if Root := M.root(diffRoot(Base), diffRoot(Ours), diffRoot(Theirs)); Root != nil {
+		Root.document = M.Result
+		M.Result.RootNodes[xeNormal] = Root
+		M.Result.XmlRoot = Root
+	}
+	return M.Result, M.Conflicts
+}
+
+func (this *tXmlMerge) conflict(Kind TXmlConflictKind, Path, Name, Base, Ours, Theirs string) {
+	this.Conflicts = append(this.Conflicts, TXmlConflict{Kind: Kind, Path: Path, Name: Name,
+		Base: Base, Ours: Ours, Theirs: Theirs})
+}
+func (this *tXmlMerge) xml(Node *TXmlNode) string {
+	if Node == nil {
+		return ""
+	}
+	return this.Result.nodeXml(Node)
+}
+func (this *tXmlMerge) equal(A, B *TXmlNode) bool {
+	return this.Diff.hash(A) == this.Diff.hash(B)
+}
+func (this *tXmlMerge) prefer(Ours, Theirs *TXmlNode) *TXmlNode {
+	Node := Ours
+	if this.Options.PreferTheirs {
+		Node = Theirs
+	}
+	if Node == nil {
+		return nil
+	}
+	return Node.copyTree(nil, 0)
+}
+func (this *tXmlMerge) merge3(Base, Ours, Theirs string, InBase, InOurs, InTheirs bool) (Value string, Exists, Conflict bool) {
+	//The value a side changed,a conflict when both changed it differently
+	Equal := func(A string, InA bool, B string, InB bool) bool {
+		return InA == InB && (!InA || this.Diff.value(A) == this.Diff.value(B))
+	}
+	switch {
+	case Equal(Ours, InOurs, Theirs, InTheirs), Equal(Base, InBase, Theirs, InTheirs):
+		return Ours, InOurs, false
+	case Equal(Base, InBase, Ours, InOurs):
+		return Theirs, InTheirs, false
+	case this.Options.PreferTheirs:
+		return Theirs, InTheirs, true
+	}
+	return Ours, InOurs, true
+}
+func (this *tXmlMerge) root(B, O, T *TXmlNode) *TXmlNode {
+	if O == nil || T == nil || O.Name == T.Name {
+		return this.resolve(B, O, T)
+	}
+	//A renamed root element replaces the whole document
+	switch {
+	case B != nil && O.Name == B.Name && this.equal(B, O):
+		return T.copyTree(nil, 0)
+	case B != nil && T.Name == B.Name && this.equal(B, T):
+		return O.copyTree(nil, 0)
+	}
+	Path := O.NodePath()
+	if B != nil {
+		Path = B.NodePath()
+	}
+	this.conflict(ConflictReplaced, Path, "", this.xml(B), this.xml(O), this.xml(T))
+	return this.prefer(O, T)
+}
+func (this *tXmlMerge) resolve(B, O, T *TXmlNode) *TXmlNode {
+	//The merged node of B,O and T are its versions in ours and theirs,nil when a side
+	//removed it or B is nil when both sides added it
+	switch {
+	case O != nil && T != nil:
+		return this.node(B, O, T)
+	case O == nil && T == nil:
+		return nil
+	}
+	Kept := O
+	if Kept == nil {
+		Kept = T
+	}
+	switch {
+	case B == nil:
+		return Kept.copyTree(nil, 0)
+	case this.equal(B, Kept):
+		return nil
+	}
+	this.conflict(ConflictDeleted, B.NodePath(), "", this.xml(B), this.xml(O), this.xml(T))
+	return this.prefer(O, T)
+}
+func (this *tXmlMerge) node(B, O, T *TXmlNode) *TXmlNode {
+	switch {
+	case this.equal(O, T):
+		return O.copyTree(nil, 0)
+	case B != nil && this.equal(B, O):
+		return T.copyTree(nil, 0)
+	case B != nil && this.equal(B, T):
+		return O.copyTree(nil, 0)
+	}
+	Result := &TXmlNode{ElementType: O.ElementType, Name: O.Name, BlankLines: O.BlankLines,
+		Attributes: make(map[string]string), Nodes: make(map[int]*TXmlNode)}
+	Path, BValue, BAttributes := O.NodePath(), "", map[string]string(nil)
+	if B != nil {
+		Path, BValue, BAttributes = B.NodePath(), B.Value, B.Attributes
+	}
+	Value, _, Conflict := this.merge3(BValue, O.Value, T.Value, B != nil, true, true)
+	Result.Value = Value
+	if Conflict {
+		this.conflict(ConflictValue, Path, "", BValue, O.Value, T.Value)
+	}
+	Names := make([]string, 0, len(O.Attributes)+len(T.Attributes))
+	for _, Attributes := range []map[string]string{BAttributes, O.Attributes, T.Attributes} {
+		for k := range Attributes {
+			Names = append(Names, k)
+		}
+	}
+	sort.Strings(Names)
+	for i, k := range Names {
+		if i > 0 && Names[i-1] == k {
+			continue
+		}
+		BValue, InBase := BAttributes[k]
+		OValue, InOurs := O.Attributes[k]
+		TValue, InTheirs := T.Attributes[k]
+		Value, Exists, Conflict := this.merge3(BValue, OValue, TValue, InBase, InOurs, InTheirs)
+		if Exists {
+			Result.Attributes[k] = Value
+		}
+		if Conflict {
+			this.conflict(ConflictAttribute, Path, k, BValue, OValue, TValue)
+		}
+	}
+	this.children(Result, B, O, T)
+	return Result
+}
+func (this *tXmlMerge) children(Result, B, O, T *TXmlNode) {
+	var BList []*TXmlNode
+	if B != nil {
+		BList = this.Diff.nodes(B)
+	}
+	OList, TList := this.Diff.nodes(O), this.Diff.nodes(T)
+	OMatch, TMatch := this.Diff.match(BList, OList), this.Diff.match(BList, TList)
+	Merged := make(map[*TXmlNode]*TXmlNode) //Child of ours or theirs to its merged node
+	OInBase, TInBase := make([]bool, len(OList)), make([]bool, len(TList))
+	for i, v := range BList {
+		var OChild, TChild *TXmlNode
+		if j := OMatch[i]; j >= 0 {
+			OChild, OInBase[j] = OList[j], true
+		}
+		if j := TMatch[i]; j >= 0 {
+			TChild, TInBase[j] = TList[j], true
+		}
+		if Node := this.resolve(v, OChild, TChild); Node != nil {
+			if OChild != nil {
+				Merged[OChild] = Node
+			}
+			if TChild != nil {
+				Merged[TChild] = Node
+			}
+		}
+	}
+	//Nodes both sides added are merged when they have the same key attribute or are equal
+	Added := make(map[string][]*TXmlNode)
+	for j, v := range TList {
+		if !TInBase[j] {
+			k := this.Diff.key(v)
+			Added[k] = append(Added[k], v)
+		}
+	}
+	for j, v := range OList {
+		if OInBase[j] {
+			continue
+		}
+		k := this.Diff.key(v)
+		_, Keyed := this.Diff.keyValue(v)
+		var TChild *TXmlNode
+		for n, w := range Added[k] {
+			if Keyed || this.equal(v, w) {
+				TChild = w
+				Added[k] = append(Added[k][:n:n], Added[k][n+1:]...)
+				break
+			}
+		}
+		Merged[v] = this.resolve(nil, v, TChild)
+		if TChild != nil {
+			Merged[TChild] = Merged[v]
+		}
+	}
+	for j, v := range TList {
+		if _, ok := Merged[v]; !ok && !TInBase[j] {
+			Merged[v] = v.copyTree(nil, 0)
+		}
+	}
+	//The order of ours,the nodes only theirs has follow the node before them in theirs
+	Placed := make(map[*TXmlNode]bool)
+	for _, v := range OList {
+		if Node := Merged[v]; Node != nil {
+			Placed[Node] = true
+		}
+	}
+	After := make(map[*TXmlNode][]*TXmlNode)
+	var Anchor *TXmlNode
+	for _, v := range TList {
+		switch Node := Merged[v]; {
+		case Node == nil:
+		case Placed[Node]:
+			Anchor = Node
+		default:
+			After[Anchor] = append(After[Anchor], Node)
+		}
+	}
+	for _, v := range After[nil] {
+		Result.addWithKey(v, 0)
+	}
+	for _, v := range OList {
+		if Node := Merged[v]; Node != nil {
+			Result.addWithKey(Node, 0)
+			for _, w := range After[Node] {
+				Result.addWithKey(w, 0)
+			}
+		}
+	}
+}
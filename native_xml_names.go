@@ -0,0 +1,235 @@
+package native_xml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	sxeIllegalCharInAttrName = "Illegal character in attribute name \"%s\" of element \"%s\""
+	sxeIllegalCharInText     = "Illegal character #x%X at line %d,column %d"
+	sxeInvalidUtf8           = "Invalid UTF-8 byte #x%X at line %d,column %d"
+	sxeWarnIllegalChars      = "%d illegal characters removed"
+	sxeWarnInvalidUtf8       = "Invalid UTF-8 replaced by U+FFFD"
+)
+
+// Character ranges of the NameStartChar production of XML 1.0 (fifth edition),
+// ":" and "_" are checked separately
+var cNameStartRanges = [][2]rune{
+	{'A', 'Z'}, {'a', 'z'}, {0xC0, 0xD6}, {0xD8, 0xF6}, {0xF8, 0x2FF}, {0x370, 0x37D},
+	{0x37F, 0x1FFF}, {0x200C, 0x200D}, {0x2070, 0x218F}, {0x2C00, 0x2FEF},
+	{0x3001, 0xD7FF}, {0xF900, 0xFDCF}, {0xFDF0, 0xFFFD}, {0x10000, 0xEFFFF}}
+
+func IsXmlNameStartChar(r rune) bool {
+	if r == ':' || r == '_' {
+		return true
+	}
+	for _, v := range cNameStartRanges {
+		if r >= v[0] && r <= v[1] {
+			return true
+		}
+	}
+	return false
+}
+func IsXmlNameChar(r rune) bool {
+	return IsXmlNameStartChar(r) || r == '-' || r == '.' || (r >= '0' && r <= '9') || r == 0xB7 ||
+		(r >= 0x300 && r <= 0x36F) || (r >= 0x203F && r <= 0x2040)
+}
+func IsXmlChar(r rune) bool {
+	//The Char production: tab,line feed,carriage return and the legal unicode ranges
+	return r == 0x09 || r == 0x0A || r == 0x0D || (r >= 0x20 && r <= 0xD7FF) ||
+		(r >= 0xE000 && r <= 0xFFFD) || (r >= 0x10000 && r <= 0x10FFFF)
+}
+func IsXmlName(AValue string) bool {
+	//Is AValue a Name of XML 1.0
+	if AValue == "" {
+		return false
+	}
+	for i, r := range AValue {
+		if r == utf8.RuneError || !IsXmlNameChar(r) || (i == 0 && !IsXmlNameStartChar(r)) {
+			return false
+		}
+	}
+	return true
+}
+func IsXmlNmToken(AValue string) bool {
+	if AValue == "" {
+		return false
+	}
+	for _, r := range AValue {
+		if r == utf8.RuneError || !IsXmlNameChar(r) {
+			return false
+		}
+	}
+	return true
+}
+func IsXmlText(AValue string) bool {
+	//Does AValue only contain legal characters
+	return illegalCharPos(AValue) < 0
+}
+func IsXmlEscapedText(AValue string) bool {
+	//Can AValue be written as an escaped value: legal characters,no "<" and
+	//each "&" starts a reference
+	if !IsXmlText(AValue) || strings.IndexByte(AValue, '<') >= 0 {
+		return false
+	}
+	_, ok := repairAmpersands(AValue)
+	return ok
+}
+func illegalCharPos(AValue string) int {
+	//Byte position of the first illegal character,-1 if there is none.
+	//Invalid utf-8 is not reported here
+	for i := 0; i < len(AValue); {
+		//Eight bytes of printable ascii at once,it is most of the input
+		if i+8 <= len(AValue) {
+			w := uint64(AValue[i]) | uint64(AValue[i+1])<<8 | uint64(AValue[i+2])<<16 | uint64(AValue[i+3])<<24 |
+				uint64(AValue[i+4])<<32 | uint64(AValue[i+5])<<40 | uint64(AValue[i+6])<<48 | uint64(AValue[i+7])<<56
+			if (w|(w-0x2020202020202020))&0x8080808080808080 == 0 {
+				i += 8
+				continue
+			}
+		}
+		//Otherwise these bytes are checked one character at a time
+		for End := i + 8; i < End && i < len(AValue); {
+			Ch := AValue[i]
+			if Ch < utf8.RuneSelf {
+				if Ch < 0x20 && Ch != 0x09 && Ch != 0x0A && Ch != 0x0D {
+					return i
+				}
+				i++
+				continue
+			}
+			r, Size := utf8.DecodeRuneInString(AValue[i:])
+			if r != utf8.RuneError && !IsXmlChar(r) {
+				return i
+			}
+			i += Size
+		}
+	}
+	return -1
+}
+func trimControlChars(AValue string) string {
+	//strings.Trim(AValue,cControlChars) without the cut set
+	Start, Close := 0, len(AValue)
+	for Start < Close && isControlChar(AValue[Start]) {
+		Start++
+	}
+	for Close > Start && isControlChar(AValue[Close-1]) {
+		Close--
+	}
+	return AValue[Start:Close]
+}
+func isControlChar(Ch byte) bool {
+	return Ch == 0x20 || Ch == 0x0A || Ch == 0x0D || Ch == 0x09
+}
+func removeIllegalChars(AValue string) (string, int) {
+	Count := 0
+	return strings.Map(func(r rune) rune {
+		if r != utf8.RuneError && !IsXmlChar(r) {
+			Count++
+			return -1
+		}
+		return r
+	}, AValue), Count
+}
+func invalidUtf8Pos(AValue string) int {
+	//Byte position of the first byte that is not valid UTF-8,-1 if there is none
+	if utf8.ValidString(AValue) {
+		return -1
+	}
+	for i, r := range AValue {
+		if r == utf8.RuneError {
+			if _, Size := utf8.DecodeRuneInString(AValue[i:]); Size == 1 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+func textPosition(Text string, Pos int) (Line, Column int) {
+	//Line and column (1-based,in characters) of byte position Pos in Text
+	if Pos > len(Text) {
+		Pos = len(Text)
+	}
+	Text = Text[:Pos]
+	LineStart := strings.LastIndexByte(Text, '\x0A') + 1
+	return strings.Count(Text, "\x0A") + 1, utf8.RuneCountInString(Text[LineStart:]) + 1
+}
+func (this *TNativeXml) checkXmlChars(S string) string {
+	//The input must be UTF-8 without illegal characters. When recovering invalid bytes
+	//are replaced and illegal characters removed,otherwise the first one panics
+	if p := invalidUtf8Pos(S); p >= 0 {
+		if !this.recovering() {
+			Line, Column := textPosition(S, p)
+			panic(errors.New(fmt.Sprintf(sxeInvalidUtf8, S[p], Line, Column)))
+		}
+		this.warn(p, sxeWarnInvalidUtf8)
+		S = strings.ToValidUTF8(S, "\uFFFD")
+	}
+	p := illegalCharPos(S)
+	if p < 0 {
+		return S
+	}
+	if !this.recovering() {
+		r, _ := utf8.DecodeRuneInString(S[p:])
+		Line, Column := textPosition(S, p)
+		panic(errors.New(fmt.Sprintf(sxeIllegalCharInText, r, Line, Column)))
+	}
+	S, Count := removeIllegalChars(S)
+	this.warn(p, fmt.Sprintf(sxeWarnIllegalChars, Count))
+	return S
+}
+func (this *TXmlNode) checkNames(doc *TNativeXml, IsName func(string) bool) {
+	//Element and attribute names read must be xml names
+	if !IsName(this.Name) {
+		if !doc.recovering() {
+			panic(errors.New(fmt.Sprintf(sxeIllegalCharInNodeName, this.Name)))
+		}
+		doc.warn(this.sourcePos-1, fmt.Sprintf(sxeIllegalCharInNodeName, this.Name))
+	}
+	for k := range this.Attributes {
+		if !IsName(k) {
+			if !doc.recovering() {
+				panic(errors.New(fmt.Sprintf(sxeIllegalCharInAttrName, k, this.Name)))
+			}
+			doc.warn(this.sourcePos-1, fmt.Sprintf(sxeIllegalCharInAttrName, k, this.Name))
+			delete(this.Attributes, k)
+		}
+	}
+}
+func isEditableNode(Node *TXmlNode) bool {
+	//Can the node be added to a document without writing invalid xml
+	if Node == nil {
+		return false
+	}
+	if Node.ElementType != xeNormal {
+		return true
+	}
+	if !IsXmlName(Node.Name) || !IsXmlEscapedText(Node.Value) {
+		return false
+	}
+	for k, v := range Node.Attributes {
+		if !isEditableAttribute(k, v) {
+			return false
+		}
+	}
+	for _, v := range Node.Nodes {
+		if !isEditableNode(v) {
+			return false
+		}
+	}
+	return true
+}
+func isEditableAttribute(AName, AValue string) bool {
+	return IsXmlName(AName) && IsXmlEscapedText(AValue) && strings.IndexByte(AValue, '"') < 0
+}
+func isEditablePathName(AName string) (Name string, Indexed bool, ok bool) {
+	//A path part is a name with an optional "[n]" index
+	Name = AName
+	if p := strings.IndexByte(AName, '['); p > 0 && strings.HasSuffix(AName, "]") {
+		Name, Indexed = AName[:p], true
+	}
+	return Name, Indexed, IsXmlName(Name)
+}
@@ -0,0 +1,157 @@
+package native_xml
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A document for ParseAll,read from Reader or,when Reader is nil,from the file Name
+type TXmlParseSource struct {
+	Name   string
+	Reader io.Reader
+}
+
+// Settings of ParseAllWith
+type TXmlParseAllOptions struct {
+	Workers     int                //Documents parsed at the same time,0 is GOMAXPROCS
+	PoolBuffers bool               //Reuse the input buffers between documents
+	NewDocument func() *TNativeXml //Creates the document for a source,NewNativeXml when nil
+}
+
+// Outcome of one source,Doc is nil when Err is set
+type TXmlParseResult struct {
+	Name     string
+	Doc      *TNativeXml
+	Err      error
+	Bytes    int
+	Duration time.Duration
+}
+
+// Totals of a ParseAll call
+type TXmlParseStats struct {
+	Documents int
+	Failed    int
+	Bytes     int64
+	Elapsed   time.Duration
+}
+
+var parseBufferPool = sync.Pool{New: func() interface{} {
+	return new(bytes.Buffer)
+}}
+
+func NewXmlFileSource(FileName string) TXmlParseSource {
+	return TXmlParseSource{Name: FileName}
+}
+func NewXmlReaderSource(Name string, R io.Reader) TXmlParseSource {
+	return TXmlParseSource{Name: Name, Reader: R}
+}
+func (this TXmlParseStats) DocumentsPerSecond() float64 {
+	if this.Elapsed <= 0 {
+		return 0
+	}
+	return float64(this.Documents) / this.Elapsed.Seconds()
+}
+func (this TXmlParseStats) BytesPerSecond() float64 {
+	if this.Elapsed <= 0 {
+		return 0
+	}
+	return float64(this.Bytes) / this.Elapsed.Seconds()
+}
+
+func ParseAll(ctx context.Context, Sources []TXmlParseSource, Workers int) ([]TXmlParseResult, TXmlParseStats) {
+	return ParseAllWith(ctx, Sources, TXmlParseAllOptions{Workers: Workers, PoolBuffers: true})
+}
+func ParseAllWith(ctx context.Context, Sources []TXmlParseSource, Options TXmlParseAllOptions) ([]TXmlParseResult, TXmlParseStats) {
+	//Parse the sources concurrently,the results are in the order of the sources.
+	//Sources not started when ctx is done get the error of ctx
+	Workers := Options.Workers
+	if Workers <= 0 {
+		Workers = runtime.GOMAXPROCS(0)
+	}
+	if Workers > len(Sources) {
+		Workers = len(Sources)
+	}
+	Results := make([]TXmlParseResult, len(Sources))
+	Start := time.Now()
+	var Next int64 = -1
+	var wg sync.WaitGroup
+	for w := 0; w < Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&Next, 1))
+				if i >= len(Sources) {
+					return
+				}
+				Results[i].Name = Sources[i].Name
+				if err := ctx.Err(); err != nil {
+					Results[i].Err = err
+					continue
+				}
+				Results[i] = parseSource(Sources[i], &Options)
+			}
+		}()
+	}
+	wg.Wait()
+	Stats := TXmlParseStats{Elapsed: time.Since(Start)}
+	for _, v := range Results {
+		if v.Err != nil {
+			Stats.Failed++
+		} else {
+			Stats.Documents++
+		}
+		Stats.Bytes += int64(v.Bytes)
+	}
+	return Results, Stats
+}
+func parseSource(Source TXmlParseSource, Options *TXmlParseAllOptions) (Result TXmlParseResult) {
+	Start := time.Now()
+	Result.Name = Source.Name
+	defer func() {
+		Result.Duration = time.Since(Start)
+	}()
+	Doc := NewNativeXml()
+	if Options.NewDocument != nil {
+		Doc = Options.NewDocument()
+	}
+	R := Source.Reader
+	if R == nil {
+		f, err := os.Open(Source.Name)
+		if err != nil {
+			Result.Err = err
+			return Result
+		}
+		defer f.Close()
+		R = f
+	}
+	if Max := Doc.ParseOptions.MaxInputBytes; Max > 0 {
+		R = io.LimitReader(R, int64(Max)+1)
+	}
+	var buf *bytes.Buffer
+	if Options.PoolBuffers {
+		//The document keeps a copy of the text,so the buffer can be reused
+		buf = parseBufferPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer parseBufferPool.Put(buf)
+	} else {
+		buf = new(bytes.Buffer)
+	}
+	if _, err := buf.ReadFrom(R); err != nil {
+		Result.Err = err
+		return Result
+	}
+	Result.Bytes = buf.Len()
+	if err := Doc.ParseStream(buf); err != nil {
+		Result.Err = err
+		return Result
+	}
+	Result.Doc = Doc
+	return Result
+}
@@ -0,0 +1,512 @@
+package native_xml
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	sxePatchReadOnly         = "A read-only document cannot be patched"
+	sxePatchInvalidDirective = "Invalid patch directive <%s>"
+	sxePatchInvalidSelector  = "Invalid patch selector \"%s\""
+	sxePatchUnlocatedNode    = "Patch selector \"%s\" does not locate a node"
+	sxePatchAmbiguous        = "Patch selector \"%s\" locates %d nodes"
+	sxePatchInvalidAttribute = "Invalid %s=\"%s\" in patch directive <%s sel=\"%s\">"
+	sxePatchInvalidContent   = "Invalid content of patch directive <%s sel=\"%s\">"
+	sxePatchAttributeExists  = "Patch directive <%s sel=\"%s\"> adds attribute \"%s\" that exists"
+	sxePatchRootElement      = "Patch directive <%s sel=\"%s\"> cannot remove the root element"
+)
+
+// Node,attribute or text located by the selector of a patch operation
+type tPatchTarget struct {
+	Node *TXmlNode
+	Attr string //Attribute name of a selector ending with "/@name"
+	Text bool   //The selector ends with "/text()"
+}
+
+// State of GeneratePatch. The operations are made on a copy of the old tree as
+// well,so each selector is the path at the time the operation is applied
+type tXmlPatchWriter struct {
+	Diff   *tXmlDiff
+	Patch  *TXmlNode
+	Copies map[*TXmlNode]*TXmlNode //Old node to its node in the copy
+}
+
+func (this *TNativeXml) ApplyPatch(Patch *TNativeXml) error {
+	//Apply the <add>,<replace> and <remove> operations of an RFC 5261 patch document in
+	//order. The patch is tried on a copy first,so a failing operation leaves the document
+	//unchanged. The changes of the patch are undone together
+	if this.readOnly {
+		return errors.New(sxePatchReadOnly)
+	}
+	if Patch == nil || Patch.XmlRoot == nil {
+		return errors.New(sxeNoRootElement)
+	}
+	if err := this.fork().applyPatch(Patch); err != nil {
+		return err
+	}
+	defer this.groupChanges()()
+	return this.applyPatch(Patch)
+}
+func (this *TNativeXml) ApplyPatchString(Patch string) error {
+	PatchDoc := NewNativeXml()
+	if err := PatchDoc.ParseString(Patch); err != nil {
+		return err
+	}
+	return this.ApplyPatch(PatchDoc)
+}
+func GeneratePatch(a, b *TNativeXml, Options TXmlDiffOptions) *TNativeXml {
+	//An RFC 5261 patch document <diff> that turns a into b. The selectors are node paths,
+	//moved nodes are removed and added again. What the options ignore is not patched,a
+	//changed attribute order and a missing root element cannot be expressed
+	Patch := NewNativeXml()
+	Patch.AddNodeForPath("/diff")
+	W := &tXmlPatchWriter{Diff: newXmlDiff(a, b, Options), Patch: Patch.XmlRoot, Copies: make(map[*TXmlNode]*TXmlNode)}
+	OldRoot, NewRoot := diffRoot(a), diffRoot(b)
+	switch {
+	case OldRoot == nil || NewRoot == nil:
+	case OldRoot.Name != NewRoot.Name:
+		Op := W.operation("replace", OldRoot.NodePath())
+		Op.addWithKey(NewRoot.copyTree(nil, 0), 0)
+	default:
+		Root := OldRoot.copyTree(nil, 0)
+		W.mapCopies(OldRoot, Root)
+		W.changes()
+		W.place(NewRoot, Root)
+	}
+	return Patch
+}
+
+func (this *TNativeXml) applyPatch(Patch *TNativeXml) (err error) {
+	defer recoverError(&err)
+	for _, v := range Patch.XmlRoot.NodeList() {
+		if v.ElementType == xeNormal {
+			this.applyOperation(v)
+		}
+	}
+	return nil
+}
+func (this *TNativeXml) applyOperation(Op *TXmlNode) {
+	Sel, ok := Op.Attributes["sel"]
+	Directive := Op.LocalName()
+	if !ok || (Directive != "add" && Directive != "replace" && Directive != "remove") {
+		panic(errors.New(fmt.Sprintf(sxePatchInvalidDirective, Op.Name)))
+	}
+	Sel = UnescapeString(Sel)
+	Target := this.selectPatchTarget(Sel)
+	Path := Target.Node.NodePath()
+	Content := Op.NodeList()
+	Invalid := errors.New(fmt.Sprintf(sxePatchInvalidContent, Op.Name, Sel))
+	switch {
+	case Directive == "add":
+		this.patchAdd(Op, Sel, Target)
+	case Directive == "replace" && Target.Attr != "":
+		if len(Content) > 0 || !Target.Node.HasAttribute(Target.Attr) ||
+			!this.SetAttribute(Path, Target.Attr, attributeText(Op.Value)) {
+			panic(Invalid)
+		}
+	case Directive == "replace" && Target.Text:
+		if len(Content) > 0 || !this.SetNodeValueForPath(Path, Op.Value) {
+			panic(Invalid)
+		}
+	case Directive == "replace":
+		//A node is replaced by one node of the same type
+		if len(Content) != 1 || Op.Value != "" || Content[0].ElementType != Target.Node.ElementType {
+			panic(Invalid)
+		}
+		Node := Content[0].copyTree(nil, this.generation)
+		if Target.Node.Parent == nil {
+			this.replaceRoot(Node)
+		} else if !this.ReplaceNode(Path, Node) {
+			panic(Invalid)
+		}
+	case Target.Attr != "":
+		if !this.RemoveAttribute(Path, Target.Attr) {
+			panic(errors.New(fmt.Sprintf(sxePatchUnlocatedNode, Sel)))
+		}
+	case Target.Text:
+		this.SetNodeValueForPath(Path, "")
+	default:
+		if Target.Node.Parent == nil {
+			panic(errors.New(fmt.Sprintf(sxePatchRootElement, Op.Name, Sel)))
+		}
+		this.RemoveNode(Path)
+	}
+}
+func (this *TNativeXml) patchAdd(Op *TXmlNode, Sel string, Target tPatchTarget) {
+	Content := Op.NodeList()
+	Path := Target.Node.NodePath()
+	Pos := Op.Attributes["pos"]
+	Sibling := Pos == "before" || Pos == "after"
+	if Target.Attr != "" || Target.Text || (Target.Node.ElementType != xeNormal && !Sibling) {
+		panic(errors.New(fmt.Sprintf(sxePatchInvalidContent, Op.Name, Sel)))
+	}
+	if Type, ok := Op.Attributes["type"]; ok {
+		//Only attributes,namespace declarations are written as attributes
+		Name := strings.TrimPrefix(Type, "@")
+		if Name == Type || !IsXmlName(Name) || len(Content) > 0 {
+			panic(errors.New(fmt.Sprintf(sxePatchInvalidAttribute, "type", Type, Op.Name, Sel)))
+		}
+		if Target.Node.HasAttribute(Name) {
+			panic(errors.New(fmt.Sprintf(sxePatchAttributeExists, Op.Name, Sel, Name)))
+		}
+		if !this.SetAttribute(Path, Name, attributeText(Op.Value)) {
+			panic(errors.New(fmt.Sprintf(sxePatchInvalidContent, Op.Name, Sel)))
+		}
+		return
+	}
+	Parent, Index := Target.Node, 0
+	switch Pos {
+	case "":
+		Index = len(Target.Node.Nodes)
+		if Op.Value != "" {
+			this.SetNodeValueForPath(Path, Target.Node.Value+Op.Value)
+		}
+	case "prepend":
+		if Op.Value != "" {
+			this.SetNodeValueForPath(Path, Op.Value+Target.Node.Value)
+		}
+	case "before", "after":
+		//Text between elements is not kept,only nodes can be siblings
+		if Parent = Target.Node.Parent; Parent == nil || Op.Value != "" {
+			panic(errors.New(fmt.Sprintf(sxePatchInvalidContent, Op.Name, Sel)))
+		}
+		for i, v := range Parent.NodeList() {
+			if v == Target.Node {
+				Index = i
+			}
+		}
+		if Pos == "after" {
+			Index++
+		}
+	default:
+		panic(errors.New(fmt.Sprintf(sxePatchInvalidAttribute, "pos", Pos, Op.Name, Sel)))
+	}
+	Parent = this.findNodeForEdit(Parent.NodePath())
+	for i, v := range Content {
+		this.insertChild(Parent, v.copyTree(nil, this.generation), Index+i)
+	}
+}
+func (this *TNativeXml) replaceRoot(Node *TXmlNode) {
+	Old := this.XmlRoot
+	if this.watched() {
+		this.changed(TXmlChange{Kind: ChangeNodeRemoved, Path: Old.NodePath(), OldValue: this.nodeXml(Old), Node: Old})
+	}
+	Node.Parent, Node.document = nil, this
+	this.RootNodes[xeNormal] = Node
+	this.XmlRoot = Node
+	this.nodeAdded(Node)
+}
+func (this *TNativeXml) insertChild(Parent, Node *TXmlNode, Index int) {
+	//Insert Node as the child at Index of Parent,which must be changeable. Without a free
+	//key in front of the next child the following children get the next higher keys
+	List := Parent.NodeList()
+	Key := 1
+	if Index > 0 {
+		Key = List[Index-1].NodeID + 1
+	}
+	if Index < len(List) && List[Index].NodeID <= Key {
+		for i := len(List) - 1; i >= Index; i-- {
+			v := this.editChild(Parent, List[i])
+			delete(Parent.Nodes, v.NodeID)
+			v.NodeID++
+			Parent.Nodes[v.NodeID] = v
+			if v.NodeID > Parent.MaxNodeID {
+				Parent.MaxNodeID = v.NodeID
+			}
+			//The position is the same,undo gives the node its old key back
+			this.record(TXmlChange{Kind: ChangeNodeMoved, Path: v.NodePath(), OldPath: v.NodePath(),
+				Node: v, Parent: Parent, NodeID: v.NodeID - 1})
+		}
+	}
+	Parent.addWithKey(Node, Key)
+	this.nodeAdded(Node)
+}
+func attributeText(AValue string) string {
+	//Escaped text as attribute value,the quotes of attribute values are escaped as well
+	return strings.Replace(AValue, "\"", "&quot;", -1)
+}
+
+func (this *TNativeXml) selectPatchTarget(Sel string) tPatchTarget {
+	//The restricted XPath of RFC 5261: element steps with "[n]","[@attr='v']","[child='v']"
+	//and "[.='v']" predicates,ending with an "@attr","text()","comment()" or
+	//"processing-instruction()" step. Names are compared with their prefix
+	Steps, ok := splitSelector(strings.TrimSpace(Sel))
+	if !ok {
+		panic(errors.New(fmt.Sprintf(sxePatchInvalidSelector, Sel)))
+	}
+	var Node *TXmlNode
+	for i, Step := range Steps {
+		if i == len(Steps)-1 && Node != nil {
+			switch {
+			case strings.HasPrefix(Step, "@"):
+				if !IsXmlName(Step[1:]) {
+					panic(errors.New(fmt.Sprintf(sxePatchInvalidSelector, Sel)))
+				}
+				return tPatchTarget{Node: Node, Attr: Step[1:]}
+			case Step == "text()" || Step == "text()[1]":
+				return tPatchTarget{Node: Node, Text: true}
+			}
+		}
+		var List []*TXmlNode
+		if Node != nil {
+			List = Node.NodeList()
+		} else if this.XmlRoot != nil {
+			List = []*TXmlNode{this.XmlRoot}
+		}
+		List, ok = selectStep(List, Step)
+		if !ok {
+			panic(errors.New(fmt.Sprintf(sxePatchInvalidSelector, Sel)))
+		}
+		if len(List) == 0 {
+			panic(errors.New(fmt.Sprintf(sxePatchUnlocatedNode, Sel)))
+		}
+		if len(List) > 1 {
+			panic(errors.New(fmt.Sprintf(sxePatchAmbiguous, Sel, len(List))))
+		}
+		Node = List[0]
+	}
+	if Node == nil {
+		panic(errors.New(fmt.Sprintf(sxePatchUnlocatedNode, Sel)))
+	}
+	return tPatchTarget{Node: Node}
+}
+func splitSelector(Sel string) ([]string, bool) {
+	//The steps of the path,a "/" in a predicate does not split
+	Sel = strings.TrimPrefix(Sel, "/")
+	Steps := make([]string, 0, 8)
+	Depth, Quote, Start := 0, byte(0), 0
+	for i := 0; i < len(Sel); i++ {
+		switch c := Sel[i]; {
+		case Quote != 0:
+			if c == Quote {
+				Quote = 0
+			}
+		case c == '\'' || c == '"':
+			Quote = c
+		case c == '[':
+			Depth++
+		case c == ']':
+			Depth--
+		case c == '/' && Depth == 0:
+			Steps = append(Steps, Sel[Start:i])
+			Start = i + 1
+		}
+	}
+	Steps = append(Steps, Sel[Start:])
+	for _, v := range Steps {
+		if v == "" {
+			return nil, false
+		}
+	}
+	return Steps, Depth == 0 && Quote == 0
+}
+func selectStep(List []*TXmlNode, Step string) ([]*TXmlNode, bool) {
+	Name, Predicates := Step, ""
+	if p := strings.IndexByte(Step, '['); p >= 0 {
+		Name, Predicates = Step[:p], Step[p:]
+	}
+	Target := ""
+	if strings.HasPrefix(Name, "processing-instruction(") && strings.HasSuffix(Name, ")") {
+		Target = strings.Trim(Name[len("processing-instruction("):len(Name)-1], "'\"")
+		Name = "processing-instruction()"
+	}
+	if Name != "*" && nodeTest(xeComment) != Name && nodeTest(xeQuestion) != Name && !IsXmlName(Name) {
+		return nil, false
+	}
+	Result := make([]*TXmlNode, 0, len(List))
+	for _, v := range List {
+		switch {
+		case Name == "*" && v.ElementType != xeNormal:
+		case Name != "*" && !v.hasPathName(Name):
+		case Target != "" && strings.SplitN(strings.TrimSpace(v.Value), " ", 2)[0] != Target:
+		default:
+			Result = append(Result, v)
+		}
+	}
+	for Predicates != "" {
+		End := predicateEnd(Predicates)
+		if Predicates[0] != '[' || End < 0 {
+			return nil, false
+		}
+		var ok bool
+		if Result, ok = selectPredicate(Result, strings.TrimSpace(Predicates[1:End])); !ok {
+			return nil, false
+		}
+		Predicates = Predicates[End+1:]
+	}
+	return Result, true
+}
+func predicateEnd(Predicates string) int {
+	Quote := byte(0)
+	for i := 1; i < len(Predicates); i++ {
+		switch c := Predicates[i]; {
+		case Quote != 0:
+			if c == Quote {
+				Quote = 0
+			}
+		case c == '\'' || c == '"':
+			Quote = c
+		case c == ']':
+			return i
+		}
+	}
+	return -1
+}
+func selectPredicate(List []*TXmlNode, Predicate string) ([]*TXmlNode, bool) {
+	if n, err := strconv.Atoi(Predicate); err == nil {
+		if n < 1 || n > len(List) {
+			return nil, true
+		}
+		return List[n-1 : n], true
+	}
+	Left, Right, HasValue := Predicate, "", false
+	if p := strings.IndexByte(Predicate, '='); p > 0 {
+		Left, Right, HasValue = strings.TrimSpace(Predicate[:p]), strings.TrimSpace(Predicate[p+1:]), true
+		if len(Right) < 2 || (Right[0] != '\'' && Right[0] != '"') || Right[len(Right)-1] != Right[0] {
+			return nil, false
+		}
+		Right = Right[1 : len(Right)-1]
+	}
+	if Left != "." && !IsXmlName(strings.TrimPrefix(Left, "@")) {
+		return nil, false
+	}
+	Result := make([]*TXmlNode, 0, len(List))
+	for _, v := range List {
+		AValue, Found := "", false
+		switch {
+		case strings.HasPrefix(Left, "@"):
+			AValue, Found = v.Attributes[Left[1:]]
+		case Left == ".":
+			AValue, Found = v.Value, true
+		default:
+			for _, Child := range v.NodeList() {
+				if Child.ElementType == xeNormal && Child.Name == Left {
+					AValue, Found = Child.Value, true
+					break
+				}
+			}
+		}
+		if Found && (!HasValue || UnescapeString(AValue) == Right) {
+			Result = append(Result, v)
+		}
+	}
+	return Result, true
+}
+
+func (this *tXmlPatchWriter) operation(Directive, Sel string) *TXmlNode {
+	Op := NewXmlNode(Directive)
+	Op.Attributes["sel"] = Sel
+	this.Patch.addWithKey(Op, 0)
+	return Op
+}
+func (this *tXmlPatchWriter) mapCopies(Old, Copy *TXmlNode) {
+	this.Copies[Old] = Copy
+	for k, v := range Old.Nodes {
+		this.mapCopies(v, Copy.Nodes[k])
+	}
+}
+func (this *tXmlPatchWriter) changes() {
+	//Values,attributes and deleted nodes in the order of the differences
+	for _, v := range this.Diff.Result {
+		if v.Kind == DiffMoved || (v.Kind == DiffInserted && v.Name == "") {
+			continue
+		}
+		Node := this.Copies[v.OldNode]
+		Path := Node.NodePath()
+		switch {
+		case v.Name != "" && v.Kind == DiffInserted:
+			Op := this.operation("add", Path)
+			Op.Attributes["type"] = "@" + v.Name
+			Op.Value = v.NewValue
+			Node.Attributes[v.Name] = v.NewValue
+		case v.Name != "" && v.Kind == DiffDeleted:
+			this.operation("remove", Path+"/@"+v.Name)
+			delete(Node.Attributes, v.Name)
+		case v.Name != "":
+			Op := this.operation("replace", Path+"/@"+v.Name)
+			Op.Value = v.NewValue
+			Node.Attributes[v.Name] = v.NewValue
+		case v.Kind == DiffDeleted:
+			this.operation("remove", Path)
+			delete(Node.Parent.Nodes, Node.NodeID)
+		case v.Kind == DiffValueChanged && Node.ElementType == xeNormal:
+			switch {
+			case v.NewValue == "":
+				this.operation("remove", Path+"/text()")
+			case Node.Value == "":
+				this.operation("add", Path).Value = v.NewValue
+			default:
+				this.operation("replace", Path+"/text()").Value = v.NewValue
+			}
+			Node.Value = v.NewValue
+		case v.Kind == DiffValueChanged:
+			this.operation("replace", Path).addWithKey(v.NewNode.copyTree(nil, 0), 0)
+			Node.Value = v.NewValue
+		}
+	}
+}
+func (this *tXmlPatchWriter) place(New, Copy *TXmlNode) {
+	//Add the inserted and moved children of New to Copy,behind the child before them
+	var Prev *TXmlNode
+	for _, v := range this.Diff.nodes(New) {
+		Old, Matched := this.Diff.Pairs[v]
+		if Matched && !this.Diff.Moved[v] {
+			Prev = this.Copies[Old]
+			this.place(v, Prev)
+			continue
+		}
+		Node := v.copyTree(nil, 0)
+		if Matched {
+			Node = this.Copies[Old]
+			this.operation("remove", Node.NodePath())
+			delete(Node.Parent.Nodes, Node.NodeID)
+		}
+		Index := 0
+		if Prev != nil {
+			Index = Copy.childIndex(Prev) + 1
+		}
+		var Op *TXmlNode
+		switch {
+		case Index == len(Copy.Nodes):
+			Op = this.operation("add", Copy.NodePath())
+		case Prev == nil:
+			Op = this.operation("add", Copy.NodePath())
+			Op.Attributes["pos"] = "prepend"
+		default:
+			Op = this.operation("add", Prev.NodePath())
+			Op.Attributes["pos"] = "after"
+		}
+		Op.addWithKey(Node.copyTree(nil, 0), 0)
+		Copy.insertAt(Node, Index)
+		Prev = Node
+		if Matched && !this.Diff.Equal[v] {
+			this.place(v, Node)
+		}
+	}
+}
+func (this *TXmlNode) childIndex(Node *TXmlNode) int {
+	for i, v := range this.NodeList() {
+		if v == Node {
+			return i
+		}
+	}
+	return -1
+}
+func (this *TXmlNode) insertAt(Node *TXmlNode, Index int) {
+	//Insert Node as the child at Index,all children get new keys
+	List := this.NodeList()
+	this.Nodes = make(map[int]*TXmlNode, len(List)+1)
+	this.MaxNodeID = 0
+	for i, v := range List {
+		if i == Index {
+			this.addWithKey(Node, 0)
+		}
+		this.addWithKey(v, 0)
+	}
+	if Index >= len(List) {
+		this.addWithKey(Node, 0)
+	}
+}
@@ -0,0 +1,186 @@
+package native_xml
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	sxeWarnAutoClosed     = "Element \"%s\" is not closed,closed by \"</%s>\""
+	sxeWarnUnclosedAtEnd  = "Element \"%s\" is not closed at the end of the document"
+	sxeWarnCloseTagCase   = "Close tag \"</%s>\" does not match the case of element \"%s\""
+	sxeWarnStrayCloseTag  = "Close tag \"</%s>\" without open element,ignored"
+	sxeWarnStrayAmpersand = "Stray \"&\" in %s,escaped"
+	sxeWarnUnquotedAttr   = "Value of attribute \"%s\" is not quoted"
+	sxeWarnAttrWithoutVal = "Attribute \"%s\" has no value"
+	sxeWarnExtraRoot      = "More than one root element,\"%s\" ignored"
+	sxeWarnIncompleteTag  = "Incomplete tag at the end of element \"%s\""
+)
+
+// A problem the parser repaired while reading in recovery mode
+type TXmlParseWarning struct {
+	Pos     int //Byte offset in the input
+	Line    int
+	Column  int
+	Message string
+}
+
+func (this TXmlParseWarning) Error() string {
+	return fmt.Sprintf("(%d:%d): %s", this.Line, this.Column, this.Message)
+}
+func (this *TNativeXml) recovering() bool {
+	return this != nil && this.RecoverErrors
+}
+func (this *TNativeXml) warn(Pos int, Message string) {
+	var Line, Column int
+	if this.parse != nil {
+		Line, Column = this.parse.Cursor.move(this.XmlString, Pos)
+	} else {
+		Line, Column = textPosition(this.XmlString, Pos)
+	}
+	this.Warnings = append(this.Warnings, TXmlParseWarning{Pos: Pos, Line: Line, Column: Column, Message: Message})
+}
+func (this *tTextCursor) move(Text string, Pos int) (Line, Column int) {
+	//textPosition that continues from the last position,so many warnings
+	//in one long line do not count the line again and again
+	if this.Line == 0 || Pos < this.Pos || Pos > len(Text) {
+		this.Pos = min(Pos, len(Text))
+		this.Line, this.Column = textPosition(Text, Pos)
+		return this.Line, this.Column
+	}
+	Skipped := Text[this.Pos:Pos]
+	if p := strings.LastIndexByte(Skipped, '\x0A'); p >= 0 {
+		this.Line += strings.Count(Skipped, "\x0A")
+		this.Column = utf8.RuneCountInString(Skipped[p+1:]) + 1
+	} else {
+		this.Column += utf8.RuneCountInString(Skipped)
+	}
+	this.Pos = Pos
+	return this.Line, this.Column
+}
+func (this *TXmlNode) recoverCloseTag(CloseName string, TagPos int) (Closes, Rewind bool) {
+	//Handle a close tag that does not match this element. Closes when this element ends here,
+	//Rewind when the close tag is left for an ancestor
+	doc := this.Document()
+	if strings.EqualFold(CloseName, this.Name) {
+		doc.warn(TagPos, fmt.Sprintf(sxeWarnCloseTagCase, CloseName, this.Name))
+		return true, false
+	}
+	for p := this.Parent; p != nil; p = p.Parent {
+		if p.Name == CloseName || strings.EqualFold(p.Name, CloseName) {
+			//The close tag belongs to an ancestor
+			doc.warn(TagPos, fmt.Sprintf(sxeWarnAutoClosed, this.Name, CloseName))
+			return true, true
+		}
+	}
+	doc.warn(TagPos, fmt.Sprintf(sxeWarnStrayCloseTag, CloseName))
+	return false, false
+}
+func (this *TXmlNode) recoverTag(Tag string) {
+	//Warn about unquoted attributes,keep attributes without value,escape stray "&"
+	doc := this.Document()
+	Pos := this.sourcePos - 1
+	for _, v := range splitTagFields(Tag) {
+		if strings.ContainsAny(v[:1], cQuoteChars) || v == "/" || v == this.Name {
+			continue
+		}
+		p := strings.IndexByte(v, '=')
+		if p < 0 {
+			if _, ok := this.Attributes[v]; !ok && isRecoverableName(v) {
+				doc.warn(Pos, fmt.Sprintf(sxeWarnAttrWithoutVal, v))
+				this.Attributes[v] = v
+			}
+			continue
+		}
+		Name, Value := v[:p], v[p+1:]
+		if !isRecoverableName(Name) {
+			continue
+		}
+		if Value == "" || !strings.ContainsAny(Value[:1], cQuoteChars) {
+			doc.warn(Pos, fmt.Sprintf(sxeWarnUnquotedAttr, Name))
+		}
+		//parseAttributes already read quoted values,also with blanks around "=",only an
+		//attribute it did not read is added here
+		if _, ok := this.Attributes[Name]; !ok {
+			this.Attributes[Name] = strings.Trim(Value, cQuoteChars)
+		}
+	}
+	for k, v := range this.Attributes {
+		if Repaired, ok := repairAmpersands(v); !ok {
+			doc.warn(Pos, fmt.Sprintf(sxeWarnStrayAmpersand, "attribute \""+k+"\""))
+			this.Attributes[k] = Repaired
+		}
+	}
+}
+func splitTagFields(Tag string) []string {
+	//The blank separated parts of a tag,blanks inside quotes do not separate
+	Fields := make([]string, 0)
+	var QuoteChar byte
+	Start := -1
+	for i := 0; i <= len(Tag); i++ {
+		Blank := i == len(Tag) || (QuoteChar == 0 && strings.IndexByte(cControlChars, Tag[i]) >= 0)
+		switch {
+		case Blank:
+			if Start >= 0 {
+				//"name = value" is one field
+				Field := Tag[Start:i]
+				if n := len(Fields); n > 0 && (strings.HasPrefix(Field, "=") || strings.HasSuffix(Fields[n-1], "=")) {
+					Fields[n-1] += Field
+				} else {
+					Fields = append(Fields, Field)
+				}
+				Start = -1
+			}
+			continue
+		case QuoteChar != 0:
+			if Tag[i] == QuoteChar {
+				QuoteChar = 0
+			}
+		case strings.IndexByte(cQuoteChars, Tag[i]) >= 0:
+			QuoteChar = Tag[i]
+		}
+		if Start < 0 {
+			Start = i
+		}
+	}
+	return Fields
+}
+func isRecoverableName(AValue string) bool {
+	return AValue != "" && !strings.ContainsAny(AValue, "<>&=/")
+}
+func repairAmpersands(AValue string) (string, bool) {
+	//Escape each "&" that does not start an entity or character reference
+	if strings.IndexByte(AValue, '&') < 0 {
+		return AValue, true
+	}
+	buf := new(strings.Builder)
+	ok := true
+	Semicolon := -1
+	for i := 0; i < len(AValue); i++ {
+		buf.WriteByte(AValue[i])
+		if AValue[i] != '&' {
+			continue
+		}
+		//The next ";" is searched once for all "&" in front of it
+		if Semicolon < i {
+			if Semicolon = strings.IndexByte(AValue[i:], ';'); Semicolon >= 0 {
+				Semicolon += i
+			} else {
+				Semicolon = len(AValue)
+			}
+		}
+		Close := Semicolon - i
+		if Semicolon == len(AValue) || Close <= 1 || !isReferenceName(AValue[i+1:Semicolon]) {
+			buf.WriteString("amp;")
+			ok = false
+		}
+	}
+	return buf.String(), ok
+}
+func isReferenceName(AName string) bool {
+	if _, ok := ResolveCharReference(AName); ok {
+		return true
+	}
+	return isRecoverableName(AName) && !strings.ContainsAny(AName, cControlChars+cQuoteChars+"&;#")
+}
@@ -0,0 +1,476 @@
+package native_xml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const cScanNodeBlock = 64
+
+// Index based parser over the complete input,names and values are sub strings of Text
+type tXmlScanner struct {
+	Text    string
+	Pos     int
+	doc     *TNativeXml
+	parse   *tXmlParseState
+	maxText int
+	names   map[string]string //Interned element and attribute names,all valid
+	badName bool              //A name of the current tag is not a valid xml name
+	stack   []tXmlScanFrame   //Open elements,the innermost last
+	nodes   []TXmlNode        //Unused nodes of the current block
+	texts   []string          //Text segments of the open elements,in the order of the stack
+	slab    []string          //Unused text segments of the current block
+}
+
+// Element whose content the scanner reads
+type tXmlScanFrame struct {
+	Node     *TXmlNode
+	Source   *tXmlSource //Original text of the element when the document preserves its source
+	StartPos int         //Position of the "<" of the start tag
+	SegPos   int         //Start of the text in front of the next child or the close tag
+	Texts    int         //Start of the text segments of the element in texts
+}
+
+func newXmlScanner(Doc *TNativeXml, Text string, Pos int) *tXmlScanner {
+	Scanner := &tXmlScanner{Text: Text, Pos: Pos, doc: Doc, names: make(map[string]string)}
+	if Doc != nil && Doc.parse != nil {
+		Scanner.parse = Doc.parse
+		Scanner.maxText = Doc.ParseOptions.MaxTextSize
+	} else {
+		//Nodes read on their own only get the depth cap
+		Scanner.parse = &tXmlParseState{Options: &TXmlParseOptions{}}
+	}
+	return Scanner
+}
+func (this *tXmlScanner) intern(Name string) string {
+	//Repeated names share one string,so the tree does not keep the whole input alive by its names.
+	//Only valid names are kept,so each name is checked once
+	if v, ok := this.names[Name]; ok {
+		return v
+	}
+	if !IsXmlName(Name) {
+		this.badName = true
+		return Name
+	}
+	v := strings.Clone(Name)
+	this.names[v] = v
+	return v
+}
+func (this *tXmlScanner) checkText(Length int) {
+	if this.maxText > 0 && Length > this.maxText {
+		limitExceeded(LimitTextSize, this.maxText, this.Pos)
+	}
+}
+func (this *tXmlScanner) tagIndex() int {
+	//The tag type with the longest start that matches at Pos
+	idx, Length := cTagCount-1, 0
+	Rest := this.Text[this.Pos:]
+	if len(Rest) < 2 || (Rest[1] != '!' && Rest[1] != '?') {
+		return idx
+	}
+	for i, v := range cTags {
+		if len(v.FStart) > Length && strings.HasPrefix(Rest, v.FStart) {
+			idx, Length = i, len(v.FStart)
+		}
+	}
+	return idx
+}
+func (this *tXmlScanner) readUntil(ASearch string, SkipQuotes bool) (string, bool) {
+	//The text from Pos up to ASearch,Pos is moved past it. Without ASearch the rest is returned
+	Start := this.Pos
+	if !SkipQuotes {
+		p := strings.Index(this.Text[Start:], ASearch)
+		if p < 0 {
+			this.checkText(len(this.Text) - Start)
+			this.Pos = len(this.Text)
+			return this.Text[Start:], false
+		}
+		this.checkText(p)
+		this.Pos = Start + p + len(ASearch)
+		return this.Text[Start : Start+p], true
+	}
+	First := ASearch[0]
+	for i := Start; i < len(this.Text); {
+		//The next candidate,unless a quoted value starts in front of it
+		p := strings.IndexByte(this.Text[i:], First)
+		if p < 0 {
+			break
+		}
+		if q := strings.IndexAny(this.Text[i:i+p], cQuoteChars); q >= 0 {
+			Close := strings.IndexByte(this.Text[i+q+1:], this.Text[i+q])
+			if Close < 0 {
+				break
+			}
+			i += q + Close + 2
+			continue
+		}
+		i += p
+		if strings.HasPrefix(this.Text[i:], ASearch) {
+			this.checkText(i - Start)
+			this.Pos = i + len(ASearch)
+			return this.Text[Start:i], true
+		}
+		i++
+	}
+	this.checkText(len(this.Text) - Start)
+	this.Pos = len(this.Text)
+	return this.Text[Start:], false
+}
+func (this *tXmlScanner) readDocType() string {
+	//A doctype declaration up to its closing ">",including an internal subset
+	//in "[...]" with its quoted literals,comments and processing instructions
+	Start := this.Pos
+	var QuoteChar byte
+	InSubset := false
+	for i := Start; i < len(this.Text); i++ {
+		Ch := this.Text[i]
+		switch {
+		case QuoteChar != 0:
+			if Ch == QuoteChar {
+				QuoteChar = 0
+			}
+		case Ch == '"' || Ch == '\'':
+			QuoteChar = Ch
+		case Ch == '[':
+			InSubset = true
+		case Ch == ']':
+			InSubset = false
+		case Ch == '>' && !InSubset:
+			this.checkText(i - Start)
+			this.Pos = i + 1
+			return this.Text[Start:i]
+		case InSubset && Ch == '<' && strings.HasPrefix(this.Text[i:], "<!--"):
+			if p := strings.Index(this.Text[i+4:], "-->"); p >= 0 {
+				i += p + 6
+				continue
+			}
+			i = len(this.Text)
+		case InSubset && Ch == '<' && strings.HasPrefix(this.Text[i:], "<?"):
+			if p := strings.Index(this.Text[i+2:], "?>"); p >= 0 {
+				i += p + 3
+				continue
+			}
+			i = len(this.Text)
+		}
+	}
+	this.checkText(len(this.Text) - Start)
+	this.Pos = len(this.Text)
+	return this.Text[Start:]
+}
+func (this *tXmlScanner) readDeclaration() string {
+	//A markup declaration up to ">" outside its quoted literals
+	Start := this.Pos
+	var QuoteChar byte
+	for i := Start; i < len(this.Text); i++ {
+		Ch := this.Text[i]
+		switch {
+		case QuoteChar != 0:
+			if Ch == QuoteChar {
+				QuoteChar = 0
+			}
+		case Ch == '"' || Ch == '\'':
+			QuoteChar = Ch
+		case Ch == '>':
+			this.checkText(i - Start)
+			this.Pos = i + 1
+			return this.Text[Start:i]
+		}
+	}
+	this.checkText(len(this.Text) - Start)
+	this.Pos = len(this.Text)
+	return this.Text[Start:]
+}
+func (this *tXmlScanner) parseAttributes(Node *TXmlNode, AValue string) {
+	//Blank separated name=value pairs,the "=" may have blanks around it and values in
+	//quotes may contain blanks
+	skipBlanks := func(i int) int {
+		for i < len(AValue) && isControlChar(AValue[i]) {
+			i++
+		}
+		return i
+	}
+	for i := skipBlanks(0); i < len(AValue); i = skipBlanks(i) {
+		Start := i
+		for i < len(AValue) && AValue[i] != '=' && !isControlChar(AValue[i]) {
+			i++
+		}
+		Name := AValue[Start:i]
+		if i = skipBlanks(i); i >= len(AValue) || AValue[i] != '=' || Name == "" {
+			if Name == "" {
+				i++
+			}
+			continue
+		}
+		//Blanks in front of a value only belong to the "=" when the value is quoted
+		if Start = skipBlanks(i + 1); Start >= len(AValue) || (AValue[Start] != '"' && AValue[Start] != '\'') {
+			Start = i + 1
+		}
+		var QuoteChar byte
+		for i = Start; i < len(AValue); i++ {
+			Ch := AValue[i]
+			if QuoteChar != 0 {
+				if Ch == QuoteChar {
+					QuoteChar = 0
+				}
+			} else if Ch == '"' || Ch == '\'' {
+				QuoteChar = Ch
+			} else if isControlChar(Ch) {
+				break
+			}
+		}
+		Value := AValue[Start:i]
+		if len(Value) > 0 && (Value[0] == '"' || Value[0] == '\'') {
+			Quote := Value[:1]
+			if len(Value) >= 2 && Value[len(Value)-1] == Value[0] && !strings.Contains(Value[1:len(Value)-1], Quote) {
+				Value = Value[1 : len(Value)-1]
+			} else {
+				Value = strings.Replace(Value, Quote, "", -1)
+			}
+		}
+		//Values are written in double quotes
+		if strings.IndexByte(Value, '"') >= 0 {
+			Value = strings.Replace(Value, "\"", "&quot;", -1)
+		}
+		Node.Attributes[this.intern(Name)] = Value
+	}
+}
+func (this *tXmlScanner) readNode(Node *TXmlNode) {
+	//Read the node that starts at Pos,text in front of a "<" is skipped as a clear node.
+	//Open elements are kept on the scanner stack instead of the goroutine stack,so the
+	//nesting depth only costs one frame per element
+	Base := len(this.stack)
+	this.startNode(Node)
+	for len(this.stack) > Base {
+		this.readContent()
+	}
+}
+func (this *tXmlScanner) newNode() *TXmlNode {
+	//Child nodes are taken from blocks of nodes,that saves an allocation per node
+	if len(this.nodes) == 0 {
+		this.nodes = make([]TXmlNode, cScanNodeBlock)
+	}
+	Node := &this.nodes[0]
+	this.nodes = this.nodes[1:]
+	Node.Attributes = make(map[string]string)
+	Node.Nodes = make(map[int]*TXmlNode)
+	return Node
+}
+func (this *tXmlScanner) setTexts(Node *TXmlNode, Start int, Trailing string) {
+	//Keep the text in front of each child and behind the last one,Value alone does not
+	//tell where the text was. Text that is all in Value is not kept
+	Count := len(this.texts) - Start + 1
+	if Count == 1 && Trailing == Node.Value {
+		return
+	}
+	if len(this.slab) < Count {
+		this.slab = make([]string, Count+cScanNodeBlock)
+	}
+	Node.texts = this.slab[:Count:Count]
+	this.slab = this.slab[Count:]
+	copy(Node.texts, this.texts[Start:])
+	Node.texts[Count-1] = Trailing
+}
+func (this *tXmlScanner) startNode(Node *TXmlNode) {
+	//Read the tag of the node at Pos. An element with content is pushed on the stack,
+	//other nodes are complete
+	if this.Pos >= len(this.Text) {
+		return
+	}
+	if this.Text[this.Pos] != '<' {
+		if p := strings.IndexByte(this.Text[this.Pos:], '<'); p >= 0 {
+			this.Pos += p
+		} else {
+			this.Pos = len(this.Text)
+		}
+		return
+	}
+	doc := this.doc
+	Frame := tXmlScanFrame{Node: Node, StartPos: this.Pos, Texts: len(this.texts)}
+	Node.sourcePos, Node.texts = this.Pos+1, nil
+	this.parse.enter(this.Pos)
+	//Keep the original text of the node when the document preserves its source
+	if doc != nil && doc.PreserveSource {
+		Frame.Source = &tXmlSource{Leading: make(map[*TXmlNode]string), EndTagPos: -1}
+	}
+	ATagIndex := this.tagIndex()
+	this.Pos += len(cTags[ATagIndex].FStart)
+	Node.ElementType = cTags[ATagIndex].FStyle
+	switch Node.ElementType {
+	case xeNormal, xeDeclaration, xeStyleSheet:
+		AValue, _ := this.readUntil(cTags[ATagIndex].FClose, true)
+		IsDirect := false
+		if Node.ElementType == xeNormal {
+			if strings.HasSuffix(AValue, "/") {
+				//Is it a direct tag?
+				IsDirect = true
+				AValue = AValue[:len(AValue)-1]
+			}
+			if p := strings.IndexAny(AValue, cControlChars); p >= 0 {
+				Node.Name = this.intern(AValue[:p])
+				AValue = AValue[p:]
+			} else {
+				Node.Name = this.intern(AValue)
+				AValue = ""
+			}
+			this.parseAttributes(Node, AValue)
+		} else {
+			Node.ParseTag(AValue, 0, len(AValue)-1)
+		}
+		Frame.SegPos = this.Pos
+		if Frame.Source != nil {
+			Frame.Source.StartTagPos = this.Pos
+			Frame.Source.Direct = IsDirect
+		}
+		this.parse.checkTag(Node, this.Pos)
+		if Node.ElementType == xeNormal {
+			if doc.recovering() {
+				Node.recoverTag(AValue)
+			}
+			if this.badName {
+				Node.checkNames(doc, IsXmlName)
+				this.badName = false
+			}
+		}
+		//Now the tag can be a direct close - in that case we're finished
+		if !IsDirect && Node.ElementType == xeNormal {
+			this.stack = append(this.stack, Frame)
+			return
+		}
+	case xeDocType:
+		Node.Name = "DTD"
+		Node.Value = this.readDocType()
+	case xeElement, xeAttList, xeEntity, xeNotation:
+		//Name is the first word,value the rest of the declaration as written
+		AValue := strings.Trim(this.readDeclaration(), cControlChars)
+		if p := strings.IndexAny(AValue, cControlChars); p >= 0 {
+			Node.Name = AValue[:p]
+			Node.Value = strings.Trim(AValue[p:], cControlChars)
+		} else {
+			Node.Name = AValue
+		}
+	default:
+		switch Node.ElementType {
+		case xeComment:
+			Node.Name = "Comment"
+		case xeCData:
+			Node.Name = "CData"
+		case xeExclam, xeQuestion:
+			Node.Name = "Special"
+		default:
+			Node.Name = "Unknown"
+		}
+		//In these cases just get all data up till the closing tag
+		Node.Value, _ = this.readUntil(cTags[ATagIndex].FClose, false)
+	}
+	this.endNode(&Frame)
+}
+func (this *tXmlScanner) endNode(Frame *tXmlScanFrame) {
+	this.parse.Depth--
+	if Frame.Source != nil {
+		Frame.Source.setText(this.Text, Frame.StartPos, this.Pos)
+		Frame.Node.setSource(Frame.Source)
+	}
+}
+func (this *tXmlScanner) readContent() {
+	//Read the text and the next child node of the element on top of the stack,or its
+	//close tag. The element is popped when it is closed
+	doc := this.doc
+	Top := len(this.stack) - 1
+	Frame := &this.stack[Top]
+	Node, SegPos := Frame.Node, Frame.SegPos
+	TagPos := this.Pos
+	if p := strings.IndexByte(this.Text[TagPos:], '<'); p >= 0 {
+		TagPos += p
+	} else {
+		TagPos = len(this.Text)
+	}
+	Segment := this.Text[SegPos:TagPos]
+	this.checkText(len(Segment))
+	this.Pos = TagPos
+	switch {
+	case TagPos >= len(this.Text):
+		if !doc.recovering() {
+			panic(errors.New(fmt.Sprintf(sxeMissingCloseTag, Node.Name)))
+		}
+		doc.warn(TagPos, fmt.Sprintf(sxeWarnUnclosedAtEnd, Node.Name))
+		Node.AddCharDataNode(Segment)
+	case TagPos+1 >= len(this.Text):
+		if !doc.recovering() {
+			panic(errors.New(fmt.Sprintf(sxeMissingDataAfterGreaterThan, Node.Name)))
+		}
+		doc.warn(TagPos, fmt.Sprintf(sxeWarnIncompleteTag, Node.Name))
+		Node.AddCharDataNode(Segment)
+		this.Pos = len(this.Text)
+	case this.Text[TagPos+1] == '/':
+		//This seems our closing tag
+		this.Pos = TagPos + 2
+		AValue, ok := this.readUntil(">", true)
+		if !ok {
+			if !doc.recovering() {
+				panic(errors.New(fmt.Sprintf(sxeMissingLessThanInCloseTag, Node.Name)))
+			}
+			doc.warn(TagPos, fmt.Sprintf(sxeWarnIncompleteTag, Node.Name))
+			Node.AddCharDataNode(Segment)
+			break
+		}
+		if CloseName := trimControlChars(AValue); CloseName != Node.Name {
+			if !doc.recovering() {
+				panic(errors.New(fmt.Sprintf(sxeIncorrectCloseTag, Node.Name)))
+			}
+			Closes, Rewind := Node.recoverCloseTag(CloseName, TagPos)
+			if !Closes {
+				//A stray close tag is left out of the text
+				Node.AddCharDataNode(Segment)
+				Frame.SegPos = this.Pos
+				return
+			}
+			if Rewind {
+				this.Pos = TagPos
+			}
+		}
+		Node.AddCharDataNode(Segment)
+		if Frame.Source != nil {
+			Frame.Source.Trailing = this.Text[SegPos:TagPos]
+			Frame.Source.EndTagPos = TagPos
+		} else if !doc.recovering() {
+			this.setTexts(Node, Frame.Texts, Segment)
+		}
+	default:
+		//Count the blank lines between the previous and this subtag
+		BlankLines := 0
+		if trimControlChars(Segment) == "" {
+			if BlankLines = strings.Count(Segment, "\x0A") - 1; BlankLines < 0 {
+				BlankLines = 0
+			}
+		}
+		Node.AddCharDataNode(Segment)
+		//This is a subtag... so create it and let it process
+		ANode := this.newNode()
+		ANode.BlankLines = BlankLines
+		Node.NodeAdd(ANode)
+		if Frame.Source != nil {
+			Frame.Source.Leading[ANode] = Segment
+		}
+		this.texts = append(this.texts, Segment)
+		this.startNode(ANode)
+		if len(this.stack) == Top+1 {
+			//The child is complete,an element child updates the position when it is popped
+			this.stack[Top].SegPos = this.Pos
+		}
+		return
+	}
+	//The element ends here
+	if doc.recovering() {
+		var ok bool
+		if Node.Value, ok = repairAmpersands(Node.Value); !ok {
+			doc.warn(TagPos, fmt.Sprintf(sxeWarnStrayAmpersand, "element \""+Node.Name+"\""))
+		}
+	}
+	this.endNode(Frame)
+	this.texts = this.texts[:Frame.Texts]
+	this.stack = this.stack[:Top]
+	if Top > 0 {
+		this.stack[Top-1].SegPos = this.Pos
+	}
+}
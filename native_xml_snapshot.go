@@ -0,0 +1,166 @@
+package native_xml
+
+import (
+	"strings"
+)
+
+func (this *TNativeXml) Snapshot() *TNativeXml {
+	//A read-only view of the current tree. The snapshot shares all nodes with the document,
+	//edits through the path api copy the nodes from the root to the changed node first,
+	//so the snapshot keeps its content and may be read by many goroutines. A shared node
+	//has its parent in the snapshot,edits that change its path copy it with a new parent.
+	//Nodes changed directly instead of through the path api change the snapshots as well
+	Snap := *this
+	Snap.readOnly = true
+	Snap.parse = nil
+	Snap.Warnings = append([]TXmlParseWarning(nil), this.Warnings...)
+	Snap.Changes = append([]TXmlChange(nil), this.Changes...)
+	Snap.observers = nil
+	Snap.undo = nil
+	Snap.RootNodes = make(map[TXmlElementType]*TXmlNode, len(this.RootNodes))
+	for k, v := range this.RootNodes {
+		Snap.RootNodes[k] = v
+	}
+	if this.readOnly {
+		return &Snap
+	}
+	//The root level nodes are found through the document they belong to,the snapshot
+	//keeps them and the document continues with copies
+	this.generation++
+	for k, v := range this.RootNodes {
+		v.document = &Snap
+		Clone := v.cloneForEdit(nil, this.generation)
+		Clone.document = this
+		this.RootNodes[k] = Clone
+		if v == this.XmlRoot {
+			this.XmlRoot = Clone
+		}
+	}
+	return &Snap
+}
+func (this *TNativeXml) IsReadOnly() bool {
+	return this.readOnly
+}
+func (this *TNativeXml) fork() *TNativeXml {
+	//A changeable copy without observers and history to try edits on,the nodes are
+	//shared with the document until they are changed
+	Fork := this.Snapshot()
+	Fork.readOnly = false
+	Fork.TrackChanges = false
+	Fork.UndoLevels = 0
+	Fork.generation = this.generation + 1
+	return Fork
+}
+func (this *TXmlNode) cloneForEdit(Parent *TXmlNode, Generation int) *TXmlNode {
+	//A copy that may be changed,the child nodes stay shared
+	Clone := *this
+	Clone.Parent = Parent
+	Clone.generation = Generation
+	Clone.Attributes = make(map[string]string, len(this.Attributes))
+	for k, v := range this.Attributes {
+		Clone.Attributes[k] = v
+	}
+	Clone.Nodes = make(map[int]*TXmlNode, len(this.Nodes))
+	for k, v := range this.Nodes {
+		Clone.Nodes[k] = v
+	}
+	if this.source != nil {
+		Source := *this.source
+		Clone.source = &Source
+	}
+	return &Clone
+}
+func (this *TXmlNode) copyTree(Parent *TXmlNode, Generation int) *TXmlNode {
+	//A deep copy that is not part of a document and has no source
+	Copy := this.cloneForEdit(Parent, Generation)
+	Copy.document, Copy.source, Copy.sourcePos = nil, nil, 0
+	for k, v := range Copy.Nodes {
+		Copy.Nodes[k] = v.copyTree(Copy, Generation)
+	}
+	return Copy
+}
+func (this *TNativeXml) editRoot() *TXmlNode {
+	if this.XmlRoot == nil || this.generation == 0 || this.XmlRoot.generation == this.generation {
+		return this.XmlRoot
+	}
+	Clone := this.XmlRoot.cloneForEdit(nil, this.generation)
+	this.RootNodes[xeNormal] = Clone
+	this.XmlRoot = Clone
+	return Clone
+}
+func (this *TNativeXml) editChild(Parent, Node *TXmlNode) *TXmlNode {
+	//Node as a child of Parent that may be changed,Parent must already be changeable.
+	//A node shared with a snapshot is replaced by a copy
+	if this.generation == 0 || Node.generation == this.generation {
+		return Node
+	}
+	Clone := Node.cloneForEdit(Parent, this.generation)
+	Parent.Nodes[Node.NodeID] = Clone
+	if Source := Parent.source; Source != nil {
+		//The preserved source of the parent refers to the copy
+		Children := make([]*TXmlNode, len(Source.Children))
+		for i, v := range Source.Children {
+			if v == Node {
+				v = Clone
+			}
+			Children[i] = v
+		}
+		Leading := make(map[*TXmlNode]string, len(Source.Leading))
+		for k, v := range Source.Leading {
+			if k == Node {
+				k = Clone
+			}
+			Leading[k] = v
+		}
+		Source.Children, Source.Leading = Children, Leading
+	}
+	return Clone
+}
+func (this *TNativeXml) pathsChanged(Parent, Node *TXmlNode) {
+	//Node was added to,removed from or moved within Parent,which must be changeable: the
+	//paths of the children with its name change and so do the paths below them. Nodes
+	//shared with a snapshot still have the parents they have there,they are copied so
+	//their parents lead to the changed path
+	if this.generation == 0 || Parent == nil {
+		return
+	}
+	Name := Node.Name
+	if Test := nodeTest(Node.ElementType); Test != "" {
+		Name = Test
+	}
+	for _, v := range Parent.NodeList() {
+		if v.hasPathName(Name) {
+			this.adoptTree(Parent, v)
+		}
+	}
+}
+func (this *TNativeXml) adoptTree(Parent, Node *TXmlNode) {
+	Node = this.editChild(Parent, Node)
+	Node.Parent = Parent
+	for _, v := range Node.NodeList() {
+		this.adoptTree(Node, v)
+	}
+}
+func (this *TNativeXml) findNodeForEdit(FindPath string) *TXmlNode {
+	//findNodeForPath for the path api functions that change the node. After a snapshot
+	//the nodes from the root to the found node are copied when they are shared
+	if this.readOnly {
+		return nil
+	}
+	findnode := this.findNodeForPath(FindPath)
+	if findnode == nil || this.generation == 0 {
+		return findnode
+	}
+	findnode = nil
+	for _, v := range strings.Split(strings.Replace(FindPath, " ", "", -1), "/") {
+		if v == "" {
+			continue
+		}
+		if findnode == nil {
+			findnode = this.editRoot()
+			continue
+		}
+		findnode = this.editChild(findnode, this.findNodeForName(v, findnode))
+	}
+	return findnode
+}
@@ -0,0 +1,386 @@
+package native_xml
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Original text of a node read in lossless mode,and the node state at that time
+type tXmlSource struct {
+	Text        string               //The complete node as read
+	StartTag    string               //Start tag of an element,including "<" and ">"
+	EndTag      string               //End tag of an element,empty for direct tags
+	Direct      bool                 //Element was read as a direct tag <name/>
+	Leading     map[*TXmlNode]string //Text in front of each child node
+	Trailing    string               //Text between the last child node and the end tag
+	StartTagPos int                  //Stream positions while reading
+	EndTagPos   int
+	ElementType TXmlElementType
+	Name        string
+	Value       string
+	Attributes  map[string]string
+	Children    []*TXmlNode
+	AttrOrder   []string        //Attribute names in the order of the start tag
+	AttrQuotes  map[string]byte //Quote character of each attribute
+}
+
+// Original text around the root level nodes
+type tXmlDocSource struct {
+	Nodes    []*TXmlNode
+	Leading  []string
+	Trailing string
+	LastPos  int
+}
+
+func streamPos(S *bytes.Reader) int {
+	return int(S.Size()) - S.Len()
+}
+func (this *tXmlSource) setText(XmlString string, StartPos, ClosePos int) {
+	this.Text = XmlString[StartPos:ClosePos]
+	if this.StartTagPos > StartPos {
+		this.StartTag = XmlString[StartPos:this.StartTagPos]
+	}
+	if this.EndTagPos >= 0 {
+		this.EndTag = XmlString[this.EndTagPos:ClosePos]
+	}
+}
+func (this *TXmlNode) setSource(Source *tXmlSource) {
+	//Remember the state of the node as read
+	Source.ElementType = this.ElementType
+	Source.Name = this.Name
+	Source.Value = this.Value
+	Source.Attributes = make(map[string]string, len(this.Attributes))
+	for k, v := range this.Attributes {
+		Source.Attributes[k] = v
+	}
+	Source.Children = this.NodeList()
+	Source.AttrOrder, Source.AttrQuotes = scanSourceAttributes(Source.StartTag)
+	this.source = Source
+}
+func scanSourceAttributes(StartTag string) ([]string, map[string]byte) {
+	//Attribute names and quote characters in an original start tag
+	Order := make([]string, 0)
+	Quotes := make(map[string]byte)
+	isStop := func(i int) bool {
+		return i >= len(StartTag) || StartTag[i] == '>' || StartTag[i] == '/'
+	}
+	isControl := func(i int) bool {
+		return i < len(StartTag) && strings.IndexByte(cControlChars, StartTag[i]) >= 0
+	}
+	i := 1
+	for !isStop(i) && !isControl(i) {
+		i++
+	}
+	for {
+		for isControl(i) {
+			i++
+		}
+		if isStop(i) {
+			break
+		}
+		Start := i
+		for i < len(StartTag) && StartTag[i] != '=' && StartTag[i] != '>' && !isControl(i) {
+			i++
+		}
+		Name := StartTag[Start:i]
+		for isControl(i) {
+			i++
+		}
+		if i >= len(StartTag) || StartTag[i] != '=' {
+			if i == Start {
+				i++
+			}
+			continue
+		}
+		i++
+		for isControl(i) {
+			i++
+		}
+		Quotes[Name] = '"'
+		if i < len(StartTag) && strings.IndexByte(cQuoteChars, StartTag[i]) >= 0 {
+			Quotes[Name] = StartTag[i]
+			if Close := strings.IndexByte(StartTag[i+1:], StartTag[i]); Close >= 0 {
+				i += Close + 2
+			} else {
+				i = len(StartTag)
+			}
+		} else {
+			for !isStop(i) && !isControl(i) {
+				i++
+			}
+		}
+		Order = append(Order, Name)
+	}
+	return Order, Quotes
+}
+func (this *TXmlNode) sourceModified() bool {
+	//Did the node itself change since it was read
+	Source := this.source
+	if Source == nil {
+		return true
+	}
+	if this.ElementType != Source.ElementType || this.Name != Source.Name || this.Value != Source.Value {
+		return true
+	}
+	if !this.sourceAttributesEqual() {
+		return true
+	}
+	Children := this.NodeList()
+	if len(Children) != len(Source.Children) {
+		return true
+	}
+	for i, v := range Children {
+		if v != Source.Children[i] {
+			return true
+		}
+	}
+	return false
+}
+func (this *TXmlNode) sourceAttributesEqual() bool {
+	if len(this.Attributes) != len(this.source.Attributes) {
+		return false
+	}
+	for k, v := range this.Attributes {
+		if w, ok := this.source.Attributes[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+func (this *TXmlNode) sourceUnchanged() bool {
+	//Is the whole subtree unchanged since it was read
+	if this.sourceModified() {
+		return false
+	}
+	for _, v := range this.source.Children {
+		if !v.sourceUnchanged() {
+			return false
+		}
+	}
+	return true
+}
+func (this *TXmlNode) textSegments() []string {
+	//The text in front of each child node and behind the last one. A node that preserves
+	//its source has the text it writes,a node read without it the text as read while it
+	//is unchanged. Otherwise only the value is known,it is the text in front of the children
+	if this.hasSourceLayout() {
+		return this.sourceSegments()
+	}
+	if Texts := this.texts; len(Texts) == len(this.Nodes)+1 && this.MaxNodeID == len(this.Nodes) &&
+		this.Value == segmentsValue(Texts) {
+		return Texts
+	}
+	return this.valueSegments()
+}
+func (this *TXmlNode) writtenSegments() []string {
+	//The text in front of each child node and behind the last one as the document writes it
+	if this.hasSourceLayout() {
+		return this.sourceSegments()
+	}
+	W := this.writer()
+	if W.Doc != nil && W.Doc.PreserveSource && W.Doc.source != nil {
+		//writeSource writes new and changed nodes compact
+		W.Format = xfCompact
+	}
+	Children := this.NodeList()
+	Segments := this.valueSegments()
+	ALineFeed := W.lineFeed()
+	if len(Children) == 0 || ALineFeed == "" {
+		return Segments
+	}
+	//The readable format writes a line feed behind the value and around each child
+	//that is not text and indents them,see writeToStream
+	Segments[0] += ALineFeed
+	for i, v := range Children {
+		if v.BlankLines > 0 && W.Doc.FormatOptions.PreserveBlankLines {
+			Segments[i] += strings.Repeat(ALineFeed, v.BlankLines)
+		}
+		if v.ElementType != xeCharData {
+			Segments[i] += W.indent(v)
+			Segments[i+1] = ALineFeed
+		}
+	}
+	Segments[len(Children)] += W.indent(this)
+	return Segments
+}
+func (this *TXmlNode) valueSegments() []string {
+	Segments := make([]string, len(this.Nodes)+1)
+	Segments[0] = this.Value
+	return Segments
+}
+func segmentsValue(Segments []string) string {
+	//The value AddCharDataNode leaves for these segments
+	for i := len(Segments) - 1; i >= 0; i-- {
+		if Value := trimControlChars(Segments[i]); Value != "" {
+			return Value
+		}
+	}
+	return ""
+}
+func (this *TXmlNode) hasSourceLayout() bool {
+	//Does writeSource write the text of this element from its source
+	Source := this.source
+	return Source != nil && this.ElementType == xeNormal && Source.ElementType == xeNormal && Source.StartTag != ""
+}
+func (this *TXmlNode) sourceSegments() []string {
+	//The text writeSource writes in front of each child node and behind the last one
+	Source := this.source
+	Children := this.NodeList()
+	Segments := make([]string, len(Children)+1)
+	if Source.Direct && len(this.Value) == 0 && len(Children) == 0 {
+		return Segments
+	}
+	//The value was read from the last text segment that is not blank
+	Present := make(map[*TXmlNode]bool)
+	for _, v := range Children {
+		Present[v] = true
+	}
+	var ValueOwner *TXmlNode
+	ValueInTrailing := strings.Trim(Source.Trailing, cControlChars) != ""
+	if !ValueInTrailing {
+		for i := len(Source.Children) - 1; i >= 0; i-- {
+			if strings.Trim(Source.Leading[Source.Children[i]], cControlChars) != "" {
+				ValueOwner = Source.Children[i]
+				break
+			}
+		}
+	}
+	Value := ""
+	if !ValueInTrailing && !Present[ValueOwner] {
+		ValueOwner = nil
+		Value = this.Value
+	}
+	withValue := func(Segment string, Owner bool) string {
+		if Owner {
+			Trimmed := strings.Trim(Segment, cControlChars)
+			p := strings.Index(Segment, Trimmed)
+			Segment = Segment[:p] + this.Value + Segment[p+len(Trimmed):]
+		}
+		return Segment
+	}
+	//New child nodes get the layout of the last original child in front of them
+	Indent := ""
+	for i, v := range Children {
+		if Leading, ok := Source.Leading[v]; ok {
+			Segments[i] = withValue(Leading, v == ValueOwner)
+			if strings.Trim(Leading, cControlChars) == "" {
+				Indent = Leading
+			}
+		} else {
+			Segments[i] = Indent
+		}
+	}
+	Segments[len(Children)] = withValue(Source.Trailing, ValueInTrailing)
+	Segments[0] = Value + Segments[0]
+	return Segments
+}
+func (this *TXmlNode) sourceStartTag(Direct bool) string {
+	Source := this.source
+	if this.Name == Source.Name && Direct == Source.Direct && this.sourceAttributesEqual() {
+		return Source.StartTag
+	}
+	//Write the attributes that were read in their original order and quotes,new ones after them
+	val := "<" + this.Name
+	Done := make(map[string]bool)
+	for _, k := range Source.AttrOrder {
+		v, ok := this.Attributes[k]
+		if !ok || Done[k] {
+			continue
+		}
+		Quote := string(Source.AttrQuotes[k])
+		if strings.Contains(v, Quote) {
+			Quote = strings.Replace(cQuoteChars, Quote, "", 1)
+		}
+		val += " " + k + "=" + Quote + v + Quote
+		Done[k] = true
+	}
+	Names := make([]string, 0)
+	for k := range this.Attributes {
+		if !Done[k] {
+			Names = append(Names, k)
+		}
+	}
+	sort.Strings(Names)
+	for _, k := range Names {
+		val += " " + k + "=\"" + this.Attributes[k] + "\""
+	}
+	if Direct {
+		return val + "/>"
+	}
+	return val + ">"
+}
+func (this *TXmlNode) writeSource(S *bytes.Buffer, W tXmlWriter) {
+	//Write the original text of unchanged nodes,re-serialise changed ones
+	W.Cancel.check()
+	Source := this.source
+	if Source == nil {
+		this.writeToStream(S, W)
+		return
+	}
+	if this.sourceUnchanged() {
+		WriteStringToStream(S, Source.Text)
+		return
+	}
+	if !this.hasSourceLayout() {
+		this.writeToStream(S, W)
+		return
+	}
+	Direct := Source.Direct && len(this.Value) == 0 && this.NodeCount() == 0
+	WriteStringToStream(S, this.sourceStartTag(Direct))
+	if Direct {
+		return
+	}
+	Segments := this.sourceSegments()
+	for i, v := range this.NodeList() {
+		WriteStringToStream(S, Segments[i])
+		v.writeSource(S, W)
+	}
+	WriteStringToStream(S, Segments[len(Segments)-1])
+	if Source.Direct || this.Name != Source.Name {
+		WriteStringToStream(S, "</"+this.Name+">")
+	} else {
+		WriteStringToStream(S, Source.EndTag)
+	}
+}
+func (this *tXmlDocSource) add(Node *TXmlNode, XmlString string, ClosePos int) {
+	StartPos := ClosePos - len(Node.source.Text)
+	this.Leading = append(this.Leading, XmlString[this.LastPos:StartPos])
+	this.Nodes = append(this.Nodes, Node)
+	this.LastPos = ClosePos
+}
+func (this *TNativeXml) writeSource(S *bytes.Buffer, Cancel *tCancelCheck) {
+	//New and changed nodes are written compact,the original text keeps the layout
+	W := tXmlWriter{Doc: this, Format: xfCompact, Cancel: Cancel}
+	Written := make(map[*TXmlNode]bool)
+	write := func(Node *TXmlNode, Leading string) {
+		if Node == nil || Written[Node] || (Node.ElementType == xeDeclaration && this.FormatOptions.OmitDeclaration) {
+			return
+		}
+		WriteStringToStream(S, Leading)
+		Node.writeSource(S, W)
+		Written[Node] = true
+	}
+	InSource := make(map[TXmlElementType]bool)
+	for _, v := range this.source.Nodes {
+		InSource[v.ElementType] = true
+	}
+	//A declaration added after reading comes first,a doctype in front of the root
+	if v := this.RootNodes[xeDeclaration]; v != nil && !InSource[xeDeclaration] {
+		write(v, "")
+	}
+	for i, v := range this.source.Nodes {
+		Node := v
+		switch v.ElementType {
+		case xeDeclaration, xeDocType, xeNormal:
+			Node = this.RootNodes[v.ElementType]
+		}
+		if v.ElementType == xeNormal {
+			write(this.RootNodes[xeDocType], "")
+		}
+		write(Node, this.source.Leading[i])
+	}
+	write(this.RootNodes[xeDocType], "")
+	write(this.RootNodes[xeNormal], "")
+	WriteStringToStream(S, this.source.Trailing)
+}
@@ -0,0 +1,146 @@
+package native_xml
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Document that may be shared by goroutines,reads and writes through the path
+// api are guarded by a RWMutex
+type TSyncDocument struct {
+	mutex sync.RWMutex
+	doc   *TNativeXml
+}
+
+func NewSyncDocument(Doc *TNativeXml) *TSyncDocument {
+	if Doc == nil {
+		Doc = NewNativeXml()
+	}
+	return &TSyncDocument{doc: Doc}
+}
+
+func (this *TSyncDocument) With(Fn func(Doc *TNativeXml)) {
+	//Run several reads and edits as one exclusive operation,Doc may not be kept after Fn returns
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	Fn(this.doc)
+}
+func (this *TSyncDocument) View(Fn func(Doc *TNativeXml)) {
+	//Run several reads while no edit happens,Fn must not change Doc
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	Fn(this.doc)
+}
+func (this *TSyncDocument) Snapshot() *TNativeXml {
+	//A read-only version of the current content,see TNativeXml.Snapshot
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.doc.Snapshot()
+}
+func (this *TSyncDocument) ParseString(AValue string) error {
+	return this.ParseStream(bytes.NewBufferString(AValue))
+}
+func (this *TSyncDocument) ParseReader(R io.Reader) error {
+	this.mutex.RLock()
+	Max := this.doc.ParseOptions.MaxInputBytes
+	this.mutex.RUnlock()
+	if Max > 0 {
+		R = io.LimitReader(R, int64(Max)+1)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(R); err != nil {
+		return err
+	}
+	return this.ParseStream(buf)
+}
+func (this *TSyncDocument) ParseStream(S *bytes.Buffer) error {
+	//The new content is read into a copy with the same settings and replaces the
+	//document only when it could be read,readers never see a partly read tree
+	this.mutex.RLock()
+	Doc := *this.doc
+	this.mutex.RUnlock()
+	if err := Doc.ParseStream(S); err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	this.doc = &Doc
+	this.mutex.Unlock()
+	return nil
+}
+
+func (this *TSyncDocument) WriteToString() string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.doc.WriteToString()
+}
+func (this *TSyncDocument) XmlNodePath() []string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.doc.XmlNodePath()
+}
+func (this *TSyncDocument) XmlNodePathForNode(NodePath string) []string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.doc.XmlNodePathForNode(NodePath)
+}
+func (this *TSyncDocument) GetNodeValueForPath(FindPath string) string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.doc.GetNodeValueForPath(FindPath)
+}
+func (this *TSyncDocument) GetAttribute(FindPath, AttrName string) string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.doc.GetAttribute(FindPath, AttrName)
+}
+func (this *TSyncDocument) SetNodeValueForPath(FindPath, Value string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.doc.SetNodeValueForPath(FindPath, Value)
+}
+func (this *TSyncDocument) SetAttribute(FindPath, AttrName, AttrValue string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.doc.SetAttribute(FindPath, AttrName, AttrValue)
+}
+func (this *TSyncDocument) AddNodeForPath(Path string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.doc.AddNodeForPath(Path)
+}
+func (this *TSyncDocument) AddNodeForPathS(ParentPath string, Child string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.doc.AddNodeForPathS(ParentPath, Child)
+}
+func (this *TSyncDocument) AddNodeForPathN(ParentPath string, Child TXmlNode) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.doc.AddNodeForPathN(ParentPath, Child)
+}
+func (this *TSyncDocument) AddNodeForPathB(ParentPath string, Child *bytes.Buffer) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.doc.AddNodeForPathB(ParentPath, Child)
+}
+func (this *TSyncDocument) ReplaceNode(FindPath string, Node *TXmlNode) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.doc.ReplaceNode(FindPath, Node)
+}
+func (this *TSyncDocument) RemoveAttribute(FindPath, AttrName string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.doc.RemoveAttribute(FindPath, AttrName)
+}
+func (this *TSyncDocument) MoveNode(FindPath, NewParentPath string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.doc.MoveNode(FindPath, NewParentPath)
+}
+func (this *TSyncDocument) RemoveNode(FindPath string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.doc.RemoveNode(FindPath)
+}
@@ -0,0 +1,333 @@
+package native_xml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode/utf8"
+)
+
+const (
+	sxeTplActionContext = "%s: action %s is not allowed in %s"
+	sxeTplBranches      = "%s: the branches of %s end in different contexts"
+	sxeTplUnfinished    = "Template %s ends in %s"
+	sxeTplInvalidName   = "Invalid xml name \"%s\" written by a template"
+)
+
+// Where in the xml an action of a template writes,it decides the escaping
+const (
+	cTplText        = iota
+	cTplTagName     //Element name after "<" or "</"
+	cTplTag         //Between the attributes of a tag
+	cTplAttrName    //In an attribute name
+	cTplBeforeValue //Behind the "=" of an attribute
+	cTplAttrValue   //In a quoted attribute value
+	cTplCData       //In a CDATA section
+	cTplComment     //In a comment
+	cTplPI          //In a processing instruction
+	cTplDecl        //In a doctype or other "<!" declaration
+	cTplDeclSubset  //In the internal subset of a doctype
+)
+
+var cTplContextNames = []string{"text", "a tag name", "a tag", "an attribute name", "an unquoted attribute value",
+	"an attribute value", "a CDATA section", "a comment", "a processing instruction", "a declaration", "a declaration"}
+
+// The escaping functions added to the actions of a template
+var cTplEscapers = map[int]string{cTplText: "_xml_text", cTplTagName: "_xml_name", cTplTag: "_xml_name",
+	cTplAttrName: "_xml_name", cTplAttrValue: "_xml_attr", cTplCData: "_xml_cdata", cTplComment: "_xml_comment",
+	cTplPI: "_xml_pi"}
+
+// Xml a template writes as it is in text,other values are escaped
+type TXmlMarkup string
+
+// A text/template whose actions are escaped for the xml around them: text,attribute
+// values,CDATA sections,comments,processing instructions and element or attribute
+// names. The output is read into a document and validated when the template asks
+// for it. Templates called with {{template}} must be called in text and end there
+type TXmlTemplate struct {
+	ValidateDTD  bool             //Validate the output against its doctype declaration
+	Schema       *TXmlSchema      //Validate the output against the schema when set
+	ParseOptions TXmlParseOptions //Resource limits while reading the output
+	template     *template.Template
+}
+
+// Position in the xml a template writes
+type tXmlTplContext struct {
+	State int
+	Quote byte //Quote of the attribute value
+}
+
+// Adds the escaping functions to the parse tree of one template
+type tXmlTplEscaper struct {
+	Tree *parse.Tree
+}
+
+func NewXmlTemplate(Name, Text string, Funcs map[string]interface{}) (Result *TXmlTemplate, err error) {
+	//Parse Text and the templates it defines,Funcs are added to the template functions
+	defer recoverError(&err)
+	Template := template.New(Name).Funcs(template.FuncMap{
+		"_xml_text":    xmlTplText,
+		"_xml_attr":    xmlTplAttr,
+		"_xml_cdata":   xmlTplCData,
+		"_xml_comment": xmlTplComment,
+		"_xml_pi":      xmlTplPI,
+		"_xml_name":    xmlTplName,
+	})
+	if Funcs != nil {
+		Template.Funcs(Funcs)
+	}
+	if _, err := Template.Parse(Text); err != nil {
+		return nil, err
+	}
+	for _, v := range Template.Templates() {
+		if v.Tree == nil || v.Tree.Root == nil {
+			continue
+		}
+		E := &tXmlTplEscaper{Tree: v.Tree}
+		if End := E.list(v.Tree.Root, tXmlTplContext{}); End.State != cTplText {
+			return nil, errors.New(fmt.Sprintf(sxeTplUnfinished, v.Name(), cTplContextNames[End.State]))
+		}
+	}
+	return &TXmlTemplate{template: Template}, nil
+}
+func (this *TXmlTemplate) Execute(Data interface{}) (*TNativeXml, error) {
+	return this.ExecuteTemplate(this.template.Name(), Data)
+}
+func (this *TXmlTemplate) ExecuteTemplate(Name string, Data interface{}) (*TNativeXml, error) {
+	//The document the template Name writes for Data. A validation error of the
+	//document is returned as the first TXmlValidationError
+	buf := new(bytes.Buffer)
+	if err := this.template.ExecuteTemplate(buf, Name, Data); err != nil {
+		return nil, err
+	}
+	Doc := NewNativeXml()
+	Doc.ParseOptions = this.ParseOptions
+	if err := Doc.ParseStream(buf); err != nil {
+		return nil, err
+	}
+	if this.ValidateDTD {
+		if Errors := Doc.ValidateDTD(); len(Errors) > 0 {
+			return nil, Errors[0]
+		}
+	}
+	if this.Schema != nil {
+		if Errors := Doc.ValidateSchema(this.Schema); len(Errors) > 0 {
+			return nil, Errors[0]
+		}
+	}
+	return Doc, nil
+}
+
+func (this *tXmlTplEscaper) fail(Node parse.Node, Format string, Args ...interface{}) {
+	Location, _ := this.Tree.ErrorContext(Node)
+	panic(errors.New(fmt.Sprintf(Format, append([]interface{}{Location}, Args...)...)))
+}
+func (this *tXmlTplEscaper) list(List *parse.ListNode, Context tXmlTplContext) tXmlTplContext {
+	if List == nil {
+		return Context
+	}
+	for _, v := range List.Nodes {
+		Context = this.node(v, Context)
+	}
+	return Context
+}
+func (this *tXmlTplEscaper) node(Node parse.Node, Context tXmlTplContext) tXmlTplContext {
+	switch n := Node.(type) {
+	case *parse.TextNode:
+		return Context.advance(string(n.Text))
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			//Variable declarations and assignments write nothing
+			return Context
+		}
+		Escaper, ok := cTplEscapers[Context.State]
+		if !ok {
+			this.fail(n, sxeTplActionContext, n.String(), cTplContextNames[Context.State])
+		}
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos,
+			Args: []parse.Node{parse.NewIdentifier(Escaper).SetTree(this.Tree).SetPos(n.Pos)}})
+	case *parse.IfNode:
+		return this.branch(n, &n.BranchNode, Context, false)
+	case *parse.WithNode:
+		return this.branch(n, &n.BranchNode, Context, false)
+	case *parse.RangeNode:
+		return this.branch(n, &n.BranchNode, Context, true)
+	case *parse.TemplateNode:
+		if Context.State != cTplText {
+			this.fail(n, sxeTplActionContext, n.String(), cTplContextNames[Context.State])
+		}
+	}
+	return Context
+}
+func (this *tXmlTplEscaper) branch(Node parse.Node, Branch *parse.BranchNode, Context tXmlTplContext, Loop bool) tXmlTplContext {
+	//Both branches must end where they started from or at least in the same context,
+	//the body of a loop where it started
+	Then := this.list(Branch.List, Context)
+	Else := Context
+	if Branch.ElseList != nil {
+		Else = this.list(Branch.ElseList, Context)
+	}
+	if Then != Else || (Loop && Then != Context) {
+		this.fail(Node, sxeTplBranches, Node.String())
+	}
+	return Then
+}
+func (this tXmlTplContext) advance(Text string) tXmlTplContext {
+	//The context behind Text
+	for i := 0; i < len(Text); {
+		s := Text[i:]
+		switch this.State {
+		case cTplText:
+			p := strings.IndexByte(s, '<')
+			if p < 0 {
+				return this
+			}
+			s, i = s[p:], i+p
+			switch {
+			case strings.HasPrefix(s, "<!--"):
+				this.State, i = cTplComment, i+4
+			case strings.HasPrefix(s, "<![CDATA["):
+				this.State, i = cTplCData, i+9
+			case strings.HasPrefix(s, "<?"):
+				this.State, i = cTplPI, i+2
+			case strings.HasPrefix(s, "<!"):
+				this.State, i = cTplDecl, i+2
+			case strings.HasPrefix(s, "</"):
+				this.State, i = cTplTagName, i+2
+			default:
+				this.State, i = cTplTagName, i+1
+			}
+		case cTplTagName, cTplAttrName:
+			if r, Size := utf8.DecodeRuneInString(s); IsXmlNameChar(r) {
+				i += Size
+			} else {
+				this.State = cTplTag
+			}
+		case cTplTag:
+			switch c := s[0]; {
+			case c == '>':
+				this.State = cTplText
+			case c == '=':
+				this.State = cTplBeforeValue
+			case strings.IndexByte(cControlChars+"/", c) < 0:
+				if r, _ := utf8.DecodeRuneInString(s); IsXmlNameChar(r) {
+					this.State = cTplAttrName
+					continue
+				}
+			}
+			i++
+		case cTplBeforeValue:
+			if c := s[0]; c == '"' || c == '\'' {
+				this.State, this.Quote = cTplAttrValue, c
+			}
+			i++
+		case cTplAttrValue:
+			p := strings.IndexByte(s, this.Quote)
+			if p < 0 {
+				return this
+			}
+			this.State, this.Quote, i = cTplTag, 0, i+p+1
+		case cTplDecl:
+			p := strings.IndexAny(s, "[>")
+			if p < 0 {
+				return this
+			}
+			if s[p] == '[' {
+				this.State = cTplDeclSubset
+			} else {
+				this.State = cTplText
+			}
+			i += p + 1
+		case cTplDeclSubset:
+			p := strings.IndexByte(s, ']')
+			if p < 0 {
+				return this
+			}
+			this.State, i = cTplDecl, i+p+1
+		default:
+			End := map[int]string{cTplComment: "-->", cTplCData: "]]>", cTplPI: "?>"}[this.State]
+			p := strings.Index(s, End)
+			if p < 0 {
+				return this
+			}
+			this.State, i = cTplText, i+p+len(End)
+		}
+	}
+	return this
+}
+
+func xmlTplString(Args []interface{}) (string, bool) {
+	//The text of the arguments like print writes it,true for TXmlMarkup. Characters
+	//xml does not allow are replaced by U+FFFD
+	var Text string
+	Markup := false
+	switch v := Args[0].(type) {
+	case nil:
+	case string:
+		Text = v
+	case TXmlMarkup:
+		Text, Markup = string(v), true
+	default:
+		Text = fmt.Sprint(Args...)
+	}
+	if len(Args) > 1 {
+		Text, Markup = fmt.Sprint(Args...), false
+	}
+	for _, r := range Text {
+		if r == utf8.RuneError || !IsXmlChar(r) {
+			return strings.Map(func(r rune) rune {
+				if !IsXmlChar(r) {
+					return utf8.RuneError
+				}
+				return r
+			}, strings.ToValidUTF8(Text, string(utf8.RuneError))), Markup
+		}
+	}
+	return Text, Markup
+}
+func xmlTplText(Args ...interface{}) string {
+	Text, Markup := xmlTplString(Args)
+	if Markup {
+		return Text
+	}
+	return canonicalEscapeText(Text)
+}
+func xmlTplAttr(Args ...interface{}) string {
+	Text, _ := xmlTplString(Args)
+	return strings.Replace(canonicalEscapeAttr(Text), "'", "&apos;", -1)
+}
+func xmlTplCData(Args ...interface{}) string {
+	Text, _ := xmlTplString(Args)
+	return strings.Replace(Text, "]]>", "]]]]><![CDATA[>", -1)
+}
+func xmlTplComment(Args ...interface{}) string {
+	Text, _ := xmlTplString(Args)
+	for strings.Contains(Text, "--") {
+		Text = strings.Replace(Text, "--", "- -", -1)
+	}
+	if strings.HasSuffix(Text, "-") {
+		Text += " "
+	}
+	return Text
+}
+func xmlTplPI(Args ...interface{}) string {
+	Text, _ := xmlTplString(Args)
+	return strings.Replace(Text, "?>", "? >", -1)
+}
+func xmlTplName(Args ...interface{}) (string, error) {
+	//Names are not escaped,a value that is not a name is an error. A prefix and
+	//its local name must both be names without colon
+	Text, _ := xmlTplString(Args)
+	if !IsXmlName(Text) {
+		return "", errors.New(fmt.Sprintf(sxeTplInvalidName, Text))
+	}
+	if Prefix, Local := SplitQualifiedName(Text); Prefix != "" || Local != Text {
+		if !IsXmlName(Prefix) || !IsXmlName(Local) || strings.Contains(Local, ":") {
+			return "", errors.New(fmt.Sprintf(sxeTplInvalidName, Text))
+		}
+	}
+	return Text, nil
+}
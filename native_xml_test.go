@@ -2,9 +2,25 @@ package native_xml_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-xml/native_xml"
 )
@@ -116,6 +132,13 @@ func Test_Read_nativexml(t *testing.T) {
 	if nxml.GetNodeValueForPath("/Root/Items/Item4") != "ValueItem4" {
 		t.Fatalf("node /Root/Items/Item4 Value " + nxml.GetNodeValueForPath("/Root/Items/Item4") + "!=ValueItem4")
 	}
+	//Blank text after the last sub node keeps the value in front of it
+	for xml, value := range map[string]string{"<a>x<b/>\n</a>": "x", "<a>\n\tx\n\t<b/>\t\n</a>": "x", "<a>\n\t<b/>\n\t</a>": ""} {
+		nxml.ReadFromString(xml)
+		if nxml.GetNodeValueForPath("/a") != value {
+			t.Fatalf("node /a of %q Value %q!=%q", xml, nxml.GetNodeValueForPath("/a"), value)
+		}
+	}
 }
 func Test_Edit_nativexml(t *testing.T) {
 	nxml := native_xml.NewNativeXml()
@@ -175,3 +198,1679 @@ func Test_Edit_nativexml(t *testing.T) {
 	nxml.SetXmlFormat(true)
 	fmt.Println("xfReadable:\n" + nxml.WriteToString())
 }
+func Test_Signature_nativexml(t *testing.T) {
+	signxmlstr := `<Root xmlns="urn:test" xmlns:a="urn:a"><Order Id="o1" a:No="7">Value&amp;1</Order><Note>n</Note></Root>`
+	//Enveloped RSA signature over the whole document
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nxml := native_xml.NewNativeXml()
+	nxml.ReadFromString(signxmlstr)
+	if _, err = native_xml.NewXmlSigner(rsakey).SignEnveloped(nxml.XmlRoot); err != nil {
+		t.Fatalf("SignEnveloped rsa: %v", err)
+	}
+	signed := native_xml.NewNativeXml()
+	signed.ReadFromString(nxml.WriteToString())
+	if _, err = signed.VerifySignatures(native_xml.NewXmlVerifier(&rsakey.PublicKey)); err != nil {
+		t.Fatalf("VerifySignatures rsa: %v\n%s", err, nxml.WriteToString())
+	}
+	signed.SetNodeValueForPath("/Root/Note", "changed")
+	if _, err = signed.VerifySignatures(native_xml.NewXmlVerifier(&rsakey.PublicKey)); err == nil {
+		t.Fatalf("VerifySignatures rsa accepted a changed document")
+	}
+	//Enveloped ECDSA signature over an element referenced by Id
+	eckey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nxml.ReadFromString(signxmlstr)
+	if _, err = native_xml.NewXmlSigner(eckey).SignEnveloped(nxml.XMLNodeForPath("/Root/Order")); err != nil {
+		t.Fatalf("SignEnveloped ecdsa: %v", err)
+	}
+	signed.ReadFromString(nxml.WriteToString())
+	nodes, err := signed.VerifySignatures(native_xml.NewXmlVerifier(&eckey.PublicKey))
+	if err != nil || len(nodes) != 1 || nodes[0] != signed.XMLNodeForPath("/Root/Order") {
+		t.Fatalf("VerifySignatures ecdsa: %v %v", err, nodes)
+	}
+	//The signed element moved into a wrapper still verifies,but a forged element in its place is not signed
+	order := nxml.WriteToString()
+	start, end := strings.Index(order, "<Order"), strings.Index(order, "</Order>")+len("</Order>")
+	wrapped := native_xml.NewNativeXml()
+	wrapped.ReadFromString(order[:start] + `<Order Id="o2" a:No="7">Value&amp;1000</Order>` + order[end:len(order)-len("</Root>")] +
+		"<Wrap>" + order[start:end] + "</Wrap></Root>")
+	if nodes, err = wrapped.VerifySignatures(native_xml.NewXmlVerifier(&eckey.PublicKey)); err != nil ||
+		len(nodes) != 1 || nodes[0] != wrapped.XMLNodeForPath("/Root/Wrap/Order") {
+		t.Fatalf("VerifySignatures wrapped: %v %v", err, nodes)
+	}
+	if err = wrapped.VerifyNode(wrapped.XMLNodeForPath("/Root/Order"), native_xml.NewXmlVerifier(&eckey.PublicKey)); err == nil {
+		t.Fatalf("VerifyNode accepted a forged element")
+	}
+	if err = signed.VerifyNode(signed.XMLNodeForPath("/Root/Order"), native_xml.NewXmlVerifier(&eckey.PublicKey)); err != nil {
+		t.Fatalf("VerifyNode ecdsa: %v", err)
+	}
+	signed.SetNodeValueForPath("/Root/Note", "changed")
+	if _, err = signed.VerifySignatures(native_xml.NewXmlVerifier(&eckey.PublicKey)); err != nil {
+		t.Fatalf("VerifySignatures ecdsa failed on a change outside the signed element: %v", err)
+	}
+	//Detached HMAC signature over external data
+	secret := []byte("secret")
+	data := []byte("detached data")
+	nxml.ReadFromString(signxmlstr)
+	if _, err = native_xml.NewXmlSigner(secret).SignDetached(nxml.XmlRoot,
+		native_xml.TXmlSigReference{URI: "data.bin", Data: data}); err != nil {
+		t.Fatalf("SignDetached hmac: %v", err)
+	}
+	signed.ReadFromString(nxml.WriteToString())
+	verifier := native_xml.NewXmlVerifier(secret)
+	if _, err = signed.VerifySignatures(verifier); err == nil {
+		t.Fatalf("VerifySignatures hmac accepted an unresolved reference")
+	}
+	verifier.Resolver = func(URI string) ([]byte, error) {
+		if URI == "data.bin" {
+			return data, nil
+		}
+		return nil, errors.New("not found " + URI)
+	}
+	if _, err = signed.VerifySignatures(verifier); err != nil {
+		t.Fatalf("VerifySignatures hmac: %v", err)
+	}
+	//signed.xml was signed with libxml2 exclusive c14n (xmllint --exc-c14n) and openssl,
+	//signed.c14n is the canonical document without the signature
+	data, err = os.ReadFile(filepath.Join("testdata", "dsig", "signed.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c14n, err := os.ReadFile(filepath.Join("testdata", "dsig", "signed.c14n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemdata, err := os.ReadFile(filepath.Join("testdata", "dsig", "rsa.pub.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pemdata)
+	pubkey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, preserve := range []bool{false, true} {
+		signed = native_xml.NewNativeXml()
+		signed.PreserveSource = preserve
+		signed.ReadFromString(string(data))
+		canonicalizer := &native_xml.TXmlCanonicalizer{Exclusive: true, Exclude: signed.Signatures()[0]}
+		if got := canonicalizer.WriteToString(signed.XmlRoot); got != string(c14n) {
+			t.Fatalf("Exclusive c14n (preserve %v):\n%s", preserve, got)
+		}
+		if _, err = signed.VerifySignatures(native_xml.NewXmlVerifier(pubkey)); err != nil {
+			t.Fatalf("VerifySignatures external (preserve %v): %v", preserve, err)
+		}
+	}
+	//Text that Value does not hold must be signed as well
+	for _, changed := range [][2]string{{"<m>x<b/>", "<m>X<b/>"}, {"<a>\n    <b>", "<a>\n  <b>"},
+		{"z&#xD;", "z\r\n"}, {"one\ntwo", "one  two"}} {
+		signed.ReadFromString(strings.Replace(string(data), changed[0], changed[1], 1))
+		if _, err = signed.VerifySignatures(native_xml.NewXmlVerifier(pubkey)); err == nil {
+			t.Fatalf("VerifySignatures external accepted %q changed to %q", changed[0], changed[1])
+		}
+	}
+	//A document read with its layout is signed as it is written
+	for _, preserve := range []bool{false, true} {
+		nxml = native_xml.NewNativeXml()
+		nxml.PreserveSource = preserve
+		nxml.ReadFromString("<a>\n  <b> x </b>\n  <c>x<d/>y</c>\n</a>")
+		if _, err = native_xml.NewXmlSigner(rsakey).SignEnveloped(nxml.XmlRoot); err != nil {
+			t.Fatalf("SignEnveloped layout: %v", err)
+		}
+		signed.ReadFromString(nxml.WriteToString())
+		if _, err = signed.VerifySignatures(native_xml.NewXmlVerifier(&rsakey.PublicKey)); err != nil {
+			t.Fatalf("VerifySignatures layout (preserve %v): %v\n%s", preserve, err, nxml.WriteToString())
+		}
+	}
+	//The readable format indents the signed element and the signature
+	for _, path := range []string{"/Root", "/Root/Order"} {
+		nxml = native_xml.NewNativeXml()
+		nxml.ReadFromString(`<Root xmlns="urn:test"><!--c--><Order Id="o1"><Item>1</Item><Item>2</Item></Order><Note>n</Note></Root>`)
+		nxml.SetXmlFormat(true)
+		nxml.IndentString = "  "
+		nxml.FormatOptions.AttributesPerLine = 1
+		if _, err = native_xml.NewXmlSigner(rsakey).SignEnveloped(nxml.XMLNodeForPath(path)); err != nil {
+			t.Fatalf("SignEnveloped readable: %v", err)
+		}
+		signed.ReadFromString(nxml.WriteToString())
+		if _, err = signed.VerifySignatures(native_xml.NewXmlVerifier(&rsakey.PublicKey)); err != nil {
+			t.Fatalf("VerifySignatures readable %s: %v\n%s", path, err, nxml.WriteToString())
+		}
+	}
+}
+func Test_Format_nativexml(t *testing.T) {
+	nxml := native_xml.NewNativeXml()
+	nxml.ReadFromString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Root>\n  <A a=\"1\" b=\"2\" c=\"3\"/>\n\n\n  <B/>\n</Root>")
+	nxml.SetXmlFormat(true)
+	nxml.FormatOptions.LineFeed = "\n"
+	nxml.FormatOptions.AttributesPerLine = 2
+	nxml.FormatOptions.PreserveBlankLines = true
+	nxml.FormatOptions.FullNodes = map[string]bool{"B": false}
+	expect := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Root>\n  <A a=\"1\" b=\"2\"\n     c=\"3\"></A>\n\n\n  <B/>\n</Root>\n"
+	if nxml.WriteToString() != expect {
+		t.Fatalf("WriteToString with format options:\n%q\n!=\n%q", nxml.WriteToString(), expect)
+	}
+	nxml.FormatOptions.OmitDeclaration = true
+	nxml.FormatOptions.AttributesPerLine = 0
+	nxml.FormatOptions.MaxLineWidth = 14
+	nxml.FormatOptions.PreserveBlankLines = false
+	expect = "<Root>\n  <A a=\"1\"\n     b=\"2\"\n     c=\"3\"></A>\n  <B/>\n</Root>\n"
+	if nxml.WriteToString() != expect {
+		t.Fatalf("WriteToString with max line width:\n%q\n!=\n%q", nxml.WriteToString(), expect)
+	}
+}
+func Test_PreserveSource_nativexml(t *testing.T) {
+	srcxmlstr := "<?xml version='1.0'?>\n<!-- top -->\n<!DOCTYPE r [\n <!ELEMENT r (a)*>\n <!-- it's > -->\n]>\n" +
+		"<r  b='1'   a=\"2\">\n\t<a x='1' >v</a>\n\n\t<c/>\n\t<d>keep  </d>\n</r>\n<!-- end -->\n"
+	nxml := native_xml.NewNativeXml()
+	nxml.PreserveSource = true
+	nxml.ReadFromString(srcxmlstr)
+	if nxml.WriteToString() != srcxmlstr {
+		t.Fatalf("WriteToString unchanged:\n%q\n!=\n%q", nxml.WriteToString(), srcxmlstr)
+	}
+	nxml.SetNodeValueForPath("/r/a", "new")
+	nxml.SetAttribute("/r", "z", "9")
+	nxml.AddNodeForPath("/r/e")
+	nxml.RemoveNode("/r/c")
+	expect := "<?xml version='1.0'?>\n<!-- top -->\n<!DOCTYPE r [\n <!ELEMENT r (a)*>\n <!-- it's > -->\n]>\n" +
+		"<r b='1' a=\"2\" z=\"9\">\n\t<a x='1' >new</a>\n\t<d>keep  </d>\n\t<e></e>\n</r>\n<!-- end -->\n"
+	if nxml.WriteToString() != expect {
+		t.Fatalf("WriteToString changed:\n%q\n!=\n%q", nxml.WriteToString(), expect)
+	}
+}
+
+var dtdxmlstr = `<!DOCTYPE note PUBLIC "-//X//DTD Note//EN" "note.dtd" [
+  <!ENTITY % common "id ID #REQUIRED">
+  <!ELEMENT note (to+,from?,(body|text)*)>
+  <!ELEMENT to (#PCDATA)>
+  <!ELEMENT from (#PCDATA)>
+  <!ELEMENT body (#PCDATA|b)*>
+  <!ELEMENT b (#PCDATA)>
+  <!-- it's a comment with > ] -->
+  <!ATTLIST note %common; type (a|b) "a" ver CDATA #FIXED "1.0" ref IDREF #IMPLIED>
+  <!ATTLIST to id ID #IMPLIED>
+  <!ENTITY company "ACME">
+  <!ENTITY logo SYSTEM "logo.gif" NDATA gif>
+  <!NOTATION gif PUBLIC "image/gif">
+]>
+<note id="n1" ver="1.0"><to>x</to><body>b</body></note>`
+
+func Test_Dtd_nativexml(t *testing.T) {
+	nxml := native_xml.NewNativeXml()
+	nxml.ReadFromString(dtdxmlstr)
+	dtd, err := nxml.Dtd()
+	if err != nil {
+		t.Fatalf("Dtd: %v", err)
+	}
+	if dtd.Name != "note" || dtd.PublicID != "-//X//DTD Note//EN" || dtd.SystemID != "note.dtd" {
+		t.Fatalf("Dtd external id %s %s %s", dtd.Name, dtd.PublicID, dtd.SystemID)
+	}
+	if note := dtd.Elements["note"]; note == nil || note.ContentType != "CHILDREN" || note.Content.String() != "(to+,from?,(body|text)*)" {
+		t.Fatalf("Dtd element note %v", note)
+	}
+	if body := dtd.Elements["body"]; body == nil || body.ContentType != "MIXED" || body.Content.String() != "(b)*" {
+		t.Fatalf("Dtd element body %v", body)
+	}
+	if attr := dtd.AttributeDecl("note", "id"); attr == nil || attr.Type != "ID" || attr.Default != "#REQUIRED" {
+		t.Fatalf("Dtd attribute note/id %v", attr)
+	}
+	if attr := dtd.AttributeDecl("note", "type"); attr == nil || attr.Type != "ENUMERATION" || len(attr.Values) != 2 || attr.Value != "a" {
+		t.Fatalf("Dtd attribute note/type %v", attr)
+	}
+	if dtd.Entities["company"] == nil || dtd.Entities["company"].Value != "ACME" || dtd.Entities["logo"].Notation != "gif" {
+		t.Fatalf("Dtd entities %v", dtd.Entities)
+	}
+	if dtd.Notations["gif"] == nil || dtd.Notations["gif"].PublicID != "image/gif" {
+		t.Fatalf("Dtd notations %v", dtd.Notations)
+	}
+	if again, _ := nxml.Dtd(); again != dtd {
+		t.Fatalf("Dtd parsed again")
+	}
+	for _, v := range nxml.RootNodes {
+		if v.Name == "DTD" {
+			v.Value = "other"
+		}
+	}
+	if again, _ := nxml.Dtd(); again == dtd || again.Name != "other" {
+		t.Fatalf("Dtd not parsed after a change")
+	}
+	//Ten references per level,six levels deep
+	subset := `<!ENTITY % p0 "x">`
+	for i := 1; i <= 6; i++ {
+		subset += fmt.Sprintf(`<!ENTITY %% p%d "%s">`, i, strings.Repeat(fmt.Sprintf("%%p%d;", i-1), 10))
+	}
+	_, err = native_xml.ParseDtd(`a [` + subset + `<!ELEMENT a (%p6; c)*>]`)
+	var limit *native_xml.TXmlEntityLimitError
+	if !errors.As(err, &limit) || limit.Limit != native_xml.LimitEntitySize {
+		t.Fatalf("Parameter entity fan-out: %v", err)
+	}
+}
+func Test_ValidateDTD_nativexml(t *testing.T) {
+	//The declarations are all in the internal subset,note.dtd is empty
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "note.dtd"), nil, 0644)
+	nxml := native_xml.NewNativeXml()
+	nxml.ReadFromString(dtdxmlstr)
+	nxml.EntityOptions.Resolver = native_xml.NewXmlFileResolver(dir)
+	if errs := nxml.ValidateDTD(); len(errs) != 0 {
+		t.Fatalf("ValidateDTD valid document: %v", errs)
+	}
+	nxml.SetAttribute("/note", "ver", "2.0")
+	nxml.SetAttribute("/note", "type", "c")
+	nxml.SetAttribute("/note", "ref", "n2")
+	nxml.SetAttribute("/note/to", "id", "n1")
+	nxml.AddNodeForPath("/note/from")
+	nxml.AddNodeForPath("/note/unknown")
+	expect := map[string]bool{
+		"/note: Attribute \"ver\" must have the fixed value \"1.0\"":                 true,
+		"/note: Value \"c\" of attribute \"type\" is not one of (a|b)":               true,
+		"/note: Content of element \"note\" does not match (to+,from?,(body|text)*)": true,
+		"/note/to: Duplicate ID \"n1\"":                                              true,
+		"/note/unknown: Element \"unknown\" is not declared":                         true,
+		"/note: IDREF \"n2\" does not match any ID":                                  true,
+	}
+	errs := nxml.ValidateDTD()
+	for _, err := range errs {
+		if !expect[err.Path+": "+err.Message] {
+			t.Fatalf("ValidateDTD unexpected violation %s", err.Error())
+		}
+		delete(expect, err.Path+": "+err.Message)
+	}
+	if len(expect) > 0 {
+		t.Fatalf("ValidateDTD missing violations %v", expect)
+	}
+	//The external subset is read through the resolver or reported as not loaded
+	external := `<!DOCTYPE a SYSTEM "a.dtd"><a><undeclared/></a>`
+	nxml = native_xml.NewNativeXml()
+	nxml.ReadFromString(external)
+	if errs = nxml.ValidateDTD(); len(errs) != 1 || !strings.Contains(errs[0].Message, "was not loaded") {
+		t.Fatalf("ValidateDTD without external subset: %v", errs)
+	}
+	os.WriteFile(filepath.Join(dir, "a.dtd"), []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!ENTITY % keep "INCLUDE">
+<![%keep;[<!ELEMENT a (b*)> <![IGNORE[<!ELEMENT undeclared EMPTY> <![INCLUDE[]]> ]]>]]>
+<![IGNORE[<!ELEMENT undeclared EMPTY>]]>
+<!ELEMENT b EMPTY>`), 0644)
+	nxml.EntityOptions.Resolver = native_xml.NewXmlFileResolver(dir)
+	errs = nxml.ValidateDTD()
+	if len(errs) != 2 || errs[1].Message != "Element \"undeclared\" is not declared" {
+		t.Fatalf("ValidateDTD with external subset: %v", errs)
+	}
+	nxml.ReadFromString(`<!DOCTYPE a SYSTEM "a.dtd"><a><b/></a>`)
+	nxml.EntityOptions.Resolver = native_xml.NewXmlFileResolver(dir)
+	if errs = nxml.ValidateDTD(); len(errs) != 0 {
+		t.Fatalf("ValidateDTD valid with external subset: %v", errs)
+	}
+	nxml.EntityOptions.Resolver = native_xml.NewXmlFileResolver(t.TempDir())
+	if errs = nxml.ValidateDTD(); len(errs) != 1 || !strings.Contains(errs[0].Message, "a.dtd") {
+		t.Fatalf("ValidateDTD missing external subset: %v", errs)
+	}
+}
+
+var xsdmainstr = `<?xml version="1.0"?>
+<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns="urn:order" xmlns:adr="urn:address"
+  targetNamespace="urn:order" elementFormDefault="qualified">
+  <xs:include schemaLocation="types.xsd"/>
+  <xs:import namespace="urn:address" schemaLocation="sub/address.xsd"/>
+  <xs:element name="order">
+    <xs:complexType>
+      <xs:sequence>
+        <xs:element name="date" type="xs:date"/>
+        <xs:element ref="adr:address" minOccurs="0"/>
+        <xs:element name="item" type="itemType" maxOccurs="unbounded"/>
+        <xs:choice>
+          <xs:element name="paid" type="xs:boolean"/>
+          <xs:element name="due" type="xs:date"/>
+        </xs:choice>
+      </xs:sequence>
+      <xs:attribute name="id" type="skuType" use="required"/>
+      <xs:attribute name="status" default="new">
+        <xs:simpleType>
+          <xs:restriction base="xs:token">
+            <xs:enumeration value="new"/>
+            <xs:enumeration value="sent"/>
+          </xs:restriction>
+        </xs:simpleType>
+      </xs:attribute>
+    </xs:complexType>
+  </xs:element>
+</xs:schema>`
+
+var xsdtypesstr = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+  <xs:simpleType name="skuType">
+    <xs:restriction base="xs:string">
+      <xs:pattern value="\d{3}-[A-Z]{2}"/>
+    </xs:restriction>
+  </xs:simpleType>
+  <xs:complexType name="itemType">
+    <xs:simpleContent>
+      <xs:extension base="amountType">
+        <xs:attribute name="sku" type="skuType"/>
+      </xs:extension>
+    </xs:simpleContent>
+  </xs:complexType>
+  <xs:simpleType name="amountType">
+    <xs:restriction base="xs:decimal">
+      <xs:minInclusive value="0"/>
+      <xs:maxExclusive value="1000"/>
+      <xs:fractionDigits value="2"/>
+    </xs:restriction>
+  </xs:simpleType>
+</xs:schema>`
+
+var xsdaddressstr = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" targetNamespace="urn:address">
+  <xs:element name="address">
+    <xs:complexType>
+      <xs:attribute name="zip" use="required">
+        <xs:simpleType>
+          <xs:restriction base="xs:string">
+            <xs:length value="5"/>
+          </xs:restriction>
+        </xs:simpleType>
+      </xs:attribute>
+    </xs:complexType>
+  </xs:element>
+</xs:schema>`
+
+var xsdorderstr = `<order xmlns="urn:order" xmlns:a="urn:address" id="123-AB">
+  <date>2024-02-29</date>
+  <a:address zip="12345"/>
+  <item sku="456-CD">12.50</item>
+  <item>3</item>
+  <paid>true</paid>
+</order>`
+
+func Test_Schema_nativexml(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "order.xsd"), []byte(xsdmainstr), 0644)
+	os.WriteFile(filepath.Join(dir, "types.xsd"), []byte(xsdtypesstr), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "address.xsd"), []byte(xsdaddressstr), 0644)
+	schema, err := native_xml.LoadXmlSchema(filepath.Join(dir, "order.xsd"))
+	if err != nil {
+		t.Fatalf("LoadXmlSchema %v", err)
+	}
+	nxml := native_xml.NewNativeXml()
+	nxml.ReadFromString(xsdorderstr)
+	if errs := nxml.ValidateSchema(schema); len(errs) != 0 {
+		t.Fatalf("ValidateSchema valid document: %v", errs)
+	}
+	nxml.SetAttribute("/order", "id", "12-AB")
+	nxml.SetAttribute("/order", "status", "lost")
+	nxml.SetAttribute("/order/a:address", "zip", "123")
+	nxml.SetNodeValueForPath("/order/item[2]", "1000")
+	nxml.SetNodeValueForPath("/order/date", "2024-13-01")
+	expect := map[string]bool{
+		"/order: id: Value \"12-AB\" does not match pattern \"\\d{3}-[A-Z]{2}\"": true,
+		"/order: status: Value \"lost\" is not one of the enumerated values":     true,
+		"/order/a:address: zip: Length of value \"123\" must be 5":               true,
+		"/order/item[2]: Value \"1000\" must be less than 1000":                  true,
+		"/order/date: Value \"2024-13-01\" is not a valid date":                  true,
+	}
+	errs := nxml.ValidateSchema(schema)
+	for _, err := range errs {
+		if !expect[err.Path+": "+err.Message] {
+			t.Fatalf("ValidateSchema unexpected violation %s", err.Error())
+		}
+		delete(expect, err.Path+": "+err.Message)
+	}
+	if len(expect) > 0 {
+		t.Fatalf("ValidateSchema missing violations %v", expect)
+	}
+	nxml.ReadFromString(`<order xmlns="urn:order" id="123-AB"><item>1</item><date>2024-01-01</date></order>`)
+	errs = nxml.ValidateSchema(schema)
+	if len(errs) == 0 || errs[0].Path != "/order/item" || errs[0].Line != 1 {
+		t.Fatalf("ValidateSchema content order %v", errs)
+	}
+	//types.xsd has no target namespace and takes the one of each schema including it
+	os.WriteFile(filepath.Join(dir, "both.xsd"), []byte(`<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" targetNamespace="urn:both">
+  <xs:import namespace="urn:order" schemaLocation="order.xsd"/>
+  <xs:include schemaLocation="types.xsd"/>
+</xs:schema>`), 0644)
+	if schema, err = native_xml.LoadXmlSchema(filepath.Join(dir, "both.xsd")); err != nil {
+		t.Fatalf("LoadXmlSchema chameleon %v", err)
+	}
+	if schema.Types["{urn:order}skuType"] == nil || schema.Types["{urn:both}skuType"] == nil {
+		t.Fatalf("Chameleon include in two namespaces")
+	}
+	os.WriteFile(filepath.Join(dir, "redefine.xsd"), []byte(`<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" targetNamespace="urn:order">
+  <xs:redefine schemaLocation="types.xsd"/>
+</xs:schema>`), 0644)
+	if _, err = native_xml.LoadXmlSchema(filepath.Join(dir, "redefine.xsd")); err == nil || !strings.Contains(err.Error(), "redefine") {
+		t.Fatalf("LoadXmlSchema redefine %v", err)
+	}
+}
+
+var entityxmlstr = `<?xml version="1.0"?>
+<!DOCTYPE doc [
+  <!ENTITY company "ACME &amp; Sons">
+  <!ENTITY owner "&company; Ltd">
+  <!ENTITY sig "<sig by='&company;'>regards</sig>">
+  <!ENTITY chapter SYSTEM "chapter.xml">
+  <!ENTITY passwd SYSTEM "../passwd">
+]>
+<doc from="&owner;"><body>&sig;</body><text>&chapter;</text></doc>`
+
+var laughsxmlstr = `<?xml version="1.0"?>
+<!DOCTYPE lolz [
+  <!ENTITY lol "lol">
+  <!ENTITY lol1 "&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;">
+  <!ENTITY lol2 "&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;">
+  <!ENTITY lol3 "&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;">
+  <!ENTITY lol4 "&lol3;&lol3;&lol3;&lol3;&lol3;&lol3;&lol3;&lol3;&lol3;&lol3;">
+  <!ENTITY lol5 "&lol4;&lol4;&lol4;&lol4;&lol4;&lol4;&lol4;&lol4;&lol4;&lol4;">
+  <!ENTITY lol6 "&lol5;&lol5;&lol5;&lol5;&lol5;&lol5;&lol5;&lol5;&lol5;&lol5;">
+  <!ENTITY lol7 "&lol6;&lol6;&lol6;&lol6;&lol6;&lol6;&lol6;&lol6;&lol6;&lol6;">
+  <!ENTITY lol8 "&lol7;&lol7;&lol7;&lol7;&lol7;&lol7;&lol7;&lol7;&lol7;&lol7;">
+  <!ENTITY lol9 "&lol8;&lol8;&lol8;&lol8;&lol8;&lol8;&lol8;&lol8;&lol8;&lol8;">
+]>
+<lolz>&lol9;</lolz>`
+
+func readxmlerror(nxml *native_xml.TNativeXml, xmlstr string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	nxml.ReadFromString(xmlstr)
+	return nil
+}
+func Test_Entity_nativexml(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "docs"), 0755)
+	os.WriteFile(filepath.Join(dir, "docs", "chapter.xml"), []byte(`<?xml version="1.0" encoding="UTF-8"?>Chapter by &company;`), 0644)
+	os.WriteFile(filepath.Join(dir, "passwd"), []byte("secret"), 0644)
+	nxml := native_xml.NewNativeXml()
+	nxml.ReadFromString(entityxmlstr)
+	if nxml.GetAttribute("/doc", "from") != "&owner;" {
+		t.Fatalf("Entity expanded without Expand: %s", nxml.GetAttribute("/doc", "from"))
+	}
+	nxml.EntityOptions = native_xml.TXmlEntityOptions{Expand: true}
+	nxml.ReadFromString(entityxmlstr)
+	if v := nxml.GetAttribute("/doc", "from"); v != "ACME &amp; Sons Ltd" {
+		t.Fatalf("Entity nested expansion: %s", v)
+	}
+	if v := nxml.GetAttribute("/doc/body/sig", "by"); v != "ACME &amp; Sons" || nxml.GetNodeValueForPath("/doc/body/sig") != "regards" {
+		t.Fatalf("Entity markup expansion: %s", nxml.WriteToString())
+	}
+	if v := nxml.GetNodeValueForPath("/doc/text"); v != "&chapter;" {
+		t.Fatalf("External entity expanded without resolver: %s", v)
+	}
+	nxml.EntityOptions.Resolver = native_xml.NewXmlFileResolver(filepath.Join(dir, "docs"))
+	if err := readxmlerror(nxml, entityxmlstr); err != nil {
+		t.Fatalf("External entity: %v", err)
+	}
+	if v := nxml.GetNodeValueForPath("/doc/text"); v != "Chapter by ACME &amp; Sons" {
+		t.Fatalf("External entity expansion: %s", v)
+	}
+	if err := readxmlerror(nxml, strings.Replace(entityxmlstr, "&chapter;", "&passwd;", 1)); err == nil {
+		t.Fatalf("External entity outside the base directory was read")
+	}
+	//The elements of a replacement text take the place of the reference among the text and child nodes
+	nxml.ReadFromString(`<!DOCTYPE p [<!ENTITY m "x<i>in</i>y">]><p>a&m;b<c/>d&m;</p>`)
+	names := []string{}
+	for _, v := range nxml.XmlRoot.NodeList() {
+		names = append(names, v.Name)
+	}
+	if strings.Join(names, ",") != "i,c,i" {
+		t.Fatalf("Expanded node order %v", names)
+	}
+	if c14n := (&native_xml.TXmlCanonicalizer{}).WriteToString(nxml.XmlRoot); c14n != "<p>ax<i>in</i>yb<c></c>dx<i>in</i>y</p>" {
+		t.Fatalf("Expanded mixed content %s", c14n)
+	}
+	nxml.EntityOptions = native_xml.TXmlEntityOptions{Expand: true, MaxSize: 100000}
+	if err := readxmlerror(nxml, laughsxmlstr); err == nil || !strings.Contains(err.Error(), "exceeds 100000 bytes") {
+		t.Fatalf("Billion laughs: %v", err)
+	}
+	nxml.EntityOptions = native_xml.TXmlEntityOptions{Expand: true, MaxDepth: 5}
+	if err := readxmlerror(nxml, laughsxmlstr); err == nil || !strings.Contains(err.Error(), "deeper than 5") {
+		t.Fatalf("Entity depth: %v", err)
+	}
+	//Parameter entities in the doctype are expanded within the same limits
+	subset := `<!ENTITY % p0 "<!ELEMENT x ANY>">`
+	for i := 1; i <= 4; i++ {
+		subset += fmt.Sprintf(`<!ENTITY %% p%d "%s">`, i, strings.Repeat(fmt.Sprintf("%%p%d;", i-1), 10))
+	}
+	fanout := `<!DOCTYPE a [` + subset + `%p4;]><a>&amp;</a>`
+	var limit *native_xml.TXmlEntityLimitError
+	for _, c := range []struct {
+		options native_xml.TXmlEntityOptions
+		limit   string
+	}{
+		{native_xml.TXmlEntityOptions{Expand: true, MaxSize: 10000}, native_xml.LimitEntitySize},
+		{native_xml.TXmlEntityOptions{Expand: true, MaxDepth: 3}, native_xml.LimitEntityDepth},
+	} {
+		nxml.EntityOptions = c.options
+		if err := nxml.ParseString(fanout); !errors.As(err, &limit) || limit.Limit != c.limit {
+			t.Fatalf("Parameter entity fan-out %s: %v", c.limit, err)
+		}
+	}
+	nxml.EntityOptions = native_xml.TXmlEntityOptions{Expand: true}
+	if err := nxml.ParseString(fanout); err != nil {
+		t.Fatalf("Parameter entities within the limits: %v", err)
+	}
+	if dtd, err := nxml.Dtd(); err != nil || dtd.Elements["x"] == nil {
+		t.Fatalf("Parameter entity declarations: %v", err)
+	}
+	nxml.EntityOptions.MaxSize = 100
+	if _, err := nxml.Dtd(); !errors.As(err, &limit) {
+		t.Fatalf("Dtd with a smaller MaxSize: %v", err)
+	}
+	//A symbolic link below the base directory may not lead out of it
+	nxml.EntityOptions = native_xml.TXmlEntityOptions{Expand: true, Resolver: native_xml.NewXmlFileResolver(filepath.Join(dir, "docs"))}
+	if err := os.Symlink(filepath.Join(dir, "passwd"), filepath.Join(dir, "docs", "link.xml")); err != nil {
+		t.Skipf("Symlink: %v", err)
+	}
+	linkxmlstr := strings.Replace(strings.Replace(entityxmlstr, "../passwd", "link.xml", 1), "&chapter;", "&passwd;", 1)
+	if err := readxmlerror(nxml, linkxmlstr); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Fatalf("External entity linked outside the base directory: %v", err)
+	}
+}
+func Test_ParseLimits_nativexml(t *testing.T) {
+	nxml := native_xml.NewNativeXml()
+	if err := nxml.ParseString(xmlstr); err != nil {
+		t.Fatalf("ParseString without limits: %v", err)
+	}
+	cases := []struct {
+		options native_xml.TXmlParseOptions
+		xml     string
+		limit   string
+	}{
+		{native_xml.TXmlParseOptions{MaxDepth: 50}, strings.Repeat("<a>", 100) + strings.Repeat("</a>", 100), native_xml.LimitDepth},
+		{native_xml.TXmlParseOptions{MaxAttributes: 2}, `<a x="1" y="2" z="3"/>`, native_xml.LimitAttributes},
+		{native_xml.TXmlParseOptions{MaxNameLength: 8}, `<averyverylongname/>`, native_xml.LimitNameLength},
+		{native_xml.TXmlParseOptions{MaxNameLength: 8}, `<a averyverylongname="1"/>`, native_xml.LimitNameLength},
+		{native_xml.TXmlParseOptions{MaxTextSize: 100}, "<a>" + strings.Repeat("x", 1000) + "</a>", native_xml.LimitTextSize},
+		{native_xml.TXmlParseOptions{MaxTextSize: 100}, "<a><!--" + strings.Repeat("x", 1000) + "--></a>", native_xml.LimitTextSize},
+		{native_xml.TXmlParseOptions{MaxNodes: 10}, "<a>" + strings.Repeat("<b/>", 20) + "</a>", native_xml.LimitNodes},
+		{native_xml.TXmlParseOptions{MaxInputBytes: 10}, "<a>" + strings.Repeat(" ", 20) + "</a>", native_xml.LimitInputBytes},
+		{native_xml.TXmlParseOptions{}, strings.Repeat("<a>", 1<<20), native_xml.LimitDepth},
+	}
+	for _, c := range cases {
+		nxml.ParseOptions = c.options
+		err := nxml.ParseString(c.xml)
+		var limit *native_xml.TXmlLimitError
+		if !errors.As(err, &limit) || limit.Limit != c.limit {
+			t.Fatalf("ParseString limit %s: %v", c.limit, err)
+		}
+		if err = nxml.ParseReader(strings.NewReader(c.xml)); !errors.As(err, &limit) || limit.Limit != c.limit {
+			t.Fatalf("ParseReader limit %s: %v", c.limit, err)
+		}
+	}
+	nxml.ParseOptions = native_xml.DefaultParseOptions()
+	if err := nxml.ParseString(xmlstr); err != nil {
+		t.Fatalf("ParseString with default limits: %v", err)
+	}
+	//Content model groups are nested no deeper than elements
+	model := func(n int) string {
+		return "<!DOCTYPE a [<!ELEMENT a " + strings.Repeat("(", n) + "a?" + strings.Repeat(")", n) + ">]><a/>"
+	}
+	for _, c := range []struct {
+		maxDepth, groups int
+		expand           bool
+	}{{0, 3 << 20, false}, {0, 3 << 20, true}, {50, 100, false}} {
+		nxml = native_xml.NewNativeXml()
+		nxml.ParseOptions = native_xml.DefaultParseOptions()
+		nxml.ParseOptions.MaxDepth = c.maxDepth
+		nxml.EntityOptions.Expand = c.expand
+		var limit *native_xml.TXmlLimitError
+		err := nxml.ParseString(model(c.groups))
+		if c.expand {
+			if !errors.As(err, &limit) || limit.Limit != native_xml.LimitDepth {
+				t.Fatalf("ParseString nested content model: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ParseString nested content model: %v", err)
+		}
+		if _, err = nxml.Dtd(); !errors.As(err, &limit) || limit.Limit != native_xml.LimitDepth {
+			t.Fatalf("Dtd nested content model %d: %v", c.groups, err)
+		}
+		if errs := nxml.ValidateDTD(); len(errs) != 1 {
+			t.Fatalf("ValidateDTD nested content model: %v", errs)
+		}
+	}
+	nxml.ParseString(model(50))
+	if errs := nxml.ValidateDTD(); len(errs) != 0 {
+		t.Fatalf("ValidateDTD content model within MaxDepth: %v", errs)
+	}
+}
+func Test_Recover_nativexml(t *testing.T) {
+	broken := `<feed><Item id=7 hidden><title>Fish & Chips</TITLE><price cur="EUR">3</price></item>
+<item><title>Tea</title></bogus><note>open</feed>`
+	nxml := native_xml.NewNativeXml()
+	if err := nxml.ParseString(broken); err == nil {
+		t.Fatalf("Broken document read without recovery")
+	}
+	nxml.RecoverErrors = true
+	if err := nxml.ParseString(broken); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if v := nxml.GetNodeValueForPath("/feed/Item/title"); v != "Fish &amp; Chips" {
+		t.Fatalf("Recover stray ampersand: %s", v)
+	}
+	if nxml.GetAttribute("/feed/Item", "id") != "7" || nxml.GetAttribute("/feed/Item", "hidden") != "hidden" {
+		t.Fatalf("Recover attributes: %v", nxml.XMLNodeForPath("/feed/Item").Attributes)
+	}
+	if nxml.GetNodeValueForPath("/feed/item/title") != "Tea" || nxml.GetNodeValueForPath("/feed/item/note") != "open" {
+		t.Fatalf("Recover auto close: %s", nxml.WriteToString())
+	}
+	expect := []string{
+		`(1:7): Value of attribute "id" is not quoted`,
+		`(1:7): Attribute "hidden" has no value`,
+		`(1:44): Close tag "</TITLE>" does not match the case of element "title"`,
+		`(1:44): Stray "&" in element "title",escaped`,
+		`(1:78): Close tag "</item>" does not match the case of element "Item"`,
+		`(2:25): Close tag "</bogus>" without open element,ignored`,
+		`(2:43): Element "note" is not closed,closed by "</feed>"`,
+		`(2:43): Element "item" is not closed,closed by "</feed>"`,
+	}
+	got := make([]string, len(nxml.Warnings))
+	for i, w := range nxml.Warnings {
+		got[i] = w.Error()
+	}
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("Recover warnings:\n%s", strings.Join(got, "\n"))
+	}
+}
+func Test_Names_nativexml(t *testing.T) {
+	for name, valid := range map[string]bool{"item": true, "_x:y-1.2": true, "Größe": true, "数据": true,
+		"1item": false, "a b": false, "a<b": false, "-x": false, "": false, "x×y": false} {
+		if native_xml.IsXmlName(name) != valid {
+			t.Fatalf("IsXmlName(%q) is not %v", name, valid)
+		}
+	}
+	nxml := native_xml.NewNativeXml()
+	for _, xml := range []string{"<1a/>", `<a 2b="x"/>`, "<a>bell\x07</a>", "<a><!-- \x00 --></a>"} {
+		if err := nxml.ParseString(xml); err == nil {
+			t.Fatalf("ParseString accepted %q", xml)
+		}
+	}
+	if err := nxml.ParseString(`<Größe 数据="1">text</Größe>`); err != nil {
+		t.Fatalf("ParseString non-ascii names: %v", err)
+	}
+	nxml.ReadFromString(xmlstr)
+	if nxml.AddNodeForPath("/Root/Body/new<item") || nxml.AddNodeForPath("/Root/9lives") ||
+		nxml.AddNodeForPath("/Root/Fresh/Sub[2]") || nxml.XMLNodeForPath("/Root/Fresh") != nil {
+		t.Fatalf("AddNodeForPath accepted an invalid name")
+	}
+	if !nxml.AddNodeForPath("/Root/Fresh/Sub") || nxml.AddNodeForPathS("/Root", "a/b") {
+		t.Fatalf("AddNodeForPath valid or AddNodeForPathS invalid name")
+	}
+	if nxml.SetNodeValueForPath("/Root/Fresh", "a<b") || nxml.SetNodeValueForPath("/Root/Fresh", "\x01") ||
+		nxml.SetAttribute("/Root/Fresh", "a b", "1") || nxml.SetAttribute("/Root/Fresh", "q", `say "hi"`) {
+		t.Fatalf("Editing accepted invalid text or attribute")
+	}
+	if !nxml.SetNodeValueForPath("/Root/Fresh", "a&lt;b &amp; c") || !nxml.ReplaceNode("/Root/Fresh", native_xml.NewXmlNode("Fresh")) ||
+		nxml.ReplaceNode("/Root/Fresh", native_xml.NewXmlNode("no good")) {
+		t.Fatalf("Editing valid values or ReplaceNode")
+	}
+	nxml.RecoverErrors = true
+	if err := nxml.ParseString("<a>bell\x07</a>"); err != nil || nxml.GetNodeValueForPath("/a") != "bell" || len(nxml.Warnings) != 1 {
+		t.Fatalf("Recover illegal characters: %v %v", err, nxml.Warnings)
+	}
+}
+func Test_Unicode_nativexml(t *testing.T) {
+	unicodexml := "<数据 名称=\"值 «ü»\">\n  <项目 类型='中文'>文本 ñ 😀</项目><!-- 注释 --><ключ/>\n</数据>"
+	nxml := native_xml.NewNativeXml()
+	if err := nxml.ParseString(unicodexml); err != nil {
+		t.Fatalf("ParseString unicode: %v", err)
+	}
+	if nxml.XmlRoot.Name != "数据" || nxml.GetAttribute("/数据", "名称") != "值 «ü»" ||
+		nxml.GetAttribute("/数据/项目", "类型") != "中文" || nxml.GetNodeValueForPath("/数据/项目") != "文本 ñ 😀" {
+		t.Fatalf("ParseString unicode values: %s", nxml.WriteToString())
+	}
+	if line, column := nxml.XMLNodeForPath("/数据/ключ").SourcePosition(); line != 2 || column != 37 {
+		t.Fatalf("SourcePosition unicode: %d:%d", line, column)
+	}
+	out := nxml.WriteToString()
+	if err := nxml.ParseString(out); err != nil || nxml.WriteToString() != out {
+		t.Fatalf("Unicode round trip: %v %s", err, out)
+	}
+	err := nxml.ParseString("<a>\n  <b>ok 数\xff</b></a>")
+	if err == nil || err.Error() != "Invalid UTF-8 byte #xFF at line 2,column 10" {
+		t.Fatalf("Invalid UTF-8: %v", err)
+	}
+	nxml.RecoverErrors = true
+	if err = nxml.ParseString("<a>\n  <b>ok 数\xff</b></a>"); err != nil || nxml.GetNodeValueForPath("/a/b") != "ok 数�" {
+		t.Fatalf("Recover invalid UTF-8: %v %v", err, nxml.Warnings)
+	}
+	node := &native_xml.TXmlNode{}
+	node.ParseTag(` href="ü 数.xsl"  type='text/xsl' title="a'b"`, 0, 0)
+	if len(node.Attributes) != 3 || node.Attributes["href"] != "ü 数.xsl" || node.Attributes["type"] != "text/xsl" ||
+		node.Attributes["title"] != "a'b" {
+		t.Fatalf("ParseTag unicode: %v", node.Attributes)
+	}
+}
+
+func benchmarkxml(items int) string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<catalog>\n")
+	for i := 0; i < items; i++ {
+		fmt.Fprintf(buf, "  <book id=\"bk%d\" lang=\"en\">\n    <author>Author %d</author>\n    <title>Title of book %d &amp; more</title>\n", i, i, i)
+		fmt.Fprintf(buf, "    <price currency=\"EUR\">%d.95</price>\n    <!-- note %d -->\n    <description>A description of the book with some text in it.</description>\n  </book>\n", i%100, i)
+	}
+	buf.WriteString("</catalog>\n")
+	return buf.String()
+}
+
+var benchmarksizes = []int{10, 1000, 10000}
+
+func Test_ReadAllocs_nativexml(t *testing.T) {
+	//Each node needs its attribute and child maps,the scanner itself adds next to nothing.
+	//Those maps bound the throughput of BenchmarkReadFromString,so the allocations per node
+	//are what is held here
+	xml := benchmarkxml(1000)
+	allocs := testing.AllocsPerRun(5, func() {
+		nxml := native_xml.NewNativeXml()
+		nxml.ReadFromString(xml)
+	})
+	if perNode := allocs / (1000 * 6); perNode > 3 {
+		t.Fatalf("ReadFromString: %.2f allocations per node", perNode)
+	}
+	//Illegal characters are found inside and behind blocks of printable ascii
+	for _, text := range []string{"abcdefgh\x01", "abcdefghijklmno\x1F", "\x02abcdefghij", "abcdef数\x0Bghijklmnop"} {
+		nxml := native_xml.NewNativeXml()
+		if err := nxml.ParseString("<a>" + text + "</a>"); err == nil || !strings.Contains(err.Error(), "Illegal character") {
+			t.Fatalf("Illegal character in %q: %v", text, err)
+		}
+	}
+	nxml := native_xml.NewNativeXml()
+	if err := nxml.ParseString("<a b='x>\"y' c=\"'>\">abcdefghijkl\tmnopqrstu数v</a>"); err != nil ||
+		nxml.GetAttribute("/a", "b") != "x>&quot;y" || nxml.GetAttribute("/a", "c") != "'>" {
+		t.Fatalf("Quoted attributes: %v %s", err, nxml.WriteToString())
+	}
+	//Eq may have blanks on both sides
+	if err := nxml.ParseString("<a b = 'x y'\n c\t=\"z\" d/>"); err != nil ||
+		nxml.GetAttribute("/a", "b") != "x y" || nxml.GetAttribute("/a", "c") != "z" || nxml.XmlRoot.HasAttribute("d") {
+		t.Fatalf("Blanks around =: %v %s", err, nxml.WriteToString())
+	}
+}
+func Test_SurplusReader_nativexml(t *testing.T) {
+	//The deprecated stream functions read with the scanner
+	reader := &native_xml.TsdSurplusReader{Reader: bytes.NewReader([]byte("!-- a -->b c='>' d=\"x y\">rest"))}
+	if idx := native_xml.ReadOpenTag(reader); idx != 8 || reader.Surplus != " a -->b c='>' d=\"x y\">rest" {
+		t.Fatalf("ReadOpenTag %d %q", idx, reader.Surplus)
+	}
+	if v, ok := native_xml.ReadStringFromStreamUntil(reader, "-->", false); !ok || v != " a " {
+		t.Fatalf("ReadStringFromStreamUntil %q", v)
+	}
+	if v, ok := native_xml.ReadStringFromStreamWithQuotes(reader, ">"); !ok || v != "b c='>' d=\"x y\"" {
+		t.Fatalf("ReadStringFromStreamWithQuotes %q", v)
+	}
+	if ch, ok := reader.ReadCharSkipBlanks(); !ok || ch != 'r' || reader.Surplus != "est" {
+		t.Fatalf("ReadCharSkipBlanks %c %q", ch, reader.Surplus)
+	}
+	attrs := map[string]string{"old": "1"}
+	native_xml.ParseAttributes("b c='>' d = \"x y\"", 1, 16, attrs)
+	if len(attrs) != 2 || attrs["c"] != ">" || attrs["d"] != "x y" {
+		t.Fatalf("ParseAttributes %v", attrs)
+	}
+	if start, end, ok := native_xml.TrimPos("  ab  ", 0, 5); !ok || start != 2 || end != 3 {
+		t.Fatalf("TrimPos %d %d", start, end)
+	}
+}
+
+func BenchmarkReadFromString(b *testing.B) {
+	//Measured on one core with go1.27: items=1000 reads at 41 MB/s,encoding/xml RawToken
+	//reads the same input at 30 MB/s without building a tree. Without the attribute and child
+	//maps of each node the scanner reads 53 MB/s,100 MB/s is not reached with map fields
+	for _, items := range benchmarksizes {
+		xml := benchmarkxml(items)
+		b.Run(fmt.Sprintf("items=%d", items), func(b *testing.B) {
+			b.SetBytes(int64(len(xml)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				nxml := native_xml.NewNativeXml()
+				nxml.ReadFromString(xml)
+			}
+		})
+	}
+}
+func BenchmarkQuery(b *testing.B) {
+	for _, items := range benchmarksizes {
+		nxml := native_xml.NewNativeXml()
+		nxml.ReadFromString(benchmarkxml(items))
+		b.Run(fmt.Sprintf("items=%d", items), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if nxml.GetNodeValueForPath("/catalog/book/title") == "" ||
+					nxml.GetAttribute("/catalog/book/price", "currency") != "EUR" {
+					b.Fatalf("Query failed")
+				}
+				nxml.XmlNodePathForNode("/catalog/book")
+			}
+		})
+	}
+}
+func BenchmarkWriteToString(b *testing.B) {
+	for _, items := range benchmarksizes {
+		nxml := native_xml.NewNativeXml()
+		nxml.ReadFromString(benchmarkxml(items))
+		b.Run(fmt.Sprintf("items=%d", items), func(b *testing.B) {
+			b.SetBytes(int64(len(nxml.XmlString)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				nxml.WriteToString()
+			}
+		})
+	}
+}
+
+// Seeds of the fuzz targets
+var fuzzxmlstr = []string{
+	"<a/>",
+	"<a b=\"1\" c='2'>text &amp; &#x41;<b/><!-- c --><![CDATA[<d>]]></a>",
+	"<?xml version=\"1.0\"?>\n<!DOCTYPE a [<!ENTITY e \"x\">]>\n<a>&e;</a>",
+	"<a><?pi data?><b>1</b><b>2</b></a>",
+	"<a>\n  <b x=\"&lt;\">数</b>\n</a>",
+	"<a><b></a>",
+	"<a b=c d>",
+	"<a b=0\"\" c='\"'/>",
+}
+
+func fuzzparse(t *testing.T, xml string, Recover bool) (*native_xml.TNativeXml, error) {
+	//A parse error is fine,a runtime panic of the parser is not
+	nxml := native_xml.NewNativeXml()
+	nxml.ParseOptions = native_xml.DefaultParseOptions()
+	nxml.RecoverErrors = Recover
+	err := nxml.ParseString(xml)
+	var rterr runtime.Error
+	if errors.As(err, &rterr) {
+		t.Fatalf("Parser panic on %q: %v", xml, err)
+	}
+	return nxml, err
+}
+func equalxmlnode(a, b *native_xml.TXmlNode) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Name != b.Name || a.Value != b.Value || a.ElementType != b.ElementType ||
+		len(a.Attributes) != len(b.Attributes) {
+		return false
+	}
+	for k, v := range a.Attributes {
+		if w, ok := b.Attributes[k]; !ok || v != w {
+			return false
+		}
+	}
+	alist, blist := a.NodeList(), b.NodeList()
+	if len(alist) != len(blist) {
+		return false
+	}
+	for i := range alist {
+		if !equalxmlnode(alist[i], blist[i]) {
+			return false
+		}
+	}
+	return true
+}
+func FuzzReadFromString(f *testing.F) {
+	for _, v := range append(fuzzxmlstr, xmlstr) {
+		f.Add(v)
+	}
+	f.Fuzz(func(t *testing.T, xml string) {
+		for _, Recover := range []bool{false, true} {
+			if nxml, err := fuzzparse(t, xml, Recover); err == nil {
+				nxml.WriteToString()
+			}
+		}
+	})
+}
+func FuzzRoundTrip(f *testing.F) {
+	for _, v := range append(fuzzxmlstr, xmlstr) {
+		f.Add(v)
+	}
+	f.Fuzz(func(t *testing.T, xml string) {
+		nxml, err := fuzzparse(t, xml, false)
+		if err != nil {
+			return
+		}
+		written := nxml.WriteToString()
+		nxml2, err := fuzzparse(t, written, false)
+		if err != nil {
+			t.Fatalf("Written xml cannot be read: %v\n%q\n%q", err, xml, written)
+		}
+		if !equalxmlnode(nxml.XmlRoot, nxml2.XmlRoot) {
+			t.Fatalf("Trees differ after round trip\n%q\n%q", xml, written)
+		}
+	})
+}
+
+// Conformance test cases are read from the catalog of the W3C XML Conformance Test Suite.
+// testdata/xmlconf holds a small sample in its layout that always runs,the full suite is
+// fetched and run by the test built with the xmlts tag
+var xmlconfdir = flag.String("xmlconf", filepath.Join("testdata", "xmlconf"), "directory of the XML conformance test suite")
+var xmlconfupdate = flag.Bool("xmlconf.update", false, "write the failing conformance cases to the expected failures file")
+
+type xmlconfcase struct {
+	ID, Type, Uri, Sections string
+}
+
+func readxmlconf(t *testing.T, dir string) []xmlconfcase {
+	nxml := native_xml.NewNativeXml()
+	nxml.EntityOptions = native_xml.TXmlEntityOptions{Expand: true,
+		Resolver: native_xml.NewXmlFileResolver(dir), MaxSize: 256 << 20}
+	Data, err := os.ReadFile(filepath.Join(dir, "xmlconf.xml"))
+	if err == nil {
+		err = nxml.ParseStream(bytes.NewBuffer(Data))
+	}
+	if err != nil {
+		t.Fatalf("Conformance catalog: %v", err)
+	}
+	cases := make([]xmlconfcase, 0)
+	var walk func(node *native_xml.TXmlNode, base string)
+	walk = func(node *native_xml.TXmlNode, base string) {
+		base += node.Attributes["xml:base"]
+		if node.Name == "TEST" {
+			//Only XML 1.0 cases that hold for its fifth edition
+			edition := node.Attributes["EDITION"]
+			if (node.Attributes["RECOMMENDATION"] == "" || strings.HasPrefix(node.Attributes["RECOMMENDATION"], "XML1.0")) &&
+				(edition == "" || strings.Contains(" "+edition+" ", " 5 ")) {
+				cases = append(cases, xmlconfcase{ID: node.Attributes["ID"], Type: node.Attributes["TYPE"],
+					Uri: filepath.Join(dir, filepath.FromSlash(base+node.Attributes["URI"])), Sections: node.Attributes["SECTIONS"]})
+			}
+		}
+		for _, v := range node.NodeList() {
+			walk(v, base)
+		}
+	}
+	walk(nxml.XmlRoot, "")
+	return cases
+}
+func runxmlconfcase(c xmlconfcase) (bool, string) {
+	//valid and invalid cases must be well-formed and pass or fail the doctype validation,
+	//not-wf cases must be rejected
+	Data, err := os.ReadFile(c.Uri)
+	if err != nil {
+		return false, err.Error()
+	}
+	nxml := native_xml.NewNativeXml()
+	nxml.EntityOptions.Resolver = native_xml.NewXmlFileResolver(filepath.Dir(c.Uri))
+	err = nxml.ParseStream(bytes.NewBuffer(Data))
+	switch c.Type {
+	case "not-wf":
+		return err != nil, "document accepted"
+	case "valid", "invalid":
+		if err != nil {
+			return false, err.Error()
+		}
+		Errors := make([]native_xml.TXmlValidationError, 0)
+		if Dtd, err := nxml.Dtd(); err != nil || Dtd != nil {
+			Errors = nxml.ValidateDTD()
+		}
+		if c.Type == "valid" && len(Errors) > 0 {
+			return false, Errors[0].Error()
+		}
+		if c.Type == "invalid" && len(Errors) == 0 {
+			return false, "document validated"
+		}
+	}
+	return true, ""
+}
+func Test_Conformance_nativexml(t *testing.T) {
+	dir := *xmlconfdir
+	if _, err := os.Stat(filepath.Join(dir, "xmlconf.xml")); err != nil {
+		t.Skipf("No conformance test suite in %s", dir)
+	}
+	runxmlconf(t, dir, filepath.Join(dir, "expected_failures.txt"))
+}
+func runxmlconf(t *testing.T, dir, baseline string) {
+	//Cases that are known to fail,a case that starts to pass must be removed from the list
+	expected := make(map[string]bool)
+	Data, err := os.ReadFile(baseline)
+	if err != nil && !*xmlconfupdate {
+		t.Fatalf("No expected failures %v,write them with -xmlconf.update", err)
+	}
+	if err == nil {
+		for _, v := range strings.Split(string(Data), "\n") {
+			if v = strings.TrimSpace(v); v != "" && !strings.HasPrefix(v, "#") {
+				expected[strings.Fields(v)[0]] = true
+			}
+		}
+	}
+	passed, failed := make(map[string]int), make(map[string]int)
+	failures := make([]string, 0)
+	for _, c := range readxmlconf(t, dir) {
+		if c.Type == "error" {
+			continue
+		}
+		ok, reason := runxmlconfcase(c)
+		if ok {
+			passed[c.Type]++
+		} else {
+			failed[c.Type]++
+			failures = append(failures, fmt.Sprintf("%s %s: %s", c.ID, c.Type, strings.ReplaceAll(reason, "\n", " ")))
+		}
+		if *xmlconfupdate {
+			continue
+		}
+		switch {
+		case !ok && !expected[c.ID]:
+			t.Errorf("%s (%s,section %s) failed: %s", c.ID, c.Type, c.Sections, reason)
+		case ok && expected[c.ID]:
+			t.Errorf("%s (%s) passes now,remove it from %s", c.ID, c.Type, filepath.Base(baseline))
+		}
+	}
+	for _, v := range []string{"valid", "invalid", "not-wf"} {
+		t.Logf("%-8s passed %5d failed %5d", v, passed[v], failed[v])
+	}
+	if *xmlconfupdate {
+		sort.Strings(failures)
+		Data := "# Conformance cases the parser fails,written by go test with -xmlconf.update\n" +
+			strings.Join(failures, "\n") + "\n"
+		if err := os.WriteFile(baseline, []byte(Data), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+}
+
+func Test_SyncDocument_nativexml(t *testing.T) {
+	nxml := native_xml.NewNativeXml()
+	nxml.PreserveSource = true
+	doc := native_xml.NewSyncDocument(nxml)
+	if err := doc.ParseString(`<config><server port="80">web</server><items/></config>`); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	done := make(chan bool)
+	for g := 0; g < 4; g++ {
+		go func(g int) {
+			for i := 0; i < 200; i++ {
+				switch (g + i) % 4 {
+				case 0:
+					doc.SetAttribute("/config/server", "port", strconv.Itoa(i))
+				case 1:
+					doc.GetAttribute("/config/server", "port")
+					doc.WriteToString()
+				case 2:
+					doc.With(func(nxml *native_xml.TNativeXml) {
+						name := fmt.Sprintf("item%d", g)
+						nxml.AddNodeForPathS("/config/items", name)
+						nxml.RemoveNode("/config/items/" + name)
+					})
+				case 3:
+					doc.ParseString(`<config><server port="81">web</server><items/></config>`)
+				}
+			}
+			done <- true
+		}(g)
+	}
+	for g := 0; g < 4; g++ {
+		<-done
+	}
+	if doc.GetNodeValueForPath("/config/server") != "web" {
+		t.Fatalf("Server value lost: %s", doc.WriteToString())
+	}
+	if err := doc.ParseString("<config>"); err == nil || doc.GetNodeValueForPath("/config/server") != "web" {
+		t.Fatalf("Failed reload replaced the document: %v", err)
+	}
+	doc.View(func(nxml *native_xml.TNativeXml) {
+		if len(nxml.XmlNodePathForNode("/config/items")) != 0 {
+			t.Fatalf("Items left: %v", nxml.XmlNodePathForNode("/config/items"))
+		}
+	})
+}
+
+func Test_Snapshot_nativexml(t *testing.T) {
+	nxml := native_xml.NewNativeXml()
+	nxml.PreserveSource = true
+	source := "<config>\n  <server port=\"80\">web</server>\n  <db>\n    <host>h1</host>\n  </db>\n</config>"
+	nxml.ReadFromString(source)
+	snap := nxml.Snapshot()
+	if !snap.IsReadOnly() || snap.SetAttribute("/config/server", "port", "1") || snap.AddNodeForPath("/config/new") {
+		t.Fatalf("Snapshot can be edited")
+	}
+	if !nxml.SetAttribute("/config/server", "port", "8080") || !nxml.AddNodeForPathS("/config", "cache") {
+		t.Fatalf("Document cannot be edited")
+	}
+	if snap.GetAttribute("/config/server", "port") != "80" || snap.XMLNodeForPath("/config/cache") != nil {
+		t.Fatalf("Snapshot changed: %s", snap.WriteToString())
+	}
+	if snap.XMLNodeForPath("/config/db") != nxml.XMLNodeForPath("/config/db") ||
+		snap.XMLNodeForPath("/config/server") == nxml.XMLNodeForPath("/config/server") {
+		t.Fatalf("Only the changed nodes are copied")
+	}
+	if snap.WriteToString() != source {
+		t.Fatalf("Snapshot source: %q", snap.WriteToString())
+	}
+	if s := nxml.WriteToString(); s != "<config>\n  <server port=\"8080\">web</server>\n  <db>\n    <host>h1</host>\n  </db>\n  <cache></cache>\n</config>" {
+		t.Fatalf("Document source: %q", s)
+	}
+	//Readers of snapshots run while the document is edited
+	done := make(chan bool)
+	for g := 0; g < 4; g++ {
+		go func(snap *native_xml.TNativeXml) {
+			for i := 0; i < 100; i++ {
+				if snap.GetNodeValueForPath("/config/db/host") == "" {
+					t.Errorf("Snapshot lost a value")
+				}
+				snap.WriteToString()
+			}
+			done <- true
+		}(nxml.Snapshot())
+	}
+	for i := 0; i < 100; i++ {
+		nxml.SetNodeValueForPath("/config/db/host", "h"+strconv.Itoa(i))
+		nxml.RemoveNode("/config/cache")
+		nxml.AddNodeForPathS("/config", "cache")
+	}
+	for g := 0; g < 4; g++ {
+		<-done
+	}
+	if snap.GetNodeValueForPath("/config/db/host") != "h1" || nxml.GetNodeValueForPath("/config/db/host") != "h99" {
+		t.Fatalf("Values after edits: %s %s", snap.WriteToString(), nxml.WriteToString())
+	}
+	//Nodes below a changed path have parents at the new path,the snapshot keeps the old ones
+	nxml = native_xml.NewNativeXml()
+	nxml.UndoLevels = 10
+	nxml.ReadFromString("<a><b><c/></b><d/><x><y/></x></a>")
+	snap = nxml.Snapshot()
+	nxml.MoveNode("/a/b", "/a/d")
+	nxml.AddNodeForPathS("/a", "x")
+	for _, path := range []string{"/a/d/b/c", "/a/x[1]/y"} {
+		if node := nxml.XMLNodeForPath(path); node == nil || node.NodePath() != path ||
+			node.Parent != nxml.XMLNodeForPath(path[:strings.LastIndex(path, "/")]) {
+			t.Fatalf("NodePath after copy-on-write edits %s", path)
+		}
+	}
+	if node := snap.XMLNodeForPath("/a/b/c"); node == nil || node.NodePath() != "/a/b/c" || node.Parent != snap.XMLNodeForPath("/a/b") {
+		t.Fatalf("NodePath in the snapshot")
+	}
+	snap = nxml.Snapshot()
+	nxml.RemoveNode("/a/x[1]")
+	if !nxml.Undo() || !nxml.Undo() {
+		t.Fatalf("Undo after a snapshot")
+	}
+	if node := nxml.XMLNodeForPath("/a/x/y"); node == nil || node.NodePath() != "/a/x/y" {
+		t.Fatalf("NodePath after undo: %s", nxml.WriteToString())
+	}
+	if node := snap.XMLNodeForPath("/a/x[1]/y"); node == nil || node.NodePath() != "/a/x[1]/y" {
+		t.Fatalf("NodePath in the second snapshot")
+	}
+}
+
+func Test_ParseAll_nativexml(t *testing.T) {
+	sources := make([]native_xml.TXmlParseSource, 0)
+	for i := 0; i < 50; i++ {
+		sources = append(sources, native_xml.NewXmlReaderSource(fmt.Sprintf("doc%d", i),
+			strings.NewReader(fmt.Sprintf("<doc><id>%d</id></doc>", i))))
+	}
+	sources = append(sources, native_xml.NewXmlReaderSource("broken", strings.NewReader("<doc><id></doc>")),
+		native_xml.NewXmlFileSource(filepath.Join(t.TempDir(), "missing.xml")))
+	results, stats := native_xml.ParseAll(context.Background(), sources, 4)
+	if len(results) != 52 || stats.Documents != 50 || stats.Failed != 2 || stats.Bytes == 0 {
+		t.Fatalf("Stats: %+v", stats)
+	}
+	for i := 0; i < 50; i++ {
+		if results[i].Err != nil || results[i].Doc.GetNodeValueForPath("/doc/id") != strconv.Itoa(i) {
+			t.Fatalf("Result %d: %+v", i, results[i])
+		}
+	}
+	if results[50].Err == nil || results[51].Err == nil || results[51].Name != sources[51].Name {
+		t.Fatalf("Errors not reported: %v %v", results[50].Err, results[51].Err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, stats = native_xml.ParseAll(ctx, sources[:10], 2)
+	if stats.Failed != 10 || !errors.Is(results[0].Err, context.Canceled) {
+		t.Fatalf("Cancel: %+v %v", stats, results[0].Err)
+	}
+}
+
+func Test_Context_nativexml(t *testing.T) {
+	xml := benchmarkxml(2000)
+	ctx, cancel := context.WithCancel(context.Background())
+	nxml := native_xml.NewNativeXml()
+	if err := nxml.ParseStringContext(ctx, xml); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	paths, err := nxml.XmlNodePathContext(ctx)
+	if err != nil || len(paths) != len(nxml.XmlNodePath()) {
+		t.Fatalf("Paths: %d %v", len(paths), err)
+	}
+	if s, err := nxml.WriteToStringContext(ctx); err != nil || s != nxml.WriteToString() {
+		t.Fatalf("Write: %v", err)
+	}
+	cancel()
+	if err := native_xml.NewNativeXml().ParseStringContext(ctx, xml); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Canceled parse: %v", err)
+	}
+	if _, err := nxml.XmlNodePathForNodeContext(ctx, "/catalog"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Canceled query: %v", err)
+	}
+	if _, err := nxml.WriteToStringContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Canceled write: %v", err)
+	}
+	//A context that ends while parsing stops the parser
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = native_xml.NewNativeXml().ParseReaderContext(ctx, io.MultiReader(strings.NewReader(xml), slowreader{}))
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Fatalf("Timeout: %v %v", err, time.Since(start))
+	}
+}
+
+type slowreader struct{}
+
+func (slowreader) Read(p []byte) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	p[0] = ' '
+	return 1, nil
+}
+
+func Test_Changes_nativexml(t *testing.T) {
+	nxml := native_xml.NewNativeXml()
+	nxml.ReadFromString(`<order id="1"><customer>Ann</customer><items><item>a</item></items><notes/></order>`)
+	nxml.TrackChanges = true
+	events := make([]string, 0)
+	observer := native_xml.TXmlChangeFunc(func(doc *native_xml.TNativeXml, change native_xml.TXmlChange) {
+		events = append(events, change.Kind.String()+" "+change.Path)
+	})
+	id := nxml.AddObserver(observer)
+	nxml.SetNodeValueForPath("/order/customer", "Bob")
+	nxml.SetNodeValueForPath("/order/customer", "Bob")
+	nxml.SetAttribute("/order", "id", "2")
+	nxml.SetAttribute("/order", "state", "new")
+	nxml.RemoveAttribute("/order", "state")
+	nxml.AddNodeForPath("/order/items/item[1]")
+	nxml.AddNodeForPath("/order/shipping/address")
+	nxml.AddNodeForPathS("/order/items", "item")
+	nxml.MoveNode("/order/notes", "/order/shipping")
+	nxml.ReplaceNode("/order/items/item[2]", native_xml.NewXmlNode("gift"))
+	nxml.RemoveNode("/order/items/item")
+	nxml.MoveNode("/order/shipping", "/order/shipping/address")
+	expected := []string{"ValueSet /order/customer", "AttributeSet /order", "AttributeSet /order", "AttributeRemoved /order",
+		"NodeAdded /order/shipping", "NodeAdded /order/shipping/address", "NodeAdded /order/items/item[2]",
+		"NodeMoved /order/shipping/notes", "NodeRemoved /order/items/item[2]", "NodeAdded /order/items/gift",
+		"NodeRemoved /order/items/item"}
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") || len(nxml.Changes) != len(expected) {
+		t.Fatalf("Events:\n%s", strings.Join(events, "\n"))
+	}
+	c := nxml.Changes
+	if c[0].OldValue != "Ann" || c[0].NewValue != "Bob" || c[1].OldValue != "1" || !c[1].Existed || c[2].Existed ||
+		c[7].OldPath != "/order/notes" || c[10].OldValue != "<item>a</item>" {
+		t.Fatalf("Change values: %+v", c)
+	}
+	nxml.RemoveObserver(id)
+	nxml.ClearChanges()
+	nxml.SetNodeValueForPath("/order/customer", "Cid")
+	if len(events) != len(expected) || len(nxml.Changes) != 1 {
+		t.Fatalf("Observer not removed: %v", events)
+	}
+	nxml.ClearChanges()
+	if nxml.RemoveNode("/order") || len(nxml.Changes) != 0 || nxml.XmlRoot == nil {
+		t.Fatalf("Root element removed: %v", nxml.Changes)
+	}
+	empty := native_xml.NewNativeXml()
+	if empty.GetNodeValueForPath("/a") != "" || empty.RemoveNode("/a") {
+		t.Fatalf("Path found in an empty document")
+	}
+}
+
+func Test_Undo_nativexml(t *testing.T) {
+	nxml := native_xml.NewNativeXml()
+	nxml.ReadFromString(`<config><server port="80">web</server><db><host>h1</host><user>u</user></db></config>`)
+	original := nxml.WriteToString()
+	if nxml.Commit() == nil || nxml.Rollback() == nil || nxml.Begin() != nil || nxml.Begin() == nil {
+		t.Fatalf("Transaction state")
+	}
+	nxml.AddNodeForPath("/config/cache/size")
+	nxml.SetAttribute("/config/server", "port", "8080")
+	nxml.RemoveNode("/config/db/host")
+	nxml.MoveNode("/config/db/user", "/config/cache")
+	nxml.SetNodeValueForPath("/config/server", "api")
+	if err := nxml.Rollback(); err != nil || nxml.WriteToString() != original {
+		t.Fatalf("Rollback: %v\n%s", err, nxml.WriteToString())
+	}
+	if nxml.CanUndo() {
+		t.Fatalf("Undo without undo levels")
+	}
+	nxml.UndoLevels = 10
+	nxml.SetAttribute("/config/server", "port", "8080")
+	afterport := nxml.WriteToString()
+	nxml.Begin()
+	nxml.AddNodeForPath("/config/cache/size")
+	nxml.RemoveNode("/config/db/host")
+	nxml.Commit()
+	aftertx := nxml.WriteToString()
+	snap := nxml.Snapshot()
+	nxml.AddNodeForPath("/config/log/level")
+	nxml.RemoveAttribute("/config/server", "port")
+	if !nxml.Undo() || !nxml.Undo() || !nxml.Undo() || nxml.WriteToString() != afterport {
+		t.Fatalf("Undo transaction:\n%s", nxml.WriteToString())
+	}
+	if snap.WriteToString() != aftertx {
+		t.Fatalf("Undo changed the snapshot:\n%s", snap.WriteToString())
+	}
+	if !nxml.Undo() || nxml.WriteToString() != original || nxml.Undo() {
+		t.Fatalf("Undo all:\n%s", nxml.WriteToString())
+	}
+	if !nxml.Redo() || !nxml.Redo() || nxml.WriteToString() != aftertx {
+		t.Fatalf("Redo:\n%s", nxml.WriteToString())
+	}
+	nxml.SetNodeValueForPath("/config/server", "api")
+	if nxml.CanRedo() {
+		t.Fatalf("Redo after a new edit")
+	}
+	//A step that fails halfway is not applied and stays on its stack
+	nxml.Begin()
+	nxml.AddNodeForPath("/config/tmp")
+	nxml.SetNodeValueForPath("/config/server", "web")
+	nxml.Commit()
+	nxml.XMLNodeForPath("/config/tmp").Name = "renamed"
+	failed := nxml.WriteToString()
+	if nxml.Undo() || nxml.WriteToString() != failed || !nxml.CanUndo() {
+		t.Fatalf("Failed undo applied:\n%s", nxml.WriteToString())
+	}
+	nxml.XMLNodeForPath("/config/renamed").Name = "tmp"
+	if !nxml.Undo() || nxml.GetNodeValueForPath("/config/server") != "api" || nxml.XMLNodeForPath("/config/tmp") != nil {
+		t.Fatalf("Undo after a failed undo:\n%s", nxml.WriteToString())
+	}
+	nxml.Begin()
+	nxml.AddNodeForPath("/config/tmp")
+	nxml.SetNodeValueForPath("/config/server", "web")
+	nxml.XMLNodeForPath("/config/tmp").Name = "renamed"
+	failed = nxml.WriteToString()
+	if nxml.Rollback() == nil || nxml.WriteToString() != failed || !nxml.InTransaction() {
+		t.Fatalf("Failed rollback applied:\n%s", nxml.WriteToString())
+	}
+	nxml.Commit()
+}
+
+func difflines(diffs []native_xml.TXmlDifference) string {
+	lines := make([]string, len(diffs))
+	for i, v := range diffs {
+		lines[i] = v.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func Test_Diff_nativexml(t *testing.T) {
+	a := native_xml.NewNativeXml()
+	a.ReadFromString(`<partners><!--v1--><partner id="1" kind="a">Acme Inc</partner><partner id="2">Bolt</partner>` +
+		`<partner id="3">Crane</partner><contact><name>x</name></contact><note>old</note><archive/></partners>`)
+	b := native_xml.NewNativeXml()
+	b.ReadFromString(`<partners><!--v2--><partner id="4">Delta</partner><partner id="3">Crane</partner>` +
+		`<partner id="1" kind="b" vip="yes">Acme   Inc</partner><note>new</note><archive><contact><name>x</name></contact></archive></partners>`)
+	options := native_xml.TXmlDiffOptions{KeyAttributes: map[string]string{"partner": "id"}}
+	expected := `ValueChanged /partners/comment() "v1" -> "v2"
+Moved /partners/partner[1] -> /partners/partner[3]
+ValueChanged /partners/partner[1] "Acme Inc" -> "Acme   Inc"
+AttributeChanged /partners/partner[1]/@kind "a" -> "b"
+Inserted /partners/partner[1]/@vip "yes"
+Deleted /partners/partner[2] "<partner id=\"2\">Bolt</partner>"
+Moved /partners/contact -> /partners/archive/contact
+ValueChanged /partners/note "old" -> "new"
+Inserted /partners/partner[1] "<partner id=\"4\">Delta</partner>"`
+	if got := difflines(native_xml.Diff(a, b, options)); got != expected {
+		t.Fatalf("Diff:\n%s", got)
+	}
+	options.IgnoreComments, options.IgnoreSiblingOrder, options.IgnoreWhitespace = true, true, true
+	diffs := native_xml.Diff(a, b, options)
+	for _, v := range diffs {
+		if v.Kind == native_xml.DiffMoved && v.OldNode.Name == "partner" || v.Kind == native_xml.DiffValueChanged && v.OldNode.Name != "note" {
+			t.Fatalf("Ignore options:\n%s", difflines(diffs))
+		}
+	}
+	if diffs := native_xml.Diff(a, a, native_xml.TXmlDiffOptions{}); len(diffs) != 0 {
+		t.Fatalf("Same document:\n%s", difflines(diffs))
+	}
+	c := native_xml.NewNativeXml()
+	c.ReadFromString(`<list><item>1</item><item>2</item></list>`)
+	d := native_xml.NewNativeXml()
+	d.ReadFromString(`<list><item>0</item><item>1</item><item>2</item></list>`)
+	if got := difflines(native_xml.Diff(c, d, native_xml.TXmlDiffOptions{})); got != `Inserted /list/item[1] "<item>0</item>"` {
+		t.Fatalf("Repeated siblings without key:\n%s", got)
+	}
+	c.PreserveSource, d.PreserveSource = true, true
+	c.ReadFromString(`<a x="1" y="2"/>`)
+	d.ReadFromString(`<a y="2" x="1"/>`)
+	if diffs := native_xml.Diff(c, d, native_xml.TXmlDiffOptions{}); len(diffs) != 1 || diffs[0].OldValue != "x y" {
+		t.Fatalf("Attribute order:\n%s", difflines(diffs))
+	}
+	if diffs := native_xml.Diff(c, d, native_xml.TXmlDiffOptions{IgnoreAttributeOrder: true}); len(diffs) != 0 {
+		t.Fatalf("Ignore attribute order:\n%s", difflines(diffs))
+	}
+}
+
+func Test_Patch_nativexml(t *testing.T) {
+	nxml := native_xml.NewNativeXml()
+	nxml.UndoLevels = 10
+	nxml.SetXmlFormat(false)
+	nxml.ReadFromString(`<doc><note>old</note><!--c--><item id="1">a</item><item id="2">b</item><?pi x?></doc>`)
+	original := nxml.WriteToString()
+	err := nxml.ApplyPatchString(`<diff>
+	<add sel="/doc/item[@id='1']" pos="before"><item id="0">z</item></add>
+	<add sel="/doc/item[2]" type="@new">v</add>
+	<replace sel="/doc/note/text()">new</replace>
+	<replace sel="/doc/comment()"><!--changed--></replace>
+	<replace sel="/doc/item[@id=&quot;2&quot;]/@id">3</replace>
+	<remove sel="/doc/processing-instruction('pi')"/>
+	<add sel="/doc"><tail/></add>
+	<add sel="doc/note" pos="prepend"><first/></add>
+</diff>`)
+	expected := `<doc><note>new<first></first></note><!--changed--><item id="0">z</item><item id="1" new="v">a</item><item id="3">b</item><tail></tail></doc>`
+	if got := nxml.WriteToString(); err != nil || got != expected {
+		t.Fatalf("Apply patch: %v\n%s", err, got)
+	}
+	if !nxml.Undo() || nxml.WriteToString() != original {
+		t.Fatalf("Undo patch:\n%s", nxml.WriteToString())
+	}
+	before := nxml.WriteToString()
+	for _, v := range []string{
+		`<diff><remove sel="/doc/item"/></diff>`,
+		`<diff><remove sel="/doc/missing"/></diff>`,
+		`<diff><add sel="/doc/note" type="@x">1</add><add sel="/doc/note" type="@x">2</add></diff>`,
+		`<diff><remove sel="/doc"/></diff>`,
+		`<diff><replace sel="/doc/note"><!--c--></replace></diff>`,
+		`<diff><add sel="/doc/note" pos="middle"><x/></add></diff>`,
+		`<diff><remove sel="/doc/note[@a='1'"/></diff>`,
+		`<diff><move sel="/doc/note"/></diff>`,
+	} {
+		if err := nxml.ApplyPatchString(v); err == nil || nxml.WriteToString() != before {
+			t.Fatalf("Invalid patch %s: %v\n%s", v, err, nxml.WriteToString())
+		}
+	}
+	options := native_xml.TXmlDiffOptions{KeyAttributes: map[string]string{"partner": "id"}}
+	for _, v := range [][2]string{
+		{`<partners><!--v1--><partner id="1" kind="a">Acme Inc</partner><partner id="2">Bolt</partner>` +
+			`<partner id="3">Crane</partner><contact><name>x</name></contact><note>old</note><archive/></partners>`,
+			`<partners><!--v2--><partner id="4">Delta</partner><partner id="3">Crane</partner>` +
+				`<partner id="1" kind="b" vip="yes">Acme   Inc</partner><note>new</note><archive><contact><name>x</name></contact></archive></partners>`},
+		{`<a><b>1</b><b>2</b><b>3</b><c/></a>`, `<a><c>t</c><b>3</b><b>1</b><d/><b>2</b></a>`},
+		{`<a><b/></a>`, `<x/>`},
+	} {
+		a := native_xml.NewNativeXml()
+		a.ReadFromString(v[0])
+		b := native_xml.NewNativeXml()
+		b.ReadFromString(v[1])
+		patch := native_xml.GeneratePatch(a, b, options)
+		if err := a.ApplyPatch(patch); err != nil || a.WriteToString() != b.WriteToString() {
+			t.Fatalf("Generated patch: %v\n%s\n%s", err, patch.WriteToString(), a.WriteToString())
+		}
+	}
+}
+
+func Test_Merge_nativexml(t *testing.T) {
+	read := func(xml string) *native_xml.TNativeXml {
+		nxml := native_xml.NewNativeXml()
+		nxml.SetXmlFormat(false)
+		nxml.ReadFromString(xml)
+		return nxml
+	}
+	base := read(`<config><server port="80" host="a">web</server><users><user id="1" role="r">ann</user>` +
+		`<user id="2">bob</user></users><timeout>30</timeout><log>info</log><mode>a</mode></config>`)
+	ours := read(`<config><server port="8080" host="a">web</server><users><user id="1" role="admin">ann</user>` +
+		`<user id="2">bob</user><user id="3">cid</user></users><timeout>60</timeout><log>info</log></config>`)
+	theirs := read(`<config><server port="80" host="b">web</server><users><user id="2">bob</user>` +
+		`<user id="1" role="r">anna</user><user id="4">dan</user></users><timeout>90</timeout><mode>b</mode><cache/></config>`)
+	options := native_xml.TXmlMergeOptions{KeyAttributes: map[string]string{"user": "id"}}
+	merged, conflicts := native_xml.Merge(base, ours, theirs, options)
+	expected := `<config><server host="b" port="8080">web</server><users><user id="1" role="admin">anna</user>` +
+		`<user id="4">dan</user><user id="2">bob</user><user id="3">cid</user></users><timeout>60</timeout><cache></cache></config>`
+	if got := merged.WriteToString(); !strings.HasSuffix(got, expected) {
+		t.Fatalf("Merge:\n%s", got)
+	}
+	if len(conflicts) != 2 || conflicts[0].Kind != native_xml.ConflictValue || conflicts[0].Path != "/config/timeout" ||
+		conflicts[0].Ours != "60" || conflicts[0].Theirs != "90" ||
+		conflicts[1].Kind != native_xml.ConflictDeleted || conflicts[1].Path != "/config/mode" || conflicts[1].Ours != "" {
+		t.Fatalf("Conflicts: %v", conflicts)
+	}
+	options.PreferTheirs = true
+	merged, _ = native_xml.Merge(base, ours, theirs, options)
+	if got := merged.WriteToString(); !strings.Contains(got, "<timeout>90</timeout><mode>b</mode><cache></cache>") {
+		t.Fatalf("Merge preferring theirs:\n%s", got)
+	}
+	both := read(`<config><server port="80" host="a" tls="on">web</server></config>`)
+	other := read(`<config><server port="80" host="a" tls="off">web</server></config>`)
+	if _, conflicts := native_xml.Merge(base, both, other, options); len(conflicts) != 1 ||
+		conflicts[0].Kind != native_xml.ConflictAttribute || conflicts[0].Name != "tls" || conflicts[0].Base != "" {
+		t.Fatalf("Attribute conflict: %v", conflicts)
+	}
+	if merged, conflicts := native_xml.Merge(base, base, ours, options); len(conflicts) != 0 ||
+		merged.WriteToString() != ours.WriteToString() {
+		t.Fatalf("One sided merge: %v\n%s", conflicts, merged.WriteToString())
+	}
+}
+func Test_Xslt_nativexml(t *testing.T) {
+	source := native_xml.NewNativeXml()
+	source.PreserveSource = true
+	source.ReadFromString(`<orders xmlns:p="urn:partner"><order id="3"><p:customer>Zed &amp; Co</p:customer><total>30.5</total>` +
+		`<line sku="a" qty="2"/><line sku="b" qty="1"/></order><order id="1"><p:customer>Acme</p:customer><total>100</total>` +
+		`<line sku="c" qty="5"/></order><order id="2"><p:customer>Bolt</p:customer><total>7</total>` +
+		`<note>Rush <b>now</b> please</note></order></orders>`)
+	sheet, err := native_xml.NewXslStylesheetString(`<xsl:stylesheet version="1.0"
+    xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:p="urn:partner">
+  <xsl:param name="min" select="0"/>
+  <xsl:variable name="count" select="count(/orders/order)"/>
+  <xsl:template match="/">
+    <purchases count="{$count}">
+      <xsl:apply-templates select="orders/order[total &gt;= $min]">
+        <xsl:sort select="total" data-type="number" order="descending"/>
+      </xsl:apply-templates>
+      <xsl:call-template name="sum"><xsl:with-param name="value" select="sum(//total)"/></xsl:call-template>
+    </purchases>
+  </xsl:template>
+  <xsl:template match="order">
+    <xsl:element name="purchase">
+      <xsl:attribute name="ref">PO-<xsl:value-of select="@id"/></xsl:attribute>
+      <xsl:if test="position() = 1"><xsl:attribute name="first">yes</xsl:attribute></xsl:if>
+      <xsl:choose>
+        <xsl:when test="total &gt; 50"><size>large</size></xsl:when>
+        <xsl:otherwise><size>small</size></xsl:otherwise>
+      </xsl:choose>
+      <xsl:for-each select="line"><xsl:sort select="@sku" order="descending"/>
+        <item sku="{@sku}"><xsl:value-of select="@qty * 2"/></item>
+      </xsl:for-each>
+      <xsl:apply-templates select="note"/>
+      <xsl:copy-of select="p:customer"/>
+    </xsl:element>
+  </xsl:template>
+  <xsl:template match="note"><remark><xsl:apply-templates/></remark></xsl:template>
+  <xsl:template match="note/b"><em><xsl:value-of select="."/></em></xsl:template>
+  <xsl:template name="sum"><xsl:param name="value"/><total>
+    <xsl:value-of select="$value"/><xsl:text> EUR</xsl:text></total></xsl:template>
+</xsl:stylesheet>`)
+	if err != nil {
+		t.Fatalf("Stylesheet: %v", err)
+	}
+	result, err := sheet.Transform(source, map[string]string{"min": "5"})
+	if err != nil {
+		t.Fatalf("Transform: %v", err)
+	}
+	expected := `<?xml version="1.0" encoding="UTF-8"?><purchases count="3">` +
+		`<purchase first="yes" ref="PO-1"><size>large</size><item sku="c">10</item><p:customer xmlns:p="urn:partner">Acme</p:customer></purchase>` +
+		`<purchase ref="PO-3"><size>small</size><item sku="b">2</item><item sku="a">4</item>` +
+		`<p:customer xmlns:p="urn:partner">Zed &amp; Co</p:customer></purchase>` +
+		`<purchase ref="PO-2"><size>small</size><remark>Rush <em>now</em> please</remark>` +
+		`<p:customer xmlns:p="urn:partner">Bolt</p:customer></purchase><total>137.5 EUR</total></purchases>`
+	if got := result.WriteToString(); got != expected {
+		t.Fatalf("Transform:\n%s", got)
+	}
+	if got := result.GetAttribute("/purchases/purchase", "ref"); got != "PO-1" {
+		t.Fatalf("Result path api: %q", got)
+	}
+	text, err := native_xml.NewXslStylesheetString(`<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">` +
+		`<xsl:output method="text"/><xsl:template match="order"><xsl:value-of select="@id"/>:` +
+		`<xsl:apply-templates select="line" mode="sku"/>;</xsl:template>` +
+		`<xsl:template match="line" mode="sku"><xsl:value-of select="@sku"/></xsl:template></xsl:stylesheet>`)
+	if err != nil {
+		t.Fatalf("Text stylesheet: %v", err)
+	}
+	if got, err := text.TransformToString(source, nil); err != nil || got != "3:ab;1:c;2:;" {
+		t.Fatalf("Text output: %q %v", got, err)
+	}
+	for _, invalid := range []string{`<xsl:template match="a/.."/>`, `<xsl:template match="/"><xsl:value-of select="count(("/></xsl:template>`,
+		`<xsl:template match="/"><xsl:number/></xsl:template>`, `<xsl:template match="/"><xsl:sort/></xsl:template>`} {
+		if _, err := native_xml.NewXslStylesheetString(`<xsl:stylesheet version="1.0" ` +
+			`xmlns:xsl="http://www.w3.org/1999/XSL/Transform">` + invalid + `</xsl:stylesheet>`); err == nil {
+			t.Fatalf("Invalid stylesheet compiled: %s", invalid)
+		}
+	}
+	loop, _ := native_xml.NewXslStylesheetString(`<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">` +
+		`<xsl:template match="/"><xsl:call-template name="loop"/></xsl:template>` +
+		`<xsl:template name="loop"><r><xsl:call-template name="loop"/></r></xsl:template></xsl:stylesheet>`)
+	if _, err := loop.Transform(source, nil); err == nil {
+		t.Fatalf("Endless recursion not stopped")
+	}
+}
+func Test_XmlTemplate_nativexml(t *testing.T) {
+	type line struct {
+		Sku  string
+		Qty  int
+		Note string
+	}
+	tmpl, err := native_xml.NewXmlTemplate("order", `<{{.Tag}} customer="{{.Customer}}" ref='{{.Ref}}'>`+
+		`<!-- for {{.Customer}} -->{{range $i, $v := .Lines}}<line n="{{$i}}" sku="{{.Sku}}"{{if gt .Qty 1}} bulk="yes"{{end}}>`+
+		`<![CDATA[{{.Note}}]]></line>{{end}}<text>{{.Customer}}{{.Markup}}</text>{{template "total" .}}</{{.Tag}}>`+
+		`{{define "total"}}<total>{{len .Lines}}</total>{{end}}`, nil)
+	if err != nil {
+		t.Fatalf("Template: %v", err)
+	}
+	data := map[string]interface{}{"Tag": "order", "Customer": `Zed "&" <Co>`, "Ref": `'/><evil a='`,
+		"Lines": []line{{"a'1", 2, "x]]>y"}, {"b", 1, ""}}, "Markup": native_xml.TXmlMarkup("<b>!</b>")}
+	doc, err := tmpl.Execute(data)
+	if err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	expected := `<order customer="Zed &quot;&amp;&quot; &lt;Co>" ref="&apos;/>&lt;evil a=&apos;">` +
+		`<!-- for Zed "&" <Co> --><line bulk="yes" n="0" sku="a&apos;1"><![CDATA[x]]]]><![CDATA[>y]]></line>` +
+		`<line n="1" sku="b"><![CDATA[]]></line><text>Zed "&amp;" &lt;Co&gt;<b>!</b></text><total>2</total></order>`
+	if got := doc.WriteToString(); got != expected {
+		t.Fatalf("Execute:\n%s", got)
+	}
+	for _, invalid := range []string{"a b", "1abc", "-x", ":x", "x:", "a:b:c"} {
+		data["Tag"] = invalid
+		if _, err := tmpl.Execute(data); err == nil || !strings.Contains(err.Error(), "Invalid xml name") {
+			t.Fatalf("Invalid element name %q written: %v", invalid, err)
+		}
+	}
+	for _, invalid := range []string{`<a b={{.}}/>`, `<a>{{if .}}<b x="{{end}}"/></a>`, `<a>{{range .}}<b{{end}}/></a>`,
+		`<!DOCTYPE a [{{.}}]><a/>`, `<a {{template "x"}}/>`, `<a`} {
+		if _, err := native_xml.NewXmlTemplate("invalid", invalid, nil); err == nil {
+			t.Fatalf("Unsafe template accepted: %s", invalid)
+		}
+	}
+	schema := native_xml.NewXmlSchema()
+	if err := schema.ReadFromString(`<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">`+
+		`<xs:element name="qty" type="xs:int"/></xs:schema>`, ""); err != nil {
+		t.Fatalf("Schema: %v", err)
+	}
+	qty, _ := native_xml.NewXmlTemplate("qty", `<qty>{{.}}</qty>`, nil)
+	qty.Schema = schema
+	if doc, err := qty.Execute(5); err != nil || doc.GetNodeValueForPath("/qty") != "5" {
+		t.Fatalf("Valid output: %v", err)
+	}
+	if _, err := qty.Execute("five"); err == nil {
+		t.Fatalf("Invalid output returned")
+	} else if _, ok := err.(native_xml.TXmlValidationError); !ok {
+		t.Fatalf("Validation error: %v", err)
+	}
+}
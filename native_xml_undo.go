@@ -0,0 +1,310 @@
+package native_xml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	cEditSetValue = iota
+	cEditSetAttribute
+	cEditInsert
+	cEditDelete
+	cEditMove
+)
+
+const (
+	sxeTransactionActive = "A transaction is already active"
+	sxeNoTransaction     = "No transaction is active"
+	sxeUndoPathNotFound  = "Node \"%s\" of the edit to revert not found"
+)
+
+// One step that reverts a change,applied through paths so copies made for
+// snapshots are respected
+type tXmlEdit struct {
+	Kind       int
+	Path       string //Node to change,delete or move
+	ParentPath string //Parent to insert into or move to
+	Key        int    //Node key in that parent
+	Name       string
+	Value      string
+	Exists     bool //The attribute is set to Value,otherwise removed
+	Node       *TXmlNode
+}
+
+// Undo and redo stacks and the changes of the active transaction,each action
+// is a list of edits that reverts it when applied in order
+type tXmlHistory struct {
+	Undo   [][]tXmlEdit
+	Redo   [][]tXmlEdit
+	Tx     []tXmlEdit
+	InTx   bool
+	Group  []tXmlEdit
+	Groups int
+	Apply  bool
+}
+
+func (this *TNativeXml) Begin() error {
+	//Start a transaction,its changes are kept until Commit or reverted by Rollback
+	History := this.history()
+	if History.InTx {
+		return errors.New(sxeTransactionActive)
+	}
+	History.InTx = true
+	History.Tx = nil
+	return nil
+}
+func (this *TNativeXml) Commit() error {
+	//The changes of the transaction become one undo step
+	History := this.history()
+	if !History.InTx {
+		return errors.New(sxeNoTransaction)
+	}
+	History.InTx = false
+	this.pushUndo(History.Tx)
+	History.Tx = nil
+	return nil
+}
+func (this *TNativeXml) Rollback() error {
+	History := this.history()
+	if !History.InTx {
+		return errors.New(sxeNoTransaction)
+	}
+	//A rollback that cannot be applied leaves the transaction active
+	if _, err := this.revertEdits(History.Tx); err != nil {
+		return err
+	}
+	History.InTx = false
+	History.Tx = nil
+	return nil
+}
+func (this *TNativeXml) InTransaction() bool {
+	return this.undo != nil && this.undo.InTx
+}
+func (this *TNativeXml) CanUndo() bool {
+	return this.undo != nil && !this.undo.InTx && len(this.undo.Undo) > 0
+}
+func (this *TNativeXml) CanRedo() bool {
+	return this.undo != nil && !this.undo.InTx && len(this.undo.Redo) > 0
+}
+func (this *TNativeXml) Undo() bool {
+	//Revert the last action,a path api call or a transaction. False when there is
+	//none or it cannot be reverted,the step then stays on the undo stack
+	if !this.CanUndo() {
+		return false
+	}
+	History := this.undo
+	Redo, err := this.revertEdits(History.Undo[len(History.Undo)-1])
+	if err != nil {
+		return false
+	}
+	History.Undo = History.Undo[:len(History.Undo)-1]
+	History.Redo = append(History.Redo, Redo)
+	return true
+}
+func (this *TNativeXml) Redo() bool {
+	if !this.CanRedo() {
+		return false
+	}
+	History := this.undo
+	Undo, err := this.revertEdits(History.Redo[len(History.Redo)-1])
+	if err != nil {
+		return false
+	}
+	History.Redo = History.Redo[:len(History.Redo)-1]
+	History.Undo = append(History.Undo, Undo)
+	return true
+}
+
+func (this *TNativeXml) history() *tXmlHistory {
+	if this.undo == nil {
+		this.undo = &tXmlHistory{}
+	}
+	return this.undo
+}
+func (this *TNativeXml) pushUndo(Edits []tXmlEdit) {
+	if len(Edits) == 0 || this.UndoLevels <= 0 {
+		return
+	}
+	History := this.history()
+	History.Undo = append(History.Undo, Edits)
+	if len(History.Undo) > this.UndoLevels {
+		History.Undo = History.Undo[len(History.Undo)-this.UndoLevels:]
+	}
+	History.Redo = nil
+}
+func (this *TNativeXml) recording() bool {
+	if this.UndoLevels > 0 {
+		this.history()
+	}
+	return this.undo != nil && (this.UndoLevels > 0 || this.undo.InTx)
+}
+func (this *TNativeXml) groupChanges() func() {
+	//The changes of one path api call are undone together
+	if !this.recording() {
+		return func() {}
+	}
+	History := this.history()
+	History.Groups++
+	return func() {
+		if History.Groups--; History.Groups == 0 {
+			Group := History.Group
+			History.Group = nil
+			this.pushUndo(Group)
+		}
+	}
+}
+func (this *TNativeXml) record(Change TXmlChange) {
+	//Keep the edit that reverts Change,the last change is reverted first
+	if !this.recording() || this.undo.Apply {
+		return
+	}
+	History := this.undo
+	Edit := revertEdit(Change)
+	switch {
+	case History.InTx:
+		History.Tx = append([]tXmlEdit{Edit}, History.Tx...)
+	case History.Groups > 0:
+		History.Group = append([]tXmlEdit{Edit}, History.Group...)
+	default:
+		this.pushUndo([]tXmlEdit{Edit})
+	}
+}
+func revertEdit(Change TXmlChange) tXmlEdit {
+	switch Change.Kind {
+	case ChangeValueSet:
+		return tXmlEdit{Kind: cEditSetValue, Path: Change.Path, Value: Change.OldValue}
+	case ChangeAttributeSet, ChangeAttributeRemoved:
+		return tXmlEdit{Kind: cEditSetAttribute, Path: Change.Path, Name: Change.Name, Value: Change.OldValue, Exists: Change.Existed}
+	case ChangeNodeAdded:
+		return tXmlEdit{Kind: cEditDelete, Path: Change.Path}
+	case ChangeNodeRemoved:
+		return tXmlEdit{Kind: cEditInsert, ParentPath: parentPath(Change.Path), Key: Change.NodeID, Node: Change.Node}
+	default:
+		return tXmlEdit{Kind: cEditMove, Path: Change.Path, ParentPath: parentPath(Change.OldPath), Key: Change.NodeID}
+	}
+}
+func parentPath(Path string) string {
+	if p := strings.LastIndexByte(Path, '/'); p > 0 {
+		return Path[:p]
+	}
+	return ""
+}
+func (this *TNativeXml) revertEdits(Edits []tXmlEdit) ([]tXmlEdit, error) {
+	//applyEdits that is tried on a copy first,so an edit that fails leaves the
+	//document unchanged
+	if _, err := this.fork().applyEdits(Edits); err != nil {
+		return nil, err
+	}
+	return this.applyEdits(Edits)
+}
+func (this *TNativeXml) applyEdits(Edits []tXmlEdit) (Reverse []tXmlEdit, err error) {
+	//Apply the edits in order,the result reverts them again
+	History := this.history()
+	History.Apply = true
+	defer func() {
+		History.Apply = false
+	}()
+	for _, v := range Edits {
+		Edit, err := this.applyEdit(v)
+		if err != nil {
+			return Reverse, err
+		}
+		Reverse = append([]tXmlEdit{Edit}, Reverse...)
+	}
+	return Reverse, nil
+}
+func (this *TNativeXml) applyEdit(Edit tXmlEdit) (tXmlEdit, error) {
+	if Edit.Kind == cEditInsert {
+		return this.insertNode(Edit.ParentPath, Edit.Key, Edit.Node)
+	}
+	Node := this.findNodeForEdit(Edit.Path)
+	if Node == nil {
+		return Edit, errors.New(fmt.Sprintf(sxeUndoPathNotFound, Edit.Path))
+	}
+	switch Edit.Kind {
+	case cEditSetValue:
+		OldValue := Node.Value
+		Node.Value = Edit.Value
+		if this.watched() {
+			this.changed(TXmlChange{Kind: ChangeValueSet, Path: Edit.Path, OldValue: OldValue, NewValue: Edit.Value, Node: Node})
+		}
+		return tXmlEdit{Kind: cEditSetValue, Path: Edit.Path, Value: OldValue}, nil
+	case cEditSetAttribute:
+		OldValue, Existed := Node.Attributes[Edit.Name]
+		Change := TXmlChange{Kind: ChangeAttributeSet, Path: Edit.Path, Name: Edit.Name, OldValue: OldValue,
+			NewValue: Edit.Value, Existed: Existed, Node: Node}
+		if Edit.Exists {
+			Node.Attributes[Edit.Name] = Edit.Value
+		} else {
+			delete(Node.Attributes, Edit.Name)
+			Change.Kind, Change.NewValue = ChangeAttributeRemoved, ""
+		}
+		if this.watched() {
+			this.changed(Change)
+		}
+		return tXmlEdit{Kind: cEditSetAttribute, Path: Edit.Path, Name: Edit.Name, Value: OldValue, Exists: Existed}, nil
+	case cEditDelete:
+		Parent, Key := Node.Parent, Node.NodeID
+		if this.watched() {
+			this.changed(TXmlChange{Kind: ChangeNodeRemoved, Path: Edit.Path, OldValue: this.nodeXml(Node),
+				Node: Node, Parent: Parent, NodeID: Key})
+		}
+		if Parent == nil {
+			delete(this.RootNodes, xeNormal)
+			this.XmlRoot = nil
+			return tXmlEdit{Kind: cEditInsert, Node: Node}, nil
+		}
+		delete(Parent.Nodes, Key)
+		this.pathsChanged(Parent, Node)
+		return tXmlEdit{Kind: cEditInsert, ParentPath: parentPath(Edit.Path), Key: Key, Node: Node}, nil
+	default:
+		OldPath, OldParent, OldKey := Edit.Path, Node.Parent, Node.NodeID
+		NewParent := this.findNodeForEdit(Edit.ParentPath)
+		if NewParent == nil || OldParent == nil {
+			return Edit, errors.New(fmt.Sprintf(sxeUndoPathNotFound, Edit.ParentPath))
+		}
+		delete(OldParent.Nodes, OldKey)
+		NewParent.addWithKey(Node, Edit.Key)
+		this.pathsChanged(OldParent, Node)
+		this.pathsChanged(NewParent, Node)
+		if this.watched() {
+			this.changed(TXmlChange{Kind: ChangeNodeMoved, Path: Node.NodePath(), OldPath: OldPath,
+				Node: Node, Parent: OldParent, NodeID: OldKey})
+		}
+		return tXmlEdit{Kind: cEditMove, Path: Node.NodePath(), ParentPath: parentPath(OldPath), Key: OldKey}, nil
+	}
+}
+func (this *TNativeXml) insertNode(ParentPath string, Key int, Node *TXmlNode) (tXmlEdit, error) {
+	//Put a removed node back,a copy when snapshots still share it
+	if Node.generation != this.generation {
+		Node = Node.cloneForEdit(nil, this.generation)
+	}
+	if ParentPath == "" {
+		Node.Parent, Node.document = nil, this
+		this.RootNodes[xeNormal] = Node
+		this.XmlRoot = Node
+	} else {
+		Parent := this.findNodeForEdit(ParentPath)
+		if Parent == nil {
+			return tXmlEdit{Kind: cEditInsert, ParentPath: ParentPath, Key: Key, Node: Node},
+				errors.New(fmt.Sprintf(sxeUndoPathNotFound, ParentPath))
+		}
+		Parent.addWithKey(Node, Key)
+	}
+	this.nodeAdded(Node)
+	return tXmlEdit{Kind: cEditDelete, Path: Node.NodePath()}, nil
+}
+func (this *TXmlNode) addWithKey(Node *TXmlNode, Key int) {
+	//Add Node with the key it had before,so it gets its old position back
+	if Key <= 0 {
+		this.MaxNodeID++
+		Key = this.MaxNodeID
+	} else if Key > this.MaxNodeID {
+		this.MaxNodeID = Key
+	}
+	Node.NodeID = Key
+	Node.Parent = this
+	this.Nodes[Key] = Node
+}
@@ -0,0 +1,266 @@
+package native_xml
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	sxeValNoDoctype           = "Document has no doctype declaration"
+	sxeValExternalNotLoaded   = "External DTD subset \"%s\" was not loaded,set EntityOptions.Resolver to read it"
+	sxeValRootName            = "Root element \"%s\" does not match doctype name \"%s\""
+	sxeValUndeclaredElement   = "Element \"%s\" is not declared"
+	sxeValNotEmpty            = "Element \"%s\" is declared EMPTY but has content"
+	sxeValTextNotAllowed      = "Element \"%s\" may not contain character data"
+	sxeValChildNotAllowed     = "Element \"%s\" is not allowed in the content of \"%s\""
+	sxeValContentMismatch     = "Content of element \"%s\" does not match %s"
+	sxeValUndeclaredAttribute = "Attribute \"%s\" is not declared"
+	sxeValRequiredAttribute   = "Required attribute \"%s\" is missing"
+	sxeValFixedAttribute      = "Attribute \"%s\" must have the fixed value \"%s\""
+	sxeValEnumAttribute       = "Value \"%s\" of attribute \"%s\" is not one of %s"
+	sxeValInvalidToken        = "Value \"%s\" of attribute \"%s\" is not a valid %s"
+	sxeValDuplicateID         = "Duplicate ID \"%s\""
+	sxeValUnknownIDRef        = "IDREF \"%s\" does not match any ID"
+	sxeValUnknownEntity       = "Value \"%s\" of attribute \"%s\" is not an unparsed entity"
+)
+
+// A validation violation,with the path and source position of the node it was found at
+type TXmlValidationError struct {
+	Path    string
+	Line    int //0 when the node was not read from text
+	Column  int
+	Message string
+}
+
+type tDtdValidator struct {
+	Dtd    *TXmlDtd
+	IDs    map[string]bool
+	IDRefs []TXmlValidationError //Path and value of each IDREF,resolved at the end
+	Errors []TXmlValidationError
+}
+
+func (this TXmlValidationError) Error() string {
+	if this.Line > 0 {
+		return fmt.Sprintf("%s (%d:%d): %s", this.Path, this.Line, this.Column, this.Message)
+	}
+	return this.Path + ": " + this.Message
+}
+func newValidationError(Node *TXmlNode, Message string) TXmlValidationError {
+	Line, Column := Node.SourcePosition()
+	return TXmlValidationError{Path: Node.NodePath(), Line: Line, Column: Column, Message: Message}
+}
+func (this *TNativeXml) ValidateDTD() []TXmlValidationError {
+	//Validate the document against its doctype declaration,an empty list means valid
+	Dtd, err := this.Dtd()
+	if err != nil {
+		return []TXmlValidationError{{Path: "/", Message: err.Error()}}
+	}
+	if Dtd == nil {
+		return []TXmlValidationError{{Path: "/", Message: sxeValNoDoctype}}
+	}
+	if this.XmlRoot == nil {
+		return []TXmlValidationError{{Path: "/", Message: sxeNoRootElement}}
+	}
+	Validator := &tDtdValidator{Dtd: Dtd, IDs: make(map[string]bool)}
+	if this.XmlRoot.Name != Dtd.Name {
+		Validator.add(this.XmlRoot, fmt.Sprintf(sxeValRootName, this.XmlRoot.Name, Dtd.Name))
+	}
+	if Dtd.SystemID != "" && !Dtd.ExternalLoaded {
+		//Declarations missing from the external subset would let invalid documents pass
+		Validator.Errors = append(Validator.Errors, TXmlValidationError{Path: "/",
+			Message: fmt.Sprintf(sxeValExternalNotLoaded, Dtd.SystemID)})
+	}
+	Validator.validateNode(this.XmlRoot)
+	for _, v := range Validator.IDRefs {
+		if !Validator.IDs[v.Message] {
+			v.Message = fmt.Sprintf(sxeValUnknownIDRef, v.Message)
+			Validator.Errors = append(Validator.Errors, v)
+		}
+	}
+	return Validator.Errors
+}
+func (this *tDtdValidator) add(Node *TXmlNode, Message string) {
+	this.Errors = append(this.Errors, newValidationError(Node, Message))
+}
+func (this *tDtdValidator) validateNode(Node *TXmlNode) {
+	Children := make([]*TXmlNode, 0)
+	HasText := strings.Trim(Node.Value, cControlChars) != ""
+	for _, v := range Node.NodeList() {
+		switch v.ElementType {
+		case xeNormal:
+			Children = append(Children, v)
+		case xeCData, xeCharData:
+			HasText = true
+		}
+	}
+	this.validateAttributes(Node)
+	//Only documents that declare elements are checked for element content
+	if len(this.Dtd.Elements) > 0 {
+		if Element, ok := this.Dtd.Elements[Node.Name]; !ok {
+			this.add(Node, fmt.Sprintf(sxeValUndeclaredElement, Node.Name))
+		} else {
+			this.validateContent(Node, Element, Children, HasText)
+		}
+	}
+	for _, v := range Children {
+		this.validateNode(v)
+	}
+}
+func (this *tDtdValidator) validateContent(Node *TXmlNode, Element *TXmlDtdElement, Children []*TXmlNode, HasText bool) {
+	switch Element.ContentType {
+	case "EMPTY":
+		if HasText || len(Children) > 0 {
+			this.add(Node, fmt.Sprintf(sxeValNotEmpty, Node.Name))
+		}
+	case "MIXED":
+		Allowed := make(map[string]bool)
+		for _, v := range Element.Content.Items {
+			Allowed[v.Name] = true
+		}
+		for _, v := range Children {
+			if !Allowed[v.Name] {
+				this.add(v, fmt.Sprintf(sxeValChildNotAllowed, v.Name, Node.Name))
+			}
+		}
+	case "CHILDREN":
+		if HasText {
+			this.add(Node, fmt.Sprintf(sxeValTextNotAllowed, Node.Name))
+		}
+		Names := make([]string, len(Children))
+		for i, v := range Children {
+			Names[i] = v.Name
+		}
+		if !Element.Content.Matches(Names) {
+			this.add(Node, fmt.Sprintf(sxeValContentMismatch, Node.Name, Element.Content.String()))
+		}
+	}
+}
+func (this *tDtdValidator) validateAttributes(Node *TXmlNode) {
+	Decls := this.Dtd.Attributes[Node.Name]
+	for _, k := range Node.AttributeNames() {
+		if this.Dtd.AttributeDecl(Node.Name, k) == nil && (len(this.Dtd.Elements) > 0 || len(Decls) > 0) {
+			this.add(Node, fmt.Sprintf(sxeValUndeclaredAttribute, k))
+		}
+	}
+	for _, Decl := range Decls {
+		Raw, ok := Node.Attributes[Decl.Name]
+		if !ok {
+			if Decl.Default == "#REQUIRED" {
+				this.add(Node, fmt.Sprintf(sxeValRequiredAttribute, Decl.Name))
+			}
+			continue
+		}
+		//Values of all types but CDATA are normalized to single spaces
+		Value := UnescapeString(Raw)
+		if Decl.Type != "CDATA" {
+			Value = strings.Join(strings.Fields(Value), " ")
+		}
+		if Decl.Default == "#FIXED" && Value != Decl.Value {
+			this.add(Node, fmt.Sprintf(sxeValFixedAttribute, Decl.Name, Decl.Value))
+		}
+		switch Decl.Type {
+		case "ID":
+			if !isDtdName(Value) {
+				this.add(Node, fmt.Sprintf(sxeValInvalidToken, Value, Decl.Name, "name"))
+			} else if this.IDs[Value] {
+				this.add(Node, fmt.Sprintf(sxeValDuplicateID, Value))
+			}
+			this.IDs[Value] = true
+		case "IDREF", "IDREFS":
+			for _, v := range tokenList(Value, Decl.Type == "IDREFS") {
+				if !isDtdName(v) {
+					this.add(Node, fmt.Sprintf(sxeValInvalidToken, v, Decl.Name, "name"))
+					continue
+				}
+				this.IDRefs = append(this.IDRefs, newValidationError(Node, v))
+			}
+		case "ENTITY", "ENTITIES":
+			for _, v := range tokenList(Value, Decl.Type == "ENTITIES") {
+				if Entity, ok := this.Dtd.Entities[v]; !ok || Entity.Notation == "" {
+					this.add(Node, fmt.Sprintf(sxeValUnknownEntity, v, Decl.Name))
+				}
+			}
+		case "NMTOKEN", "NMTOKENS":
+			for _, v := range tokenList(Value, Decl.Type == "NMTOKENS") {
+				if !isDtdNmToken(v) {
+					this.add(Node, fmt.Sprintf(sxeValInvalidToken, v, Decl.Name, "name token"))
+				}
+			}
+		case "NOTATION", "ENUMERATION":
+			Found := false
+			for _, v := range Decl.Values {
+				Found = Found || v == Value
+			}
+			if !Found {
+				this.add(Node, fmt.Sprintf(sxeValEnumAttribute, Value, Decl.Name, "("+strings.Join(Decl.Values, "|")+")"))
+			}
+		}
+	}
+}
+func tokenList(Value string, Multiple bool) []string {
+	if Multiple {
+		return strings.Fields(Value)
+	}
+	return []string{Value}
+}
+func isDtdNmToken(AValue string) bool {
+	return IsXmlNmToken(AValue)
+}
+func isDtdName(AValue string) bool {
+	return IsXmlName(AValue)
+}
+func (this *TXmlDtdParticle) Matches(Names []string) bool {
+	//Does the sequence of child element names match this content model
+	return this.ends(Names, map[int]bool{0: true})[len(Names)]
+}
+func (this *TXmlDtdParticle) ends(Names []string, Starts map[int]bool) map[int]bool {
+	//All positions in Names where a match of this particle can end,starting at any of Starts
+	once := func(From map[int]bool) map[int]bool {
+		Result := make(map[int]bool)
+		if this.Name != "" {
+			for p := range From {
+				if p < len(Names) && Names[p] == this.Name {
+					Result[p+1] = true
+				}
+			}
+			return Result
+		}
+		if this.Choice {
+			for _, v := range this.Items {
+				for p := range v.ends(Names, From) {
+					Result[p] = true
+				}
+			}
+			return Result
+		}
+		Result = From
+		for _, v := range this.Items {
+			Result = v.ends(Names, Result)
+		}
+		return Result
+	}
+	Result := make(map[int]bool)
+	switch this.Occurs {
+	case 0, '+':
+		Result = once(Starts)
+	case '?', '*':
+		Result = once(Starts)
+		for p := range Starts {
+			Result[p] = true
+		}
+	}
+	if this.Occurs == '*' || this.Occurs == '+' {
+		//Repeat until no new end positions are found
+		for Next := Result; len(Next) > 0; {
+			Found := make(map[int]bool)
+			for p := range once(Next) {
+				if !Result[p] {
+					Result[p] = true
+					Found[p] = true
+				}
+			}
+			Next = Found
+		}
+	}
+	return Result
+}
@@ -0,0 +1,145 @@
+//go:build xmlts
+
+package native_xml_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The W3C XML Conformance Test Suite is not part of the repository. Its archive is cached
+// and checked against the checksum in testdata/xmlts20130923.sha256 before each run,the
+// cases are compared with testdata/xmlts_expected_failures.txt. The first run with
+// -xmlconf.update downloads the archive and writes both files,they are committed:
+//
+//	go test -tags xmlts -run Xmlts -xmlconf.update
+//	go test -tags xmlts -run Xmlts
+const xmltsurl = "https://www.w3.org/XML/Test/xmlts20130923.tar.gz"
+
+var xmltsdir = flag.String("xmlts", "", "directory the archive of the XML conformance test suite is cached in,the user cache when empty")
+
+func Test_Xmlts_nativexml(t *testing.T) {
+	pin := filepath.Join("testdata", "xmlts20130923.sha256")
+	sum, err := os.ReadFile(pin)
+	if err != nil && !*xmlconfupdate {
+		t.Skipf("No checksum of the suite %v,fetch it with -xmlconf.update", err)
+	}
+	dir := *xmltsdir
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		dir = filepath.Join(cache, "native_xml")
+	}
+	archive := filepath.Join(dir, path.Base(xmltsurl))
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		if data, err = fetchxmlts(archive); err != nil {
+			t.Fatalf("Fetch %s: %v", xmltsurl, err)
+		}
+	}
+	got := fmt.Sprintf("%x", sha256.Sum256(data))
+	if sum == nil {
+		if err = os.WriteFile(pin, []byte(got+"\n"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	} else if want := strings.TrimSpace(string(sum)); got != want {
+		t.Fatalf("Checksum of %s is %s,%s expects %s", archive, got, pin, want)
+	}
+	suite := t.TempDir()
+	if err = unpackxmlts(data, suite); err != nil {
+		t.Fatalf("Unpack %s: %v", archive, err)
+	}
+	runxmlconf(t, filepath.Join(suite, "xmlconf"), filepath.Join("testdata", "xmlts_expected_failures.txt"))
+}
+func fetchxmlts(archive string) ([]byte, error) {
+	//The archive is written next to its place in the cache and moved there when it is complete
+	resp, err := http.Get(xmltsurl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(archive), "xmlts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+	return data, os.Rename(tmp.Name(), archive)
+}
+func unpackxmlts(data []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	rd := tar.NewReader(gz)
+	for {
+		hdr, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid path %q in archive", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writexmltsfile(target, rd)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "xmlconf", "xmlconf.xml")); err != nil {
+		return fmt.Errorf("archive has no xmlconf/xmlconf.xml")
+	}
+	return nil
+}
+func writexmltsfile(target string, rd io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, rd); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,1132 @@
+package native_xml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	sxeXPathSyntax          = "XPath syntax error at %d in \"%s\": %s"
+	sxeXPathUnknownFunction = "Unknown XPath function %s()"
+	sxeXPathArgumentCount   = "Wrong number of arguments for XPath function %s()"
+	sxeXPathUnknownVariable = "Unknown XPath variable $%s"
+	sxeXPathNodeSetExpected = "XPath expression \"%s\" is not a node-set"
+)
+
+// Kinds of the nodes of the XPath data model
+const (
+	cXPathRoot = iota
+	cXPathElement
+	cXPathAttribute
+	cXPathText
+	cXPathComment
+	cXPathPI
+)
+
+// Node tests of a location step
+const (
+	cXPathTestName = iota
+	cXPathTestNode
+	cXPathTestText
+	cXPathTestComment
+	cXPathTestPI
+)
+
+// Token kinds of an XPath expression
+const (
+	cXPathTokenEnd = iota
+	cXPathTokenName
+	cXPathTokenNumber
+	cXPathTokenLiteral
+	cXPathTokenVariable
+	cXPathTokenOperator
+	cXPathTokenPunct
+)
+
+// Name of the node that holds the nodes of a result tree fragment
+const cXPathFragment = "#fragment"
+
+// A node of the XPath data model. The root node holds the root element or the
+// container of a result tree fragment. A text node is a text segment of an element
+// or a character data node,an attribute is its element and name
+type tXPathNode struct {
+	Kind  int
+	Node  *TXmlNode
+	Name  string //Attribute name
+	Index int    //Text segment of the element
+}
+
+// Evaluation state of an expression
+type tXPathContext struct {
+	Node      tXPathNode
+	Position  int
+	Size      int
+	Current   tXPathNode                            //The node current() returns
+	Variables func(Name string) (interface{}, bool) //Value of a variable reference
+	Order     *tXPathOrder
+}
+
+// Document order of the nodes of all trees an evaluation has seen
+type tXPathOrder struct {
+	Index map[tXPathNode]int
+}
+
+// A parsed expression. The values are string,float64,bool and []tXPathNode in
+// document order
+type tXPathExpr interface {
+	eval(Ctx *tXPathContext) interface{}
+}
+
+type tXPathBinary struct {
+	Op          string
+	Left, Right tXPathExpr
+}
+type tXPathNegate struct {
+	Expr tXPathExpr
+}
+type tXPathConstant struct {
+	Value interface{}
+}
+type tXPathVariable struct {
+	Name string
+}
+type tXPathCall struct {
+	Name string
+	Args []tXPathExpr
+}
+
+// A location path,relative to the node-set of Filter when it is set
+type tXPathPath struct {
+	Filter   tXPathExpr
+	Absolute bool
+	Steps    []*tXPathStep
+}
+type tXPathStep struct {
+	Axis       string
+	Test       int
+	Name       string //Name test or the target of processing-instruction()
+	Predicates []tXPathExpr
+}
+type tXPathFilter struct {
+	Expr       tXPathExpr
+	Predicates []tXPathExpr
+}
+
+type tXPathToken struct {
+	Kind int
+	Text string
+	Pos  int
+}
+type tXPathParser struct {
+	Expr   string
+	Tokens []tXPathToken
+	Pos    int
+}
+
+// A core function,Max is -1 for any number of arguments
+type tXPathFunction struct {
+	Min, Max int
+	Call     func(Ctx *tXPathContext, Args []interface{}) interface{}
+}
+
+var xpathAxes = map[string]bool{"ancestor": true, "ancestor-or-self": true, "attribute": true, "child": true,
+	"descendant": true, "descendant-or-self": true, "following": true, "following-sibling": true,
+	"parent": true, "preceding": true, "preceding-sibling": true, "self": true}
+var xpathNodeTypes = map[string]int{"node": cXPathTestNode, "text": cXPathTestText, "comment": cXPathTestComment,
+	"processing-instruction": cXPathTestPI}
+var xpathFunctions = map[string]tXPathFunction{
+	"last":          {0, 0, func(Ctx *tXPathContext, Args []interface{}) interface{} { return float64(Ctx.Size) }},
+	"position":      {0, 0, func(Ctx *tXPathContext, Args []interface{}) interface{} { return float64(Ctx.Position) }},
+	"count":         {1, 1, func(Ctx *tXPathContext, Args []interface{}) interface{} { return float64(len(xpathNodes(Args[0]))) }},
+	"local-name":    {0, 1, xpathLocalName},
+	"name":          {0, 1, xpathName},
+	"namespace-uri": {0, 1, xpathNamespaceURI},
+	"string":        {0, 1, func(Ctx *tXPathContext, Args []interface{}) interface{} { return xpathString(xpathArg(Ctx, Args)) }},
+	"concat":        {2, -1, xpathConcat},
+	"starts-with": {2, 2, func(Ctx *tXPathContext, Args []interface{}) interface{} {
+		return strings.HasPrefix(xpathString(Args[0]), xpathString(Args[1]))
+	}},
+	"contains": {2, 2, func(Ctx *tXPathContext, Args []interface{}) interface{} {
+		return strings.Contains(xpathString(Args[0]), xpathString(Args[1]))
+	}},
+	"substring-before": {2, 2, xpathSubstringBefore},
+	"substring-after":  {2, 2, xpathSubstringAfter},
+	"substring":        {2, 3, xpathSubstring},
+	"string-length": {0, 1, func(Ctx *tXPathContext, Args []interface{}) interface{} {
+		return float64(utf8.RuneCountInString(xpathString(xpathArg(Ctx, Args))))
+	}},
+	"normalize-space": {0, 1, func(Ctx *tXPathContext, Args []interface{}) interface{} {
+		return strings.Join(strings.Fields(xpathString(xpathArg(Ctx, Args))), " ")
+	}},
+	"translate":   {3, 3, xpathTranslate},
+	"boolean":     {1, 1, func(Ctx *tXPathContext, Args []interface{}) interface{} { return xpathBoolean(Args[0]) }},
+	"not":         {1, 1, func(Ctx *tXPathContext, Args []interface{}) interface{} { return !xpathBoolean(Args[0]) }},
+	"true":        {0, 0, func(Ctx *tXPathContext, Args []interface{}) interface{} { return true }},
+	"false":       {0, 0, func(Ctx *tXPathContext, Args []interface{}) interface{} { return false }},
+	"number":      {0, 1, func(Ctx *tXPathContext, Args []interface{}) interface{} { return xpathNumber(xpathArg(Ctx, Args)) }},
+	"sum":         {1, 1, xpathSum},
+	"floor":       {1, 1, func(Ctx *tXPathContext, Args []interface{}) interface{} { return math.Floor(xpathNumber(Args[0])) }},
+	"ceiling":     {1, 1, func(Ctx *tXPathContext, Args []interface{}) interface{} { return math.Ceil(xpathNumber(Args[0])) }},
+	"round":       {1, 1, func(Ctx *tXPathContext, Args []interface{}) interface{} { return xpathRound(xpathNumber(Args[0])) }},
+	"current":     {0, 0, func(Ctx *tXPathContext, Args []interface{}) interface{} { return []tXPathNode{Ctx.Current} }},
+	"generate-id": {0, 1, xpathGenerateID},
+}
+
+func compileXPath(Expr string) (Result tXPathExpr, err error) {
+	defer recoverError(&err)
+	return parseXPath(Expr), nil
+}
+func parseXPath(Expr string) tXPathExpr {
+	//Parse Expr or panic with a syntax error
+	P := &tXPathParser{Expr: Expr, Tokens: xpathTokens(Expr)}
+	Result := P.parseOr()
+	if T := P.peek(); T.Kind != cXPathTokenEnd {
+		P.fail(T, "unexpected \""+T.Text+"\"")
+	}
+	return Result
+}
+func xpathTokens(Expr string) []tXPathToken {
+	Tokens := make([]tXPathToken, 0, 16)
+	Fail := func(Pos int, Msg string) {
+		panic(errors.New(fmt.Sprintf(sxeXPathSyntax, Pos+1, Expr, Msg)))
+	}
+	IsDigit := func(i int) bool {
+		return i < len(Expr) && Expr[i] >= '0' && Expr[i] <= '9'
+	}
+	NCName := func(i int) int {
+		//End of the NCName at i
+		for i < len(Expr) {
+			r, Size := utf8.DecodeRuneInString(Expr[i:])
+			if r == ':' || !IsXmlNameChar(r) {
+				break
+			}
+			i += Size
+		}
+		return i
+	}
+	for i := 0; ; {
+		for i < len(Expr) && strings.IndexByte(cControlChars, Expr[i]) >= 0 {
+			i++
+		}
+		if i >= len(Expr) {
+			Tokens = append(Tokens, tXPathToken{Kind: cXPathTokenEnd, Pos: i})
+			break
+		}
+		Start, c := i, Expr[i]
+		Kind := cXPathTokenPunct
+		switch {
+		case c == '"' || c == '\'':
+			Close := strings.IndexByte(Expr[i+1:], c)
+			if Close < 0 {
+				Fail(i, "unterminated literal")
+			}
+			Tokens = append(Tokens, tXPathToken{Kind: cXPathTokenLiteral, Text: Expr[i+1 : i+1+Close], Pos: i})
+			i += Close + 2
+			continue
+		case IsDigit(i) || (c == '.' && IsDigit(i+1)):
+			for IsDigit(i) {
+				i++
+			}
+			if i < len(Expr) && Expr[i] == '.' {
+				for i++; IsDigit(i); i++ {
+				}
+			}
+			Kind = cXPathTokenNumber
+		case c == '$':
+			i = NCName(i + 1)
+			if i < len(Expr) && Expr[i] == ':' {
+				i = NCName(i + 1)
+			}
+			if i == Start+1 {
+				Fail(Start, "variable name expected")
+			}
+			Tokens = append(Tokens, tXPathToken{Kind: cXPathTokenVariable, Text: Expr[Start+1 : i], Pos: Start})
+			continue
+		case strings.HasPrefix(Expr[i:], ".."), strings.HasPrefix(Expr[i:], "::"):
+			i += 2
+		case strings.HasPrefix(Expr[i:], "//"), strings.HasPrefix(Expr[i:], "!="),
+			strings.HasPrefix(Expr[i:], "<="), strings.HasPrefix(Expr[i:], ">="):
+			i += 2
+			Kind = cXPathTokenOperator
+		case strings.IndexByte("/|+-=<>", c) >= 0:
+			i++
+			Kind = cXPathTokenOperator
+		case strings.IndexByte(".()[]@,", c) >= 0:
+			i++
+		case c == '*':
+			//A name test,the multiply operator is told apart below
+			i++
+			Kind = cXPathTokenName
+		default:
+			if r, _ := utf8.DecodeRuneInString(Expr[i:]); !IsXmlNameStartChar(r) || r == ':' {
+				Fail(i, "unexpected character")
+			}
+			i = NCName(i)
+			if i+1 < len(Expr) && Expr[i] == ':' && Expr[i+1] != ':' {
+				if Expr[i+1] == '*' {
+					i += 2
+				} else {
+					i = NCName(i + 1)
+				}
+			}
+			Kind = cXPathTokenName
+		}
+		Tokens = append(Tokens, tXPathToken{Kind: Kind, Text: Expr[Start:i], Pos: Start})
+	}
+	//A name or * that follows an operand is an operator
+	for i := 1; i < len(Tokens); i++ {
+		T, Prev := &Tokens[i], Tokens[i-1]
+		if T.Kind != cXPathTokenName || Prev.Kind == cXPathTokenOperator {
+			continue
+		}
+		if Prev.Kind == cXPathTokenPunct && strings.Contains(" @ :: ( [ , ", " "+Prev.Text+" ") {
+			continue
+		}
+		switch T.Text {
+		case "*", "and", "or", "mod", "div":
+			T.Kind = cXPathTokenOperator
+		}
+	}
+	return Tokens
+}
+
+func (this *tXPathParser) fail(T tXPathToken, Msg string) {
+	panic(errors.New(fmt.Sprintf(sxeXPathSyntax, T.Pos+1, this.Expr, Msg)))
+}
+func (this *tXPathParser) peek() tXPathToken {
+	return this.Tokens[this.Pos]
+}
+func (this *tXPathParser) peekAt(Offset int) tXPathToken {
+	if this.Pos+Offset < len(this.Tokens) {
+		return this.Tokens[this.Pos+Offset]
+	}
+	return this.Tokens[len(this.Tokens)-1]
+}
+func (this *tXPathParser) next() tXPathToken {
+	T := this.Tokens[this.Pos]
+	if T.Kind != cXPathTokenEnd {
+		this.Pos++
+	}
+	return T
+}
+func (this *tXPathParser) is(Kind int, Text string) bool {
+	T := this.peek()
+	return T.Kind == Kind && T.Text == Text
+}
+func (this *tXPathParser) expect(Text string) {
+	if T := this.next(); T.Kind != cXPathTokenPunct || T.Text != Text {
+		this.fail(T, "\""+Text+"\" expected")
+	}
+}
+func (this *tXPathParser) binary(Operand func() tXPathExpr, Ops ...string) tXPathExpr {
+	//Left associative operators of one precedence level
+	Left := Operand()
+	for {
+		T := this.peek()
+		Found := false
+		for _, v := range Ops {
+			Found = Found || (T.Kind == cXPathTokenOperator && T.Text == v)
+		}
+		if !Found {
+			return Left
+		}
+		this.next()
+		Left = &tXPathBinary{Op: T.Text, Left: Left, Right: Operand()}
+	}
+}
+func (this *tXPathParser) parseOr() tXPathExpr {
+	return this.binary(this.parseAnd, "or")
+}
+func (this *tXPathParser) parseAnd() tXPathExpr {
+	return this.binary(this.parseEquality, "and")
+}
+func (this *tXPathParser) parseEquality() tXPathExpr {
+	return this.binary(this.parseRelational, "=", "!=")
+}
+func (this *tXPathParser) parseRelational() tXPathExpr {
+	return this.binary(this.parseAdditive, "<", ">", "<=", ">=")
+}
+func (this *tXPathParser) parseAdditive() tXPathExpr {
+	return this.binary(this.parseMultiplicative, "+", "-")
+}
+func (this *tXPathParser) parseMultiplicative() tXPathExpr {
+	return this.binary(this.parseUnary, "*", "div", "mod")
+}
+func (this *tXPathParser) parseUnary() tXPathExpr {
+	if this.is(cXPathTokenOperator, "-") {
+		this.next()
+		return &tXPathNegate{Expr: this.parseUnary()}
+	}
+	return this.binary(this.parsePath, "|")
+}
+func (this *tXPathParser) parsePath() tXPathExpr {
+	T, Next := this.peek(), this.peekAt(1)
+	IsCall := T.Kind == cXPathTokenName && Next.Kind == cXPathTokenPunct && Next.Text == "("
+	if _, IsNodeType := xpathNodeTypes[T.Text]; IsCall && IsNodeType {
+		IsCall = false
+	}
+	switch {
+	case IsCall, T.Kind == cXPathTokenVariable, T.Kind == cXPathTokenLiteral, T.Kind == cXPathTokenNumber,
+		T.Kind == cXPathTokenPunct && T.Text == "(":
+		Filter := this.parsePrimary()
+		if Predicates := this.parsePredicates(); len(Predicates) > 0 {
+			Filter = &tXPathFilter{Expr: Filter, Predicates: Predicates}
+		}
+		if !this.is(cXPathTokenOperator, "/") && !this.is(cXPathTokenOperator, "//") {
+			return Filter
+		}
+		Path := &tXPathPath{Filter: Filter}
+		this.parseSteps(Path, false)
+		return Path
+	}
+	Path := &tXPathPath{}
+	switch {
+	case this.is(cXPathTokenOperator, "/"):
+		Path.Absolute = true
+		this.next()
+		if !this.stepStart() {
+			return Path
+		}
+		this.parseSteps(Path, true)
+	case this.is(cXPathTokenOperator, "//"):
+		Path.Absolute = true
+		this.parseSteps(Path, false)
+	default:
+		this.parseSteps(Path, true)
+	}
+	return Path
+}
+func (this *tXPathParser) stepStart() bool {
+	T := this.peek()
+	return T.Kind == cXPathTokenName || (T.Kind == cXPathTokenPunct && strings.Contains(" . .. @ ", " "+T.Text+" "))
+}
+func (this *tXPathParser) parseSteps(Path *tXPathPath, First bool) {
+	//Steps separated by "/" and "//",First when the path starts with a step
+	for {
+		if First {
+			Path.Steps = append(Path.Steps, this.parseStep())
+		}
+		First = true
+		switch {
+		case this.is(cXPathTokenOperator, "/"):
+			this.next()
+		case this.is(cXPathTokenOperator, "//"):
+			this.next()
+			Path.Steps = append(Path.Steps, &tXPathStep{Axis: "descendant-or-self", Test: cXPathTestNode})
+		default:
+			return
+		}
+	}
+}
+func (this *tXPathParser) parseStep() *tXPathStep {
+	T := this.next()
+	switch {
+	case T.Kind == cXPathTokenPunct && T.Text == ".":
+		return &tXPathStep{Axis: "self", Test: cXPathTestNode}
+	case T.Kind == cXPathTokenPunct && T.Text == "..":
+		return &tXPathStep{Axis: "parent", Test: cXPathTestNode}
+	}
+	Step := &tXPathStep{Axis: "child"}
+	if T.Kind == cXPathTokenPunct && T.Text == "@" {
+		Step.Axis = "attribute"
+		T = this.next()
+	} else if T.Kind == cXPathTokenName && this.is(cXPathTokenPunct, "::") {
+		if !xpathAxes[T.Text] {
+			this.fail(T, "unknown axis \""+T.Text+"\"")
+		}
+		Step.Axis = T.Text
+		this.next()
+		T = this.next()
+	}
+	if T.Kind != cXPathTokenName {
+		this.fail(T, "node test expected")
+	}
+	if Test, ok := xpathNodeTypes[T.Text]; ok && this.is(cXPathTokenPunct, "(") {
+		this.next()
+		Step.Test = Test
+		if Test == cXPathTestPI && this.peek().Kind == cXPathTokenLiteral {
+			Step.Name = this.next().Text
+		}
+		this.expect(")")
+	} else {
+		Step.Test, Step.Name = cXPathTestName, T.Text
+	}
+	Step.Predicates = this.parsePredicates()
+	return Step
+}
+func (this *tXPathParser) parsePredicates() []tXPathExpr {
+	var Predicates []tXPathExpr
+	for this.is(cXPathTokenPunct, "[") {
+		this.next()
+		Predicates = append(Predicates, this.parseOr())
+		this.expect("]")
+	}
+	return Predicates
+}
+func (this *tXPathParser) parsePrimary() tXPathExpr {
+	T := this.next()
+	switch T.Kind {
+	case cXPathTokenVariable:
+		return &tXPathVariable{Name: T.Text}
+	case cXPathTokenLiteral:
+		return &tXPathConstant{Value: T.Text}
+	case cXPathTokenNumber:
+		f, _ := strconv.ParseFloat(T.Text, 64)
+		return &tXPathConstant{Value: f}
+	case cXPathTokenPunct:
+		Expr := this.parseOr()
+		this.expect(")")
+		return Expr
+	}
+	Function, ok := xpathFunctions[T.Text]
+	if !ok {
+		panic(errors.New(fmt.Sprintf(sxeXPathUnknownFunction, T.Text)))
+	}
+	Call := &tXPathCall{Name: T.Text}
+	this.expect("(")
+	for !this.is(cXPathTokenPunct, ")") {
+		if len(Call.Args) > 0 {
+			this.expect(",")
+		}
+		Call.Args = append(Call.Args, this.parseOr())
+	}
+	this.next()
+	if len(Call.Args) < Function.Min || (Function.Max >= 0 && len(Call.Args) > Function.Max) {
+		panic(errors.New(fmt.Sprintf(sxeXPathArgumentCount, T.Text)))
+	}
+	return Call
+}
+
+func (this *tXPathBinary) eval(Ctx *tXPathContext) interface{} {
+	switch this.Op {
+	case "or":
+		return xpathBoolean(this.Left.eval(Ctx)) || xpathBoolean(this.Right.eval(Ctx))
+	case "and":
+		return xpathBoolean(this.Left.eval(Ctx)) && xpathBoolean(this.Right.eval(Ctx))
+	}
+	Left, Right := this.Left.eval(Ctx), this.Right.eval(Ctx)
+	switch this.Op {
+	case "|":
+		Nodes := append(append([]tXPathNode(nil), xpathNodeSet(Left, "|")...), xpathNodeSet(Right, "|")...)
+		return Ctx.sort(Nodes)
+	case "=", "!=", "<", ">", "<=", ">=":
+		return xpathCompare(this.Op, Left, Right)
+	}
+	a, b := xpathNumber(Left), xpathNumber(Right)
+	switch this.Op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "div":
+		return a / b
+	}
+	return math.Mod(a, b)
+}
+func (this *tXPathNegate) eval(Ctx *tXPathContext) interface{} {
+	return -xpathNumber(this.Expr.eval(Ctx))
+}
+func (this *tXPathConstant) eval(Ctx *tXPathContext) interface{} {
+	return this.Value
+}
+func (this *tXPathVariable) eval(Ctx *tXPathContext) interface{} {
+	if Ctx.Variables != nil {
+		if Value, ok := Ctx.Variables(this.Name); ok {
+			return Value
+		}
+	}
+	panic(errors.New(fmt.Sprintf(sxeXPathUnknownVariable, this.Name)))
+}
+func (this *tXPathCall) eval(Ctx *tXPathContext) interface{} {
+	Args := make([]interface{}, len(this.Args))
+	for i, v := range this.Args {
+		Args[i] = v.eval(Ctx)
+	}
+	return xpathFunctions[this.Name].Call(Ctx, Args)
+}
+func (this *tXPathFilter) eval(Ctx *tXPathContext) interface{} {
+	Nodes := xpathNodeSet(this.Expr.eval(Ctx), "[]")
+	for _, v := range this.Predicates {
+		Nodes = Ctx.filter(Nodes, v)
+	}
+	return Nodes
+}
+func (this *tXPathPath) eval(Ctx *tXPathContext) interface{} {
+	var Nodes []tXPathNode
+	switch {
+	case this.Filter != nil:
+		Nodes = xpathNodeSet(this.Filter.eval(Ctx), "/")
+	case this.Absolute:
+		Nodes = []tXPathNode{Ctx.Node.root()}
+	default:
+		Nodes = []tXPathNode{Ctx.Node}
+	}
+	for _, v := range this.Steps {
+		Nodes = v.apply(Ctx, Nodes)
+	}
+	return Nodes
+}
+func (this *tXPathStep) apply(Ctx *tXPathContext, Nodes []tXPathNode) []tXPathNode {
+	Result := make([]tXPathNode, 0, len(Nodes))
+	for _, n := range Nodes {
+		Matched := make([]tXPathNode, 0)
+		for _, v := range n.axis(this.Axis) {
+			if this.matches(v) {
+				Matched = append(Matched, v)
+			}
+		}
+		for _, p := range this.Predicates {
+			Matched = Ctx.filter(Matched, p)
+		}
+		Result = append(Result, Matched...)
+	}
+	switch this.Axis {
+	case "ancestor", "ancestor-or-self", "preceding", "preceding-sibling":
+		//The predicates count from the context node,the result is in document order
+		return Ctx.sort(Result)
+	}
+	if len(Nodes) > 1 {
+		return Ctx.sort(Result)
+	}
+	return Result
+}
+func (this *tXPathStep) matches(Node tXPathNode) bool {
+	switch this.Test {
+	case cXPathTestNode:
+		return true
+	case cXPathTestText:
+		return Node.Kind == cXPathText
+	case cXPathTestComment:
+		return Node.Kind == cXPathComment
+	case cXPathTestPI:
+		return Node.Kind == cXPathPI && (this.Name == "" || Node.name() == this.Name)
+	}
+	//The principal node type of the attribute axis is attribute,element for the others
+	if (this.Axis == "attribute") != (Node.Kind == cXPathAttribute) || (Node.Kind != cXPathElement && Node.Kind != cXPathAttribute) {
+		return false
+	}
+	return xpathNameTest(this.Name, Node.name())
+}
+func xpathNameTest(Test, Name string) bool {
+	switch {
+	case Test == "*":
+		return true
+	case strings.HasSuffix(Test, ":*"):
+		Prefix, _ := SplitQualifiedName(Name)
+		return Prefix+":*" == Test
+	}
+	return Test == Name
+}
+
+func (this *tXPathContext) filter(Nodes []tXPathNode, Predicate tXPathExpr) []tXPathNode {
+	//A number predicate selects the node at that position,others are converted to boolean
+	Result := make([]tXPathNode, 0, len(Nodes))
+	Sub := *this
+	Sub.Size = len(Nodes)
+	for i, v := range Nodes {
+		Sub.Node, Sub.Position = v, i+1
+		Value := Predicate.eval(&Sub)
+		if f, ok := Value.(float64); ok {
+			if f == float64(i+1) {
+				Result = append(Result, v)
+			}
+		} else if xpathBoolean(Value) {
+			Result = append(Result, v)
+		}
+	}
+	return Result
+}
+func (this *tXPathContext) sort(Nodes []tXPathNode) []tXPathNode {
+	//Nodes in document order without duplicates
+	if this.Order == nil {
+		this.Order = &tXPathOrder{}
+	}
+	sort.SliceStable(Nodes, func(i, j int) bool {
+		return this.Order.of(Nodes[i]) < this.Order.of(Nodes[j])
+	})
+	Result := Nodes[:0]
+	for i, v := range Nodes {
+		if i == 0 || v != Nodes[i-1] {
+			Result = append(Result, v)
+		}
+	}
+	return Result
+}
+func (this *tXPathOrder) of(Node tXPathNode) int {
+	//The nodes of a tree are numbered when one of them is first seen,trees are
+	//ordered by that
+	if this.Index == nil {
+		this.Index = make(map[tXPathNode]int)
+	}
+	if i, ok := this.Index[Node]; ok {
+		return i
+	}
+	this.number(Node.root())
+	return this.Index[Node]
+}
+func (this *tXPathOrder) number(Node tXPathNode) {
+	this.Index[Node] = len(this.Index)
+	for _, v := range Node.axis("attribute") {
+		this.Index[v] = len(this.Index)
+	}
+	for _, v := range Node.children() {
+		this.number(v)
+	}
+}
+
+func xpathNodeOf(Node *TXmlNode) (tXPathNode, bool) {
+	//The node of the data model for a child node,others are not part of it
+	switch Node.ElementType {
+	case xeNormal:
+		return tXPathNode{Kind: cXPathElement, Node: Node}, true
+	case xeComment:
+		return tXPathNode{Kind: cXPathComment, Node: Node}, true
+	case xeQuestion:
+		return tXPathNode{Kind: cXPathPI, Node: Node}, true
+	case xeCData, xeCharData:
+		return tXPathNode{Kind: cXPathText, Node: Node}, Node.Value != ""
+	}
+	return tXPathNode{}, false
+}
+func xpathDocument(Doc *TNativeXml) tXPathNode {
+	return tXPathNode{Kind: cXPathRoot, Node: Doc.XmlRoot}
+}
+func (this tXPathNode) root() tXPathNode {
+	Node := this.Node
+	for Node.Parent != nil {
+		Node = Node.Parent
+	}
+	return tXPathNode{Kind: cXPathRoot, Node: Node}
+}
+func (this tXPathNode) parent() (tXPathNode, bool) {
+	switch this.Kind {
+	case cXPathRoot:
+		return tXPathNode{}, false
+	case cXPathAttribute:
+		return tXPathNode{Kind: cXPathElement, Node: this.Node}, true
+	case cXPathText:
+		if this.Node.ElementType == xeNormal {
+			//A text segment of its element
+			return this.Node.xpathElement(), true
+		}
+	}
+	if this.Node.Parent == nil {
+		return tXPathNode{Kind: cXPathRoot, Node: this.Node}, true
+	}
+	return this.Node.Parent.xpathElement(), true
+}
+func (this *TXmlNode) xpathElement() tXPathNode {
+	//The element,the root node for the container of a fragment
+	if this.Parent == nil && this.Name == cXPathFragment {
+		return tXPathNode{Kind: cXPathRoot, Node: this}
+	}
+	return tXPathNode{Kind: cXPathElement, Node: this}
+}
+func (this tXPathNode) children() []tXPathNode {
+	switch {
+	case this.Kind == cXPathRoot && this.Node.Name != cXPathFragment:
+		return []tXPathNode{{Kind: cXPathElement, Node: this.Node}}
+	case this.Kind != cXPathRoot && this.Kind != cXPathElement:
+		return nil
+	}
+	Segments := this.Node.textSegments()
+	List := make([]tXPathNode, 0, 2*len(Segments))
+	for i, v := range this.Node.NodeList() {
+		if strings.Trim(Segments[i], cControlChars) != "" {
+			List = append(List, tXPathNode{Kind: cXPathText, Node: this.Node, Index: i})
+		}
+		if Child, ok := xpathNodeOf(v); ok {
+			List = append(List, Child)
+		}
+	}
+	if Last := len(Segments) - 1; strings.Trim(Segments[Last], cControlChars) != "" {
+		List = append(List, tXPathNode{Kind: cXPathText, Node: this.Node, Index: Last})
+	}
+	return List
+}
+func (this tXPathNode) descendants(List []tXPathNode) []tXPathNode {
+	for _, v := range this.children() {
+		List = v.descendants(append(List, v))
+	}
+	return List
+}
+func (this tXPathNode) siblings() (List []tXPathNode, Index int) {
+	//The children of the parent and the position of the node in them
+	Parent, ok := this.parent()
+	if !ok || this.Kind == cXPathAttribute {
+		return nil, -1
+	}
+	List = Parent.children()
+	for i, v := range List {
+		if v == this {
+			return List, i
+		}
+	}
+	return nil, -1
+}
+func (this tXPathNode) axis(Axis string) []tXPathNode {
+	//The nodes of Axis in the order of the axis,reverse axes start at the nearest node
+	var List []tXPathNode
+	switch Axis {
+	case "self":
+		return []tXPathNode{this}
+	case "child":
+		return this.children()
+	case "descendant":
+		return this.descendants(nil)
+	case "descendant-or-self":
+		return this.descendants([]tXPathNode{this})
+	case "parent":
+		if Parent, ok := this.parent(); ok {
+			List = append(List, Parent)
+		}
+	case "ancestor-or-self":
+		List = append(List, this)
+		fallthrough
+	case "ancestor":
+		for Node, ok := this.parent(); ok; Node, ok = Node.parent() {
+			List = append(List, Node)
+		}
+	case "attribute":
+		if this.Kind != cXPathElement {
+			return nil
+		}
+		for _, v := range this.Node.AttributeNames() {
+			if _, IsDecl := namespaceDeclPrefix(v); !IsDecl {
+				List = append(List, tXPathNode{Kind: cXPathAttribute, Node: this.Node, Name: v})
+			}
+		}
+		sort.Slice(List, func(i, j int) bool { return List[i].Name < List[j].Name })
+	case "following-sibling":
+		if Siblings, i := this.siblings(); i >= 0 {
+			List = append(List, Siblings[i+1:]...)
+		}
+	case "preceding-sibling":
+		Siblings, i := this.siblings()
+		for i--; i >= 0; i-- {
+			List = append(List, Siblings[i])
+		}
+	case "following":
+		Node := this
+		if this.Kind == cXPathAttribute {
+			Node, _ = this.parent()
+			List = Node.descendants(List)
+		}
+		for ok := true; ok; Node, ok = Node.parent() {
+			if Siblings, i := Node.siblings(); i >= 0 {
+				for _, v := range Siblings[i+1:] {
+					List = v.descendants(append(List, v))
+				}
+			}
+		}
+	case "preceding":
+		Node := this
+		if this.Kind == cXPathAttribute {
+			Node, _ = this.parent()
+		}
+		for ok := true; ok; Node, ok = Node.parent() {
+			Siblings, i := Node.siblings()
+			for i--; i >= 0; i-- {
+				Sub := Siblings[i].descendants(nil)
+				for j := len(Sub) - 1; j >= 0; j-- {
+					List = append(List, Sub[j])
+				}
+				List = append(List, Siblings[i])
+			}
+		}
+	}
+	return List
+}
+func (this tXPathNode) name() string {
+	switch this.Kind {
+	case cXPathElement:
+		return this.Node.Name
+	case cXPathAttribute:
+		return this.Name
+	case cXPathPI:
+		return strings.Fields(this.Node.Value + " ")[0]
+	}
+	return ""
+}
+func (this tXPathNode) stringValue() string {
+	switch this.Kind {
+	case cXPathAttribute:
+		return UnescapeString(this.Node.Attributes[this.Name])
+	case cXPathText:
+		switch this.Node.ElementType {
+		case xeNormal:
+			return UnescapeString(this.Node.textSegments()[this.Index])
+		case xeCData:
+			return this.Node.Value
+		}
+		return UnescapeString(this.Node.Value)
+	case cXPathComment:
+		return this.Node.Value
+	case cXPathPI:
+		Value := strings.TrimLeft(this.Node.Value, cControlChars)
+		if p := strings.IndexAny(Value, cControlChars); p >= 0 {
+			return strings.Trim(Value[p:], cControlChars)
+		}
+		return ""
+	}
+	buf := new(bytes.Buffer)
+	this.writeText(buf)
+	return buf.String()
+}
+func (this tXPathNode) writeText(buf *bytes.Buffer) {
+	for _, v := range this.children() {
+		if v.Kind == cXPathText {
+			buf.WriteString(v.stringValue())
+		} else if v.Kind == cXPathElement {
+			v.writeText(buf)
+		}
+	}
+}
+
+func xpathNodes(Value interface{}) []tXPathNode {
+	Nodes, _ := Value.([]tXPathNode)
+	return Nodes
+}
+func xpathNodeSet(Value interface{}, Expr string) []tXPathNode {
+	Nodes, ok := Value.([]tXPathNode)
+	if !ok {
+		panic(errors.New(fmt.Sprintf(sxeXPathNodeSetExpected, Expr)))
+	}
+	return Nodes
+}
+func xpathArg(Ctx *tXPathContext, Args []interface{}) interface{} {
+	//The optional argument that defaults to the context node
+	if len(Args) > 0 {
+		return Args[0]
+	}
+	return []tXPathNode{Ctx.Node}
+}
+func xpathString(Value interface{}) string {
+	switch v := Value.(type) {
+	case string:
+		return v
+	case float64:
+		return xpathNumberString(v)
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case []tXPathNode:
+		if len(v) > 0 {
+			return v[0].stringValue()
+		}
+	}
+	return ""
+}
+func xpathNumberString(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case f == 0:
+		return "0"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+func xpathNumber(Value interface{}) float64 {
+	switch v := Value.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	}
+	//Only an optional minus,digits and one period are a number
+	s := strings.Trim(xpathString(Value), cControlChars)
+	Digits, Periods := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] >= '0' && s[i] <= '9':
+			Digits++
+		case s[i] == '.':
+			Periods++
+		case s[i] == '-' && i == 0:
+		default:
+			return math.NaN()
+		}
+	}
+	if Digits == 0 || Periods > 1 {
+		return math.NaN()
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+func xpathBoolean(Value interface{}) bool {
+	switch v := Value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	case []tXPathNode:
+		return len(v) > 0
+	}
+	return false
+}
+func xpathRound(f float64) float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return f
+	}
+	return math.Floor(f + 0.5)
+}
+func xpathCompare(Op string, Left, Right interface{}) bool {
+	//Node-sets compare by each of their string values,other values are converted to
+	//the type of the other operand
+	_, LBool := Left.(bool)
+	_, RBool := Right.(bool)
+	if LBool || RBool {
+		Left, Right = xpathBoolean(Left), xpathBoolean(Right)
+	}
+	if Nodes, ok := Left.([]tXPathNode); ok {
+		for _, v := range Nodes {
+			var Value interface{} = v.stringValue()
+			if _, IsNumber := Right.(float64); IsNumber {
+				Value = xpathNumber(Value)
+			}
+			if xpathCompare(Op, Value, Right) {
+				return true
+			}
+		}
+		return false
+	}
+	if _, ok := Right.([]tXPathNode); ok {
+		Swapped := map[string]string{"=": "=", "!=": "!=", "<": ">", ">": "<", "<=": ">=", ">=": "<="}
+		return xpathCompare(Swapped[Op], Right, Left)
+	}
+	if Op == "=" || Op == "!=" {
+		var Equal bool
+		_, LNumber := Left.(float64)
+		_, RNumber := Right.(float64)
+		switch {
+		case LBool || RBool:
+			Equal = xpathBoolean(Left) == xpathBoolean(Right)
+		case LNumber || RNumber:
+			Equal = xpathNumber(Left) == xpathNumber(Right)
+		default:
+			Equal = xpathString(Left) == xpathString(Right)
+		}
+		return Equal == (Op == "=")
+	}
+	a, b := xpathNumber(Left), xpathNumber(Right)
+	switch Op {
+	case "<":
+		return a < b
+	case ">":
+		return a > b
+	case "<=":
+		return a <= b
+	}
+	return a >= b
+}
+
+func xpathLocalName(Ctx *tXPathContext, Args []interface{}) interface{} {
+	_, Local := SplitQualifiedName(xpathName(Ctx, Args).(string))
+	return Local
+}
+func xpathName(Ctx *tXPathContext, Args []interface{}) interface{} {
+	if Nodes := xpathNodes(xpathArg(Ctx, Args)); len(Nodes) > 0 {
+		return Nodes[0].name()
+	}
+	return ""
+}
+func xpathNamespaceURI(Ctx *tXPathContext, Args []interface{}) interface{} {
+	Nodes := xpathNodes(xpathArg(Ctx, Args))
+	if len(Nodes) == 0 || (Nodes[0].Kind != cXPathElement && Nodes[0].Kind != cXPathAttribute) {
+		return ""
+	}
+	Prefix, _ := SplitQualifiedName(Nodes[0].name())
+	if Prefix == "" && Nodes[0].Kind == cXPathAttribute {
+		return ""
+	}
+	return Nodes[0].Node.LookupNamespaceURI(Prefix)
+}
+func xpathConcat(Ctx *tXPathContext, Args []interface{}) interface{} {
+	buf := new(bytes.Buffer)
+	for _, v := range Args {
+		buf.WriteString(xpathString(v))
+	}
+	return buf.String()
+}
+func xpathSubstringBefore(Ctx *tXPathContext, Args []interface{}) interface{} {
+	s := xpathString(Args[0])
+	if p := strings.Index(s, xpathString(Args[1])); p >= 0 {
+		return s[:p]
+	}
+	return ""
+}
+func xpathSubstringAfter(Ctx *tXPathContext, Args []interface{}) interface{} {
+	s, Sub := xpathString(Args[0]), xpathString(Args[1])
+	if p := strings.Index(s, Sub); p >= 0 {
+		return s[p+len(Sub):]
+	}
+	return ""
+}
+func xpathSubstring(Ctx *tXPathContext, Args []interface{}) interface{} {
+	//The characters at the rounded positions from start to start+length
+	Chars := []rune(xpathString(Args[0]))
+	First, Last := xpathRound(xpathNumber(Args[1])), math.Inf(1)
+	if len(Args) > 2 {
+		Last = First + xpathRound(xpathNumber(Args[2]))
+	}
+	buf := new(bytes.Buffer)
+	for i, r := range Chars {
+		if Pos := float64(i + 1); Pos >= First && Pos < Last {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+func xpathTranslate(Ctx *tXPathContext, Args []interface{}) interface{} {
+	From, To := []rune(xpathString(Args[1])), []rune(xpathString(Args[2]))
+	buf := new(bytes.Buffer)
+	for _, r := range xpathString(Args[0]) {
+		i := 0
+		for i < len(From) && From[i] != r {
+			i++
+		}
+		switch {
+		case i == len(From):
+			buf.WriteRune(r)
+		case i < len(To):
+			buf.WriteRune(To[i])
+		}
+	}
+	return buf.String()
+}
+func xpathSum(Ctx *tXPathContext, Args []interface{}) interface{} {
+	Sum := 0.0
+	for _, v := range xpathNodeSet(Args[0], "sum()") {
+		Sum += xpathNumber(v.stringValue())
+	}
+	return Sum
+}
+func xpathGenerateID(Ctx *tXPathContext, Args []interface{}) interface{} {
+	Nodes := xpathNodes(xpathArg(Ctx, Args))
+	if len(Nodes) == 0 {
+		return ""
+	}
+	if Ctx.Order == nil {
+		Ctx.Order = &tXPathOrder{}
+	}
+	return "id" + strconv.Itoa(Ctx.Order.of(Nodes[0]))
+}
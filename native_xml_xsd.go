@@ -0,0 +1,1425 @@
+package native_xml
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	XmlSchemaNamespace         = "http://www.w3.org/2001/XMLSchema"
+	XmlSchemaInstanceNamespace = "http://www.w3.org/2001/XMLSchema-instance"
+
+	sxeXsdNotASchema         = "File \"%s\" is not an xml schema"
+	sxeXsdReadError          = "Cannot read schema \"%s\": %v"
+	sxeXsdRemoteLocation     = "Schema location \"%s\" is not a local file"
+	sxeXsdUnknownType        = "Unknown type \"%s\""
+	sxeXsdUnknownElement     = "Unknown element \"%s\""
+	sxeXsdUnknownAttribute   = "Unknown attribute \"%s\""
+	sxeXsdUnknownGroup       = "Unknown group \"%s\""
+	sxeXsdUnknownAttrGroup   = "Unknown attribute group \"%s\""
+	sxeXsdCircularType       = "Circular definition of type \"%s\""
+	sxeXsdInvalidPattern     = "Invalid pattern \"%s\": %v"
+	sxeXsdInvalidOccurs      = "Invalid occurrence \"%s\""
+	sxeXsdUnsupported        = "Unsupported schema component \"%s\""
+	sxeXsdNoDeclaration      = "No declaration for element \"%s\""
+	sxeXsdUnexpectedElement  = "Element \"%s\" is not expected"
+	sxeXsdIncomplete         = "Content of element \"%s\" is incomplete"
+	sxeXsdTextNotAllowed     = "Element \"%s\" may not contain character data"
+	sxeXsdChildNotAllowed    = "Element \"%s\" may not contain elements"
+	sxeXsdAttrNotAllowed     = "Attribute \"%s\" is not allowed"
+	sxeXsdAttrRequired       = "Required attribute \"%s\" is missing"
+	sxeXsdAttrProhibited     = "Attribute \"%s\" is prohibited"
+	sxeXsdFixed              = "Value \"%s\" must be \"%s\""
+	sxeXsdInvalidValue       = "Value \"%s\" is not a valid %s"
+	sxeXsdFacetEnumeration   = "Value \"%s\" is not one of the enumerated values"
+	sxeXsdFacetPattern       = "Value \"%s\" does not match pattern \"%s\""
+	sxeXsdFacetLength        = "Length of value \"%s\" must be %d"
+	sxeXsdFacetMinLength     = "Length of value \"%s\" must be at least %d"
+	sxeXsdFacetMaxLength     = "Length of value \"%s\" must be at most %d"
+	sxeXsdFacetMinInclusive  = "Value \"%s\" must be at least %s"
+	sxeXsdFacetMaxInclusive  = "Value \"%s\" must be at most %s"
+	sxeXsdFacetMinExclusive  = "Value \"%s\" must be greater than %s"
+	sxeXsdFacetMaxExclusive  = "Value \"%s\" must be less than %s"
+	sxeXsdFacetTotalDigits   = "Value \"%s\" has more than %d digits"
+	sxeXsdFacetFractionDigit = "Value \"%s\" has more than %d fraction digits"
+	sxeXsdNilContent         = "Nil element \"%s\" must be empty"
+	sxeXsdNotNillable        = "Element \"%s\" is not nillable"
+)
+
+// A set of schema documents,loaded with LoadFromFile
+type TXmlSchema struct {
+	Elements        map[string]*TXsdElement        //Global elements by "{namespace}name"
+	Types           map[string]*TXsdType           //Named types by "{namespace}name",including the built-in types
+	Attributes      map[string]*TXsdAttribute      //Global attributes
+	Groups          map[string]*TXsdParticle       //Model groups
+	AttributeGroups map[string]*TXsdAttributeGroup //Attribute groups
+	loaded          map[string]bool
+}
+
+// Element declaration
+type TXsdElement struct {
+	Name      string
+	Namespace string
+	Type      *TXsdType //nil is anyType
+	Default   string
+	Fixed     string
+	IsFixed   bool
+	Nillable  bool
+	typeName  string
+	refName   string
+}
+
+// Element,group (sequence,choice,all) or wildcard in a content model
+type TXsdParticle struct {
+	Kind            string //"element","sequence","choice","all" or "any"
+	Element         *TXsdElement
+	Items           []*TXsdParticle
+	MinOccurs       int
+	MaxOccurs       int    //-1 is unbounded
+	Namespaces      string //Wildcard namespace constraint
+	ProcessContents string //Wildcard processing,"strict","lax" or "skip"
+	targetNamespace string
+	groupRef        string
+}
+
+// Attribute declaration or use
+type TXsdAttribute struct {
+	Name      string
+	Namespace string
+	Type      *TXsdType
+	Use       string //"optional","required" or "prohibited"
+	Default   string
+	Fixed     string
+	IsFixed   bool
+	typeName  string
+	refName   string
+}
+
+// Named attribute group
+type TXsdAttributeGroup struct {
+	Attributes   []*TXsdAttribute
+	AnyAttribute bool
+	groupRefs    []string
+	resolved     bool
+}
+
+// Simple or complex type
+type TXsdType struct {
+	Name          string
+	Namespace     string
+	Simple        bool
+	Builtin       string    //Name of a built-in type
+	Derivation    string    //"restriction","extension","list" or "union"
+	Base          *TXsdType //Base type,for complex types with simple content the type of the value
+	Facets        TXsdFacets
+	ItemType      *TXsdType   //Item type of a list
+	MemberTypes   []*TXsdType //Member types of a union
+	Mixed         bool
+	SimpleContent bool
+	Content       *TXsdParticle
+	Attributes    []*TXsdAttribute
+	AnyAttribute  bool
+	baseName      string
+	itemTypeName  string
+	memberNames   []string
+	groupRefs     []string
+	resolved      bool
+	resolving     bool
+}
+
+// Constraining facets of a simple type
+type TXsdFacets struct {
+	Enumeration    []string
+	Patterns       []*regexp.Regexp
+	Length         int //-1 when not set,like the other lengths and digits
+	MinLength      int
+	MaxLength      int
+	MinInclusive   string
+	MaxInclusive   string
+	MinExclusive   string
+	MaxExclusive   string
+	TotalDigits    int
+	FractionDigits int
+	WhiteSpace     string
+}
+
+type tXsdReader struct {
+	Schema             *TXmlSchema
+	TargetNamespace    string
+	ElementQualified   bool
+	AttributeQualified bool
+	Dir                string
+}
+
+type tXsdValidator struct {
+	Schema *TXmlSchema
+	Errors []TXmlValidationError
+}
+
+var (
+	cXsdBuiltins = []string{"anyType", "anySimpleType", "string", "normalizedString", "token", "language",
+		"Name", "NCName", "NMTOKEN", "NMTOKENS", "ID", "IDREF", "IDREFS", "ENTITY", "ENTITIES", "QName", "NOTATION",
+		"anyURI", "boolean", "base64Binary", "hexBinary", "float", "double", "decimal", "integer",
+		"nonPositiveInteger", "negativeInteger", "long", "int", "short", "byte", "nonNegativeInteger",
+		"unsignedLong", "unsignedInt", "unsignedShort", "unsignedByte", "positiveInteger",
+		"duration", "dateTime", "date", "time", "gYear", "gYearMonth", "gMonth", "gMonthDay", "gDay"}
+	cXsdIntegerRanges = map[string][2]string{
+		"nonPositiveInteger": {"", "0"}, "negativeInteger": {"", "-1"},
+		"long": {"-9223372036854775808", "9223372036854775807"}, "int": {"-2147483648", "2147483647"},
+		"short": {"-32768", "32767"}, "byte": {"-128", "127"}, "nonNegativeInteger": {"0", ""},
+		"unsignedLong": {"0", "18446744073709551615"}, "unsignedInt": {"0", "4294967295"},
+		"unsignedShort": {"0", "65535"}, "unsignedByte": {"0", "255"}, "positiveInteger": {"1", ""}}
+	cXsdLexical = map[string]*regexp.Regexp{
+		"decimal":    regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)$`),
+		"integer":    regexp.MustCompile(`^[+-]?\d+$`),
+		"float":      regexp.MustCompile(`^([+-]?(\d+(\.\d*)?|\.\d+)([eE][+-]?\d+)?|-?INF|NaN)$`),
+		"boolean":    regexp.MustCompile(`^(true|false|1|0)$`),
+		"date":       regexp.MustCompile(`^-?\d{4,}-(0[1-9]|1[0-2])-(0[1-9]|[12]\d|3[01])(Z|[+-]\d{2}:\d{2})?$`),
+		"dateTime":   regexp.MustCompile(`^-?\d{4,}-(0[1-9]|1[0-2])-(0[1-9]|[12]\d|3[01])T([01]\d|2[0-4]):[0-5]\d:[0-5]\d(\.\d+)?(Z|[+-]\d{2}:\d{2})?$`),
+		"time":       regexp.MustCompile(`^([01]\d|2[0-4]):[0-5]\d:[0-5]\d(\.\d+)?(Z|[+-]\d{2}:\d{2})?$`),
+		"gYear":      regexp.MustCompile(`^-?\d{4,}(Z|[+-]\d{2}:\d{2})?$`),
+		"gYearMonth": regexp.MustCompile(`^-?\d{4,}-(0[1-9]|1[0-2])(Z|[+-]\d{2}:\d{2})?$`),
+		"gMonth":     regexp.MustCompile(`^--(0[1-9]|1[0-2])(Z|[+-]\d{2}:\d{2})?$`),
+		"gMonthDay":  regexp.MustCompile(`^--(0[1-9]|1[0-2])-(0[1-9]|[12]\d|3[01])(Z|[+-]\d{2}:\d{2})?$`),
+		"gDay":       regexp.MustCompile(`^---(0[1-9]|[12]\d|3[01])(Z|[+-]\d{2}:\d{2})?$`),
+		"duration":   regexp.MustCompile(`^-?P(\d+Y)?(\d+M)?(\d+D)?(T(\d+H)?(\d+M)?(\d+(\.\d+)?S)?)?$`),
+		"language":   regexp.MustCompile(`^[a-zA-Z]{1,8}(-[a-zA-Z0-9]{1,8})*$`),
+	}
+	//Built-in types derived from another built-in type,for lexical checks and whitespace
+	cXsdBuiltinBase = map[string]string{
+		"normalizedString": "string", "token": "normalizedString", "language": "token", "Name": "token",
+		"NCName": "Name", "NMTOKEN": "token", "ID": "NCName", "IDREF": "NCName", "ENTITY": "NCName",
+		"integer": "decimal", "nonPositiveInteger": "integer", "negativeInteger": "nonPositiveInteger",
+		"long": "integer", "int": "long", "short": "int", "byte": "short", "nonNegativeInteger": "integer",
+		"unsignedLong": "nonNegativeInteger", "unsignedInt": "unsignedLong", "unsignedShort": "unsignedInt",
+		"unsignedByte": "unsignedShort", "positiveInteger": "nonNegativeInteger", "double": "float"}
+)
+
+func NewXmlSchema() *TXmlSchema {
+	Schema := &TXmlSchema{Elements: make(map[string]*TXsdElement),
+		Types:           make(map[string]*TXsdType),
+		Attributes:      make(map[string]*TXsdAttribute),
+		Groups:          make(map[string]*TXsdParticle),
+		AttributeGroups: make(map[string]*TXsdAttributeGroup),
+		loaded:          make(map[string]bool)}
+	for _, v := range cXsdBuiltins {
+		Schema.Types[xsdKey(XmlSchemaNamespace, v)] = &TXsdType{Name: v, Namespace: XmlSchemaNamespace,
+			Simple: v != "anyType", Builtin: v, resolved: true, Facets: newXsdFacets()}
+	}
+	return Schema
+}
+func LoadXmlSchema(FileName string) (*TXmlSchema, error) {
+	Schema := NewXmlSchema()
+	if err := Schema.LoadFromFile(FileName); err != nil {
+		return nil, err
+	}
+	return Schema, nil
+}
+func (this *TXmlSchema) LoadFromFile(FileName string) error {
+	//Add a schema document and the local files it includes or imports
+	if err := this.loadFile(FileName, "", false); err != nil {
+		return err
+	}
+	return this.resolve()
+}
+func (this *TXmlSchema) ReadFromString(AValue, BaseDir string) error {
+	//Add a schema document,included and imported files are relative to BaseDir
+	Xml, err := parseSchemaDocument([]byte(AValue), "schema")
+	if err != nil {
+		return err
+	}
+	if err = this.readSchema(Xml.XmlRoot, BaseDir, "", false); err != nil {
+		return err
+	}
+	return this.resolve()
+}
+func (this *TNativeXml) ValidateSchema(Schema *TXmlSchema) []TXmlValidationError {
+	return Schema.Validate(this)
+}
+func (this *TXmlSchema) Validate(Xml *TNativeXml) []TXmlValidationError {
+	//Validate a document against the schema,an empty list means valid
+	if Xml.XmlRoot == nil {
+		return []TXmlValidationError{{Path: "/", Message: sxeNoRootElement}}
+	}
+	Validator := &tXsdValidator{Schema: this}
+	Root := Xml.XmlRoot
+	if Decl, ok := this.Elements[xsdKey(Root.NamespaceURI(), Root.LocalName())]; ok {
+		Validator.validateElement(Root, Decl)
+	} else {
+		Validator.add(Root, fmt.Sprintf(sxeXsdNoDeclaration, Root.Name))
+	}
+	return Validator.Errors
+}
+
+func xsdKey(Namespace, Name string) string {
+	return "{" + Namespace + "}" + Name
+}
+func newXsdFacets() TXsdFacets {
+	return TXsdFacets{Length: -1, MinLength: -1, MaxLength: -1, TotalDigits: -1, FractionDigits: -1}
+}
+func parseSchemaDocument(Data []byte, FileName string) (Xml *TNativeXml, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf(sxeXsdReadError, FileName, r))
+		}
+	}()
+	Xml = NewNativeXml()
+	Xml.ReadFromStream(bytes.NewBuffer(Data))
+	if Xml.XmlRoot == nil || Xml.XmlRoot.LocalName() != "schema" || Xml.XmlRoot.NamespaceURI() != XmlSchemaNamespace {
+		return nil, errors.New(fmt.Sprintf(sxeXsdNotASchema, FileName))
+	}
+	return Xml, nil
+}
+func (this *TXmlSchema) loadFile(FileName, Namespace string, Chameleon bool) error {
+	if strings.Contains(FileName, "://") {
+		return errors.New(fmt.Sprintf(sxeXsdRemoteLocation, FileName))
+	}
+	Path, err := filepath.Abs(FileName)
+	if err != nil {
+		return err
+	}
+	//A chameleon schema is read once for each namespace it is included into
+	Key := Path + "#" + Namespace
+	if this.loaded[Key] {
+		return nil
+	}
+	this.loaded[Key] = true
+	Data, err := os.ReadFile(Path)
+	if err != nil {
+		return errors.New(fmt.Sprintf(sxeXsdReadError, FileName, err))
+	}
+	Xml, err := parseSchemaDocument(Data, FileName)
+	if err != nil {
+		return err
+	}
+	return this.readSchema(Xml.XmlRoot, filepath.Dir(Path), Namespace, Chameleon)
+}
+func (this *TXmlSchema) readSchema(Root *TXmlNode, Dir, Namespace string, Chameleon bool) error {
+	//Included schemas without a target namespace take the one of the including schema
+	Reader := &tXsdReader{Schema: this, Dir: Dir,
+		TargetNamespace:    Root.Attributes["targetNamespace"],
+		ElementQualified:   Root.Attributes["elementFormDefault"] == "qualified",
+		AttributeQualified: Root.Attributes["attributeFormDefault"] == "qualified"}
+	if Chameleon && Reader.TargetNamespace == "" {
+		Reader.TargetNamespace = Namespace
+	}
+	for _, v := range xsdChildren(Root) {
+		var err error
+		switch v.LocalName() {
+		case "include":
+			if Location := v.Attributes["schemaLocation"]; Location != "" {
+				err = this.loadFile(Reader.location(Location), Reader.TargetNamespace, true)
+			}
+		case "import":
+			if Location := v.Attributes["schemaLocation"]; Location != "" {
+				err = this.loadFile(Reader.location(Location), "", false)
+			}
+		case "element":
+			var Decl *TXsdElement
+			if Decl, err = Reader.readElement(v, true); err == nil {
+				this.Elements[xsdKey(Decl.Namespace, Decl.Name)] = Decl
+			}
+		case "complexType", "simpleType":
+			var Type *TXsdType
+			if Type, err = Reader.readType(v); err == nil {
+				this.Types[xsdKey(Reader.TargetNamespace, Type.Name)] = Type
+			}
+		case "attribute":
+			var Attr *TXsdAttribute
+			if Attr, err = Reader.readAttribute(v, true); err == nil {
+				this.Attributes[xsdKey(Attr.Namespace, Attr.Name)] = Attr
+			}
+		case "group":
+			var Group *TXsdParticle
+			if Group, err = Reader.readGroupDefinition(v); err == nil {
+				this.Groups[xsdKey(Reader.TargetNamespace, v.Attributes["name"])] = Group
+			}
+		case "attributeGroup":
+			Group := &TXsdAttributeGroup{}
+			if err = Reader.readAttributeUses(v, &Group.Attributes, &Group.groupRefs, &Group.AnyAttribute); err == nil {
+				this.AttributeGroups[xsdKey(Reader.TargetNamespace, v.Attributes["name"])] = Group
+			}
+		case "annotation", "notation":
+		default:
+			err = errors.New(fmt.Sprintf(sxeXsdUnsupported, v.Name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func xsdChildren(Node *TXmlNode) []*TXmlNode {
+	//Child elements in the schema namespace,annotations left out
+	list := make([]*TXmlNode, 0)
+	for _, v := range Node.NodeList() {
+		if v.ElementType == xeNormal && v.NamespaceURI() == XmlSchemaNamespace {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+func (this *tXsdReader) location(Location string) string {
+	if filepath.IsAbs(Location) || strings.Contains(Location, "://") {
+		return Location
+	}
+	return filepath.Join(this.Dir, filepath.FromSlash(Location))
+}
+func (this *tXsdReader) qname(Node *TXmlNode, QName string) string {
+	//Key of a qualified name used in a schema attribute
+	Prefix, Local := SplitQualifiedName(strings.TrimSpace(QName))
+	Namespace := Node.LookupNamespaceURI(Prefix)
+	if Prefix == "" && Namespace == "" {
+		Namespace = this.TargetNamespace
+	}
+	return xsdKey(Namespace, Local)
+}
+func readOccurs(Node *TXmlNode) (Min, Max int, err error) {
+	Min, Max = 1, 1
+	if v, ok := Node.Attributes["minOccurs"]; ok {
+		if Min, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || Min < 0 {
+			return 0, 0, errors.New(fmt.Sprintf(sxeXsdInvalidOccurs, v))
+		}
+	}
+	if v, ok := Node.Attributes["maxOccurs"]; ok {
+		if strings.TrimSpace(v) == "unbounded" {
+			Max = -1
+		} else if Max, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || Max < 0 {
+			return 0, 0, errors.New(fmt.Sprintf(sxeXsdInvalidOccurs, v))
+		}
+	}
+	return Min, Max, nil
+}
+func (this *tXsdReader) readElement(Node *TXmlNode, Global bool) (*TXsdElement, error) {
+	Decl := &TXsdElement{Name: Node.Attributes["name"], Nillable: Node.Attributes["nillable"] == "true"}
+	if Ref, ok := Node.Attributes["ref"]; ok {
+		Decl.refName = this.qname(Node, Ref)
+		return Decl, nil
+	}
+	Form := Node.Attributes["form"]
+	if Global || Form == "qualified" || (Form == "" && this.ElementQualified) {
+		Decl.Namespace = this.TargetNamespace
+	}
+	Decl.Default = Node.Attributes["default"]
+	Decl.Fixed, Decl.IsFixed = Node.Attributes["fixed"]
+	if TypeName, ok := Node.Attributes["type"]; ok {
+		Decl.typeName = this.qname(Node, TypeName)
+	}
+	for _, v := range xsdChildren(Node) {
+		switch v.LocalName() {
+		case "complexType", "simpleType":
+			Type, err := this.readType(v)
+			if err != nil {
+				return nil, err
+			}
+			Decl.Type = Type
+		}
+	}
+	return Decl, nil
+}
+func (this *tXsdReader) readAttribute(Node *TXmlNode, Global bool) (*TXsdAttribute, error) {
+	Attr := &TXsdAttribute{Name: Node.Attributes["name"], Use: Node.Attributes["use"]}
+	if Attr.Use == "" {
+		Attr.Use = "optional"
+	}
+	Attr.Default = Node.Attributes["default"]
+	Attr.Fixed, Attr.IsFixed = Node.Attributes["fixed"]
+	if Ref, ok := Node.Attributes["ref"]; ok {
+		Attr.refName = this.qname(Node, Ref)
+		return Attr, nil
+	}
+	Form := Node.Attributes["form"]
+	if Global || Form == "qualified" || (Form == "" && this.AttributeQualified) {
+		Attr.Namespace = this.TargetNamespace
+	}
+	if TypeName, ok := Node.Attributes["type"]; ok {
+		Attr.typeName = this.qname(Node, TypeName)
+	}
+	for _, v := range xsdChildren(Node) {
+		if v.LocalName() == "simpleType" {
+			Type, err := this.readType(v)
+			if err != nil {
+				return nil, err
+			}
+			Attr.Type = Type
+		}
+	}
+	return Attr, nil
+}
+func (this *tXsdReader) readAttributeUses(Node *TXmlNode, Attrs *[]*TXsdAttribute, GroupRefs *[]string, AnyAttribute *bool) error {
+	//attribute,attributeGroup and anyAttribute children of Node
+	for _, v := range xsdChildren(Node) {
+		switch v.LocalName() {
+		case "attribute":
+			Attr, err := this.readAttribute(v, false)
+			if err != nil {
+				return err
+			}
+			*Attrs = append(*Attrs, Attr)
+		case "attributeGroup":
+			*GroupRefs = append(*GroupRefs, this.qname(v, v.Attributes["ref"]))
+		case "anyAttribute":
+			*AnyAttribute = true
+		}
+	}
+	return nil
+}
+func (this *tXsdReader) readParticle(Node *TXmlNode) (*TXsdParticle, error) {
+	//element,sequence,choice,all,group reference or any
+	Min, Max, err := readOccurs(Node)
+	if err != nil {
+		return nil, err
+	}
+	Particle := &TXsdParticle{Kind: Node.LocalName(), MinOccurs: Min, MaxOccurs: Max}
+	switch Particle.Kind {
+	case "element":
+		if Particle.Element, err = this.readElement(Node, false); err != nil {
+			return nil, err
+		}
+	case "group":
+		Particle.groupRef = this.qname(Node, Node.Attributes["ref"])
+	case "any":
+		Particle.Namespaces = Node.Attributes["namespace"]
+		if Particle.Namespaces == "" {
+			Particle.Namespaces = "##any"
+		}
+		Particle.ProcessContents = Node.Attributes["processContents"]
+		if Particle.ProcessContents == "" {
+			Particle.ProcessContents = "strict"
+		}
+		Particle.targetNamespace = this.TargetNamespace
+	case "sequence", "choice", "all":
+		for _, v := range xsdChildren(Node) {
+			if v.LocalName() == "annotation" {
+				continue
+			}
+			Item, err := this.readParticle(v)
+			if err != nil {
+				return nil, err
+			}
+			Particle.Items = append(Particle.Items, Item)
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf(sxeXsdUnsupported, Node.Name))
+	}
+	return Particle, nil
+}
+func (this *tXsdReader) readGroupDefinition(Node *TXmlNode) (*TXsdParticle, error) {
+	for _, v := range xsdChildren(Node) {
+		switch v.LocalName() {
+		case "sequence", "choice", "all":
+			return this.readParticle(v)
+		}
+	}
+	return &TXsdParticle{Kind: "sequence", MinOccurs: 1, MaxOccurs: 1}, nil
+}
+func (this *tXsdReader) readType(Node *TXmlNode) (*TXsdType, error) {
+	Type := &TXsdType{Name: Node.Attributes["name"], Namespace: this.TargetNamespace,
+		Simple: Node.LocalName() == "simpleType", Mixed: Node.Attributes["mixed"] == "true",
+		Facets: newXsdFacets()}
+	if Type.Simple {
+		return Type, this.readSimpleDerivation(Node, Type)
+	}
+	for _, v := range xsdChildren(Node) {
+		var err error
+		switch v.LocalName() {
+		case "sequence", "choice", "all", "group":
+			Type.Content, err = this.readParticle(v)
+		case "attribute", "attributeGroup", "anyAttribute":
+		case "simpleContent", "complexContent":
+			Type.SimpleContent = v.LocalName() == "simpleContent"
+			if v.Attributes["mixed"] == "true" {
+				Type.Mixed = true
+			}
+			for _, w := range xsdChildren(v) {
+				switch w.LocalName() {
+				case "extension", "restriction":
+					Type.Derivation = w.LocalName()
+					Type.baseName = this.qname(w, w.Attributes["base"])
+					if Type.SimpleContent {
+						err = this.readFacets(w, &Type.Facets)
+					}
+					for _, x := range xsdChildren(w) {
+						switch x.LocalName() {
+						case "sequence", "choice", "all", "group":
+							if Type.Content, err = this.readParticle(x); err != nil {
+								return nil, err
+							}
+						}
+					}
+					if err == nil {
+						err = this.readAttributeUses(w, &Type.Attributes, &Type.groupRefs, &Type.AnyAttribute)
+					}
+				}
+			}
+		case "annotation":
+		default:
+			err = errors.New(fmt.Sprintf(sxeXsdUnsupported, v.Name))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return Type, this.readAttributeUses(Node, &Type.Attributes, &Type.groupRefs, &Type.AnyAttribute)
+}
+func (this *tXsdReader) readSimpleDerivation(Node *TXmlNode, Type *TXsdType) error {
+	for _, v := range xsdChildren(Node) {
+		switch v.LocalName() {
+		case "restriction":
+			Type.Derivation = "restriction"
+			if Base, ok := v.Attributes["base"]; ok {
+				Type.baseName = this.qname(v, Base)
+			}
+			for _, w := range xsdChildren(v) {
+				if w.LocalName() == "simpleType" {
+					Base, err := this.readType(w)
+					if err != nil {
+						return err
+					}
+					Type.Base = Base
+				}
+			}
+			if err := this.readFacets(v, &Type.Facets); err != nil {
+				return err
+			}
+		case "list":
+			Type.Derivation = "list"
+			if ItemType, ok := v.Attributes["itemType"]; ok {
+				Type.itemTypeName = this.qname(v, ItemType)
+			}
+			for _, w := range xsdChildren(v) {
+				if w.LocalName() == "simpleType" {
+					ItemType, err := this.readType(w)
+					if err != nil {
+						return err
+					}
+					Type.ItemType = ItemType
+				}
+			}
+		case "union":
+			Type.Derivation = "union"
+			for _, Name := range strings.Fields(v.Attributes["memberTypes"]) {
+				Type.memberNames = append(Type.memberNames, this.qname(v, Name))
+			}
+			for _, w := range xsdChildren(v) {
+				if w.LocalName() == "simpleType" {
+					Member, err := this.readType(w)
+					if err != nil {
+						return err
+					}
+					Type.MemberTypes = append(Type.MemberTypes, Member)
+				}
+			}
+		}
+	}
+	return nil
+}
+func (this *tXsdReader) readFacets(Node *TXmlNode, Facets *TXsdFacets) error {
+	for _, v := range xsdChildren(Node) {
+		Value := v.Attributes["value"]
+		var err error
+		switch v.LocalName() {
+		case "enumeration":
+			Facets.Enumeration = append(Facets.Enumeration, UnescapeString(Value))
+		case "pattern":
+			var Pattern *regexp.Regexp
+			if Pattern, err = compileXsdPattern(UnescapeString(Value)); err == nil {
+				Facets.Patterns = append(Facets.Patterns, Pattern)
+			}
+		case "length":
+			Facets.Length, err = strconv.Atoi(Value)
+		case "minLength":
+			Facets.MinLength, err = strconv.Atoi(Value)
+		case "maxLength":
+			Facets.MaxLength, err = strconv.Atoi(Value)
+		case "totalDigits":
+			Facets.TotalDigits, err = strconv.Atoi(Value)
+		case "fractionDigits":
+			Facets.FractionDigits, err = strconv.Atoi(Value)
+		case "minInclusive":
+			Facets.MinInclusive = Value
+		case "maxInclusive":
+			Facets.MaxInclusive = Value
+		case "minExclusive":
+			Facets.MinExclusive = Value
+		case "maxExclusive":
+			Facets.MaxExclusive = Value
+		case "whiteSpace":
+			Facets.WhiteSpace = Value
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func compileXsdPattern(Pattern string) (*regexp.Regexp, error) {
+	//Xml schema patterns are anchored and know the \i and \c name classes
+	r := strings.NewReplacer(`\i`, `[_:A-Za-z\x{C0}-\x{10FFFF}]`, `\I`, `[^_:A-Za-z\x{C0}-\x{10FFFF}]`,
+		`\c`, `[-._:A-Za-z0-9\x{B7}\x{C0}-\x{10FFFF}]`, `\C`, `[^-._:A-Za-z0-9\x{B7}\x{C0}-\x{10FFFF}]`)
+	Regexp, err := regexp.Compile("^(?:" + r.Replace(Pattern) + ")$")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf(sxeXsdInvalidPattern, Pattern, err))
+	}
+	return Regexp, nil
+}
+
+func (this *TXmlSchema) resolve() error {
+	//Link all references by name,after all schema documents are read
+	for _, v := range this.Elements {
+		if err := this.resolveElement(v); err != nil {
+			return err
+		}
+	}
+	for _, v := range this.Types {
+		if err := this.resolveType(v); err != nil {
+			return err
+		}
+	}
+	for _, v := range this.Attributes {
+		if err := this.resolveAttribute(v); err != nil {
+			return err
+		}
+	}
+	for _, v := range this.Groups {
+		if err := this.resolveParticle(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (this *TXmlSchema) lookupType(Key string) (*TXsdType, error) {
+	Type, ok := this.Types[Key]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(sxeXsdUnknownType, Key))
+	}
+	return Type, this.resolveType(Type)
+}
+func (this *TXmlSchema) resolveElement(Decl *TXsdElement) error {
+	if Decl.refName != "" {
+		Global, ok := this.Elements[Decl.refName]
+		if !ok {
+			return errors.New(fmt.Sprintf(sxeXsdUnknownElement, Decl.refName))
+		}
+		if Global.refName != "" {
+			return errors.New(fmt.Sprintf(sxeXsdUnknownElement, Decl.refName))
+		}
+		*Decl = *Global
+		return nil
+	}
+	var err error
+	if Decl.typeName != "" {
+		Decl.Type, err = this.lookupType(Decl.typeName)
+		Decl.typeName = ""
+	} else if Decl.Type != nil {
+		err = this.resolveType(Decl.Type)
+	}
+	return err
+}
+func (this *TXmlSchema) resolveAttribute(Attr *TXsdAttribute) error {
+	if Attr.refName != "" {
+		Global, ok := this.Attributes[Attr.refName]
+		if !ok {
+			return errors.New(fmt.Sprintf(sxeXsdUnknownAttribute, Attr.refName))
+		}
+		if err := this.resolveAttribute(Global); err != nil {
+			return err
+		}
+		Attr.Name, Attr.Namespace, Attr.Type = Global.Name, Global.Namespace, Global.Type
+		if !Attr.IsFixed && Global.IsFixed {
+			Attr.Fixed, Attr.IsFixed = Global.Fixed, true
+		}
+		if Attr.Default == "" {
+			Attr.Default = Global.Default
+		}
+		Attr.refName = ""
+		return nil
+	}
+	var err error
+	if Attr.typeName != "" {
+		Attr.Type, err = this.lookupType(Attr.typeName)
+		Attr.typeName = ""
+	} else if Attr.Type != nil {
+		err = this.resolveType(Attr.Type)
+	}
+	return err
+}
+func (this *TXmlSchema) resolveParticle(Particle *TXsdParticle) error {
+	switch Particle.Kind {
+	case "element":
+		return this.resolveElement(Particle.Element)
+	case "group":
+		//A group reference becomes a copy of the group with the occurrence of the reference
+		Group, ok := this.Groups[Particle.groupRef]
+		if !ok {
+			return errors.New(fmt.Sprintf(sxeXsdUnknownGroup, Particle.groupRef))
+		}
+		Particle.Kind, Particle.Items, Particle.groupRef = Group.Kind, Group.Items, ""
+	}
+	for _, v := range Particle.Items {
+		if err := this.resolveParticle(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (this *TXmlSchema) resolveAttributeGroup(Key string) (*TXsdAttributeGroup, error) {
+	Group, ok := this.AttributeGroups[Key]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(sxeXsdUnknownAttrGroup, Key))
+	}
+	if !Group.resolved {
+		Group.resolved = true
+		for _, v := range Group.Attributes {
+			if err := this.resolveAttribute(v); err != nil {
+				return nil, err
+			}
+		}
+		for _, v := range Group.groupRefs {
+			Nested, err := this.resolveAttributeGroup(v)
+			if err != nil {
+				return nil, err
+			}
+			Group.Attributes = append(Group.Attributes, Nested.Attributes...)
+			Group.AnyAttribute = Group.AnyAttribute || Nested.AnyAttribute
+		}
+	}
+	return Group, nil
+}
+func (this *TXmlSchema) resolveType(Type *TXsdType) error {
+	if Type.resolved {
+		return nil
+	}
+	if Type.resolving {
+		return errors.New(fmt.Sprintf(sxeXsdCircularType, Type.Name))
+	}
+	Type.resolving = true
+	defer func() {
+		Type.resolving = false
+	}()
+	var err error
+	if Type.baseName != "" {
+		if Type.Base, err = this.lookupType(Type.baseName); err != nil {
+			return err
+		}
+	} else if Type.Base != nil {
+		if err = this.resolveType(Type.Base); err != nil {
+			return err
+		}
+	}
+	if Type.Simple {
+		if Type.itemTypeName != "" {
+			if Type.ItemType, err = this.lookupType(Type.itemTypeName); err != nil {
+				return err
+			}
+		} else if Type.ItemType != nil {
+			if err = this.resolveType(Type.ItemType); err != nil {
+				return err
+			}
+		}
+		for _, v := range Type.memberNames {
+			Member, err := this.lookupType(v)
+			if err != nil {
+				return err
+			}
+			Type.MemberTypes = append(Type.MemberTypes, Member)
+		}
+		for _, v := range Type.MemberTypes {
+			if err = this.resolveType(v); err != nil {
+				return err
+			}
+		}
+		Type.resolved = true
+		return nil
+	}
+	//Complex type: own attributes,attribute groups and content
+	for _, v := range Type.Attributes {
+		if err = this.resolveAttribute(v); err != nil {
+			return err
+		}
+	}
+	for _, v := range Type.groupRefs {
+		Group, err := this.resolveAttributeGroup(v)
+		if err != nil {
+			return err
+		}
+		Type.Attributes = append(Type.Attributes, Group.Attributes...)
+		Type.AnyAttribute = Type.AnyAttribute || Group.AnyAttribute
+	}
+	if Type.Content != nil {
+		if err = this.resolveParticle(Type.Content); err != nil {
+			return err
+		}
+	}
+	if Base := Type.Base; Base != nil {
+		Type.mergeBase(Base)
+	}
+	Type.resolved = true
+	return nil
+}
+func (this *TXsdType) mergeBase(Base *TXsdType) {
+	//Inherit attributes and content of the base type
+	Own := make(map[string]bool)
+	for _, v := range this.Attributes {
+		Own[xsdKey(v.Namespace, v.Name)] = true
+	}
+	for _, v := range Base.Attributes {
+		if !Own[xsdKey(v.Namespace, v.Name)] {
+			this.Attributes = append(this.Attributes, v)
+		}
+	}
+	if this.Derivation == "extension" {
+		this.AnyAttribute = this.AnyAttribute || Base.AnyAttribute
+	}
+	if this.SimpleContent {
+		//The value type: the simple base,or the value type of a complex base with simple content
+		ValueType := Base
+		if !Base.Simple {
+			ValueType = Base.Base
+		}
+		if this.Derivation == "restriction" {
+			ValueType = &TXsdType{Simple: true, Derivation: "restriction", Base: ValueType, Facets: this.Facets, resolved: true}
+		}
+		this.Base = ValueType
+		return
+	}
+	if Base.Simple || Base.Builtin == "anyType" {
+		return
+	}
+	if this.Derivation == "extension" {
+		this.Mixed = this.Mixed || Base.Mixed
+		switch {
+		case this.Content == nil:
+			this.Content = Base.Content
+		case Base.Content != nil:
+			this.Content = &TXsdParticle{Kind: "sequence", MinOccurs: 1, MaxOccurs: 1,
+				Items: []*TXsdParticle{Base.Content, this.Content}}
+		}
+	}
+}
+
+func (this *tXsdValidator) add(Node *TXmlNode, Message string) {
+	this.Errors = append(this.Errors, newValidationError(Node, Message))
+}
+func (this *tXsdValidator) validateElement(Node *TXmlNode, Decl *TXsdElement) {
+	Type := Decl.Type
+	//xsi:type selects a named type in the instance
+	for k, v := range Node.Attributes {
+		Prefix, Local := SplitQualifiedName(k)
+		if Local == "type" && Prefix != "" && Node.LookupNamespaceURI(Prefix) == XmlSchemaInstanceNamespace {
+			Prefix, Local = SplitQualifiedName(strings.TrimSpace(v))
+			if t, ok := this.Schema.Types[xsdKey(Node.LookupNamespaceURI(Prefix), Local)]; ok {
+				Type = t
+			} else {
+				this.add(Node, fmt.Sprintf(sxeXsdUnknownType, v))
+				return
+			}
+		}
+	}
+	Children, Text := elementContent(Node)
+	if xsiAttribute(Node, "nil") == "true" {
+		if !Decl.Nillable {
+			this.add(Node, fmt.Sprintf(sxeXsdNotNillable, Node.Name))
+		} else if len(Children) > 0 || Text != "" {
+			this.add(Node, fmt.Sprintf(sxeXsdNilContent, Node.Name))
+		}
+		return
+	}
+	if Type == nil || Type.Builtin == "anyType" {
+		//anyType accepts any content,declared elements in it are still checked
+		for _, v := range Children {
+			if Global, ok := this.Schema.Elements[xsdKey(v.NamespaceURI(), v.LocalName())]; ok {
+				this.validateElement(v, Global)
+			}
+		}
+		return
+	}
+	if Text == "" && Decl.Default != "" && len(Children) == 0 {
+		Text = Decl.Default
+	}
+	if Decl.IsFixed && (Type.Simple || Type.SimpleContent) && collapseSpace(Text) != collapseSpace(Decl.Fixed) {
+		this.add(Node, fmt.Sprintf(sxeXsdFixed, Text, Decl.Fixed))
+	}
+	if Type.Simple {
+		this.validateAttributes(Node, nil, false)
+		if len(Children) > 0 {
+			this.add(Node, fmt.Sprintf(sxeXsdChildNotAllowed, Node.Name))
+		}
+		if msg := this.Schema.checkSimpleValue(Type, Text); msg != "" {
+			this.add(Node, msg)
+		}
+		return
+	}
+	this.validateAttributes(Node, Type.Attributes, Type.AnyAttribute)
+	if Type.SimpleContent {
+		if len(Children) > 0 {
+			this.add(Node, fmt.Sprintf(sxeXsdChildNotAllowed, Node.Name))
+		}
+		if Type.Base != nil {
+			if msg := this.Schema.checkSimpleValue(Type.Base, Text); msg != "" {
+				this.add(Node, msg)
+			}
+		}
+		return
+	}
+	if !Type.Mixed && strings.Trim(Text, cControlChars) != "" {
+		this.add(Node, fmt.Sprintf(sxeXsdTextNotAllowed, Node.Name))
+	}
+	//Match the child elements against the content model
+	Matcher := &tXsdMatcher{Children: Children, Decls: make(map[*TXmlNode]*TXsdElement),
+		Wildcards: make(map[*TXmlNode]*TXsdParticle)}
+	Pos, ok := 0, true
+	if Type.Content != nil {
+		Pos, ok = Matcher.match(Type.Content, 0)
+	}
+	if Pos < len(Children) {
+		this.add(Children[Pos], fmt.Sprintf(sxeXsdUnexpectedElement, Children[Pos].Name))
+	} else if !ok {
+		this.add(Node, fmt.Sprintf(sxeXsdIncomplete, Node.Name))
+	}
+	for i, v := range Children {
+		if i >= Pos {
+			break
+		}
+		if Decl, ok := Matcher.Decls[v]; ok {
+			this.validateElement(v, Decl)
+		} else if Wildcard, ok := Matcher.Wildcards[v]; ok && Wildcard.ProcessContents != "skip" {
+			Global, found := this.Schema.Elements[xsdKey(v.NamespaceURI(), v.LocalName())]
+			if found {
+				this.validateElement(v, Global)
+			} else if Wildcard.ProcessContents == "strict" {
+				this.add(v, fmt.Sprintf(sxeXsdNoDeclaration, v.Name))
+			}
+		}
+	}
+}
+func (this *tXsdValidator) validateAttributes(Node *TXmlNode, Decls []*TXsdAttribute, AnyAttribute bool) {
+	Seen := make(map[*TXsdAttribute]bool)
+	for _, k := range Node.AttributeNames() {
+		if _, ok := namespaceDeclPrefix(k); ok {
+			continue
+		}
+		Prefix, Local := SplitQualifiedName(k)
+		Namespace := ""
+		if Prefix != "" {
+			Namespace = Node.LookupNamespaceURI(Prefix)
+		}
+		if Namespace == XmlSchemaInstanceNamespace {
+			continue
+		}
+		var Decl *TXsdAttribute
+		for _, v := range Decls {
+			if v.Name == Local && v.Namespace == Namespace {
+				Decl = v
+			}
+		}
+		if Decl == nil {
+			if !AnyAttribute {
+				this.add(Node, fmt.Sprintf(sxeXsdAttrNotAllowed, k))
+			}
+			continue
+		}
+		Seen[Decl] = true
+		Value := UnescapeString(Node.Attributes[k])
+		switch {
+		case Decl.Use == "prohibited":
+			this.add(Node, fmt.Sprintf(sxeXsdAttrProhibited, k))
+		case Decl.IsFixed && collapseSpace(Value) != collapseSpace(Decl.Fixed):
+			this.add(Node, fmt.Sprintf(sxeXsdFixed, Value, Decl.Fixed))
+		case Decl.Type != nil:
+			if msg := this.Schema.checkSimpleValue(Decl.Type, Value); msg != "" {
+				this.add(Node, k+": "+msg)
+			}
+		}
+	}
+	for _, v := range Decls {
+		if v.Use == "required" && !Seen[v] {
+			this.add(Node, fmt.Sprintf(sxeXsdAttrRequired, v.Name))
+		}
+	}
+}
+func elementContent(Node *TXmlNode) ([]*TXmlNode, string) {
+	//Child elements and the unescaped character data of a node
+	Children := make([]*TXmlNode, 0)
+	Text := UnescapeString(Node.Value)
+	for _, v := range Node.NodeList() {
+		switch v.ElementType {
+		case xeNormal:
+			Children = append(Children, v)
+		case xeCData:
+			Text += v.Value
+		case xeCharData:
+			Text += UnescapeString(v.Value)
+		}
+	}
+	return Children, Text
+}
+func xsiAttribute(Node *TXmlNode, Local string) string {
+	for k, v := range Node.Attributes {
+		Prefix, Name := SplitQualifiedName(k)
+		if Name == Local && Prefix != "" && Node.LookupNamespaceURI(Prefix) == XmlSchemaInstanceNamespace {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// Greedy matcher of child elements against a content model,schemas must be deterministic
+type tXsdMatcher struct {
+	Children  []*TXmlNode
+	Decls     map[*TXmlNode]*TXsdElement
+	Wildcards map[*TXmlNode]*TXsdParticle
+}
+
+func (this *tXsdMatcher) match(Particle *TXsdParticle, Pos int) (int, bool) {
+	//Match the particle with its occurrence from Pos,returns the new position
+	Count := 0
+	for Particle.MaxOccurs < 0 || Count < Particle.MaxOccurs {
+		Next, ok := this.matchOnce(Particle, Pos)
+		if !ok {
+			if Next > Pos && Count >= Particle.MinOccurs {
+				return Next, false
+			}
+			break
+		}
+		if Next == Pos {
+			//Matched empty,further repetitions would match empty too
+			Count = Particle.MinOccurs
+			break
+		}
+		Pos = Next
+		Count++
+	}
+	return Pos, Count >= Particle.MinOccurs || this.emptiable(Particle)
+}
+func (this *tXsdMatcher) matchOnce(Particle *TXsdParticle, Pos int) (int, bool) {
+	switch Particle.Kind {
+	case "element":
+		if Pos < len(this.Children) && this.Children[Pos].LocalName() == Particle.Element.Name &&
+			this.Children[Pos].NamespaceURI() == Particle.Element.Namespace {
+			this.Decls[this.Children[Pos]] = Particle.Element
+			return Pos + 1, true
+		}
+		return Pos, false
+	case "any":
+		if Pos < len(this.Children) && wildcardAllows(Particle, this.Children[Pos].NamespaceURI()) {
+			this.Wildcards[this.Children[Pos]] = Particle
+			return Pos + 1, true
+		}
+		return Pos, false
+	case "sequence":
+		for _, v := range Particle.Items {
+			Next, ok := this.match(v, Pos)
+			if !ok {
+				return Next, false
+			}
+			Pos = Next
+		}
+		return Pos, true
+	case "choice":
+		Empty := false
+		for _, v := range Particle.Items {
+			Next, ok := this.match(v, Pos)
+			if ok && Next > Pos {
+				return Next, true
+			}
+			Empty = Empty || (ok && Next == Pos)
+		}
+		return Pos, Empty
+	case "all":
+		Used := make(map[*TXsdParticle]bool)
+		for Found := true; Found && Pos < len(this.Children); {
+			Found = false
+			for _, v := range Particle.Items {
+				if Used[v] {
+					continue
+				}
+				if Next, ok := this.matchOnce(v, Pos); ok && Next > Pos {
+					Used[v], Pos, Found = true, Next, true
+					break
+				}
+			}
+		}
+		for _, v := range Particle.Items {
+			if !Used[v] && v.MinOccurs > 0 {
+				return Pos, false
+			}
+		}
+		return Pos, true
+	}
+	return Pos, false
+}
+func (this *tXsdMatcher) emptiable(Particle *TXsdParticle) bool {
+	if Particle.MinOccurs == 0 {
+		return true
+	}
+	switch Particle.Kind {
+	case "sequence", "all":
+		for _, v := range Particle.Items {
+			if !this.emptiable(v) {
+				return false
+			}
+		}
+		return true
+	case "choice":
+		for _, v := range Particle.Items {
+			if this.emptiable(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+func wildcardAllows(Particle *TXsdParticle, Namespace string) bool {
+	switch Particle.Namespaces {
+	case "##any":
+		return true
+	case "##other":
+		return Namespace != Particle.targetNamespace && Namespace != ""
+	}
+	for _, v := range strings.Fields(Particle.Namespaces) {
+		if v == Namespace || (v == "##targetNamespace" && Namespace == Particle.targetNamespace) ||
+			(v == "##local" && Namespace == "") {
+			return true
+		}
+	}
+	return false
+}
+
+func collapseSpace(AValue string) string {
+	return strings.Join(strings.Fields(AValue), " ")
+}
+func (this *TXsdType) whiteSpace() string {
+	//Whitespace handling of a simple type: "preserve","replace" or "collapse"
+	for t := this; t != nil; t = t.Base {
+		if t.Facets.WhiteSpace != "" {
+			return t.Facets.WhiteSpace
+		}
+		switch t.Builtin {
+		case "string", "anySimpleType", "anyType":
+			return "preserve"
+		case "normalizedString":
+			return "replace"
+		case "":
+			if t.Derivation == "list" {
+				return "collapse"
+			}
+			if t.Derivation == "union" {
+				return "preserve"
+			}
+		default:
+			return "collapse"
+		}
+	}
+	return "preserve"
+}
+func (this *TXsdType) builtin() string {
+	//The built-in type this simple type is derived from
+	for t := this; t != nil; t = t.Base {
+		if t.Builtin != "" {
+			return t.Builtin
+		}
+	}
+	return ""
+}
+func (this *TXmlSchema) checkSimpleValue(Type *TXsdType, AValue string) string {
+	//Check a value against a simple type,returns an error message or ""
+	Value := this.normalize(Type, AValue)
+	switch {
+	case Type.Builtin != "":
+		return checkBuiltinValue(Type.Builtin, Value)
+	case Type.Derivation == "list":
+		for _, v := range strings.Fields(AValue) {
+			if Type.ItemType != nil {
+				if msg := this.checkSimpleValue(Type.ItemType, v); msg != "" {
+					return msg
+				}
+			}
+		}
+		return checkFacets(Type, "", collapseSpace(AValue), len(strings.Fields(AValue)))
+	case Type.Derivation == "union":
+		for _, v := range Type.MemberTypes {
+			if this.checkSimpleValue(v, AValue) == "" {
+				return ""
+			}
+		}
+		return fmt.Sprintf(sxeXsdInvalidValue, AValue, "union member")
+	}
+	if Type.Base != nil {
+		if msg := this.checkSimpleValue(Type.Base, Value); msg != "" {
+			return msg
+		}
+	}
+	Length := utf8.RuneCountInString(Value)
+	if Type.Base != nil && Type.Base.Derivation == "list" {
+		Length = len(strings.Fields(Value))
+	}
+	return checkFacets(Type, Type.builtin(), Value, Length)
+}
+func (this *TXmlSchema) normalize(Type *TXsdType, AValue string) string {
+	switch Type.whiteSpace() {
+	case "replace":
+		return strings.Map(func(r rune) rune {
+			if strings.ContainsRune(cControlChars, r) {
+				return ' '
+			}
+			return r
+		}, AValue)
+	case "collapse":
+		return collapseSpace(AValue)
+	}
+	return AValue
+}
+func checkFacets(Type *TXsdType, Builtin, Value string, Length int) string {
+	Facets := &Type.Facets
+	if len(Facets.Enumeration) > 0 {
+		Found := false
+		for _, v := range Facets.Enumeration {
+			Found = Found || v == Value || (isXsdNumeric(Builtin) && compareXsdValues(Builtin, v, Value) == 0)
+		}
+		if !Found {
+			return fmt.Sprintf(sxeXsdFacetEnumeration, Value)
+		}
+	}
+	for _, v := range Facets.Patterns {
+		if !v.MatchString(Value) {
+			return fmt.Sprintf(sxeXsdFacetPattern, Value, strings.TrimSuffix(strings.TrimPrefix(v.String(), "^(?:"), ")$"))
+		}
+	}
+	switch {
+	case Facets.Length >= 0 && Length != Facets.Length:
+		return fmt.Sprintf(sxeXsdFacetLength, Value, Facets.Length)
+	case Facets.MinLength >= 0 && Length < Facets.MinLength:
+		return fmt.Sprintf(sxeXsdFacetMinLength, Value, Facets.MinLength)
+	case Facets.MaxLength >= 0 && Length > Facets.MaxLength:
+		return fmt.Sprintf(sxeXsdFacetMaxLength, Value, Facets.MaxLength)
+	case Facets.MinInclusive != "" && compareXsdValues(Builtin, Value, Facets.MinInclusive) < 0:
+		return fmt.Sprintf(sxeXsdFacetMinInclusive, Value, Facets.MinInclusive)
+	case Facets.MaxInclusive != "" && compareXsdValues(Builtin, Value, Facets.MaxInclusive) > 0:
+		return fmt.Sprintf(sxeXsdFacetMaxInclusive, Value, Facets.MaxInclusive)
+	case Facets.MinExclusive != "" && compareXsdValues(Builtin, Value, Facets.MinExclusive) <= 0:
+		return fmt.Sprintf(sxeXsdFacetMinExclusive, Value, Facets.MinExclusive)
+	case Facets.MaxExclusive != "" && compareXsdValues(Builtin, Value, Facets.MaxExclusive) >= 0:
+		return fmt.Sprintf(sxeXsdFacetMaxExclusive, Value, Facets.MaxExclusive)
+	}
+	if Facets.TotalDigits >= 0 || Facets.FractionDigits >= 0 {
+		Digits := strings.TrimLeft(strings.TrimLeft(Value, "+-"), "0")
+		Fraction := ""
+		if p := strings.IndexByte(Digits, '.'); p >= 0 {
+			Fraction = strings.TrimRight(Digits[p+1:], "0")
+			Digits = Digits[:p] + Fraction
+		}
+		if Facets.TotalDigits >= 0 && len(Digits) > Facets.TotalDigits {
+			return fmt.Sprintf(sxeXsdFacetTotalDigits, Value, Facets.TotalDigits)
+		}
+		if Facets.FractionDigits >= 0 && len(Fraction) > Facets.FractionDigits {
+			return fmt.Sprintf(sxeXsdFacetFractionDigit, Value, Facets.FractionDigits)
+		}
+	}
+	return ""
+}
+func isXsdNumeric(Builtin string) bool {
+	for b := Builtin; b != ""; b = cXsdBuiltinBase[b] {
+		if b == "decimal" || b == "float" {
+			return true
+		}
+	}
+	return false
+}
+func compareXsdValues(Builtin, a, b string) int {
+	//Order of two values,numbers by value and other types (dates) by their text
+	if isXsdNumeric(Builtin) {
+		x, okx := new(big.Rat).SetString(a)
+		y, oky := new(big.Rat).SetString(b)
+		if okx && oky {
+			return x.Cmp(y)
+		}
+		fx, errx := strconv.ParseFloat(a, 64)
+		fy, erry := strconv.ParseFloat(b, 64)
+		if errx == nil && erry == nil {
+			switch {
+			case fx < fy:
+				return -1
+			case fx > fy:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(a, b)
+}
+func checkBuiltinValue(Builtin, Value string) string {
+	invalid := fmt.Sprintf(sxeXsdInvalidValue, Value, Builtin)
+	switch Builtin {
+	case "anyType", "anySimpleType", "string", "normalizedString", "token", "anyURI":
+		return ""
+	case "Name", "ID", "IDREF", "ENTITY", "NCName", "QName":
+		ok := isDtdName(Value)
+		if Builtin != "Name" && Builtin != "QName" {
+			ok = ok && !strings.Contains(Value, ":")
+		}
+		if !ok {
+			return invalid
+		}
+		return ""
+	case "NMTOKEN":
+		if !isDtdNmToken(Value) {
+			return invalid
+		}
+		return ""
+	case "NMTOKENS", "IDREFS", "ENTITIES":
+		if len(strings.Fields(Value)) == 0 {
+			return invalid
+		}
+		for _, v := range strings.Fields(Value) {
+			if !isDtdNmToken(v) {
+				return invalid
+			}
+		}
+		return ""
+	case "NOTATION":
+		return ""
+	case "base64Binary":
+		if _, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(Value), "")); err != nil {
+			return invalid
+		}
+		return ""
+	case "hexBinary":
+		if _, err := hex.DecodeString(Value); err != nil {
+			return invalid
+		}
+		return ""
+	case "duration":
+		if !cXsdLexical["duration"].MatchString(Value) || strings.HasSuffix(Value, "P") || strings.HasSuffix(Value, "T") {
+			return invalid
+		}
+		return ""
+	case "double":
+		Builtin = "float"
+	}
+	//Integer types are decimals without fraction within their range
+	Lexical := Builtin
+	if _, ok := cXsdIntegerRanges[Builtin]; ok {
+		Lexical = "integer"
+	}
+	if Pattern, ok := cXsdLexical[Lexical]; ok && !Pattern.MatchString(Value) {
+		return invalid
+	}
+	if Range, ok := cXsdIntegerRanges[Builtin]; ok {
+		if (Range[0] != "" && compareXsdValues("integer", Value, Range[0]) < 0) ||
+			(Range[1] != "" && compareXsdValues("integer", Value, Range[1]) > 0) {
+			return invalid
+		}
+	}
+	return ""
+}
@@ -0,0 +1,1050 @@
+package native_xml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	XslNamespaceURI = "http://www.w3.org/1999/XSL/Transform"
+
+	sxeXslNoStylesheet     = "Document is not an XSLT stylesheet"
+	sxeXslUnsupported      = "Unsupported XSLT element <%s>"
+	sxeXslMisplaced        = "XSLT element <%s> is not allowed in <%s>"
+	sxeXslMissingAttribute = "Missing attribute %s in <%s>"
+	sxeXslInvalidAttribute = "Invalid %s=\"%s\" in <%s>"
+	sxeXslInvalidPattern   = "Invalid XSLT pattern \"%s\""
+	sxeXslInvalidName      = "Invalid name \"%s\" in the transformation result"
+	sxeXslUnknownTemplate  = "Unknown named template \"%s\""
+	sxeXslCircular         = "Circular definition of the global variable $%s"
+	sxeXslRecursion        = "Templates are nested deeper than %d"
+	sxeXslTerminated       = "Transformation terminated by <xsl:message>: %s"
+	sxeXslNoResultRoot     = "The transformation result has %d root elements"
+)
+
+// Template calls a transformation may nest
+const cXslMaxDepth = 3000
+
+// Kinds of the compiled instructions
+const (
+	cXslLiteral = iota
+	cXslText
+	cXslApplyTemplates
+	cXslCallTemplate
+	cXslValueOf
+	cXslForEach
+	cXslIf
+	cXslChoose
+	cXslWhen
+	cXslOtherwise
+	cXslAttribute
+	cXslElement
+	cXslCopyOf
+	cXslCopy
+	cXslVariable
+	cXslParam
+	cXslWithParam
+	cXslSort
+	cXslComment
+	cXslPI
+	cXslMessage
+)
+
+// A compiled XSLT 1.0 stylesheet,it may transform many documents. Supported are
+// templates with match patterns,names,modes and priorities,apply-templates,call-template,
+// value-of,for-each,if,choose,attribute,element,text,copy,copy-of,sort,comment,
+// processing-instruction,message and global and local variables and parameters.
+// White space only text is stripped from the source and the stylesheet,mixed text
+// is only known for documents read with PreserveSource
+type TXslStylesheet struct {
+	Method             string               //Output method "xml" or "text"
+	Indent             bool                 //Write the result readable
+	Encoding           string               //Encoding of the xml declaration of the result
+	OmitXmlDeclaration bool                 //The result has no xml declaration
+	OnMessage          func(Message string) //Gets the text of <xsl:message>
+	templates          []*tXslTemplate      //Match templates,the one to use first
+	named              map[string]*tXslTemplate
+	globals            []*tXslVariable
+}
+
+type tXslTemplate struct {
+	Match    *tXslPattern
+	Name     string
+	Mode     string
+	Priority float64
+	Order    int //Position in the stylesheet,the later of equal priority is used
+	Params   []*tXslVariable
+	Body     []*tXslInstruction
+}
+
+// Variable,parameter or the value passed by with-param
+type tXslVariable struct {
+	Name   string
+	Select tXPathExpr
+	Body   []*tXslInstruction //Result tree fragment when there is no Select
+	Param  bool
+}
+
+// One step of a pattern,Descendant when "//" is in front of it
+type tXslPatternStep struct {
+	Step       *tXPathStep
+	Descendant bool
+}
+
+// A match pattern without unions,matched from the last step to the first
+type tXslPattern struct {
+	Absolute bool
+	Steps    []tXslPatternStep
+}
+
+// Attribute value template,the texts around the expressions
+type tXslAVT struct {
+	Text  []string
+	Exprs []tXPathExpr
+}
+
+type tXslSort struct {
+	Select   tXPathExpr
+	Order    *tXslAVT
+	DataType *tXslAVT
+}
+
+type tXslInstruction struct {
+	Kind       int
+	Source     *TXmlNode //Element of the stylesheet,the namespaces in scope are taken from it
+	Name       string    //Literal element name,template name or mode
+	NameAVT    *tXslAVT
+	Namespace  *tXslAVT
+	Attributes map[string]*tXslAVT //Attributes of a literal element
+	Select     tXPathExpr
+	Test       tXPathExpr
+	Text       string
+	Raw        bool //disable-output-escaping,terminate for a message
+	Body       []*tXslInstruction
+	Sorts      []*tXslSort
+	Params     []*tXslVariable
+	Variable   *tXslVariable
+}
+
+// Variables bound by the instructions that are run
+type tXslScope struct {
+	Name   string
+	Value  interface{}
+	Parent *tXslScope
+}
+
+type tXslGlobal struct {
+	Variable *tXslVariable
+	Value    interface{}
+	State    int //0 not evaluated,1 being evaluated,2 done
+}
+
+// Node and variables an instruction is run with
+type tXslState struct {
+	Node     tXPathNode
+	Position int
+	Size     int
+	Scope    *tXslScope
+}
+
+// State of one transformation
+type tXslProcessor struct {
+	Sheet   *TXslStylesheet
+	Order   *tXPathOrder
+	Root    tXPathNode
+	Params  map[string]string
+	Globals map[string]*tXslGlobal
+	Depth   int
+}
+
+func NewXslStylesheet(Doc *TNativeXml) (Sheet *TXslStylesheet, err error) {
+	//Compile the stylesheet in Doc. A literal result element with an xsl:version
+	//attribute is a stylesheet with only a template for the root
+	defer recoverError(&err)
+	if Doc == nil || Doc.XmlRoot == nil {
+		return nil, errors.New(sxeNoRootElement)
+	}
+	Root := Doc.XmlRoot
+	Sheet = &TXslStylesheet{Method: "xml", Encoding: "UTF-8", named: make(map[string]*tXslTemplate)}
+	switch xslName(Root) {
+	case "stylesheet", "transform":
+		Sheet.compile(Root)
+	case "":
+		if Prefix := xslPrefix(Root); Prefix != "" && Root.HasAttribute(Prefix+":version") {
+			Sheet.templates = append(Sheet.templates, &tXslTemplate{Match: &tXslPattern{Absolute: true},
+				Priority: 0.5, Body: []*tXslInstruction{xslInstruction(Root)}})
+			return Sheet, nil
+		}
+		fallthrough
+	default:
+		return nil, errors.New(sxeXslNoStylesheet)
+	}
+	return Sheet, nil
+}
+func NewXslStylesheetString(Stylesheet string) (*TXslStylesheet, error) {
+	//The stylesheet is read with PreserveSource,so the text of <xsl:text> and mixed
+	//literal content keeps its white space
+	Doc := NewNativeXml()
+	Doc.PreserveSource = true
+	if err := Doc.ParseString(Stylesheet); err != nil {
+		return nil, err
+	}
+	return NewXslStylesheet(Doc)
+}
+func (this *TXslStylesheet) Transform(Source *TNativeXml, Params map[string]string) (Result *TNativeXml, err error) {
+	//Transform Source,Params are the values of the global parameters. The result must
+	//have a single root element
+	defer recoverError(&err)
+	Fragment := this.run(Source, Params)
+	if Roots := xslRootCount(Fragment); Roots != 1 {
+		return nil, errors.New(fmt.Sprintf(sxeXslNoResultRoot, Roots))
+	}
+	return this.document(Fragment), nil
+}
+func (this *TXslStylesheet) TransformToString(Source *TNativeXml, Params map[string]string) (Result string, err error) {
+	//The text of the result for the text method,otherwise the xml. A result without a
+	//single root element is written as fragment
+	defer recoverError(&err)
+	Fragment := this.run(Source, Params)
+	switch {
+	case this.Method == "text":
+		return tXPathNode{Kind: cXPathRoot, Node: Fragment}.stringValue(), nil
+	case xslRootCount(Fragment) == 1:
+		return this.document(Fragment).WriteToString(), nil
+	}
+	W := tXmlWriter{Format: xfCompact}
+	buf := new(bytes.Buffer)
+	buf.WriteString(Fragment.Value)
+	for _, v := range Fragment.NodeList() {
+		v.Parent = nil
+		v.writeToStream(buf, W)
+	}
+	return buf.String(), nil
+}
+func xslRootCount(Fragment *TXmlNode) int {
+	Roots := 0
+	for _, v := range Fragment.Nodes {
+		if v.ElementType == xeNormal {
+			Roots++
+		}
+	}
+	return Roots
+}
+func (this *TXslStylesheet) document(Fragment *TXmlNode) *TNativeXml {
+	//The document of a result with one root element,text and other nodes around it
+	//are left out
+	Result := NewNativeXml()
+	if this.Indent {
+		Result.XmlFormat = xfReadable
+	}
+	for _, v := range Fragment.Nodes {
+		if v.ElementType == xeNormal {
+			v.Parent = nil
+			v.document = Result
+			Result.RootNodes[xeNormal] = v
+			Result.XmlRoot = v
+		}
+	}
+	if !this.OmitXmlDeclaration {
+		Result.RootNodes[xeDeclaration] = &TXmlNode{ElementType: xeDeclaration, Name: "xml", document: Result,
+			Attributes: map[string]string{"version": "1.0", "encoding": this.Encoding}, Nodes: make(map[int]*TXmlNode)}
+	}
+	return Result
+}
+func (this *TXslStylesheet) run(Source *TNativeXml, Params map[string]string) *TXmlNode {
+	//The result tree of Source
+	if Source == nil || Source.XmlRoot == nil {
+		panic(errors.New(sxeNoRootElement))
+	}
+	P := &tXslProcessor{Sheet: this, Order: &tXPathOrder{}, Root: xpathDocument(Source), Params: Params,
+		Globals: make(map[string]*tXslGlobal)}
+	for _, v := range this.globals {
+		P.Globals[v.Name] = &tXslGlobal{Variable: v}
+	}
+	Fragment := NewXmlNode(cXPathFragment)
+	P.applyTemplates(P.Root, 1, 1, "", nil, Fragment)
+	return Fragment
+}
+
+func xslPrefix(Node *TXmlNode) string {
+	//A prefix of the XSLT namespace in scope of Node
+	for k, v := range Node.InScopeNamespaces() {
+		if v == XslNamespaceURI && k != "" {
+			return k
+		}
+	}
+	return ""
+}
+func xslName(Node *TXmlNode) string {
+	//The local name of an XSLT element,"" for other nodes
+	if Node.ElementType != xeNormal {
+		return ""
+	}
+	Prefix, Local := SplitQualifiedName(Node.Name)
+	if Node.LookupNamespaceURI(Prefix) != XslNamespaceURI {
+		return ""
+	}
+	return Local
+}
+func xslAttribute(Node *TXmlNode, Name string) (string, bool) {
+	Value, ok := Node.Attributes[Name]
+	return UnescapeString(Value), ok
+}
+func xslRequired(Node *TXmlNode, Name string) string {
+	Value, ok := xslAttribute(Node, Name)
+	if !ok {
+		panic(errors.New(fmt.Sprintf(sxeXslMissingAttribute, Name, Node.Name)))
+	}
+	return Value
+}
+func xslExpr(Node *TXmlNode, Name string) tXPathExpr {
+	return parseXPath(xslRequired(Node, Name))
+}
+func xslOptionalExpr(Node *TXmlNode, Name string) tXPathExpr {
+	if Value, ok := xslAttribute(Node, Name); ok {
+		return parseXPath(Value)
+	}
+	return nil
+}
+func xslOptionalAVT(Node *TXmlNode, Name string) *tXslAVT {
+	if Value, ok := xslAttribute(Node, Name); ok {
+		return xslParseAVT(Value, Node)
+	}
+	return nil
+}
+func xslParseAVT(Value string, Node *TXmlNode) *tXslAVT {
+	//"{expr}" is replaced by the string of expr,"{{" and "}}" are braces
+	AVT := &tXslAVT{}
+	Text := new(bytes.Buffer)
+	Invalid := errors.New(fmt.Sprintf(sxeXslInvalidAttribute, "value", Value, Node.Name))
+	for i := 0; i < len(Value); i++ {
+		c := Value[i]
+		switch {
+		case (c == '{' || c == '}') && i+1 < len(Value) && Value[i+1] == c:
+			Text.WriteByte(c)
+			i++
+		case c == '{':
+			End, Quote := i+1, byte(0)
+			for ; End < len(Value) && (Quote != 0 || Value[End] != '}'); End++ {
+				switch {
+				case Quote == Value[End]:
+					Quote = 0
+				case Quote == 0 && (Value[End] == '"' || Value[End] == '\''):
+					Quote = Value[End]
+				}
+			}
+			if End == len(Value) {
+				panic(Invalid)
+			}
+			AVT.Text = append(AVT.Text, Text.String())
+			AVT.Exprs = append(AVT.Exprs, parseXPath(Value[i+1:End]))
+			Text.Reset()
+			i = End
+		case c == '}':
+			panic(Invalid)
+		default:
+			Text.WriteByte(c)
+		}
+	}
+	AVT.Text = append(AVT.Text, Text.String())
+	return AVT
+}
+func xslRawText(Node *TXmlNode) string {
+	//All text of Node including white space
+	Segments := Node.textSegments()
+	buf := new(bytes.Buffer)
+	for i, v := range Node.NodeList() {
+		buf.WriteString(UnescapeString(Segments[i]))
+		if v.ElementType == xeCData {
+			buf.WriteString(v.Value)
+		}
+	}
+	buf.WriteString(UnescapeString(Segments[len(Segments)-1]))
+	return buf.String()
+}
+
+func (this *TXslStylesheet) compile(Root *TXmlNode) {
+	for _, v := range Root.NodeList() {
+		switch Name := xslName(v); Name {
+		case "":
+			//Comments and elements of other namespaces are ignored
+		case "template":
+			this.compileTemplate(v)
+		case "variable", "param":
+			this.globals = append(this.globals, xslInstruction(v).Variable)
+		case "output":
+			if Method, ok := xslAttribute(v, "method"); ok {
+				if Method != "xml" && Method != "text" {
+					panic(errors.New(fmt.Sprintf(sxeXslInvalidAttribute, "method", Method, v.Name)))
+				}
+				this.Method = Method
+			}
+			if Encoding, ok := xslAttribute(v, "encoding"); ok {
+				this.Encoding = Encoding
+			}
+			Indent, _ := xslAttribute(v, "indent")
+			Omit, _ := xslAttribute(v, "omit-xml-declaration")
+			this.Indent, this.OmitXmlDeclaration = Indent == "yes", Omit == "yes"
+		case "strip-space", "preserve-space":
+			//White space only text is always stripped
+		default:
+			panic(errors.New(fmt.Sprintf(sxeXslUnsupported, v.Name)))
+		}
+	}
+	//The template with the highest priority and the last of equal priority wins
+	sort.SliceStable(this.templates, func(i, j int) bool {
+		a, b := this.templates[i], this.templates[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.Order > b.Order
+	})
+}
+func (this *TXslStylesheet) compileTemplate(Node *TXmlNode) {
+	Match, HasMatch := xslAttribute(Node, "match")
+	Name, HasName := xslAttribute(Node, "name")
+	if !HasMatch && !HasName {
+		panic(errors.New(fmt.Sprintf(sxeXslMissingAttribute, "match", Node.Name)))
+	}
+	Template := &tXslTemplate{Name: Name}
+	Template.Mode, _ = xslAttribute(Node, "mode")
+	for _, v := range xslBody(Node, cXslParam) {
+		if v.Kind == cXslParam {
+			Template.Params = append(Template.Params, v.Variable)
+		} else {
+			Template.Body = append(Template.Body, v)
+		}
+	}
+	if HasName {
+		this.named[Name] = Template
+	}
+	if !HasMatch {
+		return
+	}
+	Priority, HasPriority := xslAttribute(Node, "priority")
+	for _, v := range xslPatterns(Match) {
+		T := *Template
+		T.Match, T.Order, T.Priority = v, len(this.templates), v.priority()
+		if HasPriority {
+			f, err := strconv.ParseFloat(strings.TrimSpace(Priority), 64)
+			if err != nil {
+				panic(errors.New(fmt.Sprintf(sxeXslInvalidAttribute, "priority", Priority, Node.Name)))
+			}
+			T.Priority = f
+		}
+		this.templates = append(this.templates, &T)
+	}
+}
+func xslPatterns(Pattern string) []*tXslPattern {
+	//The alternatives of a pattern,each a location path of child and attribute steps
+	Invalid := errors.New(fmt.Sprintf(sxeXslInvalidPattern, Pattern))
+	var Alternatives []tXPathExpr
+	var Split func(Expr tXPathExpr)
+	Split = func(Expr tXPathExpr) {
+		if Union, ok := Expr.(*tXPathBinary); ok && Union.Op == "|" {
+			Split(Union.Left)
+			Split(Union.Right)
+		} else {
+			Alternatives = append(Alternatives, Expr)
+		}
+	}
+	Split(parseXPath(Pattern))
+	Patterns := make([]*tXslPattern, 0, len(Alternatives))
+	for _, v := range Alternatives {
+		Path, ok := v.(*tXPathPath)
+		if !ok || Path.Filter != nil {
+			panic(Invalid)
+		}
+		Result := &tXslPattern{Absolute: Path.Absolute}
+		Descendant := false
+		for _, Step := range Path.Steps {
+			switch {
+			case Step.Axis == "descendant-or-self" && Step.Test == cXPathTestNode && len(Step.Predicates) == 0:
+				Descendant = true
+				continue
+			case Step.Axis != "child" && Step.Axis != "attribute":
+				panic(Invalid)
+			}
+			Result.Steps = append(Result.Steps, tXslPatternStep{Step: Step, Descendant: Descendant})
+			Descendant = false
+		}
+		if Descendant {
+			panic(Invalid)
+		}
+		Patterns = append(Patterns, Result)
+	}
+	return Patterns
+}
+func (this *tXslPattern) priority() float64 {
+	//The default priority of the pattern
+	if this.Absolute || len(this.Steps) != 1 || len(this.Steps[0].Step.Predicates) > 0 {
+		return 0.5
+	}
+	Step := this.Steps[0].Step
+	switch {
+	case Step.Test == cXPathTestPI && Step.Name != "":
+		return 0
+	case Step.Test != cXPathTestName, Step.Name == "*":
+		return -0.5
+	case strings.HasSuffix(Step.Name, ":*"):
+		return -0.25
+	}
+	return 0
+}
+func (this *tXslPattern) matches(Ctx *tXPathContext, Node tXPathNode) bool {
+	if len(this.Steps) == 0 {
+		return Node.Kind == cXPathRoot
+	}
+	return this.matchStep(Ctx, Node, len(this.Steps)-1)
+}
+func (this *tXslPattern) matchStep(Ctx *tXPathContext, Node tXPathNode, i int) bool {
+	PatternStep := this.Steps[i]
+	Step := PatternStep.Step
+	if Node.Kind == cXPathRoot || (Node.Kind == cXPathAttribute) != (Step.Axis == "attribute") || !Step.matches(Node) {
+		return false
+	}
+	Parent, _ := Node.parent()
+	if len(Step.Predicates) > 0 {
+		//The predicates are evaluated for the nodes of the step from the parent
+		Nodes := make([]tXPathNode, 0)
+		for _, v := range Parent.axis(Step.Axis) {
+			if Step.matches(v) {
+				Nodes = append(Nodes, v)
+			}
+		}
+		for _, v := range Step.Predicates {
+			Nodes = Ctx.filter(Nodes, v)
+		}
+		Found := false
+		for _, v := range Nodes {
+			Found = Found || v == Node
+		}
+		if !Found {
+			return false
+		}
+	}
+	if i == 0 {
+		return !this.Absolute || PatternStep.Descendant || Parent.Kind == cXPathRoot
+	}
+	for ok := true; ok; Parent, ok = Parent.parent() {
+		if this.matchStep(Ctx, Parent, i-1) {
+			return true
+		}
+		if !PatternStep.Descendant {
+			break
+		}
+	}
+	return false
+}
+
+func xslBody(Node *TXmlNode, Allowed ...int) []*tXslInstruction {
+	//The instructions of the content of Node. Sort,parameters and the parts of choose
+	//are only compiled where Allowed has them
+	Body := make([]*tXslInstruction, 0)
+	for _, v := range (tXPathNode{Kind: cXPathElement, Node: Node}).children() {
+		switch v.Kind {
+		case cXPathText:
+			Body = append(Body, &tXslInstruction{Kind: cXslText, Source: Node, Text: v.stringValue()})
+		case cXPathElement:
+			Body = append(Body, xslInstruction(v.Node))
+		}
+	}
+	for _, v := range Body {
+		switch v.Kind {
+		case cXslSort, cXslParam, cXslWithParam, cXslWhen, cXslOtherwise:
+			Found := false
+			for _, k := range Allowed {
+				Found = Found || k == v.Kind
+			}
+			if !Found {
+				panic(errors.New(fmt.Sprintf(sxeXslMisplaced, v.Source.Name, Node.Name)))
+			}
+		}
+	}
+	return Body
+}
+func xslInstruction(Node *TXmlNode) *tXslInstruction {
+	I := &tXslInstruction{Source: Node}
+	Name := xslName(Node)
+	switch Name {
+	case "":
+		I.Kind, I.Name, I.Attributes = cXslLiteral, Node.Name, make(map[string]*tXslAVT)
+		for k, v := range Node.Attributes {
+			Prefix, _ := SplitQualifiedName(k)
+			if _, IsDecl := namespaceDeclPrefix(k); !IsDecl && (Prefix == "" || Node.LookupNamespaceURI(Prefix) != XslNamespaceURI) {
+				I.Attributes[k] = xslParseAVT(UnescapeString(v), Node)
+			}
+		}
+		I.Body = xslBody(Node)
+	case "apply-templates":
+		I.Kind = cXslApplyTemplates
+		if I.Select = xslOptionalExpr(Node, "select"); I.Select == nil {
+			I.Select = parseXPath("node()")
+		}
+		I.Name, _ = xslAttribute(Node, "mode")
+		I.addSortsAndParams(xslBody(Node, cXslSort, cXslWithParam))
+	case "call-template":
+		I.Kind, I.Name = cXslCallTemplate, xslRequired(Node, "name")
+		I.addSortsAndParams(xslBody(Node, cXslWithParam))
+	case "value-of":
+		I.Kind, I.Select = cXslValueOf, xslExpr(Node, "select")
+		Raw, _ := xslAttribute(Node, "disable-output-escaping")
+		I.Raw = Raw == "yes"
+	case "for-each":
+		I.Kind, I.Select = cXslForEach, xslExpr(Node, "select")
+		I.addSortsAndParams(xslBody(Node, cXslSort))
+	case "if":
+		I.Kind, I.Test, I.Body = cXslIf, xslExpr(Node, "test"), xslBody(Node)
+	case "choose":
+		I.Kind, I.Body = cXslChoose, xslBody(Node, cXslWhen, cXslOtherwise)
+		for _, v := range I.Body {
+			if v.Kind != cXslWhen && v.Kind != cXslOtherwise {
+				panic(errors.New(fmt.Sprintf(sxeXslMisplaced, v.Source.Name, Node.Name)))
+			}
+		}
+	case "when":
+		I.Kind, I.Test, I.Body = cXslWhen, xslExpr(Node, "test"), xslBody(Node)
+	case "otherwise":
+		I.Kind, I.Body = cXslOtherwise, xslBody(Node)
+	case "attribute", "element":
+		I.Kind, I.NameAVT, I.Body = cXslAttribute, xslParseAVT(xslRequired(Node, "name"), Node), xslBody(Node)
+		if Name == "element" {
+			I.Kind = cXslElement
+		}
+		I.Namespace = xslOptionalAVT(Node, "namespace")
+	case "text":
+		I.Kind, I.Text = cXslText, xslRawText(Node)
+		Raw, _ := xslAttribute(Node, "disable-output-escaping")
+		I.Raw = Raw == "yes"
+	case "copy-of":
+		I.Kind, I.Select = cXslCopyOf, xslExpr(Node, "select")
+	case "copy":
+		I.Kind, I.Body = cXslCopy, xslBody(Node)
+	case "variable", "param", "with-param":
+		I.Kind = map[string]int{"variable": cXslVariable, "param": cXslParam, "with-param": cXslWithParam}[Name]
+		I.Variable = &tXslVariable{Name: xslRequired(Node, "name"), Select: xslOptionalExpr(Node, "select"), Param: Name == "param"}
+		if I.Variable.Select == nil {
+			I.Variable.Body = xslBody(Node)
+		}
+	case "sort":
+		I.Kind = cXslSort
+		Sort := &tXslSort{Select: xslOptionalExpr(Node, "select"), Order: xslOptionalAVT(Node, "order"),
+			DataType: xslOptionalAVT(Node, "data-type")}
+		if Sort.Select == nil {
+			Sort.Select = parseXPath(".")
+		}
+		I.Sorts = []*tXslSort{Sort}
+	case "comment":
+		I.Kind, I.Body = cXslComment, xslBody(Node)
+	case "processing-instruction":
+		I.Kind, I.NameAVT, I.Body = cXslPI, xslParseAVT(xslRequired(Node, "name"), Node), xslBody(Node)
+	case "message":
+		I.Kind, I.Body = cXslMessage, xslBody(Node)
+		Terminate, _ := xslAttribute(Node, "terminate")
+		I.Raw = Terminate == "yes"
+	default:
+		panic(errors.New(fmt.Sprintf(sxeXslUnsupported, Node.Name)))
+	}
+	return I
+}
+func (this *tXslInstruction) addSortsAndParams(Body []*tXslInstruction) {
+	for _, v := range Body {
+		switch v.Kind {
+		case cXslSort:
+			this.Sorts = append(this.Sorts, v.Sorts...)
+		case cXslWithParam:
+			this.Params = append(this.Params, v.Variable)
+		default:
+			this.Body = append(this.Body, v)
+		}
+	}
+}
+
+func (this *tXslProcessor) lookup(Scope *tXslScope, Name string) (interface{}, bool) {
+	for ; Scope != nil; Scope = Scope.Parent {
+		if Scope.Name == Name {
+			return Scope.Value, true
+		}
+	}
+	Global, ok := this.Globals[Name]
+	if !ok {
+		return nil, false
+	}
+	//Global variables are evaluated when they are first used
+	switch Global.State {
+	case 1:
+		panic(errors.New(fmt.Sprintf(sxeXslCircular, Name)))
+	case 0:
+		Global.State = 1
+		if Value, ok := this.Params[Name]; ok && Global.Variable.Param {
+			Global.Value = Value
+		} else {
+			Global.Value = this.value(Global.Variable, tXslState{Node: this.Root, Position: 1, Size: 1})
+		}
+		Global.State = 2
+	}
+	return Global.Value, true
+}
+func (this *tXslProcessor) eval(Expr tXPathExpr, State tXslState) interface{} {
+	Ctx := &tXPathContext{Node: State.Node, Position: State.Position, Size: State.Size, Current: State.Node,
+		Order: this.Order, Variables: func(Name string) (interface{}, bool) {
+			return this.lookup(State.Scope, Name)
+		}}
+	return Expr.eval(Ctx)
+}
+func (this *tXslProcessor) nodes(Expr tXPathExpr, State tXslState, Sorts []*tXslSort) []tXPathNode {
+	//The selected nodes in the order of the sort keys
+	Nodes, ok := this.eval(Expr, State).([]tXPathNode)
+	if !ok {
+		panic(errors.New(fmt.Sprintf(sxeXPathNodeSetExpected, "select")))
+	}
+	if len(Sorts) == 0 {
+		return Nodes
+	}
+	Keys := make([][]interface{}, len(Nodes))
+	Descending := make([]bool, len(Sorts))
+	for k, s := range Sorts {
+		Number := s.DataType != nil && this.avt(s.DataType, State) == "number"
+		Descending[k] = s.Order != nil && this.avt(s.Order, State) == "descending"
+		for i, n := range Nodes {
+			Value := xpathString(this.eval(s.Select, tXslState{Node: n, Position: i + 1, Size: len(Nodes), Scope: State.Scope}))
+			if Number {
+				Keys[i] = append(Keys[i], xpathNumber(Value))
+			} else {
+				Keys[i] = append(Keys[i], Value)
+			}
+		}
+	}
+	Index := make([]int, len(Nodes))
+	for i := range Index {
+		Index[i] = i
+	}
+	sort.SliceStable(Index, func(a, b int) bool {
+		for k := range Sorts {
+			c := xslCompareKeys(Keys[Index[a]][k], Keys[Index[b]][k])
+			if Descending[k] {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	Sorted := make([]tXPathNode, len(Nodes))
+	for i, v := range Index {
+		Sorted[i] = Nodes[v]
+	}
+	return Sorted
+}
+func xslCompareKeys(a, b interface{}) int {
+	//Numbers sort NaN first,strings by their bytes
+	if s, ok := a.(string); ok {
+		return strings.Compare(s, b.(string))
+	}
+	x, y := a.(float64), b.(float64)
+	switch {
+	case math.IsNaN(x) && math.IsNaN(y), x == y:
+		return 0
+	case math.IsNaN(x), x < y:
+		return -1
+	}
+	return 1
+}
+func (this *tXslProcessor) avt(AVT *tXslAVT, State tXslState) string {
+	buf := new(bytes.Buffer)
+	for i, v := range AVT.Text {
+		buf.WriteString(v)
+		if i < len(AVT.Exprs) {
+			buf.WriteString(xpathString(this.eval(AVT.Exprs[i], State)))
+		}
+	}
+	return buf.String()
+}
+func (this *tXslProcessor) value(Variable *tXslVariable, State tXslState) interface{} {
+	//The selected value or the result tree fragment of the content
+	switch {
+	case Variable.Select != nil:
+		return this.eval(Variable.Select, State)
+	case len(Variable.Body) == 0:
+		return ""
+	}
+	Fragment := NewXmlNode(cXPathFragment)
+	this.execute(Variable.Body, State, Fragment)
+	return []tXPathNode{{Kind: cXPathRoot, Node: Fragment}}
+}
+func (this *tXslProcessor) text(Body []*tXslInstruction, State tXslState) string {
+	//The string value of the content
+	Fragment := NewXmlNode(cXPathFragment)
+	this.execute(Body, State, Fragment)
+	return tXPathNode{Kind: cXPathRoot, Node: Fragment}.stringValue()
+}
+func (this *tXslProcessor) params(Params []*tXslVariable, State tXslState) map[string]interface{} {
+	Values := make(map[string]interface{}, len(Params))
+	for _, v := range Params {
+		Values[v.Name] = this.value(v, State)
+	}
+	return Values
+}
+func (this *tXslProcessor) template(Node tXPathNode, Position, Size int, Mode string) *tXslTemplate {
+	Ctx := &tXPathContext{Node: Node, Position: Position, Size: Size, Current: Node, Order: this.Order,
+		Variables: func(Name string) (interface{}, bool) {
+			return this.lookup(nil, Name)
+		}}
+	for _, v := range this.Sheet.templates {
+		if v.Mode == Mode && v.Match.matches(Ctx, Node) {
+			return v
+		}
+	}
+	return nil
+}
+func (this *tXslProcessor) applyTemplates(Node tXPathNode, Position, Size int, Mode string, Params map[string]interface{}, Out *TXmlNode) {
+	State := tXslState{Node: Node, Position: Position, Size: Size}
+	if Template := this.template(Node, Position, Size, Mode); Template != nil {
+		this.call(Template, State, Params, Out)
+		return
+	}
+	//The built-in templates process the children and copy the text
+	switch Node.Kind {
+	case cXPathRoot, cXPathElement:
+		Children := Node.children()
+		for i, v := range Children {
+			this.applyTemplates(v, i+1, len(Children), Mode, nil, Out)
+		}
+	case cXPathText, cXPathAttribute:
+		xslWrite(Out, Node.stringValue(), false)
+	}
+}
+func (this *tXslProcessor) call(Template *tXslTemplate, State tXslState, Params map[string]interface{}, Out *TXmlNode) {
+	if this.Depth++; this.Depth > cXslMaxDepth {
+		panic(errors.New(fmt.Sprintf(sxeXslRecursion, cXslMaxDepth)))
+	}
+	State.Scope = nil
+	for _, v := range Template.Params {
+		Value, ok := Params[v.Name]
+		if !ok {
+			Value = this.value(v, State)
+		}
+		State.Scope = &tXslScope{Name: v.Name, Value: Value, Parent: State.Scope}
+	}
+	this.execute(Template.Body, State, Out)
+	this.Depth--
+}
+func (this *tXslProcessor) execute(Body []*tXslInstruction, State tXslState, Out *TXmlNode) {
+	for _, v := range Body {
+		switch v.Kind {
+		case cXslVariable, cXslParam:
+			//The variable is in scope of the following instructions
+			State.Scope = &tXslScope{Name: v.Variable.Name, Value: this.value(v.Variable, State), Parent: State.Scope}
+		case cXslChoose:
+			for _, w := range v.Body {
+				if w.Kind == cXslOtherwise || xpathBoolean(this.eval(w.Test, State)) {
+					this.execute(w.Body, State, Out)
+					break
+				}
+			}
+		default:
+			this.instruction(v, State, Out)
+		}
+	}
+}
+func (this *tXslProcessor) instruction(I *tXslInstruction, State tXslState, Out *TXmlNode) {
+	switch I.Kind {
+	case cXslLiteral:
+		Element := xslElement(Out, I.Name)
+		xslDeclare(Element, I.Name, I.Source, false)
+		for k, v := range I.Attributes {
+			xslDeclare(Element, k, I.Source, true)
+			Element.Attributes[k] = canonicalEscapeAttr(this.avt(v, State))
+		}
+		this.execute(I.Body, State, Element)
+	case cXslText:
+		xslWrite(Out, I.Text, I.Raw)
+	case cXslValueOf:
+		xslWrite(Out, xpathString(this.eval(I.Select, State)), I.Raw)
+	case cXslApplyTemplates:
+		Params := this.params(I.Params, State)
+		Nodes := this.nodes(I.Select, State, I.Sorts)
+		for i, v := range Nodes {
+			this.applyTemplates(v, i+1, len(Nodes), I.Name, Params, Out)
+		}
+	case cXslCallTemplate:
+		Template, ok := this.Sheet.named[I.Name]
+		if !ok {
+			panic(errors.New(fmt.Sprintf(sxeXslUnknownTemplate, I.Name)))
+		}
+		this.call(Template, State, this.params(I.Params, State), Out)
+	case cXslForEach:
+		Nodes := this.nodes(I.Select, State, I.Sorts)
+		for i, v := range Nodes {
+			this.execute(I.Body, tXslState{Node: v, Position: i + 1, Size: len(Nodes), Scope: State.Scope}, Out)
+		}
+	case cXslIf:
+		if xpathBoolean(this.eval(I.Test, State)) {
+			this.execute(I.Body, State, Out)
+		}
+	case cXslAttribute:
+		Name := this.avt(I.NameAVT, State)
+		if !IsXmlName(Name) || Name == "xmlns" {
+			panic(errors.New(fmt.Sprintf(sxeXslInvalidName, Name)))
+		}
+		if xslIsFragment(Out) {
+			return
+		}
+		if I.Namespace != nil {
+			Prefix, _ := SplitQualifiedName(Name)
+			xslDeclareURI(Out, Prefix, this.avt(I.Namespace, State))
+		} else {
+			xslDeclare(Out, Name, I.Source, true)
+		}
+		Out.Attributes[Name] = canonicalEscapeAttr(this.text(I.Body, State))
+	case cXslElement:
+		Name := this.avt(I.NameAVT, State)
+		if !IsXmlName(Name) {
+			panic(errors.New(fmt.Sprintf(sxeXslInvalidName, Name)))
+		}
+		Element := xslElement(Out, Name)
+		if I.Namespace != nil {
+			Prefix, _ := SplitQualifiedName(Name)
+			xslDeclareURI(Element, Prefix, this.avt(I.Namespace, State))
+		} else {
+			xslDeclare(Element, Name, I.Source, false)
+		}
+		this.execute(I.Body, State, Element)
+	case cXslCopyOf:
+		Value := this.eval(I.Select, State)
+		if Nodes, ok := Value.([]tXPathNode); ok {
+			for _, v := range Nodes {
+				xslCopy(v, Out, true)
+			}
+		} else {
+			xslWrite(Out, xpathString(Value), false)
+		}
+	case cXslCopy:
+		if Copy := xslCopy(State.Node, Out, false); Copy != nil {
+			this.execute(I.Body, State, Copy)
+		}
+	case cXslComment:
+		Text := strings.Replace(this.text(I.Body, State), "--", "- -", -1)
+		if strings.HasSuffix(Text, "-") {
+			Text += " "
+		}
+		Out.NodeAdd(&TXmlNode{ElementType: xeComment, Name: "Comment", Value: Text,
+			Attributes: make(map[string]string), Nodes: make(map[int]*TXmlNode)})
+	case cXslPI:
+		Name := this.avt(I.NameAVT, State)
+		if !IsXmlName(Name) || strings.ContainsRune(Name, ':') || strings.EqualFold(Name, "xml") {
+			panic(errors.New(fmt.Sprintf(sxeXslInvalidName, Name)))
+		}
+		Value := Name
+		if Text := strings.Replace(this.text(I.Body, State), "?>", "? >", -1); Text != "" {
+			Value += " " + Text
+		}
+		Out.NodeAdd(&TXmlNode{ElementType: xeQuestion, Name: "Special", Value: Value,
+			Attributes: make(map[string]string), Nodes: make(map[int]*TXmlNode)})
+	case cXslMessage:
+		Text := this.text(I.Body, State)
+		if this.Sheet.OnMessage != nil {
+			this.Sheet.OnMessage(Text)
+		}
+		if I.Raw {
+			panic(errors.New(fmt.Sprintf(sxeXslTerminated, Text)))
+		}
+	}
+}
+
+func xslIsFragment(Node *TXmlNode) bool {
+	return Node.Parent == nil && Node.Name == cXPathFragment
+}
+func xslElement(Out *TXmlNode, Name string) *TXmlNode {
+	Element := NewXmlNode(Name)
+	Out.NodeAdd(Element)
+	return Element
+}
+func xslWrite(Out *TXmlNode, Text string, Raw bool) {
+	//Add text behind the content of Out,Raw text is not escaped
+	if Text == "" {
+		return
+	}
+	if !Raw {
+		Text = canonicalEscapeText(Text)
+	}
+	if len(Out.Nodes) == 0 {
+		Out.Value += Text
+		return
+	}
+	if Last := Out.Nodes[Out.MaxNodeID]; Last != nil && Last.ElementType == xeCharData {
+		Last.Value += Text
+		return
+	}
+	Out.NodeAdd(&TXmlNode{ElementType: xeCharData, Value: Text,
+		Attributes: make(map[string]string), Nodes: make(map[int]*TXmlNode)})
+}
+func xslDeclare(Out *TXmlNode, Name string, From *TXmlNode, IsAttribute bool) {
+	//Declare the namespace the prefix of Name has at From when Out does not have it in
+	//scope,unprefixed attributes have no namespace
+	Prefix, _ := SplitQualifiedName(Name)
+	if IsAttribute && Prefix == "" {
+		return
+	}
+	xslDeclareURI(Out, Prefix, From.LookupNamespaceURI(Prefix))
+}
+func xslDeclareURI(Out *TXmlNode, Prefix, URI string) {
+	if Prefix == "xml" || Out.LookupNamespaceURI(Prefix) == URI || (URI == "" && Prefix != "") {
+		return
+	}
+	if Prefix == "" {
+		Out.Attributes["xmlns"] = canonicalEscapeAttr(URI)
+	} else {
+		Out.Attributes["xmlns:"+Prefix] = canonicalEscapeAttr(URI)
+	}
+}
+func xslCopy(Node tXPathNode, Out *TXmlNode, Deep bool) *TXmlNode {
+	//Copy Node to the end of Out,the shallow copy of an element keeps its namespace
+	//declarations but not its attributes and content. The result is the node the
+	//content of a shallow copy goes to
+	switch Node.Kind {
+	case cXPathRoot:
+		if Deep {
+			for _, v := range Node.children() {
+				xslCopy(v, Out, true)
+			}
+		}
+		return Out
+	case cXPathElement:
+		Element := xslElement(Out, Node.Node.Name)
+		for k, v := range Node.Node.Attributes {
+			if _, IsDecl := namespaceDeclPrefix(k); IsDecl {
+				Element.Attributes[k] = canonicalEscapeAttr(UnescapeString(v))
+			}
+		}
+		xslDeclare(Element, Element.Name, Node.Node, false)
+		if Deep {
+			for _, v := range Node.axis("attribute") {
+				xslCopy(v, Element, true)
+			}
+			for _, v := range Node.children() {
+				xslCopy(v, Element, true)
+			}
+		}
+		return Element
+	case cXPathAttribute:
+		if !xslIsFragment(Out) {
+			xslDeclare(Out, Node.Name, Node.Node, true)
+			Out.Attributes[Node.Name] = canonicalEscapeAttr(Node.stringValue())
+		}
+	case cXPathText:
+		xslWrite(Out, Node.stringValue(), false)
+	case cXPathComment, cXPathPI:
+		Copy := *Node.Node
+		Copy.Parent, Copy.document, Copy.source, Copy.sourcePos = nil, nil, nil, 0
+		Copy.Attributes, Copy.Nodes = make(map[string]string), make(map[int]*TXmlNode)
+		Out.NodeAdd(&Copy)
+	}
+	return nil
+}